@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errUnauthorized = HTTPError{
+	Status:  http.StatusUnauthorized,
+	Code:    "unauthorized",
+	Message: "Unauthorized",
+}
+
+// clientID makes up the ID of the client making the request. We always make
+// it up, so that one client can't pass itself off as another.
+func clientID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestedClientID is the ID the client gave as its own, if any, with an
+// X-Client-ID header or client_id parameter, such as to keep the same one
+// when reconnecting. We report it beside the ID we give the client.
+func requestedClientID(r *http.Request) string {
+	for _, id := range []string{
+		r.Header.Get("X-Client-ID"),
+		r.URL.Query().Get("client_id"),
+	} {
+		if validClientID(id) {
+			return id
+		}
+	}
+	return ""
+}
+
+// validClientID decides whether we accept an ID a client gave. We log IDs, so
+// they must be short and plain.
+func validClientID(id string) bool {
+	if len(id) == 0 || len(id) > 32 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// authorized checks the request has the admin token as a bearer token. If not,
+// it responds with an error.
+func (h HTTPHandler) authorized(rw http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) == 1 {
+		return true
+	}
+
+	httpLog.Warnf("%s: Unauthorized admin request", r.RemoteAddr)
+	h.writeError(rw, r, errUnauthorized)
+	return false
+}
+
+// ClientStatus describes a connected client.
+type ClientStatus struct {
+	ID          string    `json:"id"`
+	RequestedID string    `json:"requested_id,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Connected   time.Time `json:"connected"`
+	BytesSent   int64     `json:"bytes_sent"`
+	Audio       bool      `json:"audio"`
+	Viewer      string    `json:"viewer,omitempty"`
+}
+
+// StreamStatus describes a stream and its clients.
+type StreamStatus struct {
+	Name    string         `json:"name"`
+	Clients []ClientStatus `json:"clients"`
+
+	// From the last frame analysed, if frame analysis is on.
+	Labels *StreamLabels `json:"labels,omitempty"`
+}
+
+// statusRequest responds with the streams and their clients as JSON.
+func (h HTTPHandler) statusRequest(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	streams := []StreamStatus{}
+	for _, stream := range h.Streams.All() {
+		status := StreamStatus{
+			Name:    stream.Definition().Name,
+			Clients: []ClientStatus{},
+		}
+
+		if labels, ok := stream.Labels(); ok {
+			status.Labels = &labels
+		}
+
+		for _, c := range stream.Clients() {
+			status.Clients = append(status.Clients, ClientStatus{
+				ID:          c.ID,
+				RequestedID: c.RequestedID,
+				RemoteAddr:  c.RemoteAddr,
+				Connected:   c.Connected,
+				BytesSent:   atomic.LoadInt64(&c.bytesSent),
+				Audio:       c.audio,
+				Viewer:      c.viewer,
+			})
+		}
+
+		streams = append(streams, status)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+		"streams": streams,
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write status: %s", r.RemoteAddr, err)
+	}
+}
+
+// kickRequest disconnects clients with the given ID, the one we gave them or
+// the one they gave. The encoder drops them when it next has a packet for
+// them. They receive what is already queued, then the end of the MP4.
+func (h HTTPHandler) kickRequest(rw http.ResponseWriter, r *http.Request,
+	id string) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	kicked := 0
+	for _, stream := range h.Streams.All() {
+		for _, c := range stream.Clients() {
+			if c.ID == id || c.RequestedID == id {
+				c.cancel()
+				kicked++
+			}
+		}
+	}
+
+	if kicked == 0 {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	httpLog.Infof("%s: Kicking %d client(s) with ID %s", r.RemoteAddr, kicked,
+		id)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(rw).Encode(map[string]int{
+		"kicked": kicked,
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write response: %s", r.RemoteAddr, err)
+	}
+}
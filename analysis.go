@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// We can send frames to an external service to analyse, such as an object
+// detection service. We post a JPEG of a frame every so often, and the
+// service responds with labels for what it found. We publish the labels as
+// events and remember the latest for the stream's status.
+
+const (
+	// Defaults unless the stream's definition says otherwise.
+	defaultAnalysisInterval = 5 * time.Second
+	defaultAnalysisWidth    = 640
+
+	analysisTimeout = 10 * time.Second
+
+	// The largest response we read from the service.
+	maxAnalysisResponseSize = 1024 * 1024
+)
+
+// Label is something the service found in a frame.
+type Label struct {
+	// Such as person.
+	Label string `json:"label"`
+
+	// The service's confidence, usually from 0 to 1.
+	Score float64 `json:"score,omitempty"`
+
+	// Where it is in the frame, if the service says.
+	Region *Region `json:"region,omitempty"`
+}
+
+// StreamLabels are the labels from analysing one frame.
+type StreamLabels struct {
+	// When we decoded the frame.
+	Time time.Time `json:"time"`
+
+	Labels []Label `json:"labels"`
+}
+
+// frameAnalysis posts frames to the service.
+type frameAnalysis struct {
+	stream *Stream
+	name   string
+	url    string
+
+	interval time.Duration
+	width    int
+
+	lastEncoded time.Time
+
+	// Frames waiting to be posted. We post one at a time. If the service is
+	// slower than the interval we skip frames rather than queueing them.
+	frames chan analysisFrame
+
+	client *http.Client
+}
+
+// analysisFrame is a frame to post.
+type analysisFrame struct {
+	jpeg []byte
+	time time.Time
+}
+
+func newFrameAnalysis(s *Stream, def StreamDefinition) *frameAnalysis {
+	interval := defaultAnalysisInterval
+	if def.AnalysisInterval > 0 {
+		interval = time.Duration(def.AnalysisInterval * float64(time.Second))
+	}
+
+	width := defaultAnalysisWidth
+	if def.AnalysisWidth > 0 {
+		width = def.AnalysisWidth
+	}
+
+	a := &frameAnalysis{
+		stream:   s,
+		name:     def.Name,
+		url:      def.AnalysisURL,
+		interval: interval,
+		width:    width,
+		frames:   make(chan analysisFrame, 1),
+		client:   &http.Client{Timeout: analysisTimeout},
+	}
+
+	go a.postFrames()
+
+	return a
+}
+
+func (a *frameAnalysis) frame(decoder MediaDecoder, now time.Time) error {
+	if now.Sub(a.lastEncoded) < a.interval || len(a.frames) == cap(a.frames) {
+		return nil
+	}
+	a.lastEncoded = now
+
+	// A frame we can't encode shouldn't stop the other analysers, so we only
+	// log it.
+	var buf []byte
+	var err error
+	if !transcodes.run(backgroundTranscodeWait, func() {
+		buf, err = decoder.JPEG(a.width, false)
+	}) {
+		encoderLog.Debugf("analysis: %s: Skipping frame, encoders busy", a.name)
+		return nil
+	}
+	if err != nil {
+		encoderLog.Warnf("analysis: %s: %s", a.name, err)
+		return nil
+	}
+
+	select {
+	case a.frames <- analysisFrame{jpeg: buf, time: now}:
+	default:
+	}
+	return nil
+}
+
+func (a *frameAnalysis) stop(now time.Time) {
+	close(a.frames)
+}
+
+func (a *frameAnalysis) postFrames() {
+	for frame := range a.frames {
+		labels, err := a.post(frame)
+		if err != nil {
+			encoderLog.Warnf("analysis: %s: Unable to analyse frame: %s", a.name,
+				err)
+			continue
+		}
+
+		a.stream.setLabels(StreamLabels{Time: frame.time, Labels: labels})
+
+		if len(labels) == 0 {
+			continue
+		}
+
+		encoderLog.Debugf("analysis: %s: %d labels", a.name, len(labels))
+		events.publish(Event{
+			Type:   "labels",
+			Stream: a.name,
+			Time:   frame.time,
+			Labels: labels,
+		})
+	}
+}
+
+// post sends the frame to the service. It responds with JSON such as
+// {"labels": [{"label": "person", "score": 0.92}]}.
+func (a *frameAnalysis) post(frame analysisFrame) ([]Label, error) {
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(frame.jpeg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("X-Stream", a.name)
+	req.Header.Set("X-Frame-Time", frame.time.UTC().Format(time.RFC3339Nano))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s responded %s", redactURL(a.url), resp.Status)
+	}
+
+	var result struct {
+		Labels []Label `json:"labels"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body,
+		maxAnalysisResponseSize)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+
+	labels := []Label{}
+	for _, label := range result.Labels {
+		if label.Label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	return labels, nil
+}
+
+// Labels returns the labels from the last frame analysed, if any has been.
+func (s *Stream) Labels() (StreamLabels, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.labels == nil {
+		return StreamLabels{}, false
+	}
+	return *s.labels, true
+}
+
+func (s *Stream) setLabels(labels StreamLabels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.labels = &labels
+}
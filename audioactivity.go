@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// We detect sound by decoding the audio and measuring how loud it is. When it
+// is louder than a threshold, such as with a baby crying or glass breaking,
+// there is audio activity. We don't tell kinds of sound apart.
+
+const (
+	// We measure the loudest frame in each window of this long.
+	audioWindow = 250 * time.Millisecond
+
+	// The level in dBFS (decibels relative to full scale) above which there is
+	// activity, unless the stream's definition says otherwise.
+	defaultAudioThreshold = -30.0
+
+	// How long it must be quiet before an audio event ends.
+	audioHold = 5 * time.Second
+
+	// How long we wait to check again if the input has no audio. Otherwise we
+	// would keep the input open for nothing.
+	noAudioRetryInterval = time.Minute
+)
+
+// AudioEvent describes audio_start and audio_end events.
+type AudioEvent struct {
+	// The level in dBFS. For audio_end, the loudest it was during the event.
+	Level float64 `json:"level"`
+
+	// For audio_end, how long the event lasted, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// audioDetector tracks audio activity on a stream.
+type audioDetector struct {
+	stream string
+
+	threshold float64
+
+	// The window we are measuring: when it started and its loudest frame's
+	// RMS.
+	windowStart time.Time
+	windowPeak  float64
+
+	// The audio event in progress, if any.
+	active     bool
+	started    time.Time
+	lastActive time.Time
+	peak       float64
+}
+
+// detectAudio detects audio activity while the stream is configured to.
+func (s *Stream) detectAudio() {
+	s.runOwnClient("audio-detector", func(def StreamDefinition) string {
+		if !def.AudioDetection {
+			return ""
+		}
+		return "on"
+	}, func(c *Client) {
+		c.audio = true
+		c.decode = true
+	}, func(c *Client, def StreamDefinition) error {
+		threshold := def.AudioThreshold
+		if threshold == 0 {
+			threshold = defaultAudioThreshold
+		}
+
+		d := &audioDetector{stream: def.Name, threshold: threshold}
+
+		err := c.decodePackets(def.libavVerbose(), func(decoder MediaDecoder) error {
+			rms, err := decoder.Level()
+			if err != nil {
+				return err
+			}
+
+			d.measure(rms, time.Now())
+			return nil
+		})
+
+		d.end(time.Now())
+
+		if err == errNoAudio {
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(noAudioRetryInterval):
+			}
+		}
+		return err
+	})
+}
+
+// measure adds a frame's level to the window, and decides whether there is
+// activity once the window is over.
+func (d *audioDetector) measure(rms float64, now time.Time) {
+	if d.windowStart.IsZero() {
+		d.windowStart = now
+	}
+
+	if rms > d.windowPeak {
+		d.windowPeak = rms
+	}
+
+	if now.Sub(d.windowStart) < audioWindow {
+		return
+	}
+
+	level := dBFS(d.windowPeak)
+	d.windowStart = now
+	d.windowPeak = 0
+
+	if level >= d.threshold {
+		d.lastActive = now
+
+		if !d.active {
+			d.active = true
+			d.started = now
+			d.peak = level
+
+			encoderLog.Infof("audio: %s: Audio started (level %.1f dBFS)", d.stream,
+				level)
+			events.publish(Event{
+				Type:   "audio_start",
+				Stream: d.stream,
+				Time:   now,
+				Audio:  &AudioEvent{Level: level},
+			})
+			return
+		}
+
+		if level > d.peak {
+			d.peak = level
+		}
+		return
+	}
+
+	if d.active && now.Sub(d.lastActive) >= audioHold {
+		d.end(now)
+	}
+}
+
+// end ends the audio event in progress, if there is one.
+func (d *audioDetector) end(now time.Time) {
+	if !d.active {
+		return
+	}
+	d.active = false
+
+	encoderLog.Infof("audio: %s: Audio ended (level %.1f dBFS)", d.stream,
+		d.peak)
+	events.publish(Event{
+		Type:   "audio_end",
+		Stream: d.stream,
+		Time:   now,
+		Audio: &AudioEvent{
+			Level:    d.peak,
+			Duration: now.Sub(d.started).Seconds(),
+		},
+	})
+}
+
+// dBFS converts an RMS level to decibels relative to full scale. Silence is
+// very quiet rather than minus infinity, which JSON can't represent.
+func dBFS(rms float64) float64 {
+	if rms <= 0 {
+		return -120
+	}
+	return math.Max(20*math.Log10(rms), -120)
+}
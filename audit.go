@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We can keep an audit log of stream sessions, as some CCTV regulations
+// require, and for looking into abuse. Each request to watch a stream, whether
+// we served it or refused it, gets a line of JSON once it ends: who made it,
+// when, for which stream, how long it lasted, what we responded, and how many
+// bytes we sent.
+//
+// We only ever append to the file, and sync each line to disk. We never
+// rotate or truncate it ourselves.
+
+// AuditLog is where we write audit entries.
+type AuditLog struct {
+	mutex *sync.Mutex
+	file  *os.File
+}
+
+// AuditEntry describes one stream session.
+type AuditEntry struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+
+	// Such as /stream/frontdoor.
+	Path   string `json:"path"`
+	Stream string `json:"stream,omitempty"`
+
+	ClientID   string `json:"client_id"`
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Referer    string `json:"referer,omitempty"`
+
+	// The ID the client gave as its own, if it did.
+	RequestedClientID string `json:"requested_client_id,omitempty"`
+
+	// With viewers, who was watching.
+	Viewer string `json:"viewer,omitempty"`
+
+	Status int   `json:"status"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// auditRecorder writes a response while noting what we audit about it.
+type auditRecorder struct {
+	http.ResponseWriter
+
+	log   *AuditLog
+	entry AuditEntry
+
+	// If set, finish passes the entry here rather than writing it, such as to
+	// make an HLS session's requests one entry.
+	onFinish func(AuditEntry)
+}
+
+func openAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{
+		mutex: &sync.Mutex{},
+		file:  file,
+	}, nil
+}
+
+// audited decides whether we audit requests to a path. These are the paths
+// serving a stream's media.
+func audited(path string) bool {
+	for _, prefix := range []string{"/stream", "/audio", "/segments", "/dvr",
+		"/compare"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return path == "/init.mp4" || strings.HasPrefix(path, "/hls/")
+}
+
+// start begins auditing a request.
+func (a *AuditLog) start(rw http.ResponseWriter, r *http.Request, id string,
+	streams *Streams) *auditRecorder {
+	// The stream is named in the path, or it is the default stream.
+	name := strings.TrimSuffix(r.URL.Path, "/init.mp4")
+	for _, prefix := range []string{"/stream", "/audio", "/segments", "/dvr",
+		"/compare"} {
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			name = strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/")
+			break
+		}
+	}
+	if strings.HasPrefix(r.URL.Path, "/hls/") {
+		name, _ = hlsPath(r.URL.Path)
+	}
+
+	entry := AuditEntry{
+		Start:             time.Now(),
+		Path:              r.URL.Path,
+		ClientID:          id,
+		RequestedClientID: requestedClientID(r),
+		RemoteAddr:        r.RemoteAddr,
+		UserAgent:         r.UserAgent(),
+		Referer:           r.Referer(),
+	}
+
+	if stream := streams.Get(name); stream != nil {
+		entry.Stream = stream.Definition().Name
+	}
+
+	return &auditRecorder{
+		ResponseWriter: rw,
+		log:            a,
+		entry:          entry,
+	}
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.entry.Status == 0 {
+		a.entry.Status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(buf []byte) (int, error) {
+	if a.entry.Status == 0 {
+		a.entry.Status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(buf)
+	a.entry.Bytes += int64(n)
+	return n, err
+}
+
+func (a *auditRecorder) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the request's entry.
+func (a *auditRecorder) finish() {
+	a.entry.End = time.Now()
+	a.entry.Duration = a.entry.End.Sub(a.entry.Start).Seconds()
+	if a.entry.Status == 0 {
+		a.entry.Status = http.StatusOK
+	}
+
+	if a.onFinish != nil {
+		a.onFinish(a.entry)
+		return
+	}
+	a.log.write(a.entry)
+}
+
+func (a *AuditLog) write(entry AuditEntry) {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		httpLog.Errorf("Unable to encode audit entry: %s", err)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, err := a.file.Write(append(buf, '\n')); err != nil {
+		httpLog.Errorf("Unable to write audit entry: %s", err)
+		return
+	}
+
+	if err := a.file.Sync(); err != nil {
+		httpLog.Errorf("Unable to sync audit log: %s", err)
+	}
+}
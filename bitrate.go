@@ -0,0 +1,257 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Clients on slow links, such as phones, can ask for at most so many kbit/s
+// with ?maxkbps=, such as ?maxkbps=800.
+//
+// If the stream has profiles, we serve the client from the best that fits:
+// the one of the highest bitrate no higher than it asked, or failing that the
+// lowest. A profile's bitrate is what its bitrate setting says, or if it has
+// none, what we last measured reading its input. Profiles we know nothing
+// about yet aren't picked. A ?profile= the client asks for wins.
+//
+// Whatever we serve it from, we then keep to the client's budget by thinning
+// the video: when sending a frame would take the client over, we skip to the
+// next keyframe, since frames between keyframes are no use without those
+// before them. A client far over budget gets keyframes alone, as a slide
+// show. Audio always goes through, though it counts against the budget.
+
+// How long we measure an input's bitrate over.
+const bitrateWindow = 2 * time.Second
+
+// How many seconds of its budget a thinned client may save up, so that it can
+// take a keyframe bigger than a second's worth.
+const thinBurstSeconds = 2
+
+// bitrateMeter measures an input's bitrate. Only the encoder may use it.
+type bitrateMeter struct {
+	start time.Time
+	bytes int64
+}
+
+// observe counts a packet read from the input, storing the bitrate each
+// window.
+func (m *bitrateMeter) observe(size int64, now time.Time, stats *StreamStats) {
+	// After a gap, such as when the input was closed, start afresh.
+	if m.start.IsZero() || now.Sub(m.start) > 2*bitrateWindow {
+		m.start = now
+		m.bytes = 0
+	}
+
+	m.bytes += size
+	if elapsed := now.Sub(m.start); elapsed >= bitrateWindow {
+		atomic.StoreInt64(&stats.InputKbps,
+			int64(float64(m.bytes)*8/1000/elapsed.Seconds()))
+		m.start = now
+		m.bytes = 0
+	}
+}
+
+// parseMaxKbps reads the most kbit/s the client asks for. 0 means it didn't.
+func parseMaxKbps(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("maxkbps")
+	if s == "" {
+		return 0, nil
+	}
+	kbps, err := strconv.Atoi(s)
+	if err != nil || kbps <= 0 {
+		return 0, errBadRequest
+	}
+	return kbps, nil
+}
+
+// bitrate is the stream's bitrate in kbit/s as configured, or as last
+// measured. 0 means we don't know.
+func (s *Stream) bitrate() int {
+	if def := s.Definition(); def.Bitrate > 0 {
+		return def.Bitrate
+	}
+	return int(atomic.LoadInt64(&s.stats.InputKbps))
+}
+
+// withMaxBitrate picks the stream or one of its profiles to serve a client
+// asking for at most kbps.
+func (s *Streams) withMaxBitrate(stream *Stream, kbps int) *Stream {
+	def := stream.Definition()
+	if len(def.Profiles) == 0 {
+		return stream
+	}
+
+	candidates := []*Stream{stream}
+	for _, profile := range def.Profiles {
+		if p := s.Get(def.Name + "/" + profile.Name); p != nil {
+			candidates = append(candidates, p)
+		}
+	}
+
+	var best, lowest *Stream
+	for _, candidate := range candidates {
+		bitrate := candidate.bitrate()
+		if bitrate == 0 {
+			continue
+		}
+		if bitrate <= kbps && (best == nil || bitrate > best.bitrate()) {
+			best = candidate
+		}
+		if lowest == nil || bitrate < lowest.bitrate() {
+			lowest = candidate
+		}
+	}
+
+	if best != nil {
+		return best
+	}
+	if lowest != nil {
+		return lowest
+	}
+	return stream
+}
+
+// thinner keeps a client's video to a bitrate by skipping to keyframes. Only
+// the encoder may use it.
+type thinner struct {
+	// The budget, in bytes a second, and what is left of it.
+	rate   float64
+	tokens float64
+
+	// The time of the last packet, to refill the budget by.
+	last int64
+
+	// Whether we're skipping to the next keyframe.
+	skipping bool
+
+	// Packets we skipped.
+	skipped uint64
+}
+
+func newThinner(kbps int) *thinner {
+	rate := float64(kbps) * 1000 / 8
+	return &thinner{rate: rate, tokens: rate, last: noTime}
+}
+
+// drop decides whether to skip the packet.
+func (t *thinner) drop(p *Packet) bool {
+	if p.time != noTime {
+		if t.last != noTime && p.time > t.last {
+			t.tokens += float64(p.time-t.last) / 1e6 * t.rate
+			if t.tokens > t.rate*thinBurstSeconds {
+				t.tokens = t.rate * thinBurstSeconds
+			}
+		}
+		t.last = p.time
+	}
+
+	if p.audio {
+		t.tokens -= float64(p.size)
+		return false
+	}
+
+	// A keyframe goes if we have any budget left, even if it takes us into
+	// debt, as waiting for budget enough for a whole one could take a long
+	// time. We pay the debt off by skipping what follows it.
+	if p.keyframe {
+		if t.tokens <= 0 {
+			t.skipping = true
+			t.skipped++
+			return true
+		}
+		t.skipping = false
+		t.tokens -= float64(p.size)
+		return false
+	}
+
+	if t.skipping || t.tokens < float64(p.size) {
+		t.skipping = true
+		t.skipped++
+		return true
+	}
+	t.tokens -= float64(p.size)
+	return false
+}
+
+// Rather than drop a viewer that falls behind, we shift it to a lower
+// rendition. Its output is already under way, so we can't move it onto a
+// profile's input. Instead we thin its video as for ?maxkbps= to the bitrate
+// of the next lower of the stream's profiles, or failing that to half what it
+// gets now. Thinning skips to the next keyframe, which gives it the chance to
+// catch up. Only once there is nothing lower to shift it to do we drop it.
+
+// The lowest bitrate in kbit/s we shift a client to.
+const minShiftKbps = 100
+
+// renditions finds the streams serving the stream's profiles, and the stream
+// they are profiles of, other than the stream itself.
+func (s *Streams) renditions(stream *Stream) []*Stream {
+	name := stream.Definition().Name
+	for _, main := range s.All() {
+		def := main.Definition()
+		family := []*Stream{main}
+		member := def.Name == name
+		for _, profile := range def.Profiles {
+			if def.Name+"/"+profile.Name == name {
+				member = true
+			}
+			if p := s.Get(def.Name + "/" + profile.Name); p != nil {
+				family = append(family, p)
+			}
+		}
+		if !member {
+			continue
+		}
+
+		others := []*Stream{}
+		for _, other := range family {
+			if other != stream {
+				others = append(others, other)
+			}
+		}
+		return others
+	}
+	return nil
+}
+
+// shiftDown shifts a client that fell behind to a lower bitrate. It returns
+// the bitrate in kbit/s, or 0 if there is nothing lower to shift it to. Only
+// the encoder may call it.
+func (c *Client) shiftDown(stats *StreamStats) int {
+	if !c.shiftable {
+		return 0
+	}
+
+	current := int(atomic.LoadInt64(&stats.InputKbps))
+	if c.thin != nil {
+		current = int(c.thin.rate * 8 / 1000)
+	}
+	if current <= 0 {
+		return 0
+	}
+
+	next := 0
+	for _, rendition := range c.renditions {
+		if bitrate := rendition.bitrate(); bitrate < current && bitrate > next {
+			next = bitrate
+		}
+	}
+	if next == 0 {
+		next = current / 2
+	}
+	if next < minShiftKbps {
+		return 0
+	}
+
+	if c.thin == nil {
+		c.thin = newThinner(next)
+	}
+	c.thin.rate = float64(next) * 1000 / 8
+
+	// What it has queued is the debt it has to pay off.
+	c.thin.tokens = 0
+	c.thin.skipping = true
+	return next
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// availableCPUs is how many CPUs we may use. In a container, this is the
+// cgroup's CPU quota if it has one, which may be a fraction.
+func availableCPUs() float64 {
+	cpus := float64(runtime.NumCPU())
+
+	// cgroup v2: cpu.max is "<quota> <period>", or "max <period>".
+	quota, period := -1.0, -1.0
+	if fields := readCgroupFields("/sys/fs/cgroup/cpu.max"); len(fields) == 2 {
+		quota, _ = strconv.ParseFloat(fields[0], 64)
+		period, _ = strconv.ParseFloat(fields[1], 64)
+	} else {
+		// cgroup v1.
+		if fields := readCgroupFields(
+			"/sys/fs/cgroup/cpu/cpu.cfs_quota_us"); len(fields) == 1 {
+			quota, _ = strconv.ParseFloat(fields[0], 64)
+		}
+		if fields := readCgroupFields(
+			"/sys/fs/cgroup/cpu/cpu.cfs_period_us"); len(fields) == 1 {
+			period, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	if quota > 0 && period > 0 && quota/period < cpus {
+		return quota / period
+	}
+	return cpus
+}
+
+// cgroupMemoryLimit is the cgroup's memory limit in bytes, or 0 if it has
+// none.
+func cgroupMemoryLimit() uint64 {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+	} {
+		fields := readCgroupFields(path)
+		if len(fields) != 1 {
+			continue
+		}
+
+		limit, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			// Such as max.
+			return 0
+		}
+
+		// cgroup v1 reports no limit as a huge number.
+		if limit >= 1<<62 {
+			return 0
+		}
+		return limit
+	}
+
+	return 0
+}
+
+// residentMemory is how much memory we have resident, in bytes.
+func residentMemory() (uint64, error) {
+	buf, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return 0, nil
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return pages * uint64(os.Getpagesize()), nil
+}
+
+func readCgroupFields(path string) []string {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(buf))
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// availableCPUs is how many CPUs we may use.
+func availableCPUs() float64 {
+	return float64(runtime.NumCPU())
+}
+
+// cgroupMemoryLimit would be the cgroup's memory limit. There are only
+// cgroups on Linux.
+func cgroupMemoryLimit() uint64 {
+	return 0
+}
+
+// residentMemory would be how much memory we have resident. We only measure
+// it on Linux.
+func residentMemory() (uint64, error) {
+	return 0, fmt.Errorf("measuring resident memory is only supported on Linux")
+}
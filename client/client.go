@@ -0,0 +1,513 @@
+// Package client is a client for videostreamer's HTTP API, for Go programs
+// that watch its streams or monitor it.
+//
+// Watch gets a stream's video and Events its events, both reconnecting when
+// the connection drops. The rest are one request each: Status, Health, Pause,
+// Resume, and Kick.
+//
+// It depends only on the standard library, so that embedding it doesn't bring
+// in the server.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long we wait before reconnecting, at first and at most. We double the
+// wait each time in a row a connection fails.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Client talks to a videostreamer server.
+type Client struct {
+	// The server's base URL, such as http://localhost:8080.
+	URL string
+
+	// The admin token, for Status, Events, Pause, Resume, and Kick.
+	Token string
+
+	// A viewer's token, for Watch, if the server has a viewers file.
+	ViewerToken string
+
+	// An ID of our own to give the server. It shows us in /status and the
+	// audit log by it, beside the ID it makes up, and admins may kick us by it.
+	ID string
+
+	// The HTTP client to use. http.DefaultClient if not set. Watch and Events
+	// hold their connections open, so this should not have a timeout.
+	HTTPClient *http.Client
+}
+
+// Error is an error the server responded with.
+type Error struct {
+	// The HTTP status.
+	Status int
+
+	// Such as not_found, and a description.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("server responded %d", e.Status)
+	}
+	return fmt.Sprintf("server responded %d: %s: %s", e.Status, e.Code,
+		e.Message)
+}
+
+// temporary says whether the error may go away by itself, so that it is worth
+// trying again.
+func (e *Error) temporary() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// WatchOptions are how to watch a stream. The zero value watches the stream's
+// video live as MP4.
+type WatchOptions struct {
+	// Watch the audio only.
+	Audio bool
+
+	// Such as mp4 or mpegts. The server's default if not set.
+	Format string
+
+	// A profile of the stream, or the most a profile may use, in kbit/s.
+	Profile string
+	MaxKbps int
+
+	// Start at a keyframe, and with up to this much of what the server kept.
+	// Clients reconnecting usually want to start at a keyframe.
+	Keyframe bool
+	Burst    time.Duration
+}
+
+// query is the options as URL parameters.
+func (o WatchOptions) query() url.Values {
+	query := url.Values{}
+	if o.Format != "" {
+		query.Set("format", o.Format)
+	}
+	if o.Profile != "" {
+		query.Set("profile", o.Profile)
+	}
+	if o.MaxKbps > 0 {
+		query.Set("maxkbps", strconv.Itoa(o.MaxKbps))
+	}
+	if o.Keyframe {
+		query.Set("start", "keyframe")
+	}
+	if o.Burst > 0 {
+		query.Set("burst", strconv.FormatFloat(o.Burst.Seconds(), 'f', 3, 64))
+	}
+	return query
+}
+
+// Watch watches the stream, or the default stream if name is empty. It calls
+// handle with each connection's body. Each is a whole file in the format
+// asked for, such as an MP4 from its start.
+//
+// When the connection drops, or handle returns the error reading the body
+// gave, Watch reconnects and calls handle again. We give the server our
+// session ID, so if the stream has a reconnect grace it picks up about where
+// we left off.
+//
+// Watch returns when ctx is done, when handle returns any other error, or
+// when the server refuses us for good, such as if the stream doesn't exist.
+func (c *Client) Watch(ctx context.Context, name string, opts WatchOptions,
+	handle func(body io.Reader) error) error {
+	path := "/stream"
+	if opts.Audio {
+		path = "/audio"
+	}
+	if name != "" {
+		path += "/" + name
+	}
+	query := opts.query()
+
+	session := ""
+	return c.reconnect(ctx, func() (bool, error) {
+		req, err := c.request(ctx, "GET", path, query, c.ViewerToken)
+		if err != nil {
+			return false, err
+		}
+		if session != "" {
+			req.Header.Set("X-Session-ID", session)
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		if id := resp.Header.Get("X-Session-ID"); id != "" {
+			session = id
+		}
+
+		body := &bodyReader{r: resp.Body}
+		err = handle(body)
+		if err == nil || errors.Is(err, body.err) {
+			return body.read, nil
+		}
+		return body.read, &handlerError{err: err}
+	})
+}
+
+// EventsOptions are which events to get.
+type EventsOptions struct {
+	// Only this stream's events, or every stream's if empty.
+	Stream string
+}
+
+// Event is one of the server's events, such as motion_start.
+type Event struct {
+	Type   string    `json:"type"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+
+	// For state events, the stream's state.
+	State *State `json:"state,omitempty"`
+
+	// The whole event, for details of the other types.
+	Raw json.RawMessage `json:"-"`
+}
+
+// State is a stream's state.
+type State struct {
+	Clients   int  `json:"clients"`
+	Input     bool `json:"input"`
+	Recording bool `json:"recording"`
+	Paused    bool `json:"paused"`
+}
+
+// Events follows the server's events, calling handle with each. Each time it
+// connects, the server first sends a state event for each stream.
+//
+// It reconnects when the connection drops. It returns when ctx is done, when
+// handle returns an error, or when the server refuses us for good.
+func (c *Client) Events(ctx context.Context, opts EventsOptions,
+	handle func(Event) error) error {
+	query := url.Values{}
+	if opts.Stream != "" {
+		query.Set("stream", opts.Stream)
+	}
+
+	return c.reconnect(ctx, func() (bool, error) {
+		req, err := c.request(ctx, "GET", "/events", query, c.Token)
+		if err != nil {
+			return false, err
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		read := false
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			// We only need the data lines. The event line repeats the type.
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			read = true
+
+			raw := []byte(strings.TrimPrefix(line, "data: "))
+			var event Event
+			if err := json.Unmarshal(raw, &event); err != nil {
+				return read, &handlerError{
+					err: fmt.Errorf("unable to decode event: %s", err),
+				}
+			}
+			event.Raw = raw
+
+			if err := handle(event); err != nil {
+				return read, &handlerError{err: err}
+			}
+		}
+		return read, nil
+	})
+}
+
+// ClientStatus describes a client connected to a stream.
+type ClientStatus struct {
+	ID          string    `json:"id"`
+	RequestedID string    `json:"requested_id,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Connected   time.Time `json:"connected"`
+	BytesSent   int64     `json:"bytes_sent"`
+	Audio       bool      `json:"audio"`
+	Viewer      string    `json:"viewer,omitempty"`
+}
+
+// StreamStatus describes a stream and its clients.
+type StreamStatus struct {
+	Name    string         `json:"name"`
+	Clients []ClientStatus `json:"clients"`
+
+	// The labels from the last frame analysed, if frame analysis is on.
+	Labels json.RawMessage `json:"labels,omitempty"`
+}
+
+// Status gets the streams and their clients.
+func (c *Client) Status(ctx context.Context) ([]StreamStatus, error) {
+	var status struct {
+		Streams []StreamStatus `json:"streams"`
+	}
+	if err := c.call(ctx, "GET", "/status", c.Token, &status); err != nil {
+		return nil, err
+	}
+	return status.Streams, nil
+}
+
+// StreamHealth is how a stream's encoder is doing.
+type StreamHealth struct {
+	Name       string     `json:"name"`
+	Input      bool       `json:"input"`
+	LastRead   *time.Time `json:"last_read,omitempty"`
+	LastFanOut *time.Time `json:"last_fan_out,omitempty"`
+
+	// Why the server thinks the encoder is stuck, if it does.
+	Stalled string `json:"stalled,omitempty"`
+}
+
+// Health is the server's health.
+type Health struct {
+	OK      bool           `json:"ok"`
+	Streams []StreamHealth `json:"streams"`
+}
+
+// Health checks the server's health. An unhealthy server isn't an error:
+// Health returns it with OK false.
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var health Health
+	err := c.call(ctx, "GET", "/healthz", "", &health)
+	var e *Error
+	if errors.As(err, &e) && e.Status == http.StatusServiceUnavailable &&
+		health.Streams != nil {
+		return health, nil
+	}
+	return health, err
+}
+
+// Pause pauses the stream, and returns its state.
+func (c *Client) Pause(ctx context.Context, name string) (State, error) {
+	var state State
+	err := c.call(ctx, "POST", "/api/streams/"+name+"/pause", c.Token, &state)
+	return state, err
+}
+
+// Resume resumes the stream, and returns its state.
+func (c *Client) Resume(ctx context.Context, name string) (State, error) {
+	var state State
+	err := c.call(ctx, "POST", "/api/streams/"+name+"/resume", c.Token, &state)
+	return state, err
+}
+
+// Kick disconnects the clients with the ID. It returns how many there were.
+func (c *Client) Kick(ctx context.Context, id string) (int, error) {
+	var kicked struct {
+		Kicked int `json:"kicked"`
+	}
+	err := c.call(ctx, "POST", "/clients/"+url.PathEscape(id)+"/kick", c.Token,
+		&kicked)
+	return kicked.Kicked, err
+}
+
+// DrainStatus describes whether the server is draining.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+
+	// Viewers still watching.
+	Viewers int `json:"viewers"`
+
+	Started  *time.Time `json:"started,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// Drain starts the server draining, and returns how it's going. Draining
+// again is harmless.
+func (c *Client) Drain(ctx context.Context) (DrainStatus, error) {
+	var status DrainStatus
+	err := c.call(ctx, "POST", "/api/drain", c.Token, &status)
+	return status, err
+}
+
+// httpClient is the HTTP client to use.
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// request makes a request to the server.
+func (c *Client) request(ctx context.Context, method, path string,
+	query url.Values, token string) (*http.Request, error) {
+	u := strings.TrimSuffix(c.URL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Accept", "application/json, */*")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.ID != "" {
+		req.Header.Set("X-Client-ID", c.ID)
+	}
+	return req, nil
+}
+
+// do sends the request. If the server responds with an error, it returns it
+// as an *Error.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+// readError reads the error the server responded with.
+func readError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err == nil && json.Unmarshal(buf, &body) == nil {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+	}
+	return e
+}
+
+// call makes a request and decodes the JSON response into v. If the server
+// responds with an error but a JSON body, as /healthz does, it decodes that
+// too.
+func (c *Client) call(ctx context.Context, method, path, token string,
+	v interface{}) error {
+	req, err := c.request(ctx, method, path, nil, token)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		_ = json.Unmarshal(buf, v)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		return readError(resp)
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("unable to decode response: %s", err)
+	}
+	return nil
+}
+
+// handlerError is an error a handler returned, as opposed to one from the
+// connection. We don't reconnect after these.
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string { return e.err.Error() }
+
+// reconnect calls connect until ctx is done or it fails for good, waiting
+// longer each time in a row it fails. connect says whether it got anything
+// from the server, in which case we start waiting afresh.
+func (c *Client) reconnect(ctx context.Context,
+	connect func() (bool, error)) error {
+	backoff := minBackoff
+	for {
+		read, err := connect()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var handlerErr *handlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr.err
+		}
+		var e *Error
+		if errors.As(err, &e) && !e.temporary() {
+			return e
+		}
+
+		if read {
+			backoff = minBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// bodyReader remembers whether we read anything from the body, and the error
+// reading it gave, so we can tell it from the handler's own errors.
+type bodyReader struct {
+	r    io.Reader
+	read bool
+	err  error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		b.read = true
+	}
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
@@ -24,14 +24,14 @@ int main(const int argc, const char * const * const argv)
 	const bool verbose = true;
 
 	struct VSInput * const input = vs_open_input(input_format, input_url,
-			verbose);
+			0, NULL, verbose);
 	if (!input) {
 		printf("unable to open input\n");
 		return 1;
 	}
 
 	struct VSOutput * const output = vs_open_output(output_format, output_url,
-			input, verbose);
+			input, NULL, verbose);
 	if (!output) {
 		printf("unable to open output\n");
 		vs_destroy_input(input);
@@ -44,7 +44,11 @@ int main(const int argc, const char * const * const argv)
 		AVPacket pkt;
 		memset(&pkt, 0, sizeof(AVPacket));
 
-		const int read_res = vs_read_packet(input, &pkt, verbose);
+		const int read_res = vs_read_packet(input, &pkt, 0, verbose);
+		if (read_res == -2) {
+			break;
+		}
+
 		if (read_res == -1) {
 			printf("read failed\n");
 			vs_destroy_input(input);
@@ -67,6 +71,11 @@ int main(const int argc, const char * const * const argv)
 
 		av_packet_unref(&pkt);
 
+		// Packets from other streams, such as audio, are skipped.
+		if (write_res == 0) {
+			continue;
+		}
+
 		i++;
 		if (i == max_frames) {
 			break;
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CodecParameters describes the codec of one of an input's streams.
+type CodecParameters struct {
+	// The libav codec name, such as h264 or aac.
+	Codec string
+
+	// Profile and level as libav reports them. They are negative if unknown.
+	Profile int
+	Level   int
+
+	// Codec specific data, such as an avcC or an AudioSpecificConfig.
+	Extradata []byte
+
+	// The picture's size, for video. 0 if unknown.
+	Width  int
+	Height int
+}
+
+// StreamCodecs describes what a stream's outputs contain. We record it when we
+// open the input.
+type StreamCodecs struct {
+	Video *OutputCodecs `json:"video,omitempty"`
+	Audio *OutputCodecs `json:"audio,omitempty"`
+}
+
+// OutputCodecs describes one of a stream's outputs.
+type OutputCodecs struct {
+	// The RFC 6381 codecs parameter, such as avc1.64001f.
+	Codecs string `json:"codecs"`
+
+	// The content type including the codecs parameter, as given to
+	// MediaSource.isTypeSupported().
+	Type string `json:"type"`
+
+	// The picture's size, for video, if we know it.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// inputCodecs decides what the outputs of an input contain.
+func inputCodecs(input MediaInput) StreamCodecs {
+	codecs := StreamCodecs{}
+
+	if params, ok := input.CodecParameters(false); ok {
+		if s := params.rfc6381(); s != "" {
+			codecs.Video = &OutputCodecs{
+				Codecs: s,
+				Type:   fmt.Sprintf("%s; codecs=\"%s\"", videoFormat.ContentType, s),
+				Width:  params.Width,
+				Height: params.Height,
+			}
+		}
+	}
+
+	if params, ok := input.CodecParameters(true); ok {
+		format, err := input.AudioFormat()
+		if s := params.rfc6381(); s != "" && err == nil {
+			codecs.Audio = &OutputCodecs{
+				Codecs: s,
+				Type:   fmt.Sprintf("%s; codecs=\"%s\"", format.ContentType, s),
+			}
+		}
+	}
+
+	return codecs
+}
+
+// rfc6381 builds the codecs parameter for the codec. It returns an empty
+// string if we don't know how.
+func (p CodecParameters) rfc6381() string {
+	switch p.Codec {
+	case "h264":
+		return avcCodecs(p)
+	case "hevc":
+		return hevcCodecs(p)
+	case "aac":
+		return aacCodecs(p)
+	case "opus", "vorbis", "mp3":
+		return p.Codec
+	case "vp9":
+		if p.Profile < 0 || p.Level <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("vp09.%02d.%02d.08", p.Profile, p.Level)
+	default:
+		return ""
+	}
+}
+
+// avcCodecs is avc1. followed by the profile, constraint flags, and level from
+// the SPS, each in hex.
+func avcCodecs(p CodecParameters) string {
+	// An avcC (ISO/IEC 14496-15) has them in bytes 1 to 3.
+	if len(p.Extradata) >= 4 && p.Extradata[0] == 1 {
+		return fmt.Sprintf("avc1.%02x%02x%02x", p.Extradata[1], p.Extradata[2],
+			p.Extradata[3])
+	}
+
+	// Otherwise the extradata may be Annex B NAL units. Find the SPS. Its first
+	// bytes after the NAL header are the same three.
+	for _, nal := range bytes.Split(p.Extradata, []byte{0, 0, 1}) {
+		if len(nal) >= 4 && nal[0]&0x1f == 7 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", nal[1], nal[2], nal[3])
+		}
+	}
+
+	if p.Profile < 0 || p.Level <= 0 {
+		return ""
+	}
+
+	// libav sets flags above the low byte of the profile for constrained
+	// profiles. We don't know the constraint flags otherwise.
+	return fmt.Sprintf("avc1.%02x00%02x", p.Profile&0xff, p.Level)
+}
+
+// hevcCodecs builds hvc1.<profile>.<compatibility>.<tier and level>.<constraints>
+// from an hvcC (ISO/IEC 14496-15 annex E).
+func hevcCodecs(p CodecParameters) string {
+	if len(p.Extradata) < 13 || p.Extradata[0] != 1 {
+		return ""
+	}
+
+	profileSpace := p.Extradata[1] >> 6
+	tier := "L"
+	if p.Extradata[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profile := p.Extradata[1] & 0x1f
+
+	// The compatibility flags are written in reverse bit order.
+	compatibility := binary.BigEndian.Uint32(p.Extradata[2:])
+	reversed := uint32(0)
+	for i := uint(0); i < 32; i++ {
+		if compatibility&(1<<i) != 0 {
+			reversed |= 1 << (31 - i)
+		}
+	}
+
+	level := p.Extradata[12]
+
+	s := fmt.Sprintf("hvc1.%s%d.%x.%s%d",
+		[]string{"", "A", "B", "C"}[profileSpace], profile, reversed, tier, level)
+
+	// The six constraint bytes, leaving off trailing zero bytes.
+	constraints := p.Extradata[6:12]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, b := range constraints {
+		s += fmt.Sprintf(".%X", b)
+	}
+
+	return s
+}
+
+// silentAudioCodecs describes the silent track clients get with silent_audio:
+// AAC-LC.
+const silentAudioCodecs = "mp4a.40.2"
+
+// aacCodecs is mp4a.40. followed by the audio object type.
+func aacCodecs(p CodecParameters) string {
+	// The AudioSpecificConfig (ISO/IEC 14496-3) starts with the type in 5 bits.
+	// 31 means the type is in the following 6 bits, plus 32.
+	if len(p.Extradata) >= 2 {
+		objectType := int(p.Extradata[0] >> 3)
+		if objectType == 31 {
+			objectType = 32 + int(p.Extradata[0]&0x7)<<3 + int(p.Extradata[1]>>5)
+		}
+		return fmt.Sprintf("mp4a.40.%d", objectType)
+	}
+
+	// libav's AAC profiles are the object type less one.
+	if p.Profile >= 0 {
+		return fmt.Sprintf("mp4a.40.%d", p.Profile+1)
+	}
+
+	// Assume AAC-LC.
+	return "mp4a.40.2"
+}
+
+// How long we wait for the input to open when we don't know a stream's codecs
+// yet.
+const codecsWait = 10 * time.Second
+
+// codecsRequest responds with the codecs of the stream's outputs as JSON. If
+// we have not opened the input yet, we open it to find out.
+func (h HTTPHandler) codecsRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, id string) {
+	codecs, ok := stream.Codecs()
+	if !ok {
+		codecs, ok = stream.probeCodecs(id, r, codecsWait)
+	}
+	if !ok {
+		h.writeError(rw, r, errInputUnavailable)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(codecs); err != nil {
+		httpLog.Errorf("%s: Unable to write codecs: %s", r.RemoteAddr, err)
+	}
+}
+
+// probeCodecs opens the input, if it isn't open, by joining the stream as a
+// client until we receive a packet. By then we know the codecs.
+func (s *Stream) probeCodecs(id string, r *http.Request,
+	timeout time.Duration) (StreamCodecs, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	c := newClient(ctx, id, r.RemoteAddr)
+	defer c.cancel()
+
+	if err := s.join(c); err != nil {
+		return StreamCodecs{}, false
+	}
+
+	select {
+	case p, ok := <-c.PacketChan:
+		if ok {
+			p.release()
+		}
+	case <-c.ctx.Done():
+	}
+
+	// If the encoder already closed the channel, leave() doesn't need it to
+	// notice.
+	go c.leave()
+
+	return s.Codecs()
+}
+
+// Codecs returns what the stream's outputs contain, if we know.
+func (s *Stream) Codecs() (StreamCodecs, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.codecs == nil {
+		return StreamCodecs{}, false
+	}
+	return *s.codecs, true
+}
+
+func (s *Stream) setCodecs(codecs StreamCodecs) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.codecs = &codecs
+}
+
+// String is the codecs as a list, for logging.
+func (c StreamCodecs) String() string {
+	codecs := []string{}
+	if c.Video != nil {
+		codecs = append(codecs, c.Video.Codecs)
+	}
+	if c.Audio != nil {
+		codecs = append(codecs, c.Audio.Codecs)
+	}
+	if len(codecs) == 0 {
+		return "unknown"
+	}
+	return strings.Join(codecs, ", ")
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A stream can be shown side by side with another, such as to check a camera
+// before and after adjusting it (with its profile), or to line up a visible
+// light camera with a thermal one pointed the same way. With compare set,
+// /compare/<name> shows the stream on the left and compare's with on the
+// right.
+//
+// We have to draw the picture, so this is MJPEG, like ?format=mjpeg, and
+// costs as much as an MJPEG client of each stream. Each side is scaled down
+// to at most comparisonSideWidth wide.
+//
+// We pair up the sides' pictures by when we decoded them. Cameras' latencies
+// differ, so offset holds back the side that is ahead: with a positive offset
+// the right's pictures arrive that many seconds after the left's, and we show
+// each left picture that much later. We start once both sides have a picture.
+// A side that stops sending pictures goes blank rather than freezing, and if
+// either side's input ends, so does the response.
+
+const (
+	// The widest each side may be. Wider pictures are scaled down.
+	comparisonSideWidth = 960
+
+	// The longest offset we take. We keep a side's pictures this long.
+	maxComparisonOffset = 5 * time.Second
+
+	// How long a side may go without a picture before we blank it.
+	comparisonStale = 5 * time.Second
+)
+
+// Comparison is another stream to show beside a stream.
+type Comparison struct {
+	// With names the stream on the right. It may be a profile, such as
+	// cam/low.
+	With string `json:"with"`
+
+	// Offset is how many seconds the right's pictures arrive after the left's.
+	// Negative if the left's arrive later.
+	Offset float64 `json:"offset"`
+}
+
+// validate checks the comparison makes sense for the stream with the name.
+// Whether the other stream exists we can only check with all the streams.
+func (c Comparison) validate(name string) error {
+	if c.With == "" || c.With == name {
+		return fmt.Errorf("stream %s: compare must be with another stream", name)
+	}
+	offset := time.Duration(c.Offset * float64(time.Second))
+	if offset > maxComparisonOffset || offset < -maxComparisonOffset {
+		return fmt.Errorf("stream %s: compare offset must be at most %s either way",
+			name, maxComparisonOffset)
+	}
+	return nil
+}
+
+// delays are how long to hold back each side's pictures.
+func (c Comparison) delays() (time.Duration, time.Duration) {
+	offset := time.Duration(c.Offset * float64(time.Second))
+	if offset > 0 {
+		return offset, 0
+	}
+	return 0, -offset
+}
+
+// comparisonSide is one side of a comparison.
+type comparisonSide struct {
+	name  string
+	delay time.Duration
+
+	mutex  *sync.Mutex
+	frames []comparisonFrame
+
+	// When we last encoded a picture. Only the decoding goroutine accesses it.
+	last time.Time
+}
+
+// comparisonFrame is a picture, as a JPEG, and when we decoded it.
+type comparisonFrame struct {
+	time time.Time
+	jpeg []byte
+}
+
+func newComparisonSide(name string, delay time.Duration) *comparisonSide {
+	return &comparisonSide{
+		name:  name,
+		delay: delay,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// frame keeps a picture of the decoder's frame, as often as we send them.
+func (s *comparisonSide) frame(decoder MediaDecoder, verbose bool) error {
+	now := time.Now()
+	if now.Sub(s.last) < mjpegInterval {
+		return nil
+	}
+	s.last = now
+
+	var buf []byte
+	var err error
+	if !transcodes.run(mjpegInterval, func() {
+		buf, err = decoder.JPEG(comparisonSideWidth, verbose)
+	}) {
+		return nil
+	}
+	if err != nil {
+		// A frame we can't encode shouldn't end the response.
+		encoderLog.Warnf("compare: %s: %s", s.name, err)
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.frames = append(s.frames, comparisonFrame{time: now, jpeg: buf})
+
+	// We show the newest picture at least delay old, so we need none older.
+	cutoff := now.Add(-s.delay)
+	for len(s.frames) > 1 && !s.frames[1].time.After(cutoff) {
+		s.frames = s.frames[1:]
+	}
+	return nil
+}
+
+// at is the picture to show at now. It is nil if there is none yet, or if
+// the side stopped sending pictures.
+func (s *comparisonSide) at(now time.Time) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := now.Add(-s.delay)
+	var frame *comparisonFrame
+	for i := range s.frames {
+		if s.frames[i].time.After(cutoff) {
+			break
+		}
+		frame = &s.frames[i]
+	}
+
+	if frame == nil || cutoff.Sub(frame.time) > comparisonStale {
+		return nil
+	}
+	return frame.jpeg
+}
+
+// drawComparison draws the two pictures side by side, each in the middle of
+// its half, and encodes it as a JPEG. A missing side is blank, the size of
+// the other.
+func drawComparison(left, right []byte) ([]byte, error) {
+	pictures := make([]image.Image, 2)
+	for i, buf := range [][]byte{left, right} {
+		if buf == nil {
+			continue
+		}
+		picture, err := jpeg.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode picture: %s", err)
+		}
+		pictures[i] = picture
+	}
+
+	sizes := make([]image.Point, 2)
+	for i := range pictures {
+		if pictures[i] != nil {
+			sizes[i] = pictures[i].Bounds().Size()
+		} else if pictures[1-i] != nil {
+			sizes[i] = pictures[1-i].Bounds().Size()
+		} else {
+			sizes[i] = image.Pt(slateWidth, slateHeight)
+		}
+	}
+
+	height := sizes[0].Y
+	if sizes[1].Y > height {
+		height = sizes[1].Y
+	}
+	img := image.NewRGBA(image.Rect(0, 0, sizes[0].X+sizes[1].X, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.Gray{Y: 0x20}},
+		image.Point{}, draw.Src)
+
+	x := 0
+	for i, picture := range pictures {
+		if picture != nil {
+			y := (height - sizes[i].Y) / 2
+			draw.Draw(img, image.Rect(x, y, x+sizes[i].X, y+sizes[i].Y), picture,
+				picture.Bounds().Min, draw.Src)
+		}
+		x += sizes[i].X
+	}
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		return nil, fmt.Errorf("unable to encode picture: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// compareRequest shows the stream beside the stream it is compared with, as
+// MJPEG. Each side is a client of its stream.
+func (h HTTPHandler) compareRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, id string, span *Span) {
+	def := stream.Definition()
+	span.SetAttribute("stream", def.Name)
+
+	if def.Compare == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+	other := h.Streams.Get(def.Compare.With)
+	if other == nil {
+		httpLog.Warnf("%s: Stream %s: No stream %s to compare with",
+			r.RemoteAddr, def.Name, def.Compare.With)
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+	streams := []*Stream{stream, other}
+
+	if !h.allowedOrigin(rw, r, def) || h.refuseDraining(rw, r) {
+		return
+	}
+
+	for _, s := range streams {
+		if h.refusePaused(rw, r, s) || h.refuseUnavailable(rw, r, s) {
+			return
+		}
+	}
+
+	if h.shedding(rw, r, def, true) {
+		return
+	}
+
+	viewing, ok := h.startViewing(rw, r)
+	if !ok {
+		return
+	}
+	defer func() {
+		viewing.end(time.Now())
+	}()
+
+	for _, s := range streams {
+		maxClients := s.Definition().MaxClients
+		if clients := atomic.AddInt32(&s.clients, 1); maxClients > 0 &&
+			int(clients) > maxClients {
+			atomic.AddInt32(&s.clients, -1)
+			httpLog.Warnf("client %s (%s): Too many clients", id, r.RemoteAddr)
+			span.SetError(errTooManyClients)
+			h.writeError(rw, r, errTooManyClients)
+			return
+		}
+		defer atomic.AddInt32(&s.clients, -1)
+	}
+
+	// Either side ending ends the comparison.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	leftDelay, rightDelay := def.Compare.delays()
+	sides := []*comparisonSide{
+		newComparisonSide(def.Name, leftDelay),
+		newComparisonSide(def.Compare.With, rightDelay),
+	}
+
+	clients := []*Client{}
+	errs := make(chan error, len(streams))
+	for i, s := range streams {
+		sideDef := s.Definition()
+
+		c := newClient(ctx, id, r.RemoteAddr)
+		defer c.cancel()
+		c.RequestedID = requestedClientID(r)
+		c.decode = true
+		c.waitKeyframe = true
+		c.masks = sideDef.PrivacyMasks
+		c.orientation = sideDef.orientation()
+		c.dewarp = sideDef.dewarp()
+
+		if err := s.join(c); err != nil {
+			if e, ok := err.(HTTPError); ok {
+				h.writeError(rw, r, e)
+			}
+			return
+		}
+
+		s.addClient(c)
+		defer s.removeClient(c)
+		clients = append(clients, c)
+
+		side := sides[i]
+		go func() {
+			errs <- c.decodePackets(sideDef.libavVerbose(),
+				func(decoder MediaDecoder) error {
+					return side.frame(decoder, sideDef.libavVerbose())
+				})
+			cancel()
+		}()
+	}
+
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("X-Client-ID", id)
+
+	for name, value := range def.Headers {
+		rw.Header().Set(name, value)
+	}
+
+	w := &streamWriter{rw: rw, stats: stream.stats, client: clients[0],
+		viewing: viewing, buffered: def.BufferOutput}
+
+	err := writeComparison(ctx, w, rw, sides, errs)
+	span.SetAttribute("bytes_sent", w.sent)
+	if err != nil {
+		httpLog.Warnf("%s: %s", clients[0], err)
+		span.SetError(err)
+
+		// If a stream gave up on us before we sent anything, we can still tell
+		// the client why.
+		if e, ok := err.(HTTPError); ok && w.sent == 0 {
+			h.writeError(rw, r, e)
+		}
+	}
+
+	httpLog.Debugf("%s: Sent %d bytes", clients[0], w.sent)
+	httpLog.Infof("%s: Cleaned up", clients[0])
+}
+
+// writeComparison writes the sides' pictures side by side, a JPEG at a time
+// in a multipart/x-mixed-replace response, until a side ends. errs has why
+// each side ended.
+func writeComparison(ctx context.Context, w *streamWriter,
+	rw http.ResponseWriter, sides []*comparisonSide, errs <-chan error) error {
+	ticker := time.NewTicker(mjpegInterval)
+	defer ticker.Stop()
+
+	started := false
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			left, right := sides[0].at(now), sides[1].at(now)
+			if !started && (left == nil || right == nil) {
+				continue
+			}
+
+			var buf []byte
+			var err error
+			if !transcodes.run(mjpegInterval, func() {
+				buf, err = drawComparison(left, right)
+			}) {
+				continue
+			}
+			if err != nil {
+				encoderLog.Warnf("compare: %s: %s", sides[0].name, err)
+				continue
+			}
+
+			if !started {
+				rw.Header().Set("Content-Type",
+					"multipart/x-mixed-replace; boundary="+mjpegBoundary)
+				started = true
+			}
+
+			if err := writeMJPEGPart(w, buf); err != nil {
+				return err
+			}
+		}
+	}
+}
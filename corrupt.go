@@ -0,0 +1,47 @@
+package main
+
+// Cameras and networks send broken packets now and then, and since every
+// client gets the same packets, one broken packet can break every player at
+// once. Before handing packets out, we drop those that are clearly broken:
+//
+//   - Empty packets.
+//   - Video before the first keyframe after the input opens, reconnects, or
+//     moves on to another file. Nothing can decode it.
+//   - With discard_corrupt, packets the demuxer flagged as corrupt, such as
+//     with lost RTP packets, as with ffmpeg's -fflags discardcorrupt. Players
+//     may conceal the damage in these better than they cope with the gap, so
+//     we pass them on by default.
+
+// packetFilter decides which packets from an input to drop.
+type packetFilter struct {
+	discardCorrupt bool
+
+	// Whether we had a video keyframe since the input opened or moved on.
+	keyframe bool
+}
+
+// drop decides whether to drop the packet, and if so, says why.
+func (f *packetFilter) drop(p *Packet) string {
+	if p.size == 0 {
+		return "empty"
+	}
+
+	if f.discardCorrupt && p.corrupt {
+		return "corrupt"
+	}
+
+	if !p.audio && !f.keyframe {
+		if !p.keyframe {
+			return "no keyframe yet"
+		}
+		f.keyframe = true
+	}
+
+	return ""
+}
+
+// reset waits for a keyframe again, such as when the input moves on to
+// another file.
+func (f *packetFilter) reset() {
+	f.keyframe = false
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime is how much CPU time we have used, user and system.
+func processCPUTime() (time.Duration, error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), nil
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// processCPUTime would be how much CPU time we have used. We don't measure it
+// on Windows.
+func processCPUTime() (time.Duration, error) {
+	return 0, fmt.Errorf("measuring CPU time is not supported on Windows")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// Allocations counts what we have allocated and not freed. If these grow
+// without clients to account for them, something is leaking.
+type Allocations struct {
+	// Inputs, outputs, and decoders allocated by the Media.
+	Inputs   int64 `json:"inputs"`
+	Outputs  int64 `json:"outputs"`
+	Decoders int64 `json:"decoders"`
+
+	// Packets allocated by the Media (AVPackets for libav), and the bytes of
+	// those shared with clients.
+	Packets     int64 `json:"packets"`
+	PacketBytes int64 `json:"packet_bytes"`
+
+	// Outputs registered to write to a client.
+	OutputWriters int `json:"output_writers"`
+
+	// Clients connected to all streams.
+	Clients int64 `json:"clients"`
+
+	Goroutines int `json:"goroutines"`
+}
+
+func getAllocations(streams *Streams) Allocations {
+	allocations := mediaAllocations()
+
+	clients := int64(0)
+	for _, stream := range streams.All() {
+		clients += int64(atomic.LoadInt32(&stream.clients))
+	}
+
+	allocations.PacketBytes = atomic.LoadInt64(&livePacketBytes)
+	allocations.Clients = clients
+	allocations.Goroutines = runtime.NumGoroutine()
+
+	return allocations
+}
+
+// allocationsRequest responds with our allocation counts as JSON.
+func (h HTTPHandler) allocationsRequest(rw http.ResponseWriter,
+	r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(getAllocations(h.Streams)); err != nil {
+		httpLog.Errorf("%s: Unable to write allocations: %s", r.RemoteAddr, err)
+	}
+}
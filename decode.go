@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// videoAnalyser looks at the stream's decoded video, such as to detect motion.
+type videoAnalyser interface {
+	// frame is called with each decoded frame.
+	frame(decoder MediaDecoder, now time.Time) error
+
+	// stop is called when we stop decoding, such as because the input went
+	// away.
+	stop(now time.Time)
+}
+
+// analyseVideo decodes the stream's video while anything configured needs
+// it, and passes each frame to each analyser. They share the one decoder
+// since decoding is where the cost is.
+func (s *Stream) analyseVideo() {
+	s.runOwnClient("decoder", func(def StreamDefinition) string {
+		settings := []string{}
+		if def.Motion {
+			settings = append(settings, fmt.Sprintf("motion %g", def.MotionThreshold))
+		}
+		if def.AnalysisURL != "" {
+			settings = append(settings, fmt.Sprintf("analysis %s %g %d",
+				def.AnalysisURL, def.AnalysisInterval, def.AnalysisWidth))
+		}
+		if def.TimelapseDir != "" {
+			settings = append(settings, fmt.Sprintf("timelapse %s %g %g",
+				def.TimelapseDir, def.TimelapseInterval, def.TimelapsePeriod))
+		}
+		if def.SnapshotDir != "" || def.SnapshotS3URL != "" {
+			settings = append(settings, fmt.Sprintf("snapshot %s %s %g %g",
+				def.SnapshotDir, def.SnapshotS3URL, def.SnapshotInterval,
+				def.SnapshotRetention))
+		}
+		// Masks, orientation, and dewarping alone don't need decoding, but
+		// changing them restarts us.
+		if len(settings) > 0 && len(def.PrivacyMasks) > 0 {
+			settings = append(settings, fmt.Sprintf("masks %v", def.PrivacyMasks))
+		}
+		if len(settings) > 0 && !def.orientation().identity() {
+			settings = append(settings, fmt.Sprintf("orientation %v",
+				def.orientation()))
+		}
+		if len(settings) > 0 && def.Dewarp != nil {
+			settings = append(settings, fmt.Sprintf("dewarp %v", *def.Dewarp))
+		}
+		return strings.Join(settings, " ")
+	}, func(c *Client) {
+		c.decode = true
+		c.masks = s.Definition().PrivacyMasks
+		c.orientation = s.Definition().orientation()
+		c.dewarp = s.Definition().dewarp()
+	}, func(c *Client, def StreamDefinition) error {
+		analysers := []videoAnalyser{}
+		if def.Motion {
+			analysers = append(analysers, newMotionDetector(def))
+		}
+		if def.AnalysisURL != "" {
+			analysers = append(analysers, newFrameAnalysis(s, def))
+		}
+		if def.TimelapseDir != "" {
+			analysers = append(analysers, newTimelapse(s, def))
+		}
+		if def.SnapshotDir != "" || def.SnapshotS3URL != "" {
+			analysers = append(analysers, newSnapshotArchiver(def))
+		}
+
+		err := c.decodePackets(def.libavVerbose(), func(decoder MediaDecoder) error {
+			now := time.Now()
+			for _, analyser := range analysers {
+				if err := analyser.frame(decoder, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		now := time.Now()
+		for _, analyser := range analysers {
+			analyser.stop(now)
+		}
+		return err
+	})
+}
+
+// decodePackets receives packets from the encoder like writePackets, but
+// decodes them rather than remuxing them. The client must have decode set. We decode the video, or the audio if
+// the client is for audio. We call frame with the decoder each time it has a
+// frame.
+//
+// We end when the encoder closes the channel, or if decoding or frame fails.
+// If the encoder gave up on the client before sending it anything, the error
+// is why.
+func (c *Client) decodePackets(verbose bool,
+	frame func(MediaDecoder) error) error {
+	var decoder MediaDecoder
+	defer func() {
+		if decoder != nil {
+			decoder.Close()
+		}
+	}()
+
+	for p := range c.PacketChan {
+		atomic.AddInt64(&c.queuedBytes, -p.size)
+		if p.time != noTime {
+			atomic.StoreInt64(&c.lastWrittenTime, p.time)
+		}
+
+		if decoder == nil {
+			var err error
+			decoder, err = c.input.OpenDecoder(c.audio, verbose)
+			if err != nil {
+				p.release()
+				c.leave()
+				return err
+			}
+			if !c.audio {
+				decoder.SetMasks(c.masks)
+				decoder.SetOrientation(c.orientation)
+				decoder.SetDewarp(c.dewarp)
+			}
+		}
+
+		err := decoder.Decode(p, verbose)
+		p.release()
+		if err != nil {
+			c.leave()
+			return err
+		}
+
+		for {
+			received, err := decoder.ReceiveFrame(verbose)
+			if err != nil {
+				c.leave()
+				return err
+			}
+			if !received {
+				break
+			}
+
+			if err := frame(decoder); err != nil {
+				c.leave()
+				return err
+			}
+		}
+	}
+
+	if decoder == nil && c.failure.Code != "" {
+		return c.failure
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// /stream.json describes how a player can get a stream: each output with its
+// URL and content type, the codecs and picture size, and the stream's
+// profiles. A player page can fetch it and pick the first output it can play,
+// rather than knowing the server's configuration.
+//
+// Outputs are in the order we suggest trying them. Which are there depends on
+// the stream: Media Source Extensions segments only with segments on, HLS
+// only with hls on, the DVR only with a DVR window, the comparison only with
+// compare set, and audio alone only if the input has audio we can serve.
+
+// StreamDescriptor describes a stream for players.
+type StreamDescriptor struct {
+	Name string `json:"name"`
+
+	// The stream's codecs, if we know them.
+	Video *OutputCodecs `json:"video,omitempty"`
+	Audio *OutputCodecs `json:"audio,omitempty"`
+
+	Outputs  []StreamOutput      `json:"outputs"`
+	Profiles []ProfileDescriptor `json:"profiles,omitempty"`
+}
+
+// StreamOutput is one way to get a stream.
+type StreamOutput struct {
+	// Such as mp4 or mse.
+	Transport string `json:"transport"`
+
+	URL string `json:"url"`
+
+	// The content type, with the codecs parameter if we know the codecs.
+	Type string `json:"type"`
+
+	// For mse, the initialization segment.
+	InitURL string `json:"init_url,omitempty"`
+}
+
+// ProfileDescriptor describes one of a stream's profiles.
+type ProfileDescriptor struct {
+	Name string `json:"name"`
+
+	// In kbit/s, as configured or last measured. 0 if we don't know.
+	Bitrate int `json:"bitrate,omitempty"`
+
+	// The MP4 URL.
+	URL string `json:"url"`
+
+	// The profile's video codecs, if we know them.
+	Video *OutputCodecs `json:"video,omitempty"`
+}
+
+// describe describes the stream, with the codecs given.
+func (s *Streams) describe(stream *Stream, codecs StreamCodecs,
+	known bool) StreamDescriptor {
+	def := stream.Definition()
+	path := url.PathEscape(def.Name)
+
+	desc := StreamDescriptor{
+		Name:    def.Name,
+		Video:   codecs.Video,
+		Audio:   codecs.Audio,
+		Outputs: []StreamOutput{},
+	}
+
+	// The MP4 has the audio too if the stream includes it, or silence in its
+	// place.
+	mp4Type := videoFormat.ContentType
+	if codecs.Video != nil {
+		mp4Type = codecs.Video.Type
+		if def.IncludeAudio && codecs.Audio != nil {
+			mp4Type = fmt.Sprintf("%s; codecs=\"%s,%s\"", videoFormat.ContentType,
+				codecs.Video.Codecs, codecs.Audio.Codecs)
+		} else if def.SilentAudio {
+			mp4Type = fmt.Sprintf("%s; codecs=\"%s,%s\"", videoFormat.ContentType,
+				codecs.Video.Codecs, silentAudioCodecs)
+		}
+	}
+
+	desc.Outputs = append(desc.Outputs, StreamOutput{
+		Transport: formatMP4,
+		URL:       "/stream/" + path,
+		Type:      mp4Type,
+	})
+
+	if def.Segments {
+		segmentType := videoFormat.ContentType
+		if codecs.Video != nil {
+			segmentType = codecs.Video.Type
+		}
+		desc.Outputs = append(desc.Outputs, StreamOutput{
+			Transport: "mse",
+			URL:       "/segments/" + path,
+			Type:      segmentType,
+			InitURL:   "/segments/" + path + "/init.mp4",
+		})
+	}
+
+	if def.HLS {
+		desc.Outputs = append(desc.Outputs, StreamOutput{
+			Transport: "hls",
+			URL:       "/hls/" + path + "/" + hlsPlaylistFile,
+			Type:      hlsPlaylistType,
+		})
+	}
+
+	if def.DVRWindow > 0 {
+		desc.Outputs = append(desc.Outputs, StreamOutput{
+			Transport: "dvr",
+			URL:       "/dvr/" + path,
+			Type:      videoFormat.ContentType,
+		})
+	}
+
+	for _, format := range []string{formatTS, formatMultipart, formatMJPEG} {
+		desc.Outputs = append(desc.Outputs, StreamOutput{
+			Transport: format,
+			URL:       "/stream/" + path + "?format=" + format,
+			Type:      formatContentTypes[format],
+		})
+	}
+
+	if def.Compare != nil {
+		desc.Outputs = append(desc.Outputs, StreamOutput{
+			Transport: "compare",
+			URL:       "/compare/" + path,
+			Type:      formatContentTypes[formatMJPEG],
+		})
+	}
+
+	// If we don't know the codecs, we don't know whether there is audio, so we
+	// leave it out.
+	if known && codecs.Audio != nil {
+		desc.Outputs = append(desc.Outputs, StreamOutput{
+			Transport: "audio",
+			URL:       "/audio/" + path,
+			Type:      codecs.Audio.Type,
+		})
+	}
+
+	for _, profile := range def.Profiles {
+		profileDesc := ProfileDescriptor{
+			Name: profile.Name,
+			URL: "/stream/" + path + "?profile=" +
+				url.QueryEscape(profile.Name),
+		}
+		profileStream := s.withProfile(stream, profile.Name)
+		if profileStream != nil {
+			profileDesc.Bitrate = profileStream.bitrate()
+			if profileCodecs, ok := profileStream.Codecs(); ok {
+				profileDesc.Video = profileCodecs.Video
+			}
+		}
+		desc.Profiles = append(desc.Profiles, profileDesc)
+	}
+
+	return desc
+}
+
+// descriptorRequest responds with the stream's descriptor. ?stream=<name>
+// gives the stream, or it is the default stream. If we don't know the
+// stream's codecs yet, we open the input to find out, as /codecs does. If
+// that fails we describe it without them.
+func (h HTTPHandler) descriptorRequest(rw http.ResponseWriter,
+	r *http.Request, id string) {
+	stream := h.Streams.Get(r.URL.Query().Get("stream"))
+	if stream == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	codecs, ok := stream.Codecs()
+	if !ok {
+		codecs, ok = stream.probeCodecs(id, r, codecsWait)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(
+		h.Streams.describe(stream, codecs, ok)); err != nil {
+		httpLog.Errorf("%s: Unable to write stream descriptor: %s", r.RemoteAddr,
+			err)
+	}
+}
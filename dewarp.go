@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Fisheye and 360° cameras send a circular picture that is hard to make sense
+// of. A stream can dewarp it into a flat view of part of it, as if seen
+// through an ordinary lens pointed that way.
+//
+// This needs the pixels, so we can only do it for pictures we decode and
+// encode ourselves: MJPEG clients, snapshots, time-lapses, and analysis.
+// Motion detection sees the flat view too. The video we remux is the camera's
+// as is.
+//
+// We assume an equidistant fisheye, where how far a point is from the
+// circle's centre is in proportion to its angle from the lens's axis. Most
+// fisheye lenses are close enough.
+
+// Dewarp describes a fisheye lens and the view to take through it.
+type Dewarp struct {
+	// The centre of the lens's circle, as fractions of the picture's width and
+	// height. 0 means the default, the middle of the picture.
+	CenterX float64 `json:"center_x"`
+	CenterY float64 `json:"center_y"`
+
+	// The circle's radius, as a fraction of the picture's height. 0 means the
+	// default, 0.5.
+	Radius float64 `json:"radius"`
+
+	// The lens's field of view across the circle, in degrees. 0 means the
+	// default, 180.
+	LensFOV float64 `json:"lens_fov"`
+
+	// The view's horizontal field of view, in degrees. 0 means the default,
+	// 90.
+	FOV float64 `json:"fov"`
+
+	// Where to point the view: pan turns it around the lens's axis, and tilt
+	// away from it, both in degrees.
+	Pan  float64 `json:"pan"`
+	Tilt float64 `json:"tilt"`
+}
+
+// withDefaults fills in defaults for what isn't set.
+func (d Dewarp) withDefaults() Dewarp {
+	if d.CenterX == 0 {
+		d.CenterX = 0.5
+	}
+	if d.CenterY == 0 {
+		d.CenterY = 0.5
+	}
+	if d.Radius == 0 {
+		d.Radius = 0.5
+	}
+	if d.LensFOV == 0 {
+		d.LensFOV = 180
+	}
+	if d.FOV == 0 {
+		d.FOV = 90
+	}
+	return d
+}
+
+// validate checks the lens and view make sense.
+func (d Dewarp) validate() error {
+	if d.CenterX < 0 || d.CenterX > 1 || d.CenterY < 0 || d.CenterY > 1 {
+		return fmt.Errorf("dewarp centre must be within the picture")
+	}
+	if d.Radius < 0 {
+		return fmt.Errorf("dewarp radius must not be negative")
+	}
+	if d.LensFOV < 0 || d.LensFOV > 360 {
+		return fmt.Errorf("dewarp lens field of view must be between 0 and 360")
+	}
+	if d.FOV < 0 || d.FOV >= 180 {
+		return fmt.Errorf("dewarp field of view must be between 0 and 180")
+	}
+	if d.Tilt < -180 || d.Tilt > 180 {
+		return fmt.Errorf("dewarp tilt must be between -180 and 180")
+	}
+	return nil
+}
+
+// source finds where in the fisheye picture a point of the view comes from.
+// Points are fractions of the pictures' width and height, which are the same
+// size, width/height being aspect. It returns false if the point is outside
+// what the lens sees.
+func (d Dewarp) source(u, v, aspect float64) (float64, float64, bool) {
+	// The direction of the point from the view's centre, along the z axis.
+	scale := math.Tan(d.FOV * math.Pi / 360)
+	x := (2*u - 1) * scale
+	y := (2*v - 1) * scale / aspect
+	z := 1.0
+
+	tilt := d.Tilt * math.Pi / 180
+	y, z = y*math.Cos(tilt)-z*math.Sin(tilt), y*math.Sin(tilt)+z*math.Cos(tilt)
+
+	pan := d.Pan * math.Pi / 180
+	x, y = x*math.Cos(pan)-y*math.Sin(pan), x*math.Sin(pan)+y*math.Cos(pan)
+
+	// The angle from the lens's axis, and around it.
+	theta := math.Atan2(math.Hypot(x, y), z)
+	phi := math.Atan2(y, x)
+	if theta > d.LensFOV*math.Pi/360 {
+		return 0, 0, false
+	}
+
+	// The radius is in heights.
+	r := theta / (d.LensFOV * math.Pi / 360) * d.Radius
+	return d.CenterX + r*math.Cos(phi)/aspect, d.CenterY + r*math.Sin(phi), true
+}
+
+// apply dewarps a picture of width by height, one byte per pixel, into a new
+// one the same size. What the lens doesn't see is black.
+func (d Dewarp) apply(buf []byte, width, height int) []byte {
+	aspect := float64(width) / float64(height)
+	out := make([]byte, len(buf))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			su, sv, ok := d.source((float64(x)+0.5)/float64(width),
+				(float64(y)+0.5)/float64(height), aspect)
+			if !ok {
+				continue
+			}
+
+			sx := int(math.Floor(su * float64(width)))
+			sy := int(math.Floor(sv * float64(height)))
+			if sx < 0 || sy < 0 || sx >= width || sy >= height {
+				continue
+			}
+			out[y*width+x] = buf[sy*width+sx]
+		}
+	}
+	return out
+}
+
+// dewarp is the stream's fisheye lens and view, with defaults filled in, or
+// nil if it has none.
+func (d StreamDefinition) dewarp() *Dewarp {
+	if d.Dewarp == nil {
+		return nil
+	}
+	dewarp := d.Dewarp.withDefaults()
+	return &dewarp
+}
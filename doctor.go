@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The doctor subcommand checks that we can serve what we're configured to,
+// and says what to do about what we can't. It takes the same flags as
+// serving. It checks:
+//
+//   - The ffmpeg libraries we're linked with.
+//   - Each stream's input: that it opens, that a keyframe arrives soon, and
+//     that browsers can play its codecs.
+//   - That we can listen where we're told to, and any TLS certificate.
+//
+// Most problems people run into are one of these.
+
+// How long we wait for the first keyframe from an input.
+const doctorKeyframeWait = 10 * time.Second
+
+// Players start at a keyframe, so a client may wait this long at worst.
+const doctorKeyframeInterval = 4 * time.Second
+
+// LibraryVersion is the version of an ffmpeg library we were compiled against
+// and the one we're linked with, as libav encodes them (major<<16 |
+// minor<<8 | micro).
+type LibraryVersion struct {
+	Name     string
+	Compiled uint32
+	Linked   uint32
+}
+
+// doctor reports the outcome of each check.
+type doctor struct {
+	w        io.Writer
+	failures int
+}
+
+// runDoctor runs the doctor subcommand. It fails if any check did.
+func runDoctor(arguments []string) error {
+	d := &doctor{w: os.Stdout}
+
+	d.checkLibraries()
+
+	args, err := getArgs(arguments)
+	if err != nil {
+		d.fail("Run videostreamer doctor with the flags you serve with.",
+			"Invalid arguments: %s", err)
+		return d.result()
+	}
+
+	if err := setLogLevels(args.LogLevel, args.LogLevels); err != nil {
+		d.fail("Check -log-level names known components and levels.",
+			"Invalid log levels: %s", err)
+		return d.result()
+	}
+
+	if args.StreamKeysFile != "" {
+		if streamKeys, err = loadStreamKeys(args.StreamKeysFile); err != nil {
+			d.fail("Check -stream-keys names a readable stream keys file.",
+				"Unable to load stream keys: %s", err)
+		}
+	}
+
+	defs, err := streamDefinitions(args)
+	if err != nil {
+		d.fail("Fix the configuration file. Each stream needs a name and an input URL.",
+			"Invalid configuration: %s", err)
+		return d.result()
+	}
+
+	setThreads(args.Threads)
+	media := newMedia(args.Devices)
+	for _, def := range defs {
+		for _, def := range append([]StreamDefinition{def},
+			def.profileDefinitions()...) {
+			d.checkInput(media, def)
+		}
+	}
+
+	for _, l := range args.Listeners {
+		d.checkListener(l, args)
+	}
+
+	return d.result()
+}
+
+func (d *doctor) ok(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(d.w, "[ok]   %s\n", fmt.Sprintf(format, a...))
+}
+
+func (d *doctor) warn(advice, format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(d.w, "[warn] %s\n       %s\n", fmt.Sprintf(format, a...),
+		advice)
+}
+
+func (d *doctor) fail(advice, format string, a ...interface{}) {
+	d.failures++
+	_, _ = fmt.Fprintf(d.w, "[fail] %s\n       %s\n", fmt.Sprintf(format, a...),
+		advice)
+}
+
+func (d *doctor) result() error {
+	if d.failures > 0 {
+		return fmt.Errorf("%d checks failed", d.failures)
+	}
+	return nil
+}
+
+// checkLibraries checks that the ffmpeg libraries we're linked with are the
+// ones we were built against.
+func (d *doctor) checkLibraries() {
+	versions := libraryVersions()
+	if len(versions) == 0 {
+		d.warn("Build with cgo and the ffmpeg development libraries installed, without the nolibav tag.",
+			"Built without ffmpeg: inputs are simulated")
+		return
+	}
+
+	for _, v := range versions {
+		switch {
+		case v.Linked>>16 != v.Compiled>>16:
+			d.fail("Rebuild videostreamer against the ffmpeg libraries installed now.",
+				"%s %s is linked, but we were built against %s", v.Name,
+				formatLibraryVersion(v.Linked), formatLibraryVersion(v.Compiled))
+		case v.Linked < v.Compiled:
+			d.warn("Upgrade ffmpeg, or rebuild videostreamer against the libraries installed now.",
+				"%s %s is linked, older than the %s we were built against", v.Name,
+				formatLibraryVersion(v.Linked), formatLibraryVersion(v.Compiled))
+		default:
+			d.ok("%s %s", v.Name, formatLibraryVersion(v.Linked))
+		}
+	}
+}
+
+func formatLibraryVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", v>>16, v>>8&0xff, v&0xff)
+}
+
+// checkInput opens the stream's input, waits for a keyframe, and checks that
+// browsers can play what it has.
+func (d *doctor) checkInput(media Media, def StreamDefinition) {
+	start := time.Now()
+	input, err := openInput(media, def.Name, def.InputFormat, def.InputURL,
+		def.InputOptions, def.openTimeout(), def.libavVerbose())
+	if err != nil {
+		advice := "Check the input URL, its credentials, input_format, and input_options. Capture devices need -devices. With -log-level libav=debug, ffmpeg says more."
+		if err == errInputTimeout {
+			advice = "Check the camera is reachable from this host, and raise open_timeout if it is slow to answer."
+		}
+		d.fail(advice, "Stream %s: Unable to open input: %s", def.Name, err)
+		return
+	}
+	defer destroyInput(input)
+
+	d.ok("Stream %s: Opened input in %s", def.Name,
+		time.Since(start).Round(time.Millisecond))
+
+	d.checkKeyframe(input, def)
+	d.checkCodecs(input, def)
+}
+
+// checkKeyframe reads from the input until a keyframe arrives. Clients start
+// at one, so if they're far apart, clients wait a long time for a picture.
+func (d *doctor) checkKeyframe(input *Input, def StreamDefinition) {
+	start := time.Now()
+	for time.Since(start) < doctorKeyframeWait {
+		p, err := input.ReadPacket(def.readTimeout(), def.libavVerbose())
+		if err != nil {
+			d.fail("Check the camera keeps sending. Raise read_timeout if it sends slowly.",
+				"Stream %s: Unable to read from input: %s", def.Name, err)
+			return
+		}
+		if p == nil {
+			continue
+		}
+
+		keyframe := !p.audio && p.keyframe
+		p.release()
+		if !keyframe {
+			continue
+		}
+
+		if waited := time.Since(start); waited > doctorKeyframeInterval {
+			d.warn("Set the camera's keyframe (I-frame or GOP) interval to 1 or 2 seconds so that clients start sooner.",
+				"Stream %s: First keyframe took %s", def.Name,
+				waited.Round(time.Millisecond))
+			return
+		}
+		d.ok("Stream %s: Keyframe arrived", def.Name)
+		return
+	}
+
+	d.warn("Set the camera's keyframe (I-frame or GOP) interval to 1 or 2 seconds so that clients start sooner.",
+		"Stream %s: No keyframe within %s", def.Name, doctorKeyframeWait)
+}
+
+// checkCodecs checks that browsers can play the input's video, and that we can
+// serve its audio on /audio.
+func (d *doctor) checkCodecs(input *Input, def StreamDefinition) {
+	video, ok := input.CodecParameters(false)
+	if !ok {
+		d.fail("Check the input URL points at the camera's video.",
+			"Stream %s: Input has no video", def.Name)
+		return
+	}
+
+	codecs := video.rfc6381()
+	switch {
+	case video.Codec == "h264" && codecs != "" && !browserH264Profile(video):
+		d.fail("Set the camera to H.264 Main or High profile. Browsers can't play 10 bit, 4:2:2, or 4:4:4 H.264.",
+			"Stream %s: Video is H.264 %s, profile %d", def.Name, codecs,
+			video.Profile)
+	case video.Codec == "h264" && codecs != "":
+		d.ok("Stream %s: Video is H.264 (%s), which browsers play", def.Name, codecs)
+	case video.Codec == "hevc":
+		d.warn("Set the camera to H.264 for other browsers, or serve ?format=ts to players such as VLC.",
+			"Stream %s: Video is H.265, which only Safari and some other browsers play",
+			def.Name)
+	case codecs != "":
+		d.warn("Set the camera to H.264 if your viewers' browsers can't play it.",
+			"Stream %s: Video is %s (%s), which not all browsers play", def.Name,
+			video.Codec, codecs)
+	default:
+		d.fail("Set the camera to H.264. Clients can still get ?format=mjpeg, at a far higher CPU cost.",
+			"Stream %s: Browsers can't play %s video in MP4", def.Name, video.Codec)
+	}
+
+	audio, ok := input.CodecParameters(true)
+	if !ok {
+		return
+	}
+
+	if _, err := input.AudioFormat(); err != nil {
+		d.warn("Set the camera's audio to AAC to serve it on /audio. Audio events work with any codec.",
+			"Stream %s: Unable to serve %s audio on /audio", def.Name, audio.Codec)
+		return
+	}
+	d.ok("Stream %s: Audio is %s", def.Name, audio.Codec)
+}
+
+// browserH264Profile decides whether browsers play the H.264 profile. They
+// play Constrained Baseline, Baseline, Main, and High, but not the 10 bit,
+// 4:2:2, and 4:4:4 ones.
+func browserH264Profile(p CodecParameters) bool {
+	switch p.Profile &^ (1<<9 | 1<<11) {
+	case 66, 77, 88, 100:
+		return true
+	}
+	return false
+}
+
+// checkListener checks that we can listen where we're told to, then stops.
+func (d *doctor) checkListener(l Listener, args Args) {
+	if l.Network == "unix" {
+		if fi, err := os.Stat(l.Address); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			d.warn("Ignore this if videostreamer isn't running. We remove the old socket when we start.",
+				"%s: Socket exists, so we can't check it", l)
+			return
+		}
+	}
+
+	listener, err := listen(l, args)
+	if err != nil {
+		switch {
+		case errors.Is(err, syscall.EADDRINUSE):
+			d.fail("Stop what is listening there (such as another videostreamer), or listen elsewhere with -listen.",
+				"%s: Address is in use", l)
+		case errors.Is(err, syscall.EACCES):
+			d.fail("Listen on a port above 1024, or give videostreamer CAP_NET_BIND_SERVICE (setcap cap_net_bind_service=+ep).",
+				"%s: Permission denied", l)
+		default:
+			d.fail("Check the address in -listen is one of this host's.",
+				"%s: Unable to listen: %s", l, err)
+		}
+		return
+	}
+	_ = listener.Close()
+	d.ok("%s: Able to listen", l)
+
+	if l.Protocol == "https" {
+		d.checkCertificate(args.TLSCertFile, args.TLSKeyFile)
+	}
+}
+
+// checkCertificate checks the TLS certificate and key load, and that the
+// certificate hasn't expired.
+func (d *doctor) checkCertificate(certFile, keyFile string) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		d.fail("Check -tls-cert and -tls-key name a matching PEM certificate and key.",
+			"Unable to load TLS certificate: %s", err)
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		d.fail("Check -tls-cert names a PEM certificate.",
+			"Unable to parse TLS certificate: %s", err)
+		return
+	}
+
+	switch remaining := time.Until(leaf.NotAfter); {
+	case remaining <= 0:
+		d.fail("Renew the certificate.", "TLS certificate expired on %s",
+			leaf.NotAfter.Format("2006-01-02"))
+	case remaining < 14*24*time.Hour:
+		d.warn("Renew the certificate soon.", "TLS certificate expires on %s",
+			leaf.NotAfter.Format("2006-01-02"))
+	default:
+		d.ok("TLS certificate is valid until %s",
+			leaf.NotAfter.Format("2006-01-02"))
+	}
+}
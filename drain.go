@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// For rolling upgrades behind a load balancer, we can drain: stop taking new
+// viewers, let those watching finish, then stop. POST /api/drain starts
+// draining, as does SIGINT or SIGTERM with -drain-on-signal. Then:
+//
+//   - New viewers of /stream, /audio, /compare, and /dvr get a 503
+//     (draining) with a Retry-After header, and their connection closes, so
+//     the load balancer sends them elsewhere. So do requests starting HLS
+//     sessions. Segments, HLS requests of sessions under way, and /dvr
+//     requests with a session are still served, as players already watching
+//     fetch those.
+//   - /readyz answers 503, so the load balancer stops sending us clients.
+//   - Once /stream, /audio, /compare, and HLS have no viewers left, or
+//     -drain-timeout passes, we stop as we would on a signal, waiting a while
+//     for other requests. Our own outputs, such as recordings, carry on until
+//     then.
+//
+// A signal while draining stops us at once. Draining can't be undone, short
+// of restarting.
+
+var errDraining = HTTPError{
+	Status:  http.StatusServiceUnavailable,
+	Code:    "draining",
+	Message: "Server is draining",
+}
+
+const (
+	// How long clients refused while we drain should wait before trying again.
+	// By then, the load balancer should send them elsewhere.
+	drainRetryAfter = 30 * time.Second
+
+	// How often we check whether viewers are left while draining.
+	drainCheckInterval = time.Second
+)
+
+// drainState is whether we're draining.
+type drainState struct {
+	// 1 once we start draining. Access atomically.
+	draining int32
+
+	// Closed when we start draining.
+	started chan struct{}
+	once    sync.Once
+
+	// When we started, and when we stop regardless of viewers, if we do.
+	mutex    sync.Mutex
+	start    time.Time
+	deadline time.Time
+}
+
+var drain = &drainState{started: make(chan struct{})}
+
+// DrainStatus describes draining.
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+
+	// Viewers still watching.
+	Viewers int `json:"viewers"`
+
+	Started  *time.Time `json:"started,omitempty"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// begin starts draining, if we aren't already. timeout is how long viewers
+// have to finish. 0 means as long as they need.
+func (d *drainState) begin(timeout time.Duration) {
+	d.once.Do(func() {
+		now := time.Now()
+		d.mutex.Lock()
+		d.start = now
+		if timeout > 0 {
+			d.deadline = now.Add(timeout)
+		}
+		d.mutex.Unlock()
+
+		atomic.StoreInt32(&d.draining, 1)
+		close(d.started)
+		serverLog.Infof("Draining")
+	})
+}
+
+// active says whether we're draining.
+func (d *drainState) active() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// status describes draining, with the viewers left.
+func (d *drainState) status(streams *Streams) DrainStatus {
+	status := DrainStatus{
+		Draining: d.active(),
+		Viewers:  viewerCount(streams),
+	}
+	if !status.Draining {
+		return status
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	start := d.start
+	status.Started = &start
+	if !d.deadline.IsZero() {
+		deadline := d.deadline
+		status.Deadline = &deadline
+	}
+	return status
+}
+
+// viewerCount counts the clients of every stream, and the HLS sessions. Our
+// own clients, such as the segmenter, aren't viewers.
+func viewerCount(streams *Streams) int {
+	n := hlsSessions.count()
+	for _, stream := range streams.All() {
+		n += int(atomic.LoadInt32(&stream.clients))
+	}
+	return n
+}
+
+// stopWhenDrained waits until we start draining, then until no viewers are
+// left or the deadline passes, and calls cancel to stop us.
+func stopWhenDrained(ctx context.Context, streams *Streams,
+	cancel context.CancelFunc) {
+	select {
+	case <-drain.started:
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		status := drain.status(streams)
+		if status.Viewers == 0 {
+			serverLog.Infof("Drained")
+			cancel()
+			return
+		}
+		if status.Deadline != nil && time.Now().After(*status.Deadline) {
+			serverLog.Infof("Stopping with %d viewers left after draining",
+				status.Viewers)
+			cancel()
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refuseDraining responds with a 503 if we're draining. It returns true if
+// it did.
+func (h HTTPHandler) refuseDraining(rw http.ResponseWriter,
+	r *http.Request) bool {
+	if !drain.active() {
+		return false
+	}
+
+	setRetryAfter(rw, drainRetryAfter)
+	rw.Header().Set("Connection", "close")
+	h.writeError(rw, r, errDraining)
+	return true
+}
+
+// drainRequest starts draining on POST, and responds with how draining is
+// going.
+func (h HTTPHandler) drainRequest(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	if r.Method == "POST" {
+		httpLog.Infof("%s: Asked to drain", r.RemoteAddr)
+		drain.begin(h.DrainTimeout)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(drain.status(h.Streams)); err != nil {
+		httpLog.Errorf("%s: Unable to write response: %s", r.RemoteAddr, err)
+	}
+}
+
+// readyRequest says whether we take new viewers: 200 if so, 503 while we're
+// draining. Unlike /healthz, this is for load balancers rather than
+// supervisors. A server that isn't ready is still working.
+func (h HTTPHandler) readyRequest(rw http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if drain.active() {
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+		"ok":       status == http.StatusOK,
+		"draining": drain.active(),
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write readiness: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Cheap cameras often have an audio clock that runs a little fast or slow
+// against their video clock, adding up to minutes over days. Players go by
+// the timestamps, so the longer the input is open, the further the audio
+// drifts out of sync with the video.
+//
+// We measure drift by comparing the timestamp of each audio packet with that
+// of the latest video packet. Averaged over driftWindow, this is how far ahead
+// of the video the audio is. The first average is our baseline, since some
+// cameras have an offset that never changes, and drift is how far the average
+// moves from it.
+//
+// When drift passes max_av_drift, we log it and publish an av_drift event.
+// With correct_av_drift, we also shift the audio's timestamps to cancel it, a
+// little each window so that players see no jump. We remux the audio rather
+// than re-encode it, so we can't resample it to correct drift.
+
+const (
+	// How long we average over.
+	driftWindow = 10 * time.Second
+
+	// How far the audio may drift from the video by default before we say so.
+	defaultMaxAVDrift = 100 * time.Millisecond
+
+	// The most we shift the audio by at once, and how far it may drift before
+	// we shift it.
+	driftStep = 10 * time.Millisecond
+
+	// If the audio's offset from the video changes by more than this from one
+	// window to the next, the camera's timestamps jumped rather than drifted,
+	// and we take the change as part of the baseline.
+	driftJump = time.Second
+)
+
+// DriftEvent describes av_drift events.
+type DriftEvent struct {
+	// How far ahead of the video the audio's clock is, in seconds.
+	Drift float64 `json:"drift"`
+
+	// How far we shifted the audio to cancel it, in seconds.
+	Correction float64 `json:"correction"`
+}
+
+// driftMonitor measures and corrects drift between an input's audio and video.
+// Only the goroutine reading the input may use it.
+type driftMonitor struct {
+	stream   string
+	input    MediaInput
+	stats    *StreamStats
+	maxDrift time.Duration
+	correct  bool
+
+	// The time of the latest video packet, in microseconds.
+	lastVideo int64
+
+	// The audio's offset from the video, summed over the window so far.
+	windowStart time.Time
+	sum         int64
+	n           int64
+
+	// The average offset from the first window, and from the last one.
+	baseline     int64
+	lastAverage  int64
+	haveBaseline bool
+
+	// How far we shifted the audio, in microseconds.
+	correction int64
+
+	// Whether the drift is over maxDrift.
+	drifting bool
+}
+
+func newDriftMonitor(stream string, input MediaInput, stats *StreamStats,
+	def StreamDefinition) *driftMonitor {
+	maxDrift := time.Duration(def.MaxAVDrift * float64(time.Second))
+	if maxDrift == 0 {
+		maxDrift = defaultMaxAVDrift
+	}
+
+	return &driftMonitor{
+		stream:    stream,
+		input:     input,
+		stats:     stats,
+		maxDrift:  maxDrift,
+		correct:   def.CorrectAVDrift,
+		lastVideo: noTime,
+	}
+}
+
+// observe measures the packet against those before it.
+func (d *driftMonitor) observe(p *Packet, now time.Time) {
+	if p.time == noTime {
+		return
+	}
+
+	if !p.audio {
+		d.lastVideo = p.time
+		return
+	}
+
+	if d.lastVideo == noTime {
+		return
+	}
+
+	if d.n == 0 {
+		d.windowStart = now
+	}
+	d.sum += p.time - d.lastVideo
+	d.n++
+
+	if now.Sub(d.windowStart) < driftWindow {
+		return
+	}
+
+	// The audio timestamps we see include our correction. Take it out to see
+	// how far the camera's clocks drifted.
+	average := d.sum/d.n - d.correction
+	d.sum = 0
+	d.n = 0
+
+	if !d.haveBaseline {
+		d.baseline = average
+		d.lastAverage = average
+		d.haveBaseline = true
+		return
+	}
+
+	if jump := average - d.lastAverage; jump > int64(driftJump/time.Microsecond) ||
+		-jump > int64(driftJump/time.Microsecond) {
+		encoderLog.Infof("encoder: %s: Audio timestamps jumped %s against the video",
+			d.stream, time.Duration(jump)*time.Microsecond)
+		d.baseline += jump
+	}
+	d.lastAverage = average
+
+	drift := average - d.baseline
+	atomic.StoreInt64(&d.stats.AVDrift, drift)
+
+	if d.correct {
+		d.adjust(drift)
+	}
+
+	d.check(drift, now)
+}
+
+// adjust shifts the audio a step towards cancelling the drift.
+func (d *driftMonitor) adjust(drift int64) {
+	step := int64(driftStep / time.Microsecond)
+
+	// What's left after our correction.
+	residual := drift + d.correction
+	if residual < step && -residual < step {
+		return
+	}
+
+	if residual > 0 {
+		d.correction -= step
+	} else {
+		d.correction += step
+	}
+	d.input.SetAudioOffset(time.Duration(d.correction) * time.Microsecond)
+	atomic.StoreInt64(&d.stats.AVDriftCorrection, d.correction)
+}
+
+// check publishes an av_drift event when the drift goes over the maximum. Once
+// it has, we wait for it to come back under half the maximum before we publish
+// another.
+func (d *driftMonitor) check(drift int64, now time.Time) {
+	abs := drift
+	if abs < 0 {
+		abs = -abs
+	}
+
+	if d.drifting {
+		if abs < int64(d.maxDrift/time.Microsecond)/2 {
+			d.drifting = false
+		}
+		return
+	}
+
+	if abs < int64(d.maxDrift/time.Microsecond) {
+		return
+	}
+	d.drifting = true
+
+	drifted := time.Duration(drift) * time.Microsecond
+	if d.correct {
+		encoderLog.Infof("encoder: %s: Audio drifted %s from the video, correcting",
+			d.stream, drifted)
+	} else {
+		encoderLog.Warnf("encoder: %s: Audio drifted %s from the video",
+			d.stream, drifted)
+	}
+
+	events.publish(Event{
+		Type:   "av_drift",
+		Stream: d.stream,
+		Time:   now,
+		Drift: &DriftEvent{
+			Drift:      drifted.Seconds(),
+			Correction: (time.Duration(d.correction) * time.Microsecond).Seconds(),
+		},
+	})
+}
+
+// reset starts measuring again, such as when the input moves on to another
+// file. Its clocks are its own.
+func (d *driftMonitor) reset() {
+	if d.correction != 0 {
+		d.input.SetAudioOffset(0)
+	}
+
+	*d = driftMonitor{
+		stream:    d.stream,
+		input:     d.input,
+		stats:     d.stats,
+		maxDrift:  d.maxDrift,
+		correct:   d.correct,
+		lastVideo: noTime,
+	}
+	atomic.StoreInt64(&d.stats.AVDrift, 0)
+	atomic.StoreInt64(&d.stats.AVDriftCorrection, 0)
+}
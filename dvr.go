@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With a DVR window, we keep that much of the stream's segments, and /dvr
+// serves them so that players can pause and seek back a few minutes.
+//
+// /dvr is a growing MP4: the session's initialization segment followed by its
+// segments. A request first redirects to a URL pinning where in the session
+// the file starts, by default at the live edge, or ?behind=<seconds> before
+// it. Bytes of that URL then always mean the same thing, so players can pause
+// and carry on with a Range request from where they stopped, or seek to any
+// byte we still have. Once a byte leaves the window, requests for it fail.
+
+// The most we keep for the DVR window.
+const maxDVRWindow = time.Hour
+
+var (
+	errDVRGone = HTTPError{
+		Status:  http.StatusGone,
+		Code:    "dvr_gone",
+		Message: "No longer in the DVR window",
+	}
+	errRangeNotSatisfiable = HTTPError{
+		Status:  http.StatusRequestedRangeNotSatisfiable,
+		Code:    "range_not_satisfiable",
+		Message: "Range not satisfiable",
+	}
+)
+
+// dvrWindow is how much of the stream we keep for /dvr.
+func (d StreamDefinition) dvrWindow() time.Duration {
+	return time.Duration(d.DVRWindow * float64(time.Second))
+}
+
+// segmentsKeep is how much of the stream the segmenter must keep, for
+// recording pre-roll and for the DVR window.
+func (d StreamDefinition) segmentsKeep() time.Duration {
+	keep := d.dvrWindow()
+	if d.RecordDir != "" && len(d.RecordOnEvents) > 0 &&
+		d.recordPreRoll() > keep {
+		keep = d.recordPreRoll()
+	}
+	return keep
+}
+
+// dvrRequest serves the stream's DVR window.
+func (h HTTPHandler) dvrRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream) {
+	def := stream.Definition()
+	if def.DVRWindow == 0 {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	// Requests without a session are new viewers. Those with one carry on
+	// watching.
+	if !h.allowedOrigin(rw, r, def) ||
+		(r.URL.Query().Get("session") == "" && h.refuseDraining(rw, r)) ||
+		h.refusePaused(rw, r, stream) || h.shedding(rw, r, def, false) {
+		return
+	}
+
+	viewing, ok := h.startViewing(rw, r)
+	if !ok {
+		return
+	}
+	defer func() {
+		viewing.end(time.Now())
+	}()
+
+	query := r.URL.Query()
+	if query.Get("session") == "" {
+		h.dvrRedirect(rw, r, stream)
+		return
+	}
+
+	session, err := strconv.ParseUint(query.Get("session"), 10, 64)
+	if err != nil {
+		h.writeError(rw, r, errBadRequest)
+		return
+	}
+	base, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil || base < 0 {
+		h.writeError(rw, r, errBadRequest)
+		return
+	}
+
+	init, initSession, _ := stream.segmenter.Init()
+	if init == nil || initSession != session {
+		h.writeError(rw, r, errDVRGone)
+		return
+	}
+
+	// Positions in the file past the initialization segment are bytes of the
+	// session's chunks from base on.
+	f := dvrFile{
+		session: session,
+		init:    init,
+		base:    base,
+	}
+
+	rw.Header().Set("Content-Type", "video/mp4")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("Accept-Ranges", "bytes")
+
+	start, end, ranged := parseByteRange(r.Header.Get("Range"))
+	if !ranged {
+		// Without a range, we send the file from the start and carry on as the
+		// stream does.
+		if _, ok := f.position(stream.segmenter.Window(),
+			int64(len(f.init))); !ok {
+			h.writeError(rw, r, errDVRGone)
+			return
+		}
+		f.write(rw, r, stream, viewing, 0, -1)
+		return
+	}
+
+	// Serve what we have of the range, waiting a while for the stream to reach
+	// it if need be.
+	timeout := time.NewTimer(segmentWait)
+	defer timeout.Stop()
+
+	for {
+		window := stream.segmenter.Window()
+		size := f.size(window)
+
+		// A suffix range is the end of what we have so far.
+		from := start
+		if from < 0 {
+			from += size
+			if from < 0 {
+				from = 0
+			}
+		}
+
+		if _, ok := f.position(window, from); !ok {
+			rw.Header().Set("Content-Range", "bytes */*")
+			h.writeError(rw, r, errRangeNotSatisfiable)
+			return
+		}
+
+		if from < size {
+			start = from
+			if end < 0 || end >= size {
+				end = size - 1
+			}
+			break
+		}
+
+		select {
+		case <-window.Changed:
+		case <-timeout.C:
+			rw.Header().Set("Content-Range", "bytes */*")
+			h.writeError(rw, r, errRangeNotSatisfiable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, end))
+	rw.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	rw.WriteHeader(http.StatusPartialContent)
+	f.write(rw, r, stream, viewing, start, end)
+}
+
+// dvrRedirect redirects to a URL pinning where in the session the file
+// starts.
+func (h HTTPHandler) dvrRedirect(rw http.ResponseWriter, r *http.Request,
+	stream *Stream) {
+	behind := time.Duration(0)
+	if value := r.URL.Query().Get("behind"); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			h.writeError(rw, r, errBadRequest)
+			return
+		}
+		behind = time.Duration(seconds * float64(time.Second))
+	}
+
+	timeout := time.NewTimer(segmentWait)
+	defer timeout.Stop()
+
+	var segments []Segment
+	for {
+		window := stream.segmenter.Window()
+		segments = window.Segments
+		if len(segments) > 0 {
+			break
+		}
+
+		select {
+		case <-window.Changed:
+		case <-timeout.C:
+			h.writeError(rw, r, errInputUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	sequence := segments[len(segments)-1].Sequence
+	if behind > 0 {
+		sequence = preRollSequence(segments, behind)
+	}
+	segment, _ := findSegment(segments, sequence)
+
+	query := r.URL.Query()
+	query.Del("behind")
+	query.Set("session", strconv.FormatUint(segment.Session, 10))
+	query.Set("offset", strconv.FormatInt(segment.Offset, 10))
+
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	http.Redirect(rw, r, r.URL.Path+"?"+query.Encode(), http.StatusFound)
+}
+
+// parseByteRange parses a Range header asking for a single range of bytes,
+// such as bytes=100- or bytes=100-199. end is -1 if the range is open. For a
+// suffix range, such as bytes=-500 for the last 500 bytes, start is negative
+// and end is -1. We ignore other ranges and serve the whole file, as HTTP
+// allows.
+func parseByteRange(header string) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	if strings.TrimSpace(parts[0]) == "" {
+		suffix, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		return -suffix, -1, true
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+
+	if strings.TrimSpace(parts[1]) == "" {
+		return start, -1, true
+	}
+
+	end, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+
+	return start, end, true
+}
+
+// dvrFile is the growing MP4 of a session from a byte of its chunks on.
+type dvrFile struct {
+	session uint64
+	init    []byte
+
+	// Where in the session's chunks the file's media starts.
+	base int64
+}
+
+// position converts a position in the file to one in the session's chunks,
+// if it's after the initialization segment. It fails if we no longer have the
+// byte there.
+func (f dvrFile) position(window SegmentWindow, pos int64) (int64, bool) {
+	if pos < int64(len(f.init)) {
+		return -1, true
+	}
+
+	offset := f.base + pos - int64(len(f.init))
+
+	for _, segment := range window.Segments {
+		if segment.Session == f.session {
+			return offset, offset >= segment.Offset
+		}
+	}
+	return offset, false
+}
+
+// size is how big the file is so far.
+func (f dvrFile) size(window SegmentWindow) int64 {
+	end := f.base
+	for _, segment := range window.Segments {
+		if segment.Session != f.session {
+			continue
+		}
+		end = segment.Offset
+		for _, chunk := range segment.Chunks {
+			end += int64(len(chunk))
+		}
+	}
+	if end < f.base {
+		end = f.base
+	}
+	return int64(len(f.init)) + end - f.base
+}
+
+// read returns the bytes of the session's chunks starting at the offset, up
+// to the end of the chunk holding it. It returns nil if we don't have them
+// yet.
+func (f dvrFile) read(window SegmentWindow, offset int64) []byte {
+	for _, segment := range window.Segments {
+		if segment.Session != f.session {
+			continue
+		}
+		pos := segment.Offset
+		for _, chunk := range segment.Chunks {
+			if offset < pos+int64(len(chunk)) {
+				if offset < pos {
+					return nil
+				}
+				return chunk[offset-pos:]
+			}
+			pos += int64(len(chunk))
+		}
+	}
+	return nil
+}
+
+// write writes the file from start to end, or if end is -1, for as long as
+// the session goes on.
+func (f dvrFile) write(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, viewing *viewerSession, start, end int64) {
+	pos := start
+	for end < 0 || pos <= end {
+		var buf []byte
+		if pos < int64(len(f.init)) {
+			buf = f.init[pos:]
+		} else {
+			window := stream.segmenter.Window()
+
+			offset, ok := f.position(window, pos)
+			if !ok {
+				httpLog.Warnf("%s: Too slow: byte %d is gone", r.RemoteAddr, pos)
+				return
+			}
+
+			buf = f.read(window, offset)
+			if buf == nil {
+				// The session ended, or we wait for more of it.
+				if len(window.Segments) == 0 ||
+					window.Segments[len(window.Segments)-1].Session != f.session ||
+					!window.Remuxing {
+					return
+				}
+
+				select {
+				case <-window.Changed:
+				case <-r.Context().Done():
+					return
+				}
+				continue
+			}
+		}
+
+		if end >= 0 && int64(len(buf)) > end-pos+1 {
+			buf = buf[:end-pos+1]
+		}
+
+		n, err := rw.Write(buf)
+		pos += int64(n)
+		atomic.AddUint64(&stream.stats.BytesSent, uint64(n))
+		if err != nil {
+			return
+		}
+
+		if err := viewing.add(n, time.Now()); err != nil {
+			httpLog.Infof("%s: Viewer %s: %s", r.RemoteAddr, viewing.viewer.Name,
+				err)
+			return
+		}
+
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header string
+		start  int64
+		end    int64
+		ok     bool
+	}{
+		{"bytes=100-199", 100, 199, true},
+		{"bytes=0-0", 0, 0, true},
+		{"bytes=100-", 100, -1, true},
+		{"bytes=-500", -500, -1, true},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=200-100", 0, 0, false},
+		{"bytes=-5-10", 0, 0, false},
+		{"bytes=99999999999999999999-", 0, 0, false},
+		{"bytes=abc-", 0, 0, false},
+		{"bytes=0-99,200-299", 0, 0, false},
+		{"items=0-99", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		start, end, ok := parseByteRange(test.header)
+		if start != test.start || end != test.end || ok != test.ok {
+			t.Errorf("parseByteRange(%q) = %d, %d, %t, wanted %d, %d, %t",
+				test.header, start, end, ok, test.start, test.end, test.ok)
+		}
+	}
+}
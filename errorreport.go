@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorReporter sends reports of panics and failures somewhere someone will
+// see them. This is for deployments nobody watches the logs of.
+//
+// It either posts JSON to a webhook, or sends events to Sentry (or anything
+// accepting Sentry's protocol).
+type ErrorReporter struct {
+	// Where we post reports. For Sentry this is the project's store endpoint.
+	url string
+
+	// For Sentry, the X-Sentry-Auth header to send.
+	sentryAuth string
+
+	hostname string
+
+	client *http.Client
+
+	// Reports waiting to be sent.
+	reports chan errorReport
+
+	// The same failure often happens over and over, such as when a camera is
+	// down. We report it at most once per errorReportInterval. When we report it
+	// we include how many times it happened.
+	mutex    *sync.Mutex
+	failures map[string]*repeatedFailure
+}
+
+// errorReport is one report.
+type errorReport struct {
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Context   map[string]interface{} `json:"context,omitempty"`
+	Count     int                    `json:"count"`
+	Host      string                 `json:"host"`
+	Timestamp time.Time              `json:"timestamp"`
+	Stack     string                 `json:"stack,omitempty"`
+}
+
+// repeatedFailure tracks a failure we've seen.
+type repeatedFailure struct {
+	lastReported time.Time
+
+	// Times it happened since we last reported it.
+	count int
+}
+
+// reporter is what we report errors with. It is nil if reporting is off.
+var reporter *ErrorReporter
+
+const (
+	errorReportInterval  = 10 * time.Minute
+	errorReportQueueSize = 64
+)
+
+// newWebhookReporter reports by posting JSON to a URL.
+func newWebhookReporter(webhookURL string) *ErrorReporter {
+	return newErrorReporter(webhookURL, "")
+}
+
+// newSentryReporter reports to the Sentry project given by a DSN such as
+// https://<key>@sentry.example.com/<project>.
+func newSentryReporter(dsn string) (*ErrorReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Sentry DSN: %s", err)
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN: missing key")
+	}
+
+	path := strings.Trim(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return nil, fmt.Errorf("invalid Sentry DSN: missing project")
+	}
+
+	storeURL := url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   "/" + path[:slash+1] + "api/" + project + "/store/",
+	}
+
+	auth := fmt.Sprintf(
+		"Sentry sentry_version=7, sentry_client=videostreamer/1.0, sentry_key=%s",
+		u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+
+	return newErrorReporter(storeURL.String(), auth), nil
+}
+
+func newErrorReporter(reportURL, sentryAuth string) *ErrorReporter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	r := &ErrorReporter{
+		url:        reportURL,
+		sentryAuth: sentryAuth,
+		hostname:   hostname,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		reports:    make(chan errorReport, errorReportQueueSize),
+		mutex:      &sync.Mutex{},
+		failures:   map[string]*repeatedFailure{},
+	}
+
+	go r.sendReports()
+
+	return r
+}
+
+// reportFailure reports that something failed. key identifies the failure so
+// we can tell when it repeats, such as "open input <stream>".
+func reportFailure(key, message string, context map[string]interface{}) {
+	if reporter == nil {
+		return
+	}
+
+	reporter.mutex.Lock()
+	failure, ok := reporter.failures[key]
+	if !ok {
+		failure = &repeatedFailure{}
+		reporter.failures[key] = failure
+	}
+	failure.count++
+
+	if time.Since(failure.lastReported) < errorReportInterval {
+		reporter.mutex.Unlock()
+		return
+	}
+
+	count := failure.count
+	failure.count = 0
+	failure.lastReported = time.Now()
+	reporter.mutex.Unlock()
+
+	report := reporter.newReport("error", message, context, count)
+
+	select {
+	case reporter.reports <- report:
+	default:
+		serverLog.Warnf("Too many error reports queued, dropping: %s", message)
+	}
+}
+
+// reportPanic reports a panic and then panics again. Use it deferred at the
+// top of a goroutine. We send the report before returning since the process is
+// likely about to exit.
+func reportPanic(context map[string]interface{}) {
+	if reporter == nil {
+		return
+	}
+
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	report := reporter.newReport("fatal", fmt.Sprintf("panic: %v", v), context,
+		1)
+	report.Stack = string(debug.Stack())
+
+	if err := reporter.send(report); err != nil {
+		serverLog.Errorf("Unable to report panic: %s", err)
+	}
+
+	panic(v)
+}
+
+func (r *ErrorReporter) newReport(level, message string,
+	context map[string]interface{}, count int) errorReport {
+	return errorReport{
+		Level:     level,
+		Message:   message,
+		Context:   context,
+		Count:     count,
+		Host:      r.hostname,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+func (r *ErrorReporter) sendReports() {
+	for report := range r.reports {
+		if err := r.send(report); err != nil {
+			serverLog.Errorf("Unable to report error: %s", err)
+		}
+	}
+}
+
+func (r *ErrorReporter) send(report errorReport) error {
+	var body []byte
+	var err error
+	if r.sentryAuth != "" {
+		body, err = json.Marshal(sentryEvent(report))
+	} else {
+		body, err = json.Marshal(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.sentryAuth != "" {
+		req.Header.Set("X-Sentry-Auth", r.sentryAuth)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", r.url, resp.Status)
+	}
+
+	return nil
+}
+
+// sentryEvent converts the report to a Sentry event.
+func sentryEvent(report errorReport) map[string]interface{} {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	extra := map[string]interface{}{"count": report.Count}
+	for k, v := range report.Context {
+		extra[k] = v
+	}
+	if report.Stack != "" {
+		extra["stack"] = report.Stack
+	}
+
+	return map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   report.Timestamp.Format("2006-01-02T15:04:05"),
+		"level":       report.Level,
+		"logger":      "videostreamer",
+		"platform":    "go",
+		"server_name": report.Host,
+		"message":     report.Message,
+		"extra":       extra,
+	}
+}
+
+// reportingHandler reports panics while serving requests. net/http recovers
+// them itself, so we report and panic again to let it.
+type reportingHandler struct {
+	http.Handler
+}
+
+func (h reportingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	defer reportPanic(map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"remote": r.RemoteAddr,
+	})
+
+	h.Handler.ServeHTTP(rw, r)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HTTPError is an error we respond to a request with.
+type HTTPError struct {
+	Status int
+	// Code is a short machine readable identifier for the error.
+	Code string
+	// Message is a human readable description.
+	Message string
+}
+
+func (e HTTPError) Error() string {
+	return e.Message
+}
+
+var (
+	errBadRequest = HTTPError{
+		Status:  http.StatusBadRequest,
+		Code:    "bad_request",
+		Message: "Bad request",
+	}
+	errNotFound = HTTPError{
+		Status:  http.StatusNotFound,
+		Code:    "not_found",
+		Message: "Not found",
+	}
+	errInternal = HTTPError{
+		Status:  http.StatusInternalServerError,
+		Code:    "internal_error",
+		Message: "Internal server error",
+	}
+	errInputUnavailable = HTTPError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "input_unavailable",
+		Message: "Input unavailable",
+	}
+	errInputTimeout = HTTPError{
+		Status:  http.StatusGatewayTimeout,
+		Code:    "input_timeout",
+		Message: "Timed out opening input",
+	}
+	errNoAudio = HTTPError{
+		Status:  http.StatusNotFound,
+		Code:    "no_audio",
+		Message: "Stream has no audio we can serve",
+	}
+	errTooManyClients = HTTPError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "too_many_clients",
+		Message: "Too many clients",
+	}
+)
+
+// readErrorPages loads custom HTML error bodies from a directory. Files are
+// named after the status they are for, such as 404.html.
+func readErrorPages(dir string) (map[int][]byte, error) {
+	pages := map[int][]byte{}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading error page directory: %s", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".html" {
+			continue
+		}
+
+		status, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".html"))
+		if err != nil || http.StatusText(status) == "" {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading error page: %s", err)
+		}
+
+		pages[status] = buf
+	}
+
+	return pages, nil
+}
+
+// writeError responds with the given error. If the client prefers JSON, it
+// gets a JSON body. Otherwise it gets HTML, either from a custom error page or
+// a default.
+func (h HTTPHandler) writeError(rw http.ResponseWriter, r *http.Request,
+	e HTTPError) {
+	if acceptsJSON(r) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(e.Status)
+		if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+			"error": map[string]string{
+				"code":    e.Code,
+				"message": e.Message,
+			},
+		}); err != nil {
+			httpLog.Errorf("%s: Unable to write error: %s", r.RemoteAddr, err)
+		}
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(e.Status)
+
+	if page, ok := h.ErrorPages[e.Status]; ok {
+		_, _ = rw.Write(page)
+		return
+	}
+
+	_, _ = rw.Write([]byte(fmt.Sprintf("<h1>%d %s</h1>", e.Status, e.Message)))
+}
+
+// acceptsJSON decides whether the Accept header asks for JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		if mediaType == "application/json" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is something that happened on a stream that others may want to react
+// to, such as home automation rules. We publish events to each configured
+// sink: a webhook, an MQTT broker, and clients of /events.
+type Event struct {
+	// Such as motion_start.
+	Type string `json:"type"`
+
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+
+	// Details for motion events.
+	Motion *MotionEvent `json:"motion,omitempty"`
+
+	// Details for audio events.
+	Audio *AudioEvent `json:"audio,omitempty"`
+
+	// Details for stream_down and stream_up events.
+	Alert *AlertEvent `json:"alert,omitempty"`
+
+	// For labels events, what the frame analysis service found.
+	Labels []Label `json:"labels,omitempty"`
+
+	// For state events, the stream's state.
+	State *StateEvent `json:"state,omitempty"`
+
+	// Details for fallback_start and fallback_end events.
+	Load *LoadEvent `json:"load,omitempty"`
+
+	// Details for av_drift events.
+	Drift *DriftEvent `json:"drift,omitempty"`
+}
+
+// EventBus passes events to everyone subscribed.
+type EventBus struct {
+	mutex       *sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// events is where we publish events.
+var events = newEventBus()
+
+// How many events may wait for a subscriber. If a subscriber falls further
+// behind, it misses events.
+const eventQueueSize = 64
+
+func newEventBus() *EventBus {
+	return &EventBus{
+		mutex:       &sync.Mutex{},
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// publish passes the event to each subscriber without waiting for them.
+func (b *EventBus) publish(e Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			serverLog.Warnf("Event queue full, dropping %s event for %s", e.Type,
+				e.Stream)
+		}
+	}
+}
+
+// subscribe returns a channel receiving each event published from now on.
+func (b *EventBus) subscribe() chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := make(chan Event, eventQueueSize)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBus) unsubscribe(ch chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, ch)
+}
+
+// postEvents posts each event as JSON to a webhook.
+func postEvents(webhookURL string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for e := range events.subscribe() {
+		if e.State != nil {
+			continue
+		}
+
+		if err := postEvent(client, webhookURL, e); err != nil {
+			serverLog.Errorf("Unable to post %s event: %s", e.Type, err)
+		}
+	}
+}
+
+func postEvent(client *http.Client, webhookURL string, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(webhookURL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", redactURL(webhookURL), resp.Status)
+	}
+
+	return nil
+}
+
+// How often we send a comment to /events clients when there are no events, so
+// that proxies don't time out the connection.
+const eventsKeepAlive = 30 * time.Second
+
+// eventsRequest sends events as they happen as server-sent events. The event
+// name is the event's type and the data is the event as JSON. ?stream=<name>
+// limits them to one stream. We start with a state event for each stream so
+// that clients know where things stand.
+func (h HTTPHandler) eventsRequest(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		h.writeError(rw, r, errInternal)
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.WriteHeader(http.StatusOK)
+
+	now := time.Now()
+	for _, s := range h.Streams.All() {
+		name := s.Definition().Name
+		if stream != "" && name != stream {
+			continue
+		}
+
+		state := s.State()
+		if err := writeSSE(rw, Event{
+			Type:   "state",
+			Stream: name,
+			Time:   now,
+			State:  &state,
+		}); err != nil {
+			httpLog.Infof("%s: Events client went away: %s", r.RemoteAddr, err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case e := <-ch:
+			if stream != "" && e.Stream != stream {
+				continue
+			}
+			err = writeSSE(rw, e)
+		case <-ticker.C:
+			_, err = io.WriteString(rw, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-h.Streams.ctx.Done():
+			// We're shutting down.
+			return
+		}
+
+		if err != nil {
+			httpLog.Infof("%s: Events client went away: %s", r.RemoteAddr, err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeSSE writes the event as a server-sent event.
+func writeSSE(w io.Writer, e Event) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		// Nothing we can do about it, and the client can carry on.
+		httpLog.Errorf("Unable to encode %s event: %s", e.Type, err)
+		return nil
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, buf)
+	return err
+}
+
+// triggerRequest publishes a trigger event for a stream, such as for a
+// doorbell's webhook to start a recording. ?stream=<name> gives the stream, or
+// it is the default stream.
+func (h HTTPHandler) triggerRequest(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	stream := h.Streams.Get(r.URL.Query().Get("stream"))
+	if stream == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	e := Event{
+		Type:   "trigger",
+		Stream: stream.Definition().Name,
+		Time:   time.Now(),
+	}
+	events.publish(e)
+
+	httpLog.Infof("%s: Triggered %s", r.RemoteAddr, e.Stream)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(rw).Encode(e); err != nil {
+		httpLog.Errorf("%s: Unable to write response: %s", r.RemoteAddr, err)
+	}
+}
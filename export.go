@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// We can export a time range of a stream's recordings as one ZIP file, such
+// as for handing footage to an insurer or the police. The recordings go in
+// as they are, along with a manifest listing them with their SHA-256 digests
+// and the events during them.
+
+// The manifest's name in the ZIP file.
+const exportManifestFile = "export.json"
+
+// ExportManifest describes what we exported.
+type ExportManifest struct {
+	Stream string `json:"stream"`
+
+	// The range asked for, if it was.
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+
+	Exported time.Time `json:"exported"`
+
+	Recordings []ExportedRecording `json:"recordings"`
+	Events     []Event             `json:"events"`
+}
+
+// ExportedRecording is a recording in an export.
+type ExportedRecording struct {
+	Recording
+
+	// Of the file, hex encoded.
+	SHA256 string `json:"sha256"`
+}
+
+// exportRequest responds with a ZIP file of a stream's recordings in a time
+// range. It takes the same parameters as /api/recordings.
+//
+// We write the ZIP as we go rather than building it first, so if a file fails
+// partway through, all we can do is stop. The client receives an incomplete
+// ZIP file.
+func (h HTTPHandler) exportRequest(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	def, index, from, to, ok := h.recordingQuery(rw, r)
+	if !ok {
+		return
+	}
+
+	recordings := index.Find(def.Name, from, to)
+	if len(recordings) == 0 {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	manifest := ExportManifest{
+		Stream:     def.Name,
+		Exported:   time.Now().UTC(),
+		Recordings: []ExportedRecording{},
+		Events:     index.FindEvents(def.Name, from, to),
+	}
+	if !from.IsZero() {
+		manifest.From = &from
+	}
+	if !to.IsZero() {
+		manifest.To = &to
+	}
+
+	rw.Header().Set("Content-Type", "application/zip")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"%s-%s.zip\"", def.Name,
+		recordings[0].Start.UTC().Format("20060102T150405Z")))
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	zw := zip.NewWriter(rw)
+	sent := int64(0)
+
+	for _, recording := range recordings {
+		digest, n, err := exportRecording(zw, def.RecordDir, recording)
+		sent += n
+		if err != nil {
+			if os.IsNotExist(err) {
+				// It was deleted since we indexed it.
+				httpLog.Warnf("%s: Recording %s is gone, leaving it out of the export",
+					r.RemoteAddr, recording.Path)
+				continue
+			}
+			httpLog.Errorf("%s: Unable to export %s: %s", r.RemoteAddr,
+				recording.Path, err)
+			return
+		}
+
+		manifest.Recordings = append(manifest.Recordings, ExportedRecording{
+			Recording: recording,
+			SHA256:    digest,
+		})
+	}
+
+	w, err := zw.Create(exportManifestFile)
+	if err != nil {
+		httpLog.Errorf("%s: Unable to export manifest: %s", r.RemoteAddr, err)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		httpLog.Errorf("%s: Unable to export manifest: %s", r.RemoteAddr, err)
+		return
+	}
+
+	if err := zw.Close(); err != nil {
+		httpLog.Errorf("%s: Unable to finish export: %s", r.RemoteAddr, err)
+		return
+	}
+
+	httpLog.Infof("%s: Exported %d recordings of %s (%d bytes)", r.RemoteAddr,
+		len(manifest.Recordings), def.Name, sent)
+}
+
+// exportRecording adds the recording's file to the ZIP file. It returns the
+// file's SHA-256 digest and how many bytes it added.
+func exportRecording(zw *zip.Writer, dir string,
+	recording Recording) (string, int64, error) {
+	file, err := os.Open(filepath.Join(dir, filepath.FromSlash(recording.Path)))
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// MP4s don't compress much, so we store them as they are.
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     recording.Path,
+		Method:   zip.Store,
+		Modified: recording.Start,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), file)
+	if err != nil {
+		return "", n, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
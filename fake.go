@@ -0,0 +1,410 @@
+//go:build nolibav
+// +build nolibav
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fakeMedia generates packets rather than reading them. It lets us run the
+// encoder and clients without libav, such as to test their logic. Build with
+// the nolibav tag to use it.
+//
+// Outputs are not MP4s. They write "header\n", then each packet's data, then
+// "trailer\n". Each packet's data starts with "packet <n>\n", counting from
+// 1 for each input.
+type fakeMedia struct {
+	// How long reading each packet takes.
+	interval time.Duration
+
+	// Bytes in each packet.
+	packetSize int
+
+	// If set, opening inputs fails.
+	failOpen bool
+
+	// How long opening inputs takes.
+	openDelay time.Duration
+
+	// If set, reading fails after this many packets.
+	failAfter int
+
+	// If set, inputs end after this many packets, as files do, until Next
+	// starts another.
+	fileLength int
+}
+
+// fakeInput is an input opened by fakeMedia.
+type fakeInput struct {
+	media *fakeMedia
+
+	// Packets read so far, and since Next.
+	packets     int
+	filePackets int
+
+	// Whether we closed the input. Access atomically.
+	closed int32
+
+	// Closed when the input is interrupted.
+	interrupted     chan struct{}
+	interruptedOnce *sync.Once
+}
+
+// fakeOutput is an output opened by fakeInput.
+type fakeOutput struct {
+	input *fakeInput
+	w     io.Writer
+}
+
+// fakeDecoder is a decoder opened by fakeInput. Each packet is a frame. The
+// picture is plain except for a square that moves across it for 10 seconds of
+// every 20, at 25 frames a second.
+type fakeDecoder struct {
+	// Frames decoded so far.
+	frames int
+
+	// Whether we decoded a frame not yet received.
+	pending bool
+
+	// Regions to black out.
+	masks []Region
+
+	// How to turn and mirror the picture.
+	orientation Orientation
+
+	// The fisheye lens to take a flat view through, if any.
+	dewarp *Dewarp
+}
+
+// Counts of what fakeMedia has allocated and not freed. Access atomically.
+var (
+	fakeInputs   int64
+	fakeOutputs  int64
+	fakeDecoders int64
+	fakePackets  int64
+)
+
+// setThreads does nothing since we don't decode or encode.
+func setThreads(threads Threads) {
+}
+
+// libraryVersions returns nothing since we don't use libav.
+func libraryVersions() []LibraryVersion {
+	return nil
+}
+
+// newMedia returns a fakeMedia generating roughly 25 packets a second. It has
+// no devices.
+func newMedia(devices bool) Media {
+	return &fakeMedia{
+		interval:   40 * time.Millisecond,
+		packetSize: 1024,
+	}
+}
+
+func (m *fakeMedia) OpenInput(format, url string, options map[string]string,
+	timeout time.Duration, verbose bool) (MediaInput, error) {
+	if timeout > 0 && m.openDelay > timeout {
+		time.Sleep(timeout)
+		return nil, errInputTimeout
+	}
+	time.Sleep(m.openDelay)
+
+	if m.failOpen {
+		return nil, fmt.Errorf("unable to open input")
+	}
+
+	atomic.AddInt64(&fakeInputs, 1)
+	return &fakeInput{
+		media:           m,
+		interrupted:     make(chan struct{}),
+		interruptedOnce: &sync.Once{},
+	}, nil
+}
+
+// Faststart copies the file since there is nothing to move.
+func (m *fakeMedia) Faststart(in, out string, verbose bool) error {
+	buf, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, buf, 0644)
+}
+
+// Timelapse writes the images one after another rather than encoding them.
+func (m *fakeMedia) Timelapse(pattern, out string, fps int,
+	verbose bool) error {
+	var video []byte
+	for n := 1; ; n++ {
+		buf, err := ioutil.ReadFile(fmt.Sprintf(pattern, n))
+		if err != nil {
+			break
+		}
+		video = append(video, buf...)
+	}
+
+	if len(video) == 0 {
+		return fmt.Errorf("no images to encode")
+	}
+	return ioutil.WriteFile(out, video, 0644)
+}
+
+func (i *fakeInput) ReadPacket(timeout time.Duration,
+	verbose bool) (*Packet, error) {
+	if atomic.LoadInt32(&i.closed) == 1 {
+		return nil, fmt.Errorf("input is closed")
+	}
+
+	if i.media.failAfter > 0 && i.packets >= i.media.failAfter {
+		return nil, fmt.Errorf("failure reading packet")
+	}
+
+	if i.media.fileLength > 0 && i.filePackets >= i.media.fileLength {
+		return nil, errEndOfInput
+	}
+
+	wait := i.media.interval
+	if timeout > 0 && wait > timeout {
+		wait = timeout
+	}
+
+	select {
+	case <-i.interrupted:
+		return nil, fmt.Errorf("reading packet interrupted")
+	case <-time.After(wait):
+	}
+
+	if wait < i.media.interval {
+		return nil, fmt.Errorf("timed out reading packet")
+	}
+
+	i.packets++
+	i.filePackets++
+
+	data := make([]byte, i.media.packetSize)
+	copy(data, fmt.Sprintf("packet %d\n", i.packets))
+
+	atomic.AddInt64(&fakePackets, 1)
+
+	p := newPacket(data, func() { atomic.AddInt64(&fakePackets, -1) },
+		int64(len(data)), time.Now().UnixNano()/int64(time.Microsecond))
+	// A keyframe every 2 seconds, with the first.
+	p.keyframe = i.filePackets%50 == 1
+	return p, nil
+}
+
+// packetBytes returns the packet's data. Our packets' data is bytes already.
+func packetBytes(p *Packet) []byte {
+	return p.data.([]byte)
+}
+
+// Next starts counting packets again. Packet numbers carry on.
+func (i *fakeInput) Next(format, url string, timeout time.Duration,
+	verbose bool) error {
+	if atomic.LoadInt32(&i.closed) == 1 {
+		return fmt.Errorf("input is closed")
+	}
+
+	i.filePackets = 0
+	return nil
+}
+
+// SetAudioOffset does nothing since we have no audio.
+func (i *fakeInput) SetAudioOffset(offset time.Duration) {
+}
+
+// CodecParameters describes H.264 High profile, level 3.1 video at 1280x720.
+func (i *fakeInput) CodecParameters(audio bool) (CodecParameters, bool) {
+	if audio {
+		return CodecParameters{}, false
+	}
+
+	return CodecParameters{
+		Codec:     "h264",
+		Profile:   100,
+		Level:     31,
+		Extradata: []byte{1, 100, 0, 31},
+		Width:     1280,
+		Height:    720,
+	}, true
+}
+
+// AudioFormat fails as we only generate video.
+func (i *fakeInput) AudioFormat() (OutputFormat, error) {
+	return OutputFormat{}, fmt.Errorf("input has no audio we can serve alone")
+}
+
+func (i *fakeInput) OpenOutput(w io.Writer, format OutputFormat,
+	verbose bool) (MediaOutput, error) {
+	if atomic.LoadInt32(&i.closed) == 1 {
+		return nil, fmt.Errorf("unable to open output")
+	}
+
+	if _, err := w.Write([]byte("header\n")); err != nil {
+		return nil, fmt.Errorf("unable to open output: %s", err)
+	}
+
+	atomic.AddInt64(&fakeOutputs, 1)
+	return &fakeOutput{input: i, w: w}, nil
+}
+
+// OpenURLOutput discards what it writes.
+func (i *fakeInput) OpenURLOutput(url string, format OutputFormat,
+	verbose bool) (MediaOutput, error) {
+	return i.OpenOutput(ioutil.Discard, format, verbose)
+}
+
+func (i *fakeInput) OpenDecoder(audio, verbose bool) (MediaDecoder, error) {
+	if audio {
+		return nil, fmt.Errorf("input has no such stream")
+	}
+
+	atomic.AddInt64(&fakeDecoders, 1)
+	return &fakeDecoder{}, nil
+}
+
+func (i *fakeInput) Interrupt() {
+	i.interruptedOnce.Do(func() { close(i.interrupted) })
+}
+
+func (i *fakeInput) Close() {
+	if atomic.CompareAndSwapInt32(&i.closed, 0, 1) {
+		atomic.AddInt64(&fakeInputs, -1)
+	}
+}
+
+// WritePackets fails once the input is closed, as writing with libav does.
+func (o *fakeOutput) WritePackets(packets []*Packet, verbose bool) error {
+	if atomic.LoadInt32(&o.input.closed) == 1 {
+		return fmt.Errorf("failure writing packet")
+	}
+
+	for _, p := range packets {
+		if _, err := o.w.Write(p.data.([]byte)); err != nil {
+			return fmt.Errorf("failure writing packet: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Interrupt does nothing since writing to the writer is what would block.
+func (o *fakeOutput) Interrupt() {
+}
+
+func (o *fakeOutput) Close() {
+	_, _ = o.w.Write([]byte("trailer\n"))
+	atomic.AddInt64(&fakeOutputs, -1)
+}
+
+func (d *fakeDecoder) Decode(p *Packet, verbose bool) error {
+	d.frames++
+	d.pending = true
+	return nil
+}
+
+func (d *fakeDecoder) ReceiveFrame(verbose bool) (bool, error) {
+	received := d.pending
+	d.pending = false
+	return received, nil
+}
+
+func (d *fakeDecoder) Luma(width, height int) ([]byte, error) {
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid size")
+	}
+
+	// We draw the picture as the camera would send it, then turn it.
+	drawWidth, drawHeight := width, height
+	if d.orientation.transposes() {
+		drawWidth, drawHeight = height, width
+	}
+
+	buf := make([]byte, width*height)
+	for i := range buf {
+		buf[i] = 100
+	}
+
+	if d.frames/250%2 == 1 {
+		size := drawWidth / 8
+		left := d.frames % (drawWidth - size)
+		for y := 0; y < size && y < drawHeight; y++ {
+			for x := left; x < left+size; x++ {
+				buf[y*drawWidth+x] = 255
+			}
+		}
+	}
+
+	if d.dewarp != nil {
+		buf = d.dewarp.apply(buf, drawWidth, drawHeight)
+	}
+	buf = d.orientation.apply(buf, drawWidth, drawHeight)
+	maskLuma(buf, width, height, d.masks)
+	return buf, nil
+}
+
+// JPEG encodes the picture Luma generates, as if the frame was 1280x720.
+func (d *fakeDecoder) JPEG(maxWidth int, verbose bool) ([]byte, error) {
+	width, height := 1280, 720
+	if d.orientation.transposes() {
+		width, height = height, width
+	}
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+
+	picture, err := d.Luma(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	copy(img.Pix, picture)
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		return nil, fmt.Errorf("unable to encode frame: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *fakeDecoder) SetMasks(masks []Region) {
+	d.masks = masks
+}
+
+func (d *fakeDecoder) SetOrientation(o Orientation) {
+	d.orientation = o
+}
+
+func (d *fakeDecoder) SetDewarp(dewarp *Dewarp) {
+	d.dewarp = dewarp
+}
+
+// Level fails as we only decode video.
+func (d *fakeDecoder) Level() (float64, error) {
+	return 0, fmt.Errorf("no audio frame to measure")
+}
+
+func (d *fakeDecoder) Close() {
+	atomic.AddInt64(&fakeDecoders, -1)
+}
+
+// mediaAllocations counts what fakeMedia has allocated.
+func mediaAllocations() Allocations {
+	return Allocations{
+		Inputs:   atomic.LoadInt64(&fakeInputs),
+		Outputs:  atomic.LoadInt64(&fakeOutputs),
+		Decoders: atomic.LoadInt64(&fakeDecoders),
+		Packets:  atomic.LoadInt64(&fakePackets),
+	}
+}
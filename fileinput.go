@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Inputs need not be live. A stream can play a file, or a folder of files, as
+// if it were, such as pre-recorded content for demos and signage. A file can
+// loop, starting again when it ends with timestamps carrying on.
+//
+// A folder input plays the files in a directory one after another as one
+// stream, in name order, starting again from the first after the last. We look
+// at the directory each time a file ends, so files added to it play when their
+// turn comes. The files must all have the same video codec, and for players
+// to cope they should have the same encoding settings too.
+//
+// We read inputs that aren't live no faster than real time, going by their
+// packets' times, as ffmpeg's -re option does. Otherwise we would read a file
+// as fast as we could, and clients would receive it all at once. We pace
+// with a token bucket: we may read up to realtime_burst ahead of real time,
+// such as to fill the DVR window and give clients something to start with,
+// and after that at the input's own rate.
+//
+// Inputs we know are files on disk we always read this way. Others, such as
+// files served over HTTP, look no different to live inputs, so they need
+// realtime set.
+
+// folderInputFormat is the input format for folder inputs. The input URL is
+// the directory.
+const folderInputFormat = "folder"
+
+// If we fall this far behind or ahead of when packets are due, such as if the
+// timestamps jump, we count from the packet rather than waiting to catch up.
+const maxPaceDrift = 5 * time.Second
+
+// How far ahead of real time we may read at most.
+const maxRealtimeBurst = time.Minute
+
+// realtime is whether we read the stream's input no faster than real time.
+func (d StreamDefinition) realtime() bool {
+	return d.Realtime || d.Loop || d.InputFormat == folderInputFormat ||
+		d.InputFormat == playlistInputFormat || localFile(d.InputURL)
+}
+
+// realtimeBurst is how far ahead of real time we may read the stream's input.
+func (d StreamDefinition) realtimeBurst() time.Duration {
+	return time.Duration(d.RealtimeBurst * float64(time.Second))
+}
+
+// localFile decides whether the input URL is a regular file on disk. Devices
+// and pipes aren't.
+func localFile(url string) bool {
+	path := strings.TrimPrefix(url, "file:")
+	if path == "" || strings.Contains(path, "://") {
+		return false
+	}
+
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// nextFile decides what file in the directory to play after the one given. It
+// is the next by name, or the first if there is none after it or if after is
+// empty. Hidden files and files still being written (.part and .tmp files) are
+// skipped.
+func nextFile(dir, after string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return "", fmt.Errorf("no files in %s", dir)
+	}
+
+	sort.Strings(names)
+
+	after = filepath.Base(after)
+	for _, name := range names {
+		if name > after {
+			return filepath.Join(dir, name), nil
+		}
+	}
+
+	return filepath.Join(dir, names[0]), nil
+}
+
+// nextFile moves a folder input on to the next file in its directory.
+func (i *Input) nextFile(timeout time.Duration, verbose bool) error {
+	file, err := nextFile(i.dir, i.file)
+	if err != nil {
+		return err
+	}
+
+	if err := i.Next("", file, timeout, verbose); err != nil {
+		return fmt.Errorf("unable to open %s: %s", file, err)
+	}
+
+	i.file = file
+	return nil
+}
+
+// restart starts a looping input again from the beginning.
+func (i *Input) restart(timeout time.Duration, verbose bool) error {
+	if err := i.Next(i.format, i.expandedURL, timeout, verbose); err != nil {
+		return fmt.Errorf("unable to loop input: %s", err)
+	}
+	return nil
+}
+
+// pacer holds us to reading an input no faster than real time.
+type pacer struct {
+	// How far ahead of real time we may read, the depth of the bucket.
+	burst time.Duration
+
+	// The time and packet time we count from.
+	start      time.Time
+	packetTime int64
+}
+
+// wait waits until a packet from the given time is due. It returns false if
+// ctx is done first.
+func (p *pacer) wait(ctx context.Context, packetTime int64) bool {
+	if packetTime == noTime {
+		return true
+	}
+
+	now := time.Now()
+
+	// When the packet is due in real time. We may be up to burst ahead of
+	// that.
+	due := p.start.Add(time.Duration(packetTime-p.packetTime) *
+		time.Microsecond)
+	if p.start.IsZero() || due.Before(now.Add(-maxPaceDrift)) ||
+		due.After(now.Add(p.burst+maxPaceDrift)) {
+		p.start = now
+		p.packetTime = packetTime
+		return true
+	}
+
+	due = due.Add(-p.burst)
+	if due.Before(now) {
+		return true
+	}
+
+	timer := time.NewTimer(due.Sub(now))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A client joining a stream that is already open starts wherever the input
+// is, usually between keyframes. Players show nothing until the next
+// keyframe, and some show garbage meanwhile. So that clients can choose what
+// suits them, we keep the packets since the latest keyframe, the GOP (group of
+// pictures), and clients can ask how to start:
+//
+//   ?start=immediate  Start with the next packet. This is the default.
+//   ?start=keyframe   Start at a keyframe, waiting for the next if need be.
+//   ?burst=<seconds>  Start with up to this much of what we kept, at once.
+//
+// With both, such as ?start=keyframe&burst=2, a client starts at once with
+// the latest keyframe if it was at most 2 seconds ago, and otherwise waits
+// for the next. With a burst alone, it starts with up to 2 seconds of what we
+// kept, whether or not that begins at a keyframe.
+
+const (
+	// How long and how big a GOP we keep at most. If a GOP grows past either,
+	// we keep nothing until the next keyframe.
+	maxGOPCacheDuration = 10 * time.Second
+	maxGOPCacheBytes    = 8 * 1024 * 1024
+
+	// How many packets a burst may be beyond the usual queue. Clients asking
+	// for a burst get a queue big enough for it.
+	maxBurstPackets = 1024
+)
+
+// Bytes of packets we keep in GOP caches. We don't count them against the
+// total queued bytes limit. Access atomically.
+var gopCacheBytes int64
+
+// gopCache keeps the packets read from an input since its latest keyframe.
+// Only the encoder may use it.
+type gopCache struct {
+	packets []*Packet
+	bytes   int64
+
+	// Whether we're keeping packets. Not until the first keyframe, and not if
+	// the GOP grew too long or big.
+	keeping bool
+}
+
+// add keeps the packet, starting afresh if it is a keyframe.
+func (g *gopCache) add(p *Packet) {
+	if !p.audio && p.keyframe {
+		g.reset()
+		g.keeping = true
+	}
+	if !g.keeping {
+		return
+	}
+
+	if g.bytes+p.size > maxGOPCacheBytes || (p.time != noTime &&
+		len(g.packets) > 0 && g.packets[0].time != noTime &&
+		p.time-g.packets[0].time > int64(maxGOPCacheDuration/time.Microsecond)) {
+		g.reset()
+		return
+	}
+
+	p.retain()
+	g.packets = append(g.packets, p)
+	g.bytes += p.size
+	atomic.AddInt64(&gopCacheBytes, p.size)
+}
+
+// reset lets go of what we kept, such as when the input closes or its codec
+// parameters change. We keep nothing until the next keyframe.
+func (g *gopCache) reset() {
+	for i, p := range g.packets {
+		p.release()
+		g.packets[i] = nil
+	}
+	atomic.AddInt64(&gopCacheBytes, -g.bytes)
+	g.packets = g.packets[:0]
+	g.bytes = 0
+	g.keeping = false
+}
+
+// parseStart reads how the client asks to start. It returns whether to start
+// at a keyframe, and how long a burst to start with.
+func parseStart(r *http.Request) (bool, time.Duration, error) {
+	keyframe := false
+	switch r.URL.Query().Get("start") {
+	case "", "immediate":
+	case "keyframe":
+		keyframe = true
+	default:
+		return false, 0, errBadRequest
+	}
+
+	burst := time.Duration(0)
+	if s := r.URL.Query().Get("burst"); s != "" {
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil || seconds < 0 ||
+			seconds > maxGOPCacheDuration.Seconds() {
+			return false, 0, errBadRequest
+		}
+		burst = time.Duration(seconds * float64(time.Second))
+	}
+
+	return keyframe, burst, nil
+}
+
+// start sends the client the burst it asked for from what we kept, as the
+// encoder first sends it a packet. now is the time of that packet. If the
+// client waits for a keyframe and the burst starts at one, it waits no
+// longer.
+func (c *Client) start(g *gopCache, now int64, limits QueueLimits) {
+	if c.burst <= 0 || len(g.packets) == 0 || now == noTime {
+		return
+	}
+
+	from := now - int64(c.burst/time.Microsecond)
+
+	// What the client wants of the packets, starting within the burst.
+	burst := []*Packet{}
+	bytes := int64(0)
+	for _, p := range g.packets {
+		if len(burst) == 0 && (p.time == noTime || p.time < from) {
+			continue
+		}
+		if !c.wants(p) {
+			continue
+		}
+		burst = append(burst, p)
+		bytes += p.size
+	}
+
+	// Without a keyframe, a client waiting for one gets nothing.
+	if c.waitKeyframe && (len(burst) == 0 || burst[0] != g.packets[0]) {
+		return
+	}
+
+	// Trim the burst to fit the client's queue, or give up on it if the client
+	// must start at a keyframe.
+	space := cap(c.PacketChan) - len(c.PacketChan) - 1
+	for len(burst) > 0 && (len(burst) > space || (limits.ClientBytes > 0 &&
+		atomic.LoadInt64(&c.queuedBytes)+bytes > limits.ClientBytes)) {
+		if c.waitKeyframe {
+			return
+		}
+		bytes -= burst[0].size
+		burst = burst[1:]
+	}
+	if len(burst) == 0 {
+		return
+	}
+
+	for _, p := range burst {
+		p.retain()
+		c.PacketChan <- p
+	}
+	atomic.AddInt64(&c.queuedBytes, bytes)
+	c.waitKeyframe = false
+
+	encoderLog.Debugf("%s: Starting with a burst of %d packets", c, len(burst))
+}
+
+// wants decides whether the client gets the packet. Each client gets either
+// the video or the audio, or both if it asked.
+func (c *Client) wants(p *Packet) bool {
+	return p.audio == c.audio || (p.audio && c.withAudio)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// /healthz tells supervisors, such as a Kubernetes liveness probe, whether we
+// are working. Answering HTTP isn't enough: an encoder loop stuck in libav
+// leaves its clients without video while everything else carries on. So we
+// note when each stream's encoder last read a packet and last handed one out
+// to clients, and if either is too long ago while the input is open, we
+// answer 503 so the supervisor restarts us.
+//
+// A stream whose input is closed, because no one is watching, is healthy.
+
+// How long an encoder may go without reading or handing out a packet before
+// we call it stuck, by default. A stream's read timeout extends it, since a
+// read may take that long before we give up on it.
+const defaultStallTimeout = time.Minute
+
+// StreamHealth is how a stream's encoder is doing.
+type StreamHealth struct {
+	Name string `json:"name"`
+
+	// Whether the input is open. Only then do we expect packets.
+	Input bool `json:"input"`
+
+	// When the encoder last read a packet, and last handed one out to clients.
+	LastRead   *time.Time `json:"last_read,omitempty"`
+	LastFanOut *time.Time `json:"last_fan_out,omitempty"`
+
+	// Why we think the encoder is stuck, if we do.
+	Stalled string `json:"stalled,omitempty"`
+}
+
+// noteRead records that the encoder read a packet.
+func (s *StreamStats) noteRead(now time.Time) {
+	atomic.StoreInt64(&s.LastRead, now.UnixNano())
+}
+
+// noteFanOut records that the encoder handed a packet out to clients.
+func (s *StreamStats) noteFanOut(now time.Time) {
+	atomic.StoreInt64(&s.LastFanOut, now.UnixNano())
+}
+
+// health decides how the stream's encoder is doing.
+func (s *Stream) health(stallTimeout time.Duration, now time.Time) StreamHealth {
+	def := s.Definition()
+	health := StreamHealth{Name: def.Name, Input: s.State().Input}
+
+	lastRead := atomic.LoadInt64(&s.stats.LastRead)
+	if lastRead != 0 {
+		t := time.Unix(0, lastRead)
+		health.LastRead = &t
+	}
+	lastFanOut := atomic.LoadInt64(&s.stats.LastFanOut)
+	if lastFanOut != 0 {
+		t := time.Unix(0, lastFanOut)
+		health.LastFanOut = &t
+	}
+
+	if !health.Input || stallTimeout <= 0 {
+		return health
+	}
+
+	limit := stallTimeout
+	if def.readTimeout() > limit {
+		limit = def.readTimeout()
+	}
+
+	if health.LastRead == nil || now.Sub(*health.LastRead) > limit {
+		health.Stalled = "no packets read from the input"
+	} else if health.LastFanOut == nil || now.Sub(*health.LastFanOut) > limit {
+		health.Stalled = "no packets handed out to clients"
+	}
+	return health
+}
+
+// healthRequest reports whether every stream's encoder is working: 200 if so,
+// 503 if any is stuck.
+func (h HTTPHandler) healthRequest(rw http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	status := http.StatusOK
+	streams := []StreamHealth{}
+	for _, stream := range h.Streams.All() {
+		health := stream.health(h.StallTimeout, now)
+		if health.Stalled != "" {
+			httpLog.Warnf("Health check: %s: %s", health.Name, health.Stalled)
+			status = http.StatusServiceUnavailable
+		}
+		streams = append(streams, health)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+		"ok":      status == http.StatusOK,
+		"streams": streams,
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write health: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With hls on, we serve the stream's segments as HLS, for players that can't
+// play our MP4 responses, such as Safari on iOS and many TVs. The segments
+// are the segmenter's CMAF segments, so this costs no more remuxing:
+//
+//   /hls/<name>/stream.m3u8                  The live playlist.
+//   /hls/<name>/segment/init-<session>.mp4   A session's initialization
+//                                            segment.
+//   /hls/<name>/segment/<sequence>.m4s       A segment.
+//
+// The playlist's URLs are relative to it. It carries ?token= over to them,
+// since players such as Safari's can't send headers.
+//
+// A player fetches the playlist every few seconds, and each segment it lists,
+// so one viewer makes many requests. We tie them into one viewer session: the
+// first starts it, and the URLs in the playlist carry its ID as ?session_id=,
+// the session ID clients of /stream resume with (see resume.go). The session
+// counts against the viewer's quotas once, counts as a viewer while we drain,
+// and gets one audit entry. It ends once its player stops fetching for
+// hlsSessionTimeout.
+//
+// The playlist lists the complete segments in the window. We don't list the
+// one still being produced, so players are a segment or so behind the live
+// edge. When the session changes, such as after the input reconnects, the
+// next segment is marked with EXT-X-DISCONTINUITY and a new EXT-X-MAP, and
+// the playlist carries on.
+
+// The MIME types of the playlist and segments.
+const (
+	hlsPlaylistType = "application/vnd.apple.mpegurl"
+	hlsSegmentType  = "video/iso.segment"
+)
+
+// The playlist's name, and the directory the segments are in.
+const (
+	hlsPlaylistFile  = "stream.m3u8"
+	hlsSegmentPrefix = "segment/"
+)
+
+// How long an HLS session lasts after its player's last request. Players
+// fetch the playlist about every segment.
+const hlsSessionTimeout = 30 * time.Second
+
+// hlsSession is one player watching a stream's HLS.
+type hlsSession struct {
+	// The viewer's session, if viewers need a token.
+	viewing *viewerSession
+
+	// The session's audit entry, once a request of it finished, and where to
+	// write it.
+	auditLog *AuditLog
+	entry    *AuditEntry
+
+	// When the player last fetched anything.
+	last time.Time
+
+	// Whether the session is over, though we haven't ended it yet.
+	done bool
+}
+
+// hlsSessionStore holds the HLS sessions under way.
+type hlsSessionStore struct {
+	mutex    sync.Mutex
+	sessions map[sessionKey]*hlsSession
+	expiring sync.Once
+}
+
+var hlsSessions = &hlsSessionStore{sessions: map[sessionKey]*hlsSession{}}
+
+// hlsPath splits an HLS path into the stream's name and the file, such as
+// stream.m3u8 or segment/1.m4s. Names may contain /, so we go by the end.
+func hlsPath(path string) (string, string) {
+	rest := "/" + strings.TrimPrefix(path, "/hls/")
+	if i := strings.LastIndex(rest, "/"+hlsSegmentPrefix); i >= 0 {
+		return strings.TrimPrefix(rest[:i], "/"), rest[i+1:]
+	}
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		return strings.TrimPrefix(rest[:i], "/"), rest[i+1:]
+	}
+	return "", rest
+}
+
+// hlsPlaylist writes the live playlist of the window's complete segments.
+// query is added to each URL in it, such as to name the stream.
+func hlsPlaylist(window SegmentWindow, query string) string {
+	segments := []Segment{}
+	for _, segment := range window.Segments {
+		if segment.Complete {
+			segments = append(segments, segment)
+		}
+	}
+
+	// Each segment's duration, rounded to the nearest second, must be at most
+	// the target duration, and players don't expect it to go down, so we go by
+	// the longest segment we have had.
+	target := int((segmentTargetDuration + time.Second - 1) / time.Second)
+	if seconds := int((window.Longest + time.Second/2) /
+		time.Second); seconds > target {
+		target = seconds
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", target)
+
+	sequence := uint64(1)
+	if len(segments) > 0 {
+		sequence = segments[0].Sequence
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+
+	// Only the last segment may be incomplete, so the discontinuities dropped
+	// from the window are those before the first segment we list. We mark the
+	// first if it is one, so that the count goes up only as marks leave.
+	if window.DiscontinuitySequence > 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n",
+			window.DiscontinuitySequence)
+	}
+
+	for i, segment := range segments {
+		if segment.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i == 0 || segment.Session != segments[i-1].Session {
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%sinit-%d.mp4%s\"\n",
+				hlsSegmentPrefix, segment.Session, query)
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", segment.Duration.Seconds())
+		fmt.Fprintf(b, "%s%d.m4s%s\n", hlsSegmentPrefix, segment.Sequence, query)
+	}
+
+	return b.String()
+}
+
+// hlsQuery is the query to add to URLs in the playlist: the session, and the
+// viewer's token, if the request has one.
+func hlsQuery(r *http.Request, session string) string {
+	query := url.Values{}
+	if session != "" {
+		query.Set("session_id", session)
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		query.Set("token", token)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// hlsRequest serves the stream's HLS playlist, or one of the files it lists.
+// file is the path under /hls/<name>/.
+func (h HTTPHandler) hlsRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, file string) {
+	def := stream.Definition()
+	if !def.HLS {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	if !h.allowedOrigin(rw, r, def) || h.refusePaused(rw, r, stream) ||
+		h.shedding(rw, r, def, false) {
+		return
+	}
+
+	id, session, ok := h.hlsSession(rw, r, def.Name)
+	if !ok {
+		return
+	}
+
+	var body []byte
+	contentType := hlsSegmentType
+	switch {
+	case file == hlsPlaylistFile:
+		window, ok := h.waitForSegment(rw, r, stream)
+		if !ok {
+			return
+		}
+		body = []byte(hlsPlaylist(window, hlsQuery(r, id)))
+		contentType = hlsPlaylistType
+	case strings.HasPrefix(file, hlsSegmentPrefix+"init-") &&
+		strings.HasSuffix(file, ".mp4"):
+		segmenterSession, err := strconv.ParseUint(strings.TrimSuffix(
+			strings.TrimPrefix(file, hlsSegmentPrefix+"init-"), ".mp4"), 10, 64)
+		if err != nil {
+			h.writeError(rw, r, errNotFound)
+			return
+		}
+		body = stream.segmenter.SessionInit(segmenterSession)
+		contentType = "video/mp4"
+	case strings.HasPrefix(file, hlsSegmentPrefix) &&
+		strings.HasSuffix(file, ".m4s"):
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(
+			strings.TrimPrefix(file, hlsSegmentPrefix), ".m4s"), 10, 64)
+		if err != nil {
+			h.writeError(rw, r, errNotFound)
+			return
+		}
+		if segment, ok := findSegment(stream.segmenter.Window().Segments,
+			sequence); ok && segment.Complete {
+			for _, chunk := range segment.Chunks {
+				body = append(body, chunk...)
+			}
+		}
+	}
+
+	// Files leave the window, and players ask only for those the playlist
+	// lists, so one we don't have is gone. Anything else isn't one of ours.
+	if body == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.Header().Set("X-Session-ID", id)
+	n, err := rw.Write(body)
+	atomic.AddUint64(&stream.stats.BytesSent, uint64(n))
+	if err != nil {
+		httpLog.Warnf("%s: Unable to write HLS response: %s", r.RemoteAddr, err)
+	}
+
+	// Once the viewer reaches a quota, the session ends, and they can't start
+	// another.
+	if err := session.viewing.add(n, time.Now()); err != nil {
+		httpLog.Warnf("%s: Ending HLS session %s: %s", r.RemoteAddr, id, err)
+		hlsSessions.finish(session)
+	}
+}
+
+// hlsSession finds the HLS session the request is part of, or starts one. It
+// returns the session's ID. If we can't start a session, such as because the
+// viewer's quotas don't allow it, it responds with an error and returns false.
+func (h HTTPHandler) hlsSession(rw http.ResponseWriter, r *http.Request,
+	stream string) (string, *hlsSession, bool) {
+	now := time.Now()
+
+	id := requestSessionID(r)
+	session := hlsSessions.get(id, stream, now)
+
+	// A session is only the viewer's who started it.
+	if session != nil && session.viewing != nil {
+		if viewer, ok := h.Viewers.authenticate(r); !ok ||
+			viewer.Name != session.viewing.viewer.Name {
+			session = nil
+			id = ""
+		}
+	}
+
+	if session == nil {
+		if h.refuseDraining(rw, r) {
+			return "", nil, false
+		}
+
+		if id == "" {
+			if id = newSessionID(); id == "" {
+				h.writeError(rw, r, errInternal)
+				return "", nil, false
+			}
+		}
+
+		viewing, ok := h.startViewing(rw, r)
+		if !ok {
+			return "", nil, false
+		}
+
+		session = &hlsSession{viewing: viewing, last: now}
+		hlsSessions.add(id, stream, session)
+	}
+
+	// The session's requests make up one audit entry.
+	if recorder, ok := rw.(*auditRecorder); ok {
+		recorder.onFinish = func(entry AuditEntry) {
+			hlsSessions.record(session, recorder.log, entry)
+		}
+	}
+
+	return id, session, true
+}
+
+// get finds the session, noting the player fetched something.
+func (s *hlsSessionStore) get(id, stream string, now time.Time) *hlsSession {
+	if id == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[sessionKey{id: id, stream: stream}]
+	if !ok || session.done {
+		return nil
+	}
+	session.last = now
+	return session
+}
+
+// add stores a new session. It ends one it replaces, which is over.
+func (s *hlsSessionStore) add(id, stream string, session *hlsSession) {
+	s.expiring.Do(func() {
+		go s.expire()
+	})
+
+	key := sessionKey{id: id, stream: stream}
+
+	s.mutex.Lock()
+	old := s.sessions[key]
+	s.sessions[key] = session
+	s.mutex.Unlock()
+
+	if old != nil {
+		old.end()
+	}
+}
+
+// record adds a request's audit entry to the session's.
+func (s *hlsSessionStore) record(session *hlsSession, log *AuditLog,
+	entry AuditEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if session.entry == nil {
+		session.auditLog = log
+		session.entry = &entry
+		return
+	}
+
+	session.entry.End = entry.End
+	session.entry.Bytes += entry.Bytes
+}
+
+// finish marks the session over. Its player's requests start a new one. We end
+// it when it next expires, so that its requests under way are part of its
+// audit entry.
+func (s *hlsSessionStore) finish(session *hlsSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session.done = true
+}
+
+// expire ends sessions whose players stopped fetching.
+func (s *hlsSessionStore) expire() {
+	for range time.Tick(hlsSessionTimeout / 2) {
+		now := time.Now()
+		expired := []*hlsSession{}
+
+		s.mutex.Lock()
+		for key, session := range s.sessions {
+			if session.done || now.Sub(session.last) > hlsSessionTimeout {
+				expired = append(expired, session)
+				delete(s.sessions, key)
+			}
+		}
+		s.mutex.Unlock()
+
+		for _, session := range expired {
+			session.end()
+		}
+	}
+}
+
+// count counts the sessions under way.
+func (s *hlsSessionStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for _, session := range s.sessions {
+		if !session.done {
+			n++
+		}
+	}
+	return n
+}
+
+// end ends the viewer's session and writes the audit entry. The session lasted
+// until the player's last request.
+func (s *hlsSession) end() {
+	hlsSessions.mutex.Lock()
+	last := s.last
+	entry := s.entry
+	hlsSessions.mutex.Unlock()
+
+	s.viewing.end(last)
+
+	if entry != nil {
+		entry.Duration = entry.End.Sub(entry.Start).Seconds()
+		s.auditLog.write(*entry)
+	}
+}
+
+// waitForSegment waits for the stream to have a complete segment, such as
+// while its input opens. If it doesn't in time, we respond with an error.
+func (h HTTPHandler) waitForSegment(rw http.ResponseWriter, r *http.Request,
+	stream *Stream) (SegmentWindow, bool) {
+	timeout := time.NewTimer(segmentWait)
+	defer timeout.Stop()
+
+	for {
+		window := stream.segmenter.Window()
+		for _, segment := range window.Segments {
+			if segment.Complete {
+				return window, true
+			}
+		}
+
+		select {
+		case <-window.Changed:
+		case <-timeout.C:
+			h.writeError(rw, r, errInputUnavailable)
+			return SegmentWindow{}, false
+		case <-r.Context().Done():
+			return SegmentWindow{}, false
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A stream can run a command when its first client joins and when its last
+// client leaves, such as to turn a camera's IR illuminator on only while
+// someone is watching. Commands run through the shell, with environment
+// variables describing what happened:
+//
+//   VIDEOSTREAMER_EVENT        first_client or last_client.
+//   VIDEOSTREAMER_STREAM       The stream's name.
+//   VIDEOSTREAMER_CLIENT_ID    The client that joined or left.
+//   VIDEOSTREAMER_CLIENT_ADDR  Its remote address.
+//   VIDEOSTREAMER_TIME         When, in RFC 3339 format.
+//
+// Each stream runs its commands one at a time, in order, so that a command to
+// turn something off never overtakes the one turning it on. When the stream
+// stops, such as when we shut down, it runs those still to come, including
+// the last_client command once its clients finish, and we wait for them
+// before exiting.
+
+// How long a hook command may run before we kill it.
+const hookTimeout = 30 * time.Second
+
+// How many hook commands may wait to run for each stream. Beyond this, we
+// skip first_client commands. We never skip a last_client command, since
+// whatever the first turned on would stay on.
+const hookQueueSize = 16
+
+// Streams whose hook commands may still run.
+var hooksRunning sync.WaitGroup
+
+// hookRun is a hook command waiting to run.
+type hookRun struct {
+	// first_client or last_client.
+	event string
+
+	command string
+	client  *Client
+	time    time.Time
+}
+
+// hookQueue holds a stream's hook commands waiting to run, in order.
+type hookQueue struct {
+	mutex sync.Mutex
+	runs  []hookRun
+
+	// Receives when a command queues.
+	queued chan struct{}
+}
+
+func newHookQueue() *hookQueue {
+	return &hookQueue{queued: make(chan struct{}, 1)}
+}
+
+// queueHook queues the stream's command for the event, if it has one. Call it
+// holding clientsMutex so that commands queue in the order clients come and
+// go.
+func (s *Stream) queueHook(event string, c *Client) {
+	def := s.Definition()
+	command := def.OnFirstClient
+	if event == "last_client" {
+		command = def.OnLastClient
+	}
+	if command == "" {
+		return
+	}
+
+	q := s.hooks
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// With the queue full, the commands are behind. Skipping a first_client
+	// command leaves things off. A last_client command following one we
+	// skipped would turn them off again, so it can go as well.
+	if len(q.runs) >= hookQueueSize {
+		if event == "first_client" || q.runs[len(q.runs)-1].event == event {
+			serverLog.Warnf("hook: %s: Too many commands waiting, skipping %s command",
+				def.Name, event)
+			return
+		}
+	}
+
+	q.runs = append(q.runs, hookRun{event: event, command: command, client: c,
+		time: time.Now()})
+
+	select {
+	case q.queued <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the next command to run, if there is one.
+func (q *hookQueue) next() (hookRun, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.runs) == 0 {
+		return hookRun{}, false
+	}
+	h := q.runs[0]
+	q.runs = q.runs[1:]
+	return h, true
+}
+
+// runHooks runs the stream's hook commands as they queue, until the stream
+// stops and it has run those still to come.
+func (s *Stream) runHooks() {
+	defer hooksRunning.Done()
+
+	for {
+		select {
+		case <-s.hooks.queued:
+			s.runQueuedHooks()
+		case <-s.ctx.Done():
+			s.finishHooks()
+			return
+		}
+	}
+}
+
+// runQueuedHooks runs the commands queued so far.
+func (s *Stream) runQueuedHooks() {
+	for {
+		h, ok := s.hooks.next()
+		if !ok {
+			return
+		}
+		s.runHook(h)
+	}
+}
+
+// finishHooks runs the stream's commands still to come once it stops. Its
+// clients finish after it stops, and the last to leave queues the last_client
+// command, so we wait for them.
+func (s *Stream) finishHooks() {
+	for {
+		s.runQueuedHooks()
+
+		// Clients queue commands holding clientsMutex, so once none are left,
+		// everything they queued is in the queue.
+		s.clientsMutex.Lock()
+		left := len(s.connected)
+		s.clientsMutex.Unlock()
+
+		if left == 0 || s.Definition().OnLastClient == "" {
+			s.runQueuedHooks()
+			return
+		}
+
+		<-s.hooks.queued
+	}
+}
+
+// waitForHooks waits for the streams to run their hook commands still to come
+// as we stop, for at most hookTimeout.
+func waitForHooks() {
+	done := make(chan struct{})
+	go func() {
+		hooksRunning.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(hookTimeout):
+		serverLog.Warnf("hook: Gave up waiting for commands to run")
+	}
+}
+
+// runHook runs a hook command and logs how it went.
+func (s *Stream) runHook(h hookRun) {
+	name := s.Definition().Name
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, h.command)
+	cmd.Env = append(os.Environ(),
+		"VIDEOSTREAMER_EVENT="+h.event,
+		"VIDEOSTREAMER_STREAM="+name,
+		"VIDEOSTREAMER_CLIENT_ID="+h.client.ID,
+		"VIDEOSTREAMER_CLIENT_ADDR="+h.client.RemoteAddr,
+		"VIDEOSTREAMER_TIME="+h.time.Format(time.RFC3339),
+	)
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", hookTimeout)
+	}
+	if err != nil {
+		serverLog.Warnf("hook: %s: %s command failed: %s: %s", name, h.event, err,
+			strings.TrimSpace(string(output)))
+		return
+	}
+
+	serverLog.Infof("hook: %s: Ran %s command in %s", name, h.event,
+		time.Since(start).Round(time.Millisecond))
+	if len(output) > 0 {
+		serverLog.Debugf("hook: %s: %s command output: %s", name, h.event,
+			strings.TrimSpace(string(output)))
+	}
+}
+
+// shellCommand runs the command through the shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
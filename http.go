@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPHandler allows us to pass information to our request handlers.
+type HTTPHandler struct {
+	Streams *Streams
+
+	// Custom HTML bodies for error responses, by status.
+	ErrorPages map[int][]byte
+
+	// Serve debugging endpoints.
+	Debug bool
+
+	// Token required to use the admin endpoints. They are off if this is empty.
+	AdminToken string
+
+	// Who may watch streams, if not anyone.
+	Viewers *Viewers
+
+	// Where we audit stream sessions, if anywhere.
+	AuditLog *AuditLog
+
+	// How long an encoder may go without packets before we call it stuck.
+	StallTimeout time.Duration
+
+	// How long viewers have to finish once we start draining. 0 means as long
+	// as they need.
+	DrainTimeout time.Duration
+}
+
+// ServeHTTP handles an HTTP request.
+func (h HTTPHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	id := clientID()
+
+	httpLog.Infof("Serving [%s] request [%s] from [%s] to path [%s] (%d bytes)",
+		r.Method, id, r.RemoteAddr, r.URL.Path, r.ContentLength)
+
+	span := startRequestSpan(r)
+	defer span.End()
+	span.SetAttribute("client.id", id)
+
+	if h.AuditLog != nil && audited(r.URL.Path) {
+		recorder := h.AuditLog.start(rw, r, id, h.Streams)
+		defer recorder.finish()
+		rw = recorder
+	}
+
+	if err := h.validateRequest(r); err != nil {
+		httpLog.Infof("%s: Invalid request: %s", r.RemoteAddr, err)
+		h.writeError(rw, r, err.(HTTPError))
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/stream.json" {
+		h.descriptorRequest(rw, r, id)
+		return
+	}
+
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/hls/") {
+		name, file := hlsPath(r.URL.Path)
+		if stream := h.Streams.Get(name); stream != nil {
+			h.hlsRequest(rw, r, stream, file)
+			return
+		}
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/api/openapi.json" {
+		h.openAPIRequest(rw, r)
+		return
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/stream" ||
+		strings.HasPrefix(r.URL.Path, "/stream/")) {
+		stream := h.Streams.Get(strings.TrimPrefix(
+			strings.TrimPrefix(r.URL.Path, "/stream"), "/"))
+		if stream != nil {
+			stream = h.Streams.withProfile(stream, r.URL.Query().Get("profile"))
+		}
+		if stream != nil && r.URL.Query().Get("profile") == "" {
+			// streamRequest refuses a bad maxkbps.
+			if kbps, err := parseMaxKbps(r); err == nil && kbps > 0 {
+				stream = h.Streams.withMaxBitrate(stream, kbps)
+			}
+		}
+		if stream != nil {
+			h.streamRequest(rw, r, stream, id, false, span)
+			return
+		}
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/audio" ||
+		strings.HasPrefix(r.URL.Path, "/audio/")) {
+		stream := h.Streams.Get(strings.TrimPrefix(
+			strings.TrimPrefix(r.URL.Path, "/audio"), "/"))
+		if stream != nil {
+			stream = h.Streams.withProfile(stream, r.URL.Query().Get("profile"))
+		}
+		if stream != nil {
+			h.streamRequest(rw, r, stream, id, true, span)
+			return
+		}
+	}
+
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/compare/") {
+		stream := h.Streams.Get(strings.TrimPrefix(r.URL.Path, "/compare/"))
+		if stream != nil {
+			h.compareRequest(rw, r, stream, id, span)
+			return
+		}
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/init.mp4" ||
+		strings.HasPrefix(r.URL.Path, "/segments/") &&
+			strings.HasSuffix(r.URL.Path, "/init.mp4")) {
+		stream := h.Streams.Get(strings.TrimSuffix(
+			strings.TrimPrefix(r.URL.Path, "/segments/"), "/init.mp4"))
+		if stream != nil {
+			h.initRequest(rw, r, stream)
+			return
+		}
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/segments" ||
+		strings.HasPrefix(r.URL.Path, "/segments/")) {
+		stream := h.Streams.Get(strings.TrimPrefix(
+			strings.TrimPrefix(r.URL.Path, "/segments"), "/"))
+		if stream != nil {
+			h.segmentsRequest(rw, r, stream, span)
+			return
+		}
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/dvr" ||
+		strings.HasPrefix(r.URL.Path, "/dvr/")) {
+		stream := h.Streams.Get(strings.TrimPrefix(
+			strings.TrimPrefix(r.URL.Path, "/dvr"), "/"))
+		if stream != nil {
+			h.dvrRequest(rw, r, stream)
+			return
+		}
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/codecs" ||
+		strings.HasPrefix(r.URL.Path, "/codecs/")) {
+		stream := h.Streams.Get(strings.TrimPrefix(
+			strings.TrimPrefix(r.URL.Path, "/codecs"), "/"))
+		if stream != nil {
+			h.codecsRequest(rw, r, stream, id)
+			return
+		}
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/metrics" {
+		h.metricsRequest(rw)
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/healthz" {
+		h.healthRequest(rw, r)
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/readyz" {
+		h.readyRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "GET" && r.URL.Path == "/status" {
+		h.statusRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "GET" && r.URL.Path == "/events" {
+		h.eventsRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "GET" &&
+		r.URL.Path == "/api/recordings" {
+		h.recordingsRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "GET" &&
+		r.URL.Path == "/api/recordings/export" {
+		h.exportRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "GET" &&
+		r.URL.Path == "/api/viewers" {
+		h.viewersRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && (r.Method == "GET" || r.Method == "POST") &&
+		r.URL.Path == "/api/drain" {
+		h.drainRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "POST" &&
+		r.URL.Path == "/api/trigger" {
+		h.triggerRequest(rw, r)
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "POST" &&
+		strings.HasPrefix(r.URL.Path, "/api/streams/") &&
+		(strings.HasSuffix(r.URL.Path, "/pause") ||
+			strings.HasSuffix(r.URL.Path, "/resume")) {
+		name, paused, ok := pausePath(r.URL.Path)
+		if !ok {
+			h.writeError(rw, r, errNotFound)
+			return
+		}
+		h.pauseRequest(rw, r, name, paused)
+		return
+	}
+
+	if h.AdminToken != "" && (r.Method == "GET" || r.Method == "POST") &&
+		strings.HasPrefix(r.URL.Path, "/api/streams/") &&
+		strings.HasSuffix(r.URL.Path, "/key") {
+		h.streamKeyRequest(rw, r, strings.TrimSuffix(
+			strings.TrimPrefix(r.URL.Path, "/api/streams/"), "/key"))
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "GET" &&
+		strings.HasPrefix(r.URL.Path, "/recordings/") {
+		h.recordingFileRequest(rw, r,
+			strings.TrimPrefix(r.URL.Path, "/recordings/"))
+		return
+	}
+
+	if h.AdminToken != "" && r.Method == "POST" &&
+		strings.HasPrefix(r.URL.Path, "/clients/") &&
+		strings.HasSuffix(r.URL.Path, "/kick") {
+		h.kickRequest(rw, r, strings.TrimSuffix(
+			strings.TrimPrefix(r.URL.Path, "/clients/"), "/kick"))
+		return
+	}
+
+	if h.Debug && r.Method == "GET" && r.URL.Path == "/debug/allocations" {
+		h.allocationsRequest(rw, r)
+		return
+	}
+
+	httpLog.Infof("Unknown request.")
+	h.writeError(rw, r, errNotFound)
+}
+
+// Stream media to the client. We receive packets from the encoder and write
+// them to the client as they arrive, forever (until either the client goes
+// away, or an error of some kind occurs).
+//
+// If audio is set, we send only the audio, in a container suited to it.
+func (h HTTPHandler) streamRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, id string, audio bool, span *Span) {
+	start := time.Now()
+	def := stream.Definition()
+	span.SetAttribute("stream", def.Name)
+	span.SetAttribute("audio", audio)
+
+	if !h.allowedOrigin(rw, r, def) {
+		return
+	}
+
+	if h.refuseDraining(rw, r) || h.refusePaused(rw, r, stream) ||
+		h.refuseUnavailable(rw, r, stream) {
+		return
+	}
+
+	format := formatMP4
+	if !audio {
+		var err error
+		format, err = negotiateFormat(r, def.DefaultFormat)
+		if err != nil {
+			h.writeError(rw, r, err.(HTTPError))
+			return
+		}
+		rw.Header().Add("Vary", "Accept")
+	}
+	span.SetAttribute("container", format)
+
+	if h.shedding(rw, r, def, format == formatMJPEG) {
+		return
+	}
+
+	session, ok := h.startSession(rw, r, stream, audio)
+	if !ok {
+		return
+	}
+	if session != "" {
+		defer func() {
+			sessions.leave(session, def.Name, time.Now())
+		}()
+	}
+
+	viewing, ok := h.startViewing(rw, r)
+	if !ok {
+		return
+	}
+	defer func() {
+		viewing.end(time.Now())
+	}()
+
+	if clients := atomic.AddInt32(&stream.clients, 1); def.MaxClients > 0 &&
+		int(clients) > def.MaxClients {
+		atomic.AddInt32(&stream.clients, -1)
+		httpLog.Warnf("client %s (%s): Too many clients", id, r.RemoteAddr)
+		span.SetError(errTooManyClients)
+		h.writeError(rw, r, errTooManyClients)
+		return
+	}
+	defer atomic.AddInt32(&stream.clients, -1)
+
+	ctx := r.Context()
+
+	// A client may ask for only so many seconds of the stream, such as for a
+	// clip. It receives a complete file.
+	if duration := r.URL.Query().Get("duration"); duration != "" {
+		seconds, err := strconv.ParseFloat(duration, 64)
+		if err != nil || seconds <= 0 {
+			h.writeError(rw, r, errBadRequest)
+			return
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx,
+			time.Duration(seconds*float64(time.Second)))
+		defer cancel()
+	}
+
+	waitKeyframe, burst, err := parseStart(r)
+	if err != nil {
+		h.writeError(rw, r, err.(HTTPError))
+		return
+	}
+
+	maxKbps, err := parseMaxKbps(r)
+	if err != nil {
+		h.writeError(rw, r, err.(HTTPError))
+		return
+	}
+
+	metadataInterval := defaultMetadataInterval
+	if format == formatMultipart {
+		metadataInterval, err = parseMetadataInterval(r)
+		if err != nil {
+			h.writeError(rw, r, err.(HTTPError))
+			return
+		}
+	}
+
+	c := newClient(ctx, id, r.RemoteAddr)
+	defer c.cancel()
+	c.RequestedID = requestedClientID(r)
+	c.waitKeyframe = waitKeyframe && !audio
+	c.burst = burst
+	if burst > 0 {
+		c.PacketChan = make(chan *Packet, clientQueueSize+maxBurstPackets)
+	}
+	c.audio = audio
+	if maxKbps > 0 && !audio {
+		c.thin = newThinner(maxKbps)
+	}
+	if !audio {
+		c.shiftable = true
+		c.renditions = h.Streams.renditions(stream)
+	}
+	c.withAudio = !audio && def.IncludeAudio && format != formatMJPEG
+	c.options = def.outputOptions()
+	if viewing != nil {
+		c.viewer = viewing.viewer.Name
+	}
+	switch format {
+	case formatTS:
+		c.format = &tsFormat
+		c.reopen = true
+	case formatMJPEG:
+		c.decode = true
+		c.masks = def.PrivacyMasks
+		c.orientation = def.orientation()
+		c.dewarp = def.dewarp()
+	}
+	if !c.decode {
+		c.waitForOutput()
+		c.joining = newJoinTimer(stream, c.String(), start)
+	}
+
+	// Tell the encoder we're here.
+	c.joining.mark(joinStageRequest, time.Now())
+	if err := stream.join(c); err != nil {
+		if e, ok := err.(HTTPError); ok {
+			h.writeError(rw, r, e)
+		}
+		return
+	}
+
+	stream.addClient(c)
+	defer stream.removeClient(c)
+
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("X-Client-ID", id)
+
+	for name, value := range def.Headers {
+		rw.Header().Set(name, value)
+	}
+
+	// We send chunked by default. In compatibility mode we instead send the body
+	// as is and close the connection at the end. Requesting identity transfer
+	// encoding tells net/http to do this.
+	if def.NoChunking || r.URL.Query().Get("chunked") == "0" {
+		rw.Header().Set("Connection", "close")
+		rw.Header().Set("Transfer-Encoding", "identity")
+	}
+
+	w := &streamWriter{rw: rw, stats: stream.stats, client: c,
+		viewing: viewing, buffered: def.BufferOutput}
+
+	if format == formatMJPEG {
+		err = c.writeMJPEG(w, rw, def.libavVerbose())
+	} else if format == formatMultipart {
+		m := newMultipartWriter(w)
+		stop := m.sendMetadata(c, stream, metadataInterval)
+		err = c.writePackets(m, func(contentType string) {
+			m.setContentType(rw, contentType)
+		}, def.libavVerbose(), span)
+		stop()
+	} else {
+		err = c.writePackets(w, func(contentType string) {
+			rw.Header().Set("Content-Type", contentType)
+		}, def.libavVerbose(), span)
+	}
+	span.SetAttribute("bytes_sent", w.sent)
+	if err != nil {
+		httpLog.Warnf("%s: %s", c, err)
+		span.SetError(err)
+
+		// If the encoder gave up on us before we sent anything, we can still tell
+		// the client why.
+		if e, ok := err.(HTTPError); ok && w.sent == 0 {
+			if def.Unavailable == unavailable503 && (e == errInputUnavailable ||
+				e == errInputTimeout) {
+				setRetryAfter(rw, unavailableRetryAfter)
+			}
+			h.writeError(rw, r, e)
+		}
+	}
+
+	httpLog.Debugf("%s: Sent %d bytes", c, w.sent)
+	httpLog.Infof("%s: Cleaned up", c)
+}
+
+// streamWriter writes media to the client.
+type streamWriter struct {
+	rw      http.ResponseWriter
+	sent    int64
+	stats   *StreamStats
+	client  *Client
+	viewing *viewerSession
+
+	// Whether to leave it to net/http when to flush.
+	buffered bool
+}
+
+func (s *streamWriter) Write(buf []byte) (int, error) {
+	n, err := s.rw.Write(buf)
+	s.sent += int64(n)
+	atomic.AddUint64(&s.stats.BytesSent, uint64(n))
+	atomic.AddInt64(&s.client.bytesSent, int64(n))
+	if err != nil {
+		return n, err
+	}
+
+	if err := s.viewing.add(n, time.Now()); err != nil {
+		return n, err
+	}
+
+	// ResponseWriter buffers chunks. Flush them out ASAP to reduce the time a
+	// client is waiting, especially initially.
+	if flusher, ok := s.rw.(http.Flusher); ok && !s.buffered {
+		flusher.Flush()
+	}
+
+	return n, nil
+}
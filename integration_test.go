@@ -0,0 +1,433 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// These tests run the daemon end to end, so they need the ffmpeg libraries to
+// build it and the ffmpeg program to generate its input. Run them with:
+//
+//   go test -tags integration -run EndToEnd
+//
+// ffmpeg sends a live synthetic h264 input, and we check HTTP clients receive
+// valid fragmented MP4s in several scenarios: one client, multiple clients, a
+// client reconnecting, and a client too slow to keep up.
+
+func TestEndToEnd(t *testing.T) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not found")
+	}
+
+	binary := buildDaemon(t)
+	defer func() {
+		_ = os.RemoveAll(filepath.Dir(binary))
+	}()
+
+	inputPort, err := freeUDPPort()
+	if err != nil {
+		t.Fatalf("unable to find a port: %s", err)
+	}
+	httpPort, err := freeTCPPort()
+	if err != nil {
+		t.Fatalf("unable to find a port: %s", err)
+	}
+
+	input := startInput(t, ffmpeg, inputPort)
+	defer stopProcess(input)
+
+	server := startDaemon(t, binary, inputPort, httpPort)
+	defer stopProcess(server)
+
+	baseURL := fmt.Sprintf("http://127.0.0.1:%d", httpPort)
+	if err := waitForDaemon(baseURL); err != nil {
+		t.Fatalf("videostreamer did not start: %s", err)
+	}
+
+	t.Run("single client", func(t *testing.T) {
+		if err := readStream(baseURL, 5); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("multiple clients", func(t *testing.T) {
+		testMultipleClients(t, baseURL)
+	})
+	t.Run("reconnect", func(t *testing.T) {
+		testReconnect(t, baseURL)
+	})
+	t.Run("slow client", func(t *testing.T) {
+		testSlowClient(t, baseURL)
+	})
+}
+
+// buildDaemon builds the daemon into a temporary directory.
+func buildDaemon(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "videostreamer")
+	if err != nil {
+		t.Fatalf("unable to create directory: %s", err)
+	}
+
+	binary := filepath.Join(dir, "videostreamer")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+
+	cmd := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build",
+		"-o", binary, ".")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("unable to build videostreamer: %s: %s", err, output)
+	}
+	return binary
+}
+
+// freeUDPPort finds a UDP port nobody is using.
+func freeUDPPort() (int, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// freeTCPPort finds a TCP port nobody is using.
+func freeTCPPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// startInput starts ffmpeg sending a live h264 test pattern as MPEG-TS over
+// UDP.
+func startInput(t *testing.T, ffmpeg string, port int) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-re",
+		"-f", "lavfi", "-i", "testsrc=size=640x480:rate=25",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-g", "25", "-b:v", "2M",
+		"-f", "mpegts", fmt.Sprintf("udp://127.0.0.1:%d?pkt_size=1316", port),
+	)
+	startProcess(t, cmd)
+	return cmd
+}
+
+func startDaemon(t *testing.T, binary string, inputPort,
+	httpPort int) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(binary,
+		"-listen", fmt.Sprintf("http://127.0.0.1:%d", httpPort),
+		"-format", "mpegts",
+		"-input", fmt.Sprintf("udp://127.0.0.1:%d", inputPort),
+		// A small send buffer means a client that stops reading falls behind
+		// quickly.
+		"-send-buffer", "4096",
+	)
+	startProcess(t, cmd)
+	return cmd
+}
+
+// startProcess starts the command, showing its output with -v.
+func startProcess(t *testing.T, cmd *exec.Cmd) {
+	t.Helper()
+	if testing.Verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unable to start %s: %s", cmd.Path, err)
+	}
+}
+
+// stopProcess asks the process to exit. Windows can't send SIGTERM, so there
+// we kill it.
+func stopProcess(cmd *exec.Cmd) {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		_ = cmd.Process.Kill()
+	}
+	_ = cmd.Wait()
+}
+
+func waitForDaemon(baseURL string) error {
+	var err error
+	for i := 0; i < 50; i++ {
+		var resp *http.Response
+		resp, err = http.Get(baseURL + "/metrics")
+		if err == nil {
+			_ = resp.Body.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+func testMultipleClients(t *testing.T, baseURL string) {
+	const clients = 4
+
+	errChan := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			errChan <- readStream(baseURL, 5)
+		}()
+	}
+
+	for i := 0; i < clients; i++ {
+		if err := <-errChan; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// testReconnect checks a client can connect again after the last client
+// leaves. The server closes the input when the last client leaves, so this
+// tests reopening it too.
+func testReconnect(t *testing.T, baseURL string) {
+	if err := readStream(baseURL, 2); err != nil {
+		t.Fatalf("first connection: %s", err)
+	}
+
+	time.Sleep(time.Second)
+
+	if err := readStream(baseURL, 2); err != nil {
+		t.Fatalf("second connection: %s", err)
+	}
+}
+
+// testSlowClient checks that a client that stops reading gets dropped, and
+// that other clients are not affected.
+func testSlowClient(t *testing.T, baseURL string) {
+	droppedBefore, err := fetchMetric(baseURL,
+		"videostreamer_clients_dropped_slow_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a small receive buffer so we fall behind quickly.
+	dialer := &net.Dialer{}
+	slowClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network,
+				address string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					_ = tcpConn.SetReadBuffer(4096)
+				}
+				return conn, nil
+			},
+		},
+	}
+
+	resp, err := slowClient.Get(baseURL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// While the slow client isn't reading, a normal client should be fine.
+	if err := readStream(baseURL, 5); err != nil {
+		t.Fatalf("normal client: %s", err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		dropped, err := fetchMetric(baseURL,
+			"videostreamer_clients_dropped_slow_total")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dropped > droppedBefore {
+			// Once we read what was queued, the stream should end.
+			if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+				t.Fatalf("reading rest of slow client's stream: %s", err)
+			}
+			return
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	t.Fatalf("slow client was not dropped")
+}
+
+// readStream connects to the stream and reads until it sees the given number
+// of fragments. It checks that what it receives is a valid fragmented MP4.
+func readStream(baseURL string, fragments int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", baseURL+"/stream", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType !=
+		"video/mp4" {
+		return fmt.Errorf("unexpected content type: %s", contentType)
+	}
+
+	return checkMP4(bufio.NewReader(resp.Body), fragments)
+}
+
+// checkMP4 reads MP4 boxes and checks they are what we expect from a
+// fragmented MP4: ftyp, moov, then pairs of moof and mdat. It stops once it
+// sees the given number of fragments.
+func checkMP4(r io.Reader, fragments int) error {
+	boxes := []string{}
+	seen := 0
+
+	for seen < fragments {
+		boxType, err := skipBox(r)
+		if err != nil {
+			return fmt.Errorf("after boxes %s: %s", strings.Join(boxes, " "), err)
+		}
+		boxes = append(boxes, boxType)
+
+		switch len(boxes) {
+		case 1:
+			if boxType != "ftyp" {
+				return fmt.Errorf("first box is %s, wanted ftyp", boxType)
+			}
+			continue
+		case 2:
+			if boxType != "moov" {
+				return fmt.Errorf("second box is %s, wanted moov", boxType)
+			}
+			continue
+		}
+
+		prev := boxes[len(boxes)-2]
+		switch boxType {
+		case "moof":
+			if prev != "moov" && prev != "mdat" {
+				return fmt.Errorf("moof after %s", prev)
+			}
+		case "mdat":
+			if prev != "moof" {
+				return fmt.Errorf("mdat after %s", prev)
+			}
+			seen++
+		default:
+			return fmt.Errorf("unexpected box %s after %s", boxType, prev)
+		}
+	}
+
+	return nil
+}
+
+// skipBox reads past an MP4 box and returns its type.
+func skipBox(r io.Reader) (string, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", fmt.Errorf("error reading box header: %s", err)
+	}
+
+	size := uint64(binary.BigEndian.Uint32(header[0:4]))
+	boxType := string(header[4:8])
+	headerSize := uint64(8)
+
+	// A size of 1 means the size is in the following 8 bytes.
+	if size == 1 {
+		largeSize := make([]byte, 8)
+		if _, err := io.ReadFull(r, largeSize); err != nil {
+			return "", fmt.Errorf("error reading box size: %s", err)
+		}
+		size = binary.BigEndian.Uint64(largeSize)
+		headerSize += 8
+	}
+
+	// A size of 0 means the box extends to the end of the file. We never expect
+	// that while streaming.
+	if size < headerSize {
+		return "", fmt.Errorf("invalid size %d for box %s", size, boxType)
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r,
+		int64(size-headerSize)); err != nil {
+		return "", fmt.Errorf("error reading box %s: %s", boxType, err)
+	}
+
+	return boxType, nil
+}
+
+// fetchMetric finds the value of a metric from the server. If there are
+// several (such as for different streams), it returns their sum.
+func fetchMetric(baseURL, name string) (float64, error) {
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	total := float64(0)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] != name && !strings.HasPrefix(fields[0], name+"{") {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid metric value: %s", scanner.Text())
+		}
+		total += value
+	}
+
+	return total, scanner.Err()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How quickly a client starts is what a viewer notices most. We time each
+// MP4, MPEG-TS, and multipart client of /stream from its request to the first
+// media we write it, and split that into stages:
+//
+//   request   Handling the request before joining the stream, such as
+//             checking the viewer.
+//   input     Waiting for the encoder to hand over the input, including
+//             opening it if no one else is watching.
+//   output    Opening the client's output, including waiting for a turn to.
+//   keyframe  Waiting for the first packet, such as for a keyframe with
+//             ?start=keyframe.
+//   write     Writing the first packets.
+//
+// /metrics reports percentiles of each stream's recent join times. Joins
+// slower than -slow-join are counted and logged with the stage that took the
+// longest, so we know whether to look at the camera, at us, or at the client.
+
+// The join stages.
+const (
+	joinStageRequest = iota
+	joinStageInput
+	joinStageOutput
+	joinStageKeyframe
+	joinStageWrite
+	joinStages
+)
+
+var joinStageNames = [joinStages]string{"request", "input", "output",
+	"keyframe", "write"}
+
+const (
+	// How slow a join may be before we log it, unless we're told otherwise.
+	defaultSlowJoin = 3 * time.Second
+
+	// How many of a stream's recent joins we compute percentiles over.
+	joinWindow = 1000
+)
+
+// The percentiles of join times we report.
+var joinQuantiles = []float64{0.5, 0.9, 0.99}
+
+// slowJoin is how slow a join may be before we log it.
+var slowJoin = defaultSlowJoin
+
+// joinTimer times a client's join. Only the client's goroutine uses it. A nil
+// joinTimer times nothing.
+type joinTimer struct {
+	stream *Stream
+	client string
+
+	start  time.Time
+	last   time.Time
+	stages [joinStages]time.Duration
+
+	done bool
+}
+
+func newJoinTimer(stream *Stream, client string, start time.Time) *joinTimer {
+	return &joinTimer{stream: stream, client: client, start: start,
+		last: start}
+}
+
+// mark ends the stage.
+func (j *joinTimer) mark(stage int, now time.Time) {
+	if j == nil || j.done {
+		return
+	}
+	j.stages[stage] += now.Sub(j.last)
+	j.last = now
+}
+
+// finish ends the write stage, and with it the join. We record it, and log it
+// if it was slow.
+func (j *joinTimer) finish(now time.Time) {
+	if j == nil || j.done {
+		return
+	}
+	j.mark(joinStageWrite, now)
+	j.done = true
+
+	total := now.Sub(j.start)
+	j.stream.joins.add(total)
+
+	if total < slowJoin {
+		return
+	}
+	atomic.AddUint64(&j.stream.stats.SlowJoins, 1)
+
+	slowest := 0
+	for stage := range j.stages {
+		if j.stages[stage] > j.stages[slowest] {
+			slowest = stage
+		}
+	}
+	httpLog.Warnf("%s: Slow join to stream %s: %s, mostly %s (%s)", j.client,
+		j.stream.Definition().Name, total.Round(time.Millisecond),
+		joinStageNames[slowest], j.stages[slowest].Round(time.Millisecond))
+	httpLog.Debugf("%s: Join stages: %s", j.client, j)
+}
+
+func (j *joinTimer) String() string {
+	s := ""
+	for stage, d := range j.stages {
+		if stage > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%s=%s", joinStageNames[stage], d.Round(time.Millisecond))
+	}
+	return s
+}
+
+// joinStats keeps a stream's recent join times.
+type joinStats struct {
+	mutex  *sync.Mutex
+	recent []time.Duration
+	next   int
+
+	count uint64
+	sum   time.Duration
+}
+
+func newJoinStats() *joinStats {
+	return &joinStats{mutex: &sync.Mutex{}}
+}
+
+func (s *joinStats) add(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.recent) < joinWindow {
+		s.recent = append(s.recent, d)
+	} else {
+		s.recent[s.next] = d
+		s.next = (s.next + 1) % joinWindow
+	}
+	s.count++
+	s.sum += d
+}
+
+// quantiles gives the percentiles of recent join times, with the count and
+// sum of all joins. There are no percentiles without recent joins.
+func (s *joinStats) quantiles(qs []float64) ([]time.Duration, uint64,
+	time.Duration) {
+	s.mutex.Lock()
+	sorted := append([]time.Duration(nil), s.recent...)
+	count, sum := s.count, s.sum
+	s.mutex.Unlock()
+
+	if len(sorted) == 0 {
+		return nil, count, sum
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	values := make([]time.Duration, len(qs))
+	for i, q := range qs {
+		index := int(q*float64(len(sorted))+0.5) - 1
+		if index < 0 {
+			index = 0
+		}
+		if index >= len(sorted) {
+			index = len(sorted) - 1
+		}
+		values[i] = sorted[index]
+	}
+	return values, count, sum
+}
+
+// writeJoinMetrics writes each stream's join times as a summary.
+func writeJoinMetrics(w io.Writer, streams []*Stream) {
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_join_seconds Time from a client's request to the first media we write it, over recent joins.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_join_seconds summary\n")
+	for _, stream := range streams {
+		name := stream.Definition().Name
+		values, count, sum := stream.joins.quantiles(joinQuantiles)
+		for i, value := range values {
+			_, _ = fmt.Fprintf(w,
+				"videostreamer_join_seconds{stream=%q,quantile=\"%g\"} %g\n", name,
+				joinQuantiles[i], value.Seconds())
+		}
+		_, _ = fmt.Fprintf(w, "videostreamer_join_seconds_sum{stream=%q} %g\n",
+			name, sum.Seconds())
+		_, _ = fmt.Fprintf(w, "videostreamer_join_seconds_count{stream=%q} %d\n",
+			name, count)
+	}
+}
@@ -0,0 +1,606 @@
+//go:build !nolibav
+// +build !nolibav
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// #include "videostreamer.h"
+// #include <stdlib.h>
+// extern int goWriteOutput(void *, uint8_t *, int);
+// #cgo LDFLAGS: -lavformat -lavdevice -lavcodec -lavutil -lswscale -lm
+// #cgo CFLAGS: -std=c11
+// #cgo pkg-config: libavcodec
+import "C"
+
+// libavMedia reads and remuxes using the C library.
+type libavMedia struct{}
+
+// libavInput is an input opened by the C library.
+type libavInput struct {
+	// Protect access to vsInput. The encoder reads packets from it while
+	// clients' goroutines write packets using it. It may be closed while they
+	// are still doing so.
+	mutex   *sync.RWMutex
+	vsInput *C.struct_VSInput
+
+	// The packet we read into. We keep it around if we skip a packet.
+	pkt *C.AVPacket
+}
+
+// libavOutput is an output opened by the C library.
+type libavOutput struct {
+	input *libavInput
+
+	// Protect vsOutput so Interrupt doesn't use it once Close frees it.
+	mutex    *sync.Mutex
+	vsOutput *C.struct_VSOutput
+
+	// The output writes using goWriteOutput. It finds where to write by looking
+	// up this ID, which opaque points to. opaque is nil if libav writes to a
+	// URL itself.
+	id     uint64
+	opaque unsafe.Pointer
+
+	// The AVPackets we pass to C.
+	ptrs []*C.AVPacket
+}
+
+// libavDecoder is a decoder opened by the C library.
+type libavDecoder struct {
+	vsDecoder *C.struct_VSDecoder
+
+	// Regions to black out.
+	masks []Region
+
+	// How to turn and mirror the picture.
+	orientation Orientation
+
+	// The fisheye lens to take a flat view through, if any.
+	dewarp *Dewarp
+}
+
+// AVPackets currently allocated. Access atomically. Always allocate and free
+// them with allocPacket() and freePacket() so this is accurate.
+var livePackets int64
+
+// setThreads sets how many threads decoders and encoders use, and how. Call it
+// before newMedia.
+func setThreads(threads Threads) {
+	C.vs_set_threads(C.int(threads.Decoder), C.int(threads.Encoder),
+		C.int(threads.Type))
+}
+
+// newMedia sets up the C library. Call it once, after setting log levels. If
+// devices is set, inputs may be capture devices.
+func newMedia(devices bool) Media {
+	C.vs_setup(C.bool(devices))
+
+	switch libavLog.level {
+	case levelDebug:
+		C.av_log_set_level(C.AV_LOG_VERBOSE)
+	case levelInfo:
+		C.av_log_set_level(C.AV_LOG_INFO)
+	case levelWarn:
+		C.av_log_set_level(C.AV_LOG_WARNING)
+	case levelError:
+		C.av_log_set_level(C.AV_LOG_ERROR)
+	}
+
+	return libavMedia{}
+}
+
+// libraryVersions returns the versions of the libav libraries we were compiled
+// against and the ones we're linked with.
+func libraryVersions() []LibraryVersion {
+	return []LibraryVersion{
+		{
+			Name:     "libavformat",
+			Compiled: uint32(C.LIBAVFORMAT_VERSION_INT),
+			Linked:   uint32(C.avformat_version()),
+		},
+		{
+			Name:     "libavcodec",
+			Compiled: uint32(C.LIBAVCODEC_VERSION_INT),
+			Linked:   uint32(C.avcodec_version()),
+		},
+		{
+			Name:     "libavutil",
+			Compiled: uint32(C.LIBAVUTIL_VERSION_INT),
+			Linked:   uint32(C.avutil_version()),
+		},
+	}
+}
+
+func (libavMedia) OpenInput(format, url string, options map[string]string,
+	timeout time.Duration, verbose bool) (MediaInput, error) {
+	var optionsC *C.AVDictionary
+	for name, value := range options {
+		nameC := C.CString(name)
+		valueC := C.CString(value)
+		res := C.av_dict_set(&optionsC, nameC, valueC, 0)
+		C.free(unsafe.Pointer(nameC))
+		C.free(unsafe.Pointer(valueC))
+		if res < 0 {
+			C.av_dict_free(&optionsC)
+			return nil, fmt.Errorf("unable to set input option %s", name)
+		}
+	}
+
+	inputFormatC := C.CString(format)
+	inputURLC := C.CString(url)
+
+	var timedOut C.bool
+	input := C.vs_open_input(inputFormatC, inputURLC, optionsC,
+		C.int64_t(timeout/time.Microsecond), &timedOut, C.bool(verbose))
+	C.free(unsafe.Pointer(inputFormatC))
+	C.free(unsafe.Pointer(inputURLC))
+	C.av_dict_free(&optionsC)
+	if input == nil {
+		if timedOut {
+			return nil, errInputTimeout
+		}
+		return nil, fmt.Errorf("unable to open input")
+	}
+
+	return &libavInput{
+		mutex:   &sync.RWMutex{},
+		vsInput: input,
+	}, nil
+}
+
+func (libavMedia) Faststart(in, out string, verbose bool) error {
+	inC := C.CString(in)
+	outC := C.CString(out)
+	res := C.vs_faststart(inC, outC, C.bool(verbose))
+	C.free(unsafe.Pointer(inC))
+	C.free(unsafe.Pointer(outC))
+	if res == -1 {
+		return fmt.Errorf("unable to remux %s", in)
+	}
+	return nil
+}
+
+func (libavMedia) Timelapse(pattern, out string, fps int,
+	verbose bool) error {
+	patternC := C.CString(pattern)
+	outC := C.CString(out)
+	res := C.vs_timelapse(patternC, outC, C.int(fps), C.bool(verbose))
+	C.free(unsafe.Pointer(patternC))
+	C.free(unsafe.Pointer(outC))
+	if res == -1 {
+		return fmt.Errorf("unable to encode %s", pattern)
+	}
+	return nil
+}
+
+func (i *libavInput) ReadPacket(timeout time.Duration,
+	verbose bool) (*Packet, error) {
+	if i.pkt == nil {
+		i.pkt = allocPacket()
+		if i.pkt == nil {
+			return nil, fmt.Errorf("unable to allocate packet")
+		}
+	}
+
+	// We might want to lock the input here. It's probably not necessary though.
+	// Other goroutines should only be reading it. We're the writer.
+	readRes := C.vs_read_packet(i.vsInput, i.pkt,
+		C.int64_t(timeout/time.Microsecond), C.bool(verbose))
+	if readRes == -2 {
+		return nil, errEndOfInput
+	}
+
+	if readRes == -1 {
+		return nil, fmt.Errorf("failure reading packet")
+	}
+
+	if readRes == 0 {
+		return nil, nil
+	}
+
+	packetTime := int64(C.vs_packet_time(i.vsInput, i.pkt))
+	if packetTime == int64(C.AV_NOPTS_VALUE) {
+		packetTime = noTime
+	}
+
+	// Clients share the packet. We allocate a new one for the next read.
+	pkt := i.pkt
+	i.pkt = nil
+
+	p := newPacket(pkt, func() { freePacket(&pkt) }, int64(pkt.size),
+		packetTime)
+	p.audio = pkt.stream_index == i.vsInput.audio_stream_index
+	p.keyframe = pkt.flags&C.AV_PKT_FLAG_KEY != 0
+	p.corrupt = pkt.flags&C.AV_PKT_FLAG_CORRUPT != 0
+
+	// Only we change the codec parameters, so we can check them without
+	// locking. Outputs and decoders copy them when they open, so we lock to
+	// change them. If that fails, we carry on with what we have.
+	if C.vs_check_codec_parameters(i.vsInput, pkt, C.bool(verbose)) == 1 {
+		i.mutex.Lock()
+		applyRes := C.vs_apply_codec_parameters(i.vsInput)
+		i.mutex.Unlock()
+		p.newParameters = applyRes == 0
+	}
+
+	return p, nil
+}
+
+// Next only changes what the encoder reads from. Outputs don't use that, so
+// we don't need to lock.
+func (i *libavInput) Next(format, url string, timeout time.Duration,
+	verbose bool) error {
+	formatC := C.CString(format)
+	urlC := C.CString(url)
+
+	var timedOut C.bool
+	res := C.vs_next_input(i.vsInput, formatC, urlC,
+		C.int64_t(timeout/time.Microsecond), &timedOut, C.bool(verbose))
+	C.free(unsafe.Pointer(formatC))
+	C.free(unsafe.Pointer(urlC))
+	if res == -1 {
+		if timedOut {
+			return errInputTimeout
+		}
+		return fmt.Errorf("unable to open next input")
+	}
+
+	return nil
+}
+
+// SetAudioOffset is only for the goroutine reading packets, so we don't need
+// to lock.
+func (i *libavInput) SetAudioOffset(offset time.Duration) {
+	C.vs_set_audio_offset(i.vsInput, C.int64_t(offset/time.Microsecond))
+}
+
+func (i *libavInput) CodecParameters(audio bool) (CodecParameters, bool) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	params := C.vs_codec_parameters(i.vsInput, C.bool(audio))
+	if params == nil {
+		return CodecParameters{}, false
+	}
+
+	return CodecParameters{
+		Codec:     C.GoString(C.avcodec_get_name(params.codec_id)),
+		Profile:   int(params.profile),
+		Level:     int(params.level),
+		Extradata: C.GoBytes(unsafe.Pointer(params.extradata), params.extradata_size),
+		Width:     int(params.width),
+		Height:    int(params.height),
+	}, true
+}
+
+func (i *libavInput) AudioFormat() (OutputFormat, error) {
+	i.mutex.RLock()
+	muxerC := C.vs_audio_format(i.vsInput)
+	i.mutex.RUnlock()
+	if muxerC == nil {
+		return OutputFormat{}, fmt.Errorf("input has no audio we can serve alone")
+	}
+
+	muxer := C.GoString(muxerC)
+	contentType, ok := audioContentTypes[muxer]
+	if !ok {
+		return OutputFormat{}, fmt.Errorf("unknown audio format: %s", muxer)
+	}
+
+	return OutputFormat{Muxer: muxer, ContentType: contentType, Audio: true}, nil
+}
+
+// OpenOutput creates a container and writes the header.
+func (i *libavInput) OpenOutput(w io.Writer, format OutputFormat,
+	verbose bool) (MediaOutput, error) {
+	opaque := C.malloc(C.size_t(unsafe.Sizeof(C.uint64_t(0))))
+	if opaque == nil {
+		return nil, fmt.Errorf("unable to allocate")
+	}
+
+	id := registerOutputWriter(w)
+	*(*C.uint64_t)(opaque) = C.uint64_t(id)
+
+	outputFormatC := C.CString(format.Muxer)
+
+	options := C.struct_VSOutputOptions{
+		frag_duration: C.int64_t(format.Options.FragmentDuration /
+			time.Microsecond),
+		buffered: C.bool(format.Options.Buffered),
+		max_interleave_delta: C.int64_t(format.Options.MaxInterleaveDelta /
+			time.Microsecond),
+		with_audio:   C.bool(format.WithAudio),
+		silent_audio: C.bool(format.Options.SilentAudio),
+		rotate:       C.int(format.Options.Orientation.Rotate),
+		hflip:        C.bool(format.Options.Orientation.HFlip),
+		vflip:        C.bool(format.Options.Orientation.VFlip),
+		buffer_size:  C.int(outputBufferSize),
+	}
+
+	i.mutex.RLock()
+	output := C.vs_open_output_writer(outputFormatC,
+		C.vs_write_fn(C.goWriteOutput), opaque, i.vsInput, C.bool(format.Audio),
+		C.bool(format.CMAF), &options, C.bool(verbose))
+	i.mutex.RUnlock()
+	C.free(unsafe.Pointer(outputFormatC))
+	if output == nil {
+		unregisterOutputWriter(id)
+		C.free(opaque)
+		return nil, fmt.Errorf("unable to open output")
+	}
+
+	return &libavOutput{
+		input:    i,
+		mutex:    &sync.Mutex{},
+		vsOutput: output,
+		id:       id,
+		opaque:   opaque,
+		ptrs:     make([]*C.AVPacket, writeBatchSize),
+	}, nil
+}
+
+func (i *libavInput) OpenURLOutput(url string, format OutputFormat,
+	verbose bool) (MediaOutput, error) {
+	if format.Audio || format.CMAF {
+		return nil, fmt.Errorf("unsupported format for URL output")
+	}
+
+	outputFormatC := C.CString(format.Muxer)
+	outputURLC := C.CString(url)
+	var fecC *C.char
+	if format.FEC != "" {
+		fecC = C.CString(format.FEC)
+	}
+
+	i.mutex.RLock()
+	output := C.vs_open_output(outputFormatC, outputURLC, i.vsInput, fecC,
+		C.bool(verbose))
+	i.mutex.RUnlock()
+	C.free(unsafe.Pointer(outputFormatC))
+	C.free(unsafe.Pointer(outputURLC))
+	C.free(unsafe.Pointer(fecC))
+	if output == nil {
+		return nil, fmt.Errorf("unable to open output")
+	}
+
+	return &libavOutput{
+		input:    i,
+		mutex:    &sync.Mutex{},
+		vsOutput: output,
+		ptrs:     make([]*C.AVPacket, writeBatchSize),
+	}, nil
+}
+
+func (i *libavInput) OpenDecoder(audio, verbose bool) (MediaDecoder, error) {
+	i.mutex.RLock()
+	decoder := C.vs_open_decoder(i.vsInput, C.bool(audio), C.bool(verbose))
+	i.mutex.RUnlock()
+	if decoder == nil {
+		return nil, fmt.Errorf("unable to open decoder")
+	}
+
+	return &libavDecoder{vsDecoder: decoder}, nil
+}
+
+func (i *libavInput) Interrupt() {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	if i.vsInput != nil {
+		C.vs_interrupt_input(i.vsInput)
+	}
+}
+
+func (i *libavInput) Close() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.vsInput != nil {
+		C.vs_destroy_input(i.vsInput)
+		i.vsInput = nil
+	}
+
+	freePacket(&i.pkt)
+}
+
+func (o *libavOutput) WritePackets(packets []*Packet, verbose bool) error {
+	if len(packets) == 0 {
+		return nil
+	}
+
+	if len(packets) > len(o.ptrs) {
+		o.ptrs = make([]*C.AVPacket, len(packets))
+	}
+
+	for i, p := range packets {
+		o.ptrs[i] = p.data.(*C.AVPacket)
+	}
+
+	o.input.mutex.RLock()
+	writeRes := C.vs_write_packets(o.input.vsInput, o.vsOutput, &o.ptrs[0],
+		C.int(len(packets)), C.bool(verbose))
+	o.input.mutex.RUnlock()
+	if writeRes == -1 {
+		return fmt.Errorf("failure writing packet")
+	}
+
+	return nil
+}
+
+func (o *libavOutput) Interrupt() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.vsOutput != nil {
+		C.vs_interrupt_output(o.vsOutput)
+	}
+}
+
+func (o *libavOutput) Close() {
+	o.mutex.Lock()
+	C.vs_destroy_output(o.vsOutput)
+	o.vsOutput = nil
+	o.mutex.Unlock()
+	if o.opaque != nil {
+		unregisterOutputWriter(o.id)
+		C.free(o.opaque)
+	}
+}
+
+// Decode needs only the packet, not the input, so it works after the input
+// closes.
+func (d *libavDecoder) Decode(p *Packet, verbose bool) error {
+	decodeRes := C.vs_decode_packet(d.vsDecoder, p.data.(*C.AVPacket),
+		C.bool(verbose))
+	if decodeRes == -1 {
+		return fmt.Errorf("failure decoding packet")
+	}
+
+	return nil
+}
+
+func (d *libavDecoder) ReceiveFrame(verbose bool) (bool, error) {
+	receiveRes := C.vs_receive_frame(d.vsDecoder, C.bool(verbose))
+	if receiveRes == -1 {
+		return false, fmt.Errorf("failure receiving frame")
+	}
+
+	return receiveRes == 1, nil
+}
+
+func (d *libavDecoder) Luma(width, height int) ([]byte, error) {
+	buf := make([]byte, width*height)
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("invalid size")
+	}
+
+	// If we rotate sideways, we scale to the picture's size before rotating.
+	scaledWidth, scaledHeight := width, height
+	if d.orientation.transposes() {
+		scaledWidth, scaledHeight = height, width
+	}
+
+	lumaRes := C.vs_frame_luma(d.vsDecoder, (*C.uint8_t)(unsafe.Pointer(&buf[0])),
+		C.int(scaledWidth), C.int(scaledHeight))
+	if lumaRes == -1 {
+		return nil, fmt.Errorf("unable to scale frame")
+	}
+
+	if d.dewarp != nil {
+		buf = d.dewarp.apply(buf, scaledWidth, scaledHeight)
+	}
+	buf = d.orientation.apply(buf, scaledWidth, scaledHeight)
+	maskLuma(buf, width, height, d.masks)
+	return buf, nil
+}
+
+func (d *libavDecoder) JPEG(maxWidth int, verbose bool) ([]byte, error) {
+	// Each mask is four doubles. See vs_frame_jpeg().
+	var masksC *C.double
+	if len(d.masks) > 0 {
+		masks := make([]C.double, 0, len(d.masks)*4)
+		for _, m := range d.masks {
+			masks = append(masks, C.double(m.X), C.double(m.Y), C.double(m.Width),
+				C.double(m.Height))
+		}
+		masksC = &masks[0]
+	}
+
+	var dewarpC *C.struct_VSDewarp
+	if d.dewarp != nil {
+		dewarpC = &C.struct_VSDewarp{
+			center_x: C.double(d.dewarp.CenterX),
+			center_y: C.double(d.dewarp.CenterY),
+			radius:   C.double(d.dewarp.Radius),
+			lens_fov: C.double(d.dewarp.LensFOV),
+			fov:      C.double(d.dewarp.FOV),
+			pan:      C.double(d.dewarp.Pan),
+			tilt:     C.double(d.dewarp.Tilt),
+		}
+	}
+
+	pkt := C.vs_frame_jpeg(d.vsDecoder, C.int(maxWidth), dewarpC, masksC,
+		C.int(len(d.masks)), C.int(d.orientation.Rotate),
+		C.bool(d.orientation.HFlip), C.bool(d.orientation.VFlip),
+		C.bool(verbose))
+	if pkt == nil {
+		return nil, fmt.Errorf("unable to encode frame")
+	}
+
+	buf := C.GoBytes(unsafe.Pointer(pkt.data), pkt.size)
+	C.av_packet_free(&pkt)
+	return buf, nil
+}
+
+func (d *libavDecoder) SetMasks(masks []Region) {
+	d.masks = masks
+}
+
+func (d *libavDecoder) SetOrientation(o Orientation) {
+	d.orientation = o
+}
+
+func (d *libavDecoder) SetDewarp(dewarp *Dewarp) {
+	d.dewarp = dewarp
+}
+
+func (d *libavDecoder) Level() (float64, error) {
+	rms := float64(C.vs_frame_rms(d.vsDecoder))
+	if rms < 0 {
+		return 0, fmt.Errorf("unable to measure audio level")
+	}
+
+	return rms, nil
+}
+
+func (d *libavDecoder) Close() {
+	C.vs_destroy_decoder(d.vsDecoder)
+}
+
+func allocPacket() *C.AVPacket {
+	pkt := C.av_packet_alloc()
+	if pkt != nil {
+		atomic.AddInt64(&livePackets, 1)
+	}
+	return pkt
+}
+
+// packetBytes copies the packet's data.
+func packetBytes(p *Packet) []byte {
+	pkt := p.data.(*C.AVPacket)
+	return C.GoBytes(unsafe.Pointer(pkt.data), pkt.size)
+}
+
+func freePacket(pkt **C.AVPacket) {
+	if *pkt == nil {
+		return
+	}
+	C.av_packet_free(pkt)
+	atomic.AddInt64(&livePackets, -1)
+}
+
+// mediaAllocations counts what the C library has allocated.
+func mediaAllocations() Allocations {
+	var cAllocations C.struct_VSAllocations
+	C.vs_get_allocations(&cAllocations)
+
+	outputWriters.mutex.Lock()
+	writers := len(outputWriters.writers)
+	outputWriters.mutex.Unlock()
+
+	return Allocations{
+		Inputs:        int64(cAllocations.inputs),
+		Outputs:       int64(cAllocations.outputs),
+		Decoders:      int64(cAllocations.decoders),
+		Packets:       atomic.LoadInt64(&livePackets),
+		OutputWriters: writers,
+	}
+}
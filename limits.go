@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// So that we can share a small machine, such as a Raspberry Pi, we can cap how
+// much CPU and memory we use. With -max-cpu or -max-rss, we measure our CPU use
+// (as a percent of the CPUs available to us, going by the cgroup's quota in a
+// container) and resident memory every so often. In a cgroup with a memory
+// limit, we also keep to 90% of it.
+//
+// Over a cap, we shed load in steps:
+//
+//   1. We stop transcoding for clients: MJPEG clients disconnect, and we
+//      refuse new ones.
+//   2. If we're still over a cap when we next measure, we refuse new clients
+//      of any kind, starting with the least important streams. See
+//      priority.go.
+//
+// We stop shedding once we're back under 90% of the caps. We never shed what
+// a stream does for itself, such as recording and motion detection.
+
+var errOverloaded = HTTPError{
+	Status:  http.StatusServiceUnavailable,
+	Code:    "overloaded",
+	Message: "Server is overloaded",
+}
+
+// How much load we shed.
+const (
+	shedNothing = iota
+	shedTranscodes
+	shedClients
+)
+
+// shedLevel is how much load we shed now. Access atomically.
+var shedLevel int32
+
+// While we shed clients, we shed those of streams of this priority and below.
+// Access atomically.
+var shedPriority int32
+
+// limitResources measures our CPU use and resident memory and decides how
+// much load to shed. maxCPU is a percent of the CPUs available to us and
+// maxRSS is in bytes. 0 means no cap.
+func limitResources(streams *Streams, maxCPU float64, maxRSS uint64) {
+	if limit := cgroupMemoryLimit(); limit > 0 &&
+		(maxRSS == 0 || maxRSS > limit/10*9) {
+		maxRSS = limit / 10 * 9
+		serverLog.Infof("Capping resident memory at %d MB, 90%% of our cgroup's limit",
+			maxRSS/1024/1024)
+	}
+
+	lastCPU, err := processCPUTime()
+	if err != nil && maxCPU > 0 {
+		serverLog.Warnf("Not capping CPU use: %s", err)
+		maxCPU = 0
+	}
+	if _, err := residentMemory(); err != nil && maxRSS > 0 {
+		serverLog.Warnf("Not capping resident memory: %s", err)
+		maxRSS = 0
+	}
+	if maxCPU == 0 && maxRSS == 0 {
+		return
+	}
+
+	last := time.Now()
+
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		usedCPU := 0.0
+		if maxCPU > 0 {
+			if cpuTime, err := processCPUTime(); err == nil {
+				usedCPU = (cpuTime - lastCPU).Seconds() / elapsed /
+					availableCPUs() * 100
+				lastCPU = cpuTime
+			}
+		}
+
+		rss := uint64(0)
+		if maxRSS > 0 {
+			rss, _ = residentMemory()
+		}
+
+		over := (maxCPU > 0 && usedCPU >= maxCPU) || (maxRSS > 0 && rss >= maxRSS)
+		under := (maxCPU == 0 || usedCPU < maxCPU*0.9) &&
+			(maxRSS == 0 || rss < maxRSS/10*9)
+
+		level := atomic.LoadInt32(&shedLevel)
+		priority := int(atomic.LoadInt32(&shedPriority))
+		switch {
+		case over && level < shedClients:
+			level++
+			priority = lowestPriority(streams)
+		case over && level == shedClients:
+			next, ok := nextPriority(streams, priority)
+			if !ok {
+				continue
+			}
+			priority = next
+		case under && level > shedNothing:
+			level = shedNothing
+		default:
+			continue
+		}
+		atomic.StoreInt32(&shedPriority, int32(priority))
+		atomic.StoreInt32(&shedLevel, level)
+
+		switch level {
+		case shedNothing:
+			serverLog.Infof("Under our caps again (CPU %.0f%%, RSS %d MB), no longer shedding load",
+				usedCPU, rss/1024/1024)
+		case shedTranscodes:
+			serverLog.Warnf("Over our caps (CPU %.0f%%, RSS %d MB), stopping transcodes",
+				usedCPU, rss/1024/1024)
+			dropTranscodes(streams)
+		case shedClients:
+			serverLog.Warnf("Still over our caps (CPU %.0f%%, RSS %d MB), refusing new clients of streams of priority %d and below",
+				usedCPU, rss/1024/1024, priority)
+			dropClients(streams, priority)
+		}
+	}
+}
+
+// dropTranscodes disconnects clients we decode the video for.
+func dropTranscodes(streams *Streams) {
+	for _, stream := range streams.All() {
+		for _, c := range stream.Clients() {
+			if c.decode {
+				httpLog.Infof("%s: Disconnecting to shed load", c)
+				c.cancel()
+			}
+		}
+	}
+}
+
+// shedding decides whether to refuse a new client of the stream to shed load,
+// and if so, responds with an error. transcode says whether we'd decode the
+// video for the client.
+func (h HTTPHandler) shedding(rw http.ResponseWriter, r *http.Request,
+	def StreamDefinition, transcode bool) bool {
+	level := atomic.LoadInt32(&shedLevel)
+	if (level == shedClients &&
+		def.Priority <= int(atomic.LoadInt32(&shedPriority))) ||
+		(level >= shedTranscodes && transcode) {
+		httpLog.Warnf("%s: Refusing client to shed load", r.RemoteAddr)
+		h.writeError(rw, r, errOverloaded)
+		return true
+	}
+	return false
+}
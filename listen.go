@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Listener describes an address we listen on and how we serve it.
+type Listener struct {
+	// Protocol is http, https, or fcgi.
+	Protocol string
+
+	// Network is tcp or unix.
+	Network string
+
+	// Address is a host:port for tcp or a path for unix.
+	Address string
+}
+
+// parseListener parses a listener given as a URL such as http://:8080,
+// https://0.0.0.0:8443, fcgi://127.0.0.1:9000, or fcgi:///run/vs.sock (a UNIX
+// socket).
+func parseListener(s string) (Listener, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid listener: %s: %s", s, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "fcgi":
+	default:
+		return Listener{}, fmt.Errorf("invalid listener: %s: unknown protocol %s",
+			s, u.Scheme)
+	}
+
+	if u.Host != "" {
+		return Listener{
+			Protocol: u.Scheme,
+			Network:  "tcp",
+			Address:  u.Host,
+		}, nil
+	}
+
+	if u.Path != "" {
+		return Listener{
+			Protocol: u.Scheme,
+			Network:  "unix",
+			Address:  u.Path,
+		}, nil
+	}
+
+	return Listener{}, fmt.Errorf("invalid listener: %s: missing address", s)
+}
+
+func (l Listener) String() string {
+	name := "HTTP"
+	switch l.Protocol {
+	case "https":
+		name = "HTTPS"
+	case "fcgi":
+		name = "FastCGI"
+	}
+
+	if l.Network == "unix" {
+		return fmt.Sprintf("%s (%s, UNIX socket)", l.Address, name)
+	}
+	return fmt.Sprintf("%s (%s)", l.Address, name)
+}
+
+// listenerFlag collects listeners given on the command line.
+type listenerFlag []Listener
+
+func (l *listenerFlag) String() string {
+	listeners := []string{}
+	for _, listener := range *l {
+		listeners = append(listeners, listener.String())
+	}
+	return strings.Join(listeners, ", ")
+}
+
+func (l *listenerFlag) Set(s string) error {
+	listener, err := parseListener(s)
+	if err != nil {
+		return err
+	}
+
+	*l = append(*l, listener)
+	return nil
+}
+
+// listen opens the listening socket, applying any socket options we were
+// asked to.
+func listen(l Listener, args Args) (net.Listener, error) {
+	lc := net.ListenConfig{
+		// This applies to connections we accept. 0 means Go's default, and a
+		// negative value disables keepalives.
+		KeepAlive: args.TCPKeepAlive,
+	}
+
+	if args.ReusePort && l.Network == "tcp" {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	network, address, err := ipNetwork(l, args.IPVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := lc.Listen(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Go picks the backlog itself. Calling listen(2) again on the listening
+	// socket changes it.
+	if args.ListenBacklog > 0 {
+		if err := setBacklog(listener, args.ListenBacklog); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("unable to set backlog: %s", err)
+		}
+	}
+
+	if l.Network == "tcp" {
+		listener = tuningListener{
+			Listener:   listener,
+			noDelay:    args.TCPNoDelay,
+			sendBuffer: args.SendBufferSize,
+		}
+	}
+
+	return listener, nil
+}
+
+// tuningListener sets socket options on the connections it accepts.
+type tuningListener struct {
+	net.Listener
+	noDelay    bool
+	sendBuffer int
+}
+
+// Accept accepts a connection and tunes it. We send media in small fragments.
+// With Nagle's algorithm these can sit in the kernel waiting for more data,
+// adding latency, so normally we disable it.
+func (t tuningListener) Accept() (net.Conn, error) {
+	conn, err := t.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+
+	if err := tcpConn.SetNoDelay(t.noDelay); err != nil {
+		httpLog.Warnf("Unable to set TCP_NODELAY: %s", err)
+	}
+
+	if t.sendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(t.sendBuffer); err != nil {
+			httpLog.Warnf("Unable to set send buffer size: %s", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// ipNetwork decides the network and address to listen on to get the IP
+// version we want.
+//
+// Without a version we leave it to Go. It listens dual-stack on a wildcard
+// address such as :8080 or [::]:8080, but IPv4 only on 0.0.0.0:8080.
+func ipNetwork(l Listener, version string) (string, string, error) {
+	if l.Network != "tcp" {
+		return l.Network, l.Address, nil
+	}
+
+	switch version {
+	case "":
+		return "tcp", l.Address, nil
+	case "4":
+		return "tcp4", l.Address, nil
+	case "6":
+		// Go sets IPV6_V6ONLY for tcp6 on a wildcard address.
+		return "tcp6", l.Address, nil
+	case "dual":
+		host, port, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			return "", "", err
+		}
+
+		// Only a wildcard address can accept both IPv4 and IPv6.
+		ip := net.ParseIP(host)
+		if host != "" && (ip == nil || !ip.IsUnspecified()) {
+			return "", "", fmt.Errorf(
+				"dual-stack requires a wildcard address, not %s", host)
+		}
+
+		return "tcp", net.JoinHostPort("", port), nil
+	default:
+		return "", "", fmt.Errorf("invalid IP version: %s", version)
+	}
+}
+
+func setBacklog(listener net.Listener, backlog int) error {
+	sc, ok := listener.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return fmt.Errorf("listener does not support setting backlog")
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := rc.Control(func(fd uintptr) {
+		listenErr = listenBacklog(fd, backlog)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// serve listens and serves requests on the listener. It returns only if there
+// is an error.
+// How long we wait for requests to finish when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// serve serves requests on the listener until ctx is done. We then stop
+// listening and wait a while for requests to finish before returning nil.
+func serve(ctx context.Context, l Listener, handler http.Handler,
+	args Args) error {
+	if l.Network == "unix" {
+		// Remove a stale socket left from a previous run. Be careful to only remove
+		// a socket.
+		if fi, err := os.Stat(l.Address); err == nil &&
+			fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(l.Address); err != nil {
+				return fmt.Errorf("unable to remove old socket: %s", err)
+			}
+		}
+	}
+
+	listener, err := listen(l, args)
+	if err != nil {
+		return fmt.Errorf("unable to listen: %s", err)
+	}
+
+	serverLog.Infof("Starting to serve requests on %s", l)
+
+	var server *http.Server
+	if l.Protocol != "fcgi" {
+		server = &http.Server{Handler: handler}
+	}
+
+	// The streams stop when ctx is done too, so streaming requests finish.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		// The FastCGI server can't wait for its requests.
+		if server == nil {
+			_ = listener.Close()
+			return
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(),
+			shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			serverLog.Warnf("Unable to shut down %s cleanly: %s", l, err)
+		}
+	}()
+
+	switch l.Protocol {
+	case "fcgi":
+		err = fcgi.Serve(listener, handler)
+	case "https":
+		err = server.ServeTLS(listener, args.TLSCertFile, args.TLSKeyFile)
+	default:
+		err = server.Serve(listener)
+	}
+
+	if ctx.Err() != nil {
+		<-shutdownDone
+		serverLog.Infof("Stopped serving requests on %s", l)
+		return nil
+	}
+
+	return fmt.Errorf("unable to serve on %s: %s", l, err)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Under load, rather than degrade everyone, we can serve new clients of a
+// stream from one of its profiles, such as a camera's substream. With
+// -fallback-cpu or -fallback-egress, we measure how much CPU we use and how
+// fast we send to clients. While either is over its threshold, new clients of
+// streams with a fallback_profile get that profile unless they ask for one.
+// Clients already watching carry on as they are. Less important streams fall
+// back first. See priority.go.
+//
+// Once we're overloaded, we stay so until both are back under 90% of their
+// thresholds, so that we don't flap.
+//
+// We publish a fallback_start event for each stream with a fallback profile
+// when we become overloaded, and a fallback_end event when we recover.
+
+// How often we measure load.
+const loadSampleInterval = 5 * time.Second
+
+// LoadEvent is the load that started or ended falling back.
+type LoadEvent struct {
+	// Percent of the CPUs available to us that we used.
+	CPU float64 `json:"cpu"`
+
+	// Megabits per second we sent to clients.
+	EgressMbps float64 `json:"egress_mbps"`
+
+	// The profile new clients get.
+	Profile string `json:"profile"`
+}
+
+// overloaded is 1 while new clients should get fallback profiles. Access
+// atomically.
+var overloaded int32
+
+// While we're overloaded, streams of this priority and below fall back. See
+// priority.go. Access atomically.
+var fallbackPriority int32
+
+// isOverloaded decides whether new clients should get fallback profiles.
+func isOverloaded() bool {
+	return atomic.LoadInt32(&overloaded) == 1
+}
+
+// fallingBack decides whether new clients of a stream of the priority should
+// get its fallback profile.
+func fallingBack(priority int) bool {
+	return isOverloaded() &&
+		priority <= int(atomic.LoadInt32(&fallbackPriority))
+}
+
+// monitorLoad measures our load and decides whether we're overloaded. cpu is
+// the threshold percent of all CPUs and egressMbps the threshold for sending
+// to clients. 0 means no threshold.
+func monitorLoad(streams *Streams, cpu, egressMbps float64) {
+	lastCPU, err := processCPUTime()
+	if err != nil && cpu > 0 {
+		serverLog.Warnf("Not falling back on CPU use: %s", err)
+		cpu = 0
+	}
+	lastSent := totalBytesSent(streams)
+	last := time.Now()
+
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		usedCPU := 0.0
+		if cpu > 0 {
+			cpuTime, err := processCPUTime()
+			if err == nil {
+				usedCPU = (cpuTime - lastCPU).Seconds() / elapsed /
+					availableCPUs() * 100
+				lastCPU = cpuTime
+			}
+		}
+
+		sent := totalBytesSent(streams)
+		egress := float64(sent-lastSent) * 8 / 1e6 / elapsed
+		lastSent = sent
+
+		over := (cpu > 0 && usedCPU >= cpu) ||
+			(egressMbps > 0 && egress >= egressMbps)
+		under := (cpu == 0 || usedCPU < cpu*0.9) &&
+			(egressMbps == 0 || egress < egressMbps*0.9)
+
+		priority := int(atomic.LoadInt32(&fallbackPriority))
+
+		if !isOverloaded() && over {
+			lowest := lowestPriority(streams)
+			atomic.StoreInt32(&fallbackPriority, int32(lowest))
+			atomic.StoreInt32(&overloaded, 1)
+			serverLog.Warnf("Overloaded (CPU %.0f%%, egress %.1f Mbit/s), falling back streams of priority %d and below",
+				usedCPU, egress, lowest)
+			publishFallback(streams, "fallback_start", now, usedCPU, egress,
+				minPriority-1, lowest)
+			continue
+		}
+
+		if isOverloaded() && over {
+			next, ok := nextPriority(streams, priority)
+			if !ok {
+				continue
+			}
+			atomic.StoreInt32(&fallbackPriority, int32(next))
+			serverLog.Warnf("Still overloaded (CPU %.0f%%, egress %.1f Mbit/s), falling back streams of priority %d and below",
+				usedCPU, egress, next)
+			publishFallback(streams, "fallback_start", now, usedCPU, egress,
+				priority, next)
+			continue
+		}
+
+		if isOverloaded() && under {
+			atomic.StoreInt32(&overloaded, 0)
+			serverLog.Infof("No longer overloaded (CPU %.0f%%, egress %.1f Mbit/s)",
+				usedCPU, egress)
+			publishFallback(streams, "fallback_end", now, usedCPU, egress,
+				minPriority-1, priority)
+		}
+	}
+}
+
+// totalBytesSent is how much we have sent to clients of every stream.
+func totalBytesSent(streams *Streams) uint64 {
+	var sent uint64
+	for _, stream := range streams.All() {
+		sent += atomic.LoadUint64(&stream.stats.BytesSent)
+	}
+	return sent
+}
+
+// publishFallback publishes an event for each stream with a fallback profile
+// whose priority is above from and at most to.
+func publishFallback(streams *Streams, eventType string, now time.Time,
+	cpu, egress float64, from, to int) {
+	for _, stream := range streams.All() {
+		def := stream.Definition()
+		if def.FallbackProfile == "" || def.Priority <= from ||
+			def.Priority > to {
+			continue
+		}
+
+		events.publish(Event{
+			Type:   eventType,
+			Stream: def.Name,
+			Time:   now,
+			Load: &LoadEvent{
+				CPU:        cpu,
+				EgressMbps: egress,
+				Profile:    def.FallbackProfile,
+			},
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LoadTestArgs holds arguments to the loadtest subcommand.
+type LoadTestArgs struct {
+	URL string
+
+	// How many clients to run.
+	Clients int
+
+	// How many of the clients read slowly.
+	SlowClients int
+
+	// Bytes per second each client reads. 0 means as fast as possible.
+	Rate     int64
+	SlowRate int64
+
+	// How long to run.
+	Duration time.Duration
+
+	// Time between starting each client.
+	RampUp time.Duration
+}
+
+// loadTestResult is what happened to one client.
+type loadTestResult struct {
+	slow bool
+
+	// Status is 0 if we did not get a response.
+	status int
+	err    error
+
+	// Time until the first byte of the body.
+	firstByte time.Duration
+
+	bytes int64
+
+	// Whether the server ended the stream before we were done.
+	disconnected bool
+	elapsed      time.Duration
+}
+
+// How long past the deadline a client may take before we give up on it.
+const loadTestGrace = 10 * time.Second
+
+// runLoadTest runs the loadtest subcommand. It connects many clients to a
+// stream and reports how the server treated them. For example, it shows
+// whether slow clients get dropped while others are unaffected.
+func runLoadTest(arguments []string) error {
+	args, err := getLoadTestArgs(arguments)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Starting %d clients (%d slow) for %s", args.Clients,
+		args.SlowClients, args.Duration)
+
+	// Clients stop at the deadline. The timeout is in case one doesn't.
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: args.Clients},
+		Timeout:   args.Duration + loadTestGrace,
+	}
+
+	results := make([]loadTestResult, args.Clients)
+	deadline := time.Now().Add(args.Duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < args.Clients; i++ {
+		slow := i < args.SlowClients
+		rate := args.Rate
+		if slow {
+			rate = args.SlowRate
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = loadTestClient(client, args.URL, rate, deadline)
+			results[i].slow = slow
+		}(i)
+
+		time.Sleep(args.RampUp)
+	}
+
+	wg.Wait()
+
+	reportLoadTest(os.Stdout, results, args.Duration)
+	return nil
+}
+
+func getLoadTestArgs(arguments []string) (LoadTestArgs, error) {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+
+	url := fs.String("url", "", "URL of the stream to test, such as http://127.0.0.1:8080/stream.")
+	clients := fs.Int("clients", 10, "Number of clients to run.")
+	slowClients := fs.Int("slow-clients", 0, "Number of the clients that read at -slow-rate rather than -rate.")
+	rate := fs.Int64("rate", 0, "Bytes per second each client reads. 0 means as fast as possible.")
+	slowRate := fs.Int64("slow-rate", 1024, "Bytes per second slow clients read.")
+	duration := fs.Duration("duration", 30*time.Second, "How long to run the test.")
+	rampUp := fs.Duration("ramp-up", 10*time.Millisecond, "Time to wait between starting each client.")
+
+	if err := fs.Parse(arguments); err != nil {
+		return LoadTestArgs{}, err
+	}
+
+	if len(*url) == 0 {
+		fs.PrintDefaults()
+		return LoadTestArgs{}, fmt.Errorf("you must provide a URL")
+	}
+
+	if *clients <= 0 {
+		fs.PrintDefaults()
+		return LoadTestArgs{}, fmt.Errorf("you must run at least one client")
+	}
+
+	if *slowClients < 0 || *slowClients > *clients {
+		fs.PrintDefaults()
+		return LoadTestArgs{}, fmt.Errorf("slow clients must be between 0 and the number of clients")
+	}
+
+	if *rate < 0 || *slowRate <= 0 {
+		fs.PrintDefaults()
+		return LoadTestArgs{}, fmt.Errorf("invalid rate")
+	}
+
+	return LoadTestArgs{
+		URL:         *url,
+		Clients:     *clients,
+		SlowClients: *slowClients,
+		Rate:        *rate,
+		SlowRate:    *slowRate,
+		Duration:    *duration,
+		RampUp:      *rampUp,
+	}, nil
+}
+
+// loadTestClient streams from the URL until the deadline, reading at most rate
+// bytes per second. The deadline applies to connecting and to each read, so a
+// server that stops responding doesn't hold us past it.
+func loadTestClient(client *http.Client, url string, rate int64,
+	deadline time.Time) loadTestResult {
+	start := time.Now()
+	result := loadTestResult{}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		result.err = err
+		result.elapsed = time.Since(start)
+		return result
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	result.status = resp.StatusCode
+
+	buf := make([]byte, 4096)
+	if rate > 0 && rate < int64(len(buf)) {
+		buf = buf[:rate]
+	}
+
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 && result.bytes == 0 {
+			result.firstByte = time.Since(start)
+		}
+		result.bytes += int64(n)
+
+		if err != nil {
+			// Reaching the deadline ends the read. That's how we're meant to stop.
+			if ctx.Err() != nil {
+				break
+			}
+			if err == io.EOF {
+				result.disconnected = true
+			} else {
+				result.err = err
+			}
+			break
+		}
+
+		// Sleep until we are back under the rate, or the deadline.
+		if rate > 0 {
+			wanted := time.Duration(result.bytes * int64(time.Second) / rate)
+			if ahead := wanted - time.Since(start); ahead > 0 {
+				select {
+				case <-time.After(ahead):
+				case <-ctx.Done():
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	result.elapsed = time.Since(start)
+	return result
+}
+
+// reportLoadTest summarizes the results for normal and slow clients
+// separately.
+func reportLoadTest(w io.Writer, results []loadTestResult,
+	duration time.Duration) {
+	for _, slow := range []bool{false, true} {
+		group := []loadTestResult{}
+		for _, result := range results {
+			if result.slow == slow {
+				group = append(group, result)
+			}
+		}
+
+		if len(group) == 0 {
+			continue
+		}
+
+		name := "Clients"
+		if slow {
+			name = "Slow clients"
+		}
+
+		statuses := map[int]int{}
+		errors := 0
+		disconnected := 0
+		bytes := int64(0)
+		firstBytes := []time.Duration{}
+		for _, result := range group {
+			statuses[result.status]++
+			if result.err != nil {
+				errors++
+			}
+			if result.disconnected {
+				disconnected++
+			}
+			bytes += result.bytes
+			if result.bytes > 0 {
+				firstBytes = append(firstBytes, result.firstByte)
+			}
+		}
+
+		_, _ = fmt.Fprintf(w, "%s: %d\n", name, len(group))
+
+		codes := []int{}
+		for status := range statuses {
+			codes = append(codes, status)
+		}
+		sort.Ints(codes)
+		for _, status := range codes {
+			if status == 0 {
+				_, _ = fmt.Fprintf(w, "  No response: %d\n", statuses[status])
+				continue
+			}
+			_, _ = fmt.Fprintf(w, "  Status %d: %d\n", status, statuses[status])
+		}
+
+		_, _ = fmt.Fprintf(w, "  Disconnected by server early: %d\n", disconnected)
+		_, _ = fmt.Fprintf(w, "  Errors: %d\n", errors)
+		_, _ = fmt.Fprintf(w, "  Received: %d bytes (%.0f bytes/second per client)\n",
+			bytes, float64(bytes)/float64(len(group))/duration.Seconds())
+
+		if len(firstBytes) > 0 {
+			sort.Slice(firstBytes, func(i, j int) bool {
+				return firstBytes[i] < firstBytes[j]
+			})
+			_, _ = fmt.Fprintf(w, "  Time to first byte: median %s, max %s\n",
+				firstBytes[len(firstBytes)/2], firstBytes[len(firstBytes)-1])
+		}
+	}
+
+	for _, result := range results {
+		if result.err != nil {
+			_, _ = fmt.Fprintf(w, "Example error: %s\n", result.err)
+			break
+		}
+	}
+}
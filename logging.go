@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// setupLogging sends our log output where we were asked to. By default it goes
+// to stderr.
+//
+// This covers our own logging. ffmpeg's libraries still write to stderr.
+func setupLogging(args Args) error {
+	if args.Syslog {
+		w, err := newSyslogWriter()
+		if err != nil {
+			return fmt.Errorf("unable to connect to syslog: %s", err)
+		}
+
+		// syslog adds its own timestamps.
+		log.SetFlags(0)
+		log.SetOutput(w)
+		return nil
+	}
+
+	if args.LogFile != "" {
+		w, err := newRotatingFile(args.LogFile, args.LogMaxSize, args.LogMaxFiles)
+		if err != nil {
+			return err
+		}
+
+		log.SetOutput(w)
+	}
+
+	return nil
+}
+
+// rotatingFile is a log file we rotate when it gets too big. We rename the file
+// to <path>.1, the old <path>.1 to <path>.2, and so on, keeping a limited
+// number.
+type rotatingFile struct {
+	mutex *sync.Mutex
+
+	path string
+
+	// Rotate once the file is this many bytes.
+	maxSize int64
+
+	// How many rotated files to keep.
+	maxFiles int
+
+	// The file we're writing to. nil if we couldn't open it, in which case we
+	// write to stderr until we can.
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64,
+	maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		mutex:    &sync.Mutex{},
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	if err := r.reopen(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func openLogFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to open log file: %s", err)
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, 0, fmt.Errorf("unable to stat log file: %s", err)
+	}
+
+	return file, fi.Size(), nil
+}
+
+func (r *rotatingFile) Write(buf []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		if err := r.reopen(); err != nil {
+			return os.Stderr.Write(buf)
+		}
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Unable to rotate log file: %s\n", err)
+			if r.file == nil {
+				return os.Stderr.Write(buf)
+			}
+		}
+	}
+
+	n, err := r.file.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log file aside and starts a new one. We keep writing to the
+// file we have until the new one is open. If we can't open it, we keep the
+// file we have, if we still can. Better too big than nothing.
+func (r *rotatingFile) rotate() error {
+	if r.maxFiles > 0 {
+		for i := r.maxFiles - 1; i > 0; i-- {
+			_ = os.Rename(r.path+"."+strconv.Itoa(i),
+				r.path+"."+strconv.Itoa(i+1))
+		}
+	}
+
+	// Windows won't move a file that's open, so failing that, close it and try
+	// again.
+	if err := r.moveAside(); err != nil {
+		if err := r.file.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Unable to close log file: %s\n", err)
+		}
+		r.file = nil
+
+		if err := r.moveAside(); err != nil {
+			// Carry on with the file as it is.
+			if err2 := r.reopen(); err2 != nil {
+				return fmt.Errorf("%s, and %s", err, err2)
+			}
+			return err
+		}
+	}
+
+	file, size, err := openLogFile(r.path)
+	if err != nil {
+		// We still have the file we moved aside, if we didn't have to close it.
+		// Fill it up again before trying again.
+		r.size = 0
+		return err
+	}
+
+	if r.file != nil {
+		_ = r.file.Close()
+	}
+	r.file = file
+	r.size = size
+	return nil
+}
+
+// moveAside renames the log file to <path>.1, or removes it if we keep no
+// rotated files.
+func (r *rotatingFile) moveAside() error {
+	if r.maxFiles > 0 {
+		return os.Rename(r.path, r.path+".1")
+	}
+	return os.Remove(r.path)
+}
+
+// reopen opens the log file, such as after we had to close it.
+func (r *rotatingFile) reopen() error {
+	file, size, err := openLogFile(r.path)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.size = size
+	return nil
+}
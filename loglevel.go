@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// logLevel is how important a log message is.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logger logs for one part of the daemon. Each part has its own level, so you
+// can get detailed logs from one without noise from the others.
+type logger struct {
+	subsystem string
+	level     logLevel
+}
+
+// Our subsystems. libav's level controls the logging of the ffmpeg libraries
+// and our C code.
+var (
+	httpLog    = &logger{subsystem: "http", level: levelInfo}
+	encoderLog = &logger{subsystem: "encoder", level: levelInfo}
+	libavLog   = &logger{subsystem: "libav", level: levelInfo}
+	serverLog  = &logger{subsystem: "server", level: levelInfo}
+)
+
+var loggers = []*logger{httpLog, encoderLog, libavLog, serverLog}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return 0, fmt.Errorf("invalid log level: %s", s)
+	}
+}
+
+// setLogLevels sets every subsystem's level, then applies overrides such as
+// "http=warn,encoder=debug". Call it before starting to log.
+func setLogLevels(level string, overrides string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	for _, logger := range loggers {
+		logger.level = l
+	}
+
+	if len(strings.TrimSpace(overrides)) == 0 {
+		return nil
+	}
+
+	for _, override := range strings.Split(overrides, ",") {
+		pieces := strings.SplitN(strings.TrimSpace(override), "=", 2)
+		if len(pieces) != 2 {
+			return fmt.Errorf("invalid log level override: %s", override)
+		}
+
+		l, err := parseLogLevel(pieces[1])
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, logger := range loggers {
+			if logger.subsystem == pieces[0] {
+				logger.level = l
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("unknown log subsystem: %s", pieces[0])
+		}
+	}
+
+	return nil
+}
+
+func (l *logger) enabled(level logLevel) bool {
+	return level >= l.level
+}
+
+func (l *logger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+func (l *logger) logf(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+
+	if level >= levelWarn && logRepeats.suppress(message) {
+		return
+	}
+
+	log.Print(message)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// When something is persistently broken, such as a camera being down, we log
+// the same failure over and over. To keep other messages visible, we log a
+// warning or error the first time, then count repeats of it for a while rather
+// than logging them. Afterwards we log how many times it repeated.
+type repeatedLogs struct {
+	mutex *sync.Mutex
+
+	// How long we suppress repeats of a message. 0 means we don't.
+	interval time.Duration
+
+	messages map[string]*repeatedLog
+	started  bool
+}
+
+// repeatedLog is a message we logged recently.
+type repeatedLog struct {
+	logged time.Time
+
+	// Times we didn't log it since.
+	count int
+}
+
+var logRepeats = &repeatedLogs{
+	mutex:    &sync.Mutex{},
+	interval: time.Minute,
+	messages: map[string]*repeatedLog{},
+}
+
+// suppress decides whether to skip logging the message because we logged it
+// recently.
+func (r *repeatedLogs) suppress(message string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.interval <= 0 {
+		return false
+	}
+
+	if !r.started {
+		r.started = true
+		go r.summarize()
+	}
+
+	if m, ok := r.messages[message]; ok {
+		m.count++
+		return true
+	}
+
+	r.messages[message] = &repeatedLog{logged: time.Now()}
+	return false
+}
+
+// summarize periodically logs how many times messages repeated once we are no
+// longer suppressing them.
+func (r *repeatedLogs) summarize() {
+	ticker := time.NewTicker(r.interval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mutex.Lock()
+		for message, m := range r.messages {
+			if time.Since(m.logged) < r.interval {
+				continue
+			}
+
+			if m.count > 0 {
+				log.Printf("%s (repeated %d times in %s)", message, m.count,
+					time.Since(m.logged).Round(time.Second))
+			}
+			delete(r.messages, message)
+		}
+		r.mutex.Unlock()
+	}
+}
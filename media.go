@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Media opens inputs to read packets from.
+//
+// Normally this is libavMedia which uses the C library. Building with the
+// nolibav tag uses fakeMedia instead. It generates packets itself, so the
+// encoder and client logic can be exercised without libav.
+type Media interface {
+	// OpenInput opens an input. options are the input format's, such as a
+	// capture device's video_size, and may be nil. If opening takes longer
+	// than timeout, it gives up with errInputTimeout. A timeout of 0 means it
+	// may take as long as it needs.
+	OpenInput(format, url string, options map[string]string,
+		timeout time.Duration, verbose bool) (MediaInput, error)
+
+	// Faststart remuxes the MP4 file in into a regular MP4 file out with its
+	// index at the front, so players fetching it over HTTP can start and seek
+	// right away.
+	Faststart(in, out string, verbose bool) error
+
+	// Timelapse encodes a numbered sequence of JPEGs, such as dir/%06d.jpg
+	// numbered from 1, into an MP4 file with a frame for each at fps frames a
+	// second.
+	Timelapse(pattern, out string, fps int, verbose bool) error
+}
+
+// MediaInput is an open input.
+type MediaInput interface {
+	// ReadPacket reads the next packet. It returns nil without an error if it
+	// read a packet we skip, such as one not from the video or audio stream.
+	// It fails if reading takes longer than timeout, unless timeout is 0.
+	ReadPacket(timeout time.Duration, verbose bool) (*Packet, error)
+
+	// Next moves the input on to another file, or to the start of the same one
+	// again, such as after ReadPacket returned errEndOfInput. We read it as if
+	// it followed on from what we read so far, so outputs opened from the input
+	// carry on. The file must have the same video codec. An empty format means
+	// to guess it.
+	Next(format, url string, timeout time.Duration, verbose bool) error
+
+	// SetAudioOffset shifts the timestamps of audio packets read from now on,
+	// to cancel drift between the audio and video clocks.
+	SetAudioOffset(offset time.Duration)
+
+	// Interrupt makes a blocked ReadPacket give up. Reads fail from then on.
+	// Unlike the other methods, another goroutine may call this while the
+	// input is in use.
+	Interrupt()
+
+	// CodecParameters describes the video stream's codec, or the audio
+	// stream's if audio is set. It returns false if there is no such stream.
+	CodecParameters(audio bool) (CodecParameters, bool)
+
+	// AudioFormat decides the format for an output with just the input's audio.
+	// It fails if there is no audio, or if we can't serve it alone.
+	AudioFormat() (OutputFormat, error)
+
+	// OpenOutput opens an output remuxing packets from this input into the
+	// given format. It writes to w, starting with the header.
+	OpenOutput(w io.Writer, format OutputFormat,
+		verbose bool) (MediaOutput, error)
+
+	// OpenURLOutput is like OpenOutput, but libav writes to the URL itself,
+	// such as to rtp://239.0.0.1:5004.
+	OpenURLOutput(url string, format OutputFormat,
+		verbose bool) (MediaOutput, error)
+
+	// OpenDecoder opens a decoder for the input's video stream, or for its
+	// audio stream if audio is set.
+	OpenDecoder(audio, verbose bool) (MediaDecoder, error)
+
+	// Close closes the input. Outputs opened from it fail from then on.
+	Close()
+}
+
+// MediaDecoder decodes packets from one of an input's streams. We decode to
+// analyse the picture or sound, never to re-encode what we serve.
+type MediaDecoder interface {
+	// Decode sends a packet to the decoder. Afterwards, call ReceiveFrame until
+	// it returns false. Undecodable packets are skipped rather than failing.
+	Decode(p *Packet, verbose bool) error
+
+	// ReceiveFrame decodes the next frame. It returns false if the decoder
+	// needs another packet first.
+	ReceiveFrame(verbose bool) (bool, error)
+
+	// Luma scales the brightness of the last video frame down to width by
+	// height, one byte per pixel, row by row.
+	Luma(width, height int) ([]byte, error)
+
+	// JPEG encodes the last video frame as a JPEG. If maxWidth is positive and
+	// the frame is wider, it is scaled down to that width.
+	JPEG(maxWidth int, verbose bool) ([]byte, error)
+
+	// SetMasks blacks out the regions in the pictures Luma and JPEG give from
+	// now on, such as for privacy.
+	SetMasks(masks []Region)
+
+	// SetOrientation turns and mirrors the pictures Luma and JPEG give from now
+	// on. Luma and JPEG's sizes are of the picture as turned.
+	SetOrientation(o Orientation)
+
+	// SetDewarp takes a flat view through the fisheye lens for the pictures
+	// Luma and JPEG give from now on, before turning them. nil means not to.
+	SetDewarp(dewarp *Dewarp)
+
+	// Level measures how loud the last audio frame is: the root mean square of
+	// its samples, as a fraction of full scale.
+	Level() (float64, error)
+
+	Close()
+}
+
+// MediaOutput is an open output.
+type MediaOutput interface {
+	WritePackets(packets []*Packet, verbose bool) error
+
+	// Interrupt makes a blocked WritePackets give up, like
+	// MediaInput.Interrupt. This only helps URL outputs. For others, it is
+	// writing to the io.Writer that blocks.
+	Interrupt()
+
+	// Close finishes the output by writing its trailer, and frees it.
+	Close()
+}
+
+// OutputFormat is a format we remux into.
+type OutputFormat struct {
+	// The libav muxer, such as mp4.
+	Muxer string
+
+	ContentType string
+
+	// Whether the output has the input's audio rather than its video.
+	Audio bool
+
+	// Whether a video output has the input's audio as well. Only for outputs we
+	// write through an io.Writer.
+	WithAudio bool
+
+	// Whether the output is made of CMAF chunks. Only for mp4.
+	CMAF bool
+
+	// Forward error correction for RTP URL outputs, such as prompeg=l=5:d=20.
+	FEC string
+
+	Options OutputOptions
+}
+
+// OutputOptions tune an output we write through an io.Writer.
+type OutputOptions struct {
+	// Cut MP4 fragments at least this often, between keyframes too. 0 means
+	// only at keyframes.
+	FragmentDuration time.Duration
+
+	// Let libav buffer what it writes rather than writing out each packet as
+	// soon as it is muxed. This makes for fewer, bigger writes, at the cost of
+	// latency.
+	Buffered bool
+
+	// Write packets through libav's interleaving queue, holding each at most
+	// this long. 0 means write each packet as it arrives.
+	MaxInterleaveDelta time.Duration
+
+	// How players should turn and mirror the video, for muxers that can tell
+	// them.
+	Orientation Orientation
+
+	// Add a silent AAC track to a video output without the input's audio, for
+	// players that won't play video alone.
+	SilentAudio bool
+}
+
+// videoFormat is how we serve video.
+var videoFormat = OutputFormat{Muxer: "mp4", ContentType: "video/mp4"}
+
+// cmafFormat is how we remux video we cut into segments.
+var cmafFormat = OutputFormat{Muxer: "mp4", ContentType: "video/mp4",
+	CMAF: true}
+
+// rtpFormat is how we send video over RTP.
+var rtpFormat = OutputFormat{Muxer: "rtp_mpegts", ContentType: "video/MP2T"}
+
+// audioContentTypes maps muxers we serve audio alone in to their content
+// types.
+var audioContentTypes = map[string]string{
+	"adts": "audio/aac",
+	"ogg":  "audio/ogg",
+	"mp3":  "audio/mpeg",
+}
+
+// errEndOfInput is what ReadPacket returns at the end of an input, such as of
+// a file.
+var errEndOfInput = errors.New("end of input")
+
+// noTime is a packet's time when we don't know it. It is the same value as
+// AV_NOPTS_VALUE.
+const noTime = math.MinInt64
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// StreamStats holds counters about a stream. Access them atomically.
+type StreamStats struct {
+	// Packets and bytes we read from the input.
+	PacketsRead uint64
+	BytesRead   uint64
+
+	// Bytes we sent to clients.
+	BytesSent uint64
+
+	// Packets we could not give to a client because its queue was full.
+	PacketsDropped uint64
+
+	// Packets from the input we dropped as broken.
+	PacketsDiscarded uint64
+
+	// Clients we disconnected because they fell too far behind.
+	ClientsDroppedSlow uint64
+
+	// Times we shifted a client that fell too far behind to a lower bitrate
+	// rather than disconnect it.
+	ClientsShifted uint64
+
+	// The most packets we have seen queued for a single client.
+	QueueHighWater uint64
+
+	// As of the last packet, how far behind live the furthest behind client is
+	// (in microseconds), and how many bytes are queued for all clients.
+	MaxClientLag int64
+	QueuedBytes  int64
+
+	// How far ahead of the video the input's audio clock drifted, and how far
+	// we shifted the audio to cancel it (in microseconds).
+	AVDrift           int64
+	AVDriftCorrection int64
+
+	// When the encoder last read a packet from the input, and last handed one
+	// out to clients (in Unix nanoseconds).
+	LastRead   int64
+	LastFanOut int64
+
+	// The input's bitrate in kbit/s, as last measured. It stays once the input
+	// closes.
+	InputKbps int64
+
+	// Clients that took longer than slowJoin to start.
+	SlowJoins uint64
+
+	// Clients that resumed their session, live or from the DVR window.
+	SessionsResumedLive uint64
+	SessionsResumedDVR  uint64
+}
+
+// observeQueue records a client's queue length if it is a new high-water
+// mark.
+func (s *StreamStats) observeQueue(n int) {
+	for {
+		old := atomic.LoadUint64(&s.QueueHighWater)
+		if uint64(n) <= old {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&s.QueueHighWater, old, uint64(n)) {
+			return
+		}
+	}
+}
+
+// metricsRequest responds with metrics in the Prometheus text format.
+func (h HTTPHandler) metricsRequest(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(rw, h.Streams.All(), h.Streams.limits)
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(*Stream) float64
+}
+
+var metrics = []metric{
+	{
+		name: "videostreamer_clients",
+		help: "Clients currently connected.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadInt32(&s.clients))
+		},
+	},
+	{
+		name: "videostreamer_packets_read_total",
+		help: "Packets read from the input.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.PacketsRead))
+		},
+	},
+	{
+		name: "videostreamer_input_bytes_total",
+		help: "Bytes of packets read from the input.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.BytesRead))
+		},
+	},
+	{
+		name: "videostreamer_sent_bytes_total",
+		help: "Bytes sent to clients.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.BytesSent))
+		},
+	},
+	{
+		name: "videostreamer_packets_dropped_total",
+		help: "Packets not given to a client because its queue was full.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.PacketsDropped))
+		},
+	},
+	{
+		name: "videostreamer_packets_discarded_total",
+		help: "Packets from the input dropped as broken.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.PacketsDiscarded))
+		},
+	},
+	{
+		name: "videostreamer_clients_dropped_slow_total",
+		help: "Clients disconnected because they fell too far behind.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.ClientsDroppedSlow))
+		},
+	},
+	{
+		name: "videostreamer_clients_shifted_total",
+		help: "Times a client that fell too far behind was shifted to a lower bitrate rather than disconnected.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.ClientsShifted))
+		},
+	},
+	{
+		name: "videostreamer_client_queue_high_water_packets",
+		help: "The most packets seen queued for a single client.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.QueueHighWater))
+		},
+	},
+	{
+		name: "videostreamer_client_lag_seconds_max",
+		help: "How far behind live the furthest behind client is.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadInt64(&s.stats.MaxClientLag)) / 1e6
+		},
+	},
+	{
+		name: "videostreamer_client_queued_bytes",
+		help: "Bytes queued for all clients.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadInt64(&s.stats.QueuedBytes))
+		},
+	},
+	{
+		name: "videostreamer_av_drift_seconds",
+		help: "How far ahead of the video the input's audio clock drifted.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadInt64(&s.stats.AVDrift)) / 1e6
+		},
+	},
+	{
+		name: "videostreamer_av_drift_correction_seconds",
+		help: "How far the audio was shifted to cancel drift.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadInt64(&s.stats.AVDriftCorrection)) / 1e6
+		},
+	},
+	{
+		name: "videostreamer_slow_joins_total",
+		help: "Clients that took longer than -slow-join to start.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.SlowJoins))
+		},
+	},
+	{
+		name: "videostreamer_sessions_resumed_live_total",
+		help: "Clients that resumed their session live.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.SessionsResumedLive))
+		},
+	},
+	{
+		name: "videostreamer_sessions_resumed_dvr_total",
+		help: "Clients that resumed their session from the DVR window.",
+		kind: "counter",
+		value: func(s *Stream) float64 {
+			return float64(atomic.LoadUint64(&s.stats.SessionsResumedDVR))
+		},
+	},
+	{
+		name: "videostreamer_client_queue_capacity_packets",
+		help: "How many packets may be queued for a client before it is dropped.",
+		kind: "gauge",
+		value: func(s *Stream) float64 {
+			return float64(clientQueueSize)
+		},
+	},
+}
+
+// writeMetrics writes each stream's metrics, then those not about any one
+// stream.
+func writeMetrics(w io.Writer, streams []*Stream, limits QueueLimits) {
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, stream := range streams {
+			_, _ = fmt.Fprintf(w, "%s{stream=%q} %g\n", m.name,
+				stream.Definition().Name, m.value(stream))
+		}
+	}
+
+	writeJoinMetrics(w, streams)
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_queued_packet_bytes Bytes of packets held for clients.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_queued_packet_bytes gauge\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_queued_packet_bytes %d\n",
+		atomic.LoadInt64(&livePacketBytes))
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_queued_packet_bytes_limit The most bytes of packets that may be held for clients. 0 means no limit.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_queued_packet_bytes_limit gauge\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_queued_packet_bytes_limit %d\n",
+		limits.TotalBytes)
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_transcode_workers How many JPEG encodes may run at once.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_transcode_workers gauge\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_transcode_workers %d\n",
+		cap(transcodes.slots))
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_transcodes_queued JPEG encodes waiting for a worker.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_transcodes_queued gauge\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_transcodes_queued %d\n",
+		atomic.LoadInt64(&transcodes.queued))
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_transcodes_total JPEG encodes run.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_transcodes_total counter\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_transcodes_total %d\n",
+		atomic.LoadUint64(&transcodes.done))
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_transcodes_shed_total JPEG encodes skipped because no worker was free in time or we were over the CPU budget.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_transcodes_shed_total counter\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_transcodes_shed_total %d\n",
+		atomic.LoadUint64(&transcodes.shed))
+
+	_, _ = fmt.Fprintf(w, "# HELP videostreamer_transcode_seconds_total Time spent encoding JPEGs.\n")
+	_, _ = fmt.Fprintf(w, "# TYPE videostreamer_transcode_seconds_total counter\n")
+	_, _ = fmt.Fprintf(w, "videostreamer_transcode_seconds_total %g\n",
+		time.Duration(atomic.LoadInt64(&transcodes.busy)).Seconds())
+}
+
+// All returns all streams, sorted by name.
+func (s *Streams) All() []*Stream {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Definition().Name < streams[j].Definition().Name
+	})
+
+	return streams
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"time"
+)
+
+// We detect motion by decoding the video and comparing each picture with the
+// one before it, both scaled down to a small grid. Scaling down averages away
+// most noise. Motion is when enough of the grid changes.
+
+const (
+	// How often we compare pictures. We still decode every frame.
+	motionInterval = 250 * time.Millisecond
+
+	// The grid we scale pictures down to.
+	motionGridWidth  = 64
+	motionGridHeight = 36
+
+	// How much a cell's brightness must change (out of 255) for it to count as
+	// changed.
+	motionCellThreshold = 20
+
+	// The fraction of cells that must change to count as motion, unless the
+	// stream's definition says otherwise.
+	defaultMotionThreshold = 0.02
+
+	// How long there must be no motion before a motion event ends.
+	motionHold = 5 * time.Second
+)
+
+// MotionEvent describes motion_start and motion_end events.
+type MotionEvent struct {
+	// The fraction of the picture that changed. For motion_end, the most that
+	// changed at once during the event.
+	Score float64 `json:"score"`
+
+	// Where the picture changed. For motion_end, everywhere that changed
+	// during the event.
+	Region Region `json:"region"`
+
+	// For motion_end, how long the event lasted, in seconds.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// Region is a rectangle in the picture. Its coordinates are fractions of the
+// picture's width and height, from its top left corner.
+type Region struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// motionDetector tracks motion in a stream's pictures.
+type motionDetector struct {
+	stream string
+
+	threshold float64
+
+	// The picture we last compared, and when.
+	previous     []byte
+	lastCompared time.Time
+
+	// The motion event in progress, if any.
+	active     bool
+	started    time.Time
+	lastMotion time.Time
+	peak       float64
+	region     Region
+}
+
+func newMotionDetector(def StreamDefinition) *motionDetector {
+	threshold := def.MotionThreshold
+	if threshold == 0 {
+		threshold = defaultMotionThreshold
+	}
+
+	return &motionDetector{stream: def.Name, threshold: threshold}
+}
+
+func (d *motionDetector) frame(decoder MediaDecoder, now time.Time) error {
+	if now.Sub(d.lastCompared) < motionInterval {
+		return nil
+	}
+	d.lastCompared = now
+
+	picture, err := decoder.Luma(motionGridWidth, motionGridHeight)
+	if err != nil {
+		return err
+	}
+
+	d.compare(picture, now)
+	return nil
+}
+
+// stop ends any motion event. If the input went away, so did the motion.
+func (d *motionDetector) stop(now time.Time) {
+	d.end(now)
+}
+
+// compare compares the picture with the previous one, starting or ending a
+// motion event if need be.
+func (d *motionDetector) compare(picture []byte, now time.Time) {
+	previous := d.previous
+	d.previous = picture
+	if previous == nil {
+		return
+	}
+
+	score, region, ok := changedRegion(previous, picture)
+
+	if ok && score >= d.threshold {
+		d.lastMotion = now
+
+		if !d.active {
+			d.active = true
+			d.started = now
+			d.peak = score
+			d.region = region
+
+			motionLog(d.stream, "started", score)
+			events.publish(Event{
+				Type:   "motion_start",
+				Stream: d.stream,
+				Time:   now,
+				Motion: &MotionEvent{Score: score, Region: region},
+			})
+			return
+		}
+
+		if score > d.peak {
+			d.peak = score
+		}
+		d.region = d.region.union(region)
+		return
+	}
+
+	if d.active && now.Sub(d.lastMotion) >= motionHold {
+		d.end(now)
+	}
+}
+
+// end ends the motion event in progress, if there is one.
+func (d *motionDetector) end(now time.Time) {
+	if !d.active {
+		return
+	}
+	d.active = false
+
+	motionLog(d.stream, "ended", d.peak)
+	events.publish(Event{
+		Type:   "motion_end",
+		Stream: d.stream,
+		Time:   now,
+		Motion: &MotionEvent{
+			Score:    d.peak,
+			Region:   d.region,
+			Duration: now.Sub(d.started).Seconds(),
+		},
+	})
+}
+
+func motionLog(stream, what string, score float64) {
+	encoderLog.Infof("motion: %s: Motion %s (score %.3f)", stream, what, score)
+}
+
+// changedRegion finds the cells that changed between two pictures. It returns
+// the fraction that changed and the region around them, or false if none did.
+//
+// A cell only counts if a neighbouring cell changed too. Real motion covers
+// more than one cell, while noise and compression artifacts tend not to.
+func changedRegion(previous, picture []byte) (float64, Region, bool) {
+	changed := make([]bool, len(picture))
+	for i := range picture {
+		diff := int(picture[i]) - int(previous[i])
+		changed[i] = diff > motionCellThreshold || diff < -motionCellThreshold
+	}
+
+	count := 0
+	left, top := motionGridWidth, motionGridHeight
+	right, bottom := -1, -1
+
+	for y := 0; y < motionGridHeight; y++ {
+		for x := 0; x < motionGridWidth; x++ {
+			i := y*motionGridWidth + x
+			if !changed[i] {
+				continue
+			}
+
+			if !(x > 0 && changed[i-1] ||
+				x < motionGridWidth-1 && changed[i+1] ||
+				y > 0 && changed[i-motionGridWidth] ||
+				y < motionGridHeight-1 && changed[i+motionGridWidth]) {
+				continue
+			}
+
+			count++
+			if x < left {
+				left = x
+			}
+			if x > right {
+				right = x
+			}
+			if y < top {
+				top = y
+			}
+			if y > bottom {
+				bottom = y
+			}
+		}
+	}
+
+	if count == 0 {
+		return 0, Region{}, false
+	}
+
+	return float64(count) / float64(len(picture)), Region{
+		X:      float64(left) / motionGridWidth,
+		Y:      float64(top) / motionGridHeight,
+		Width:  float64(right-left+1) / motionGridWidth,
+		Height: float64(bottom-top+1) / motionGridHeight,
+	}, true
+}
+
+// union is the smallest region covering both regions.
+func (r Region) union(o Region) Region {
+	left, top := r.X, r.Y
+	right, bottom := r.X+r.Width, r.Y+r.Height
+
+	if o.X < left {
+		left = o.X
+	}
+	if o.Y < top {
+		top = o.Y
+	}
+	if o.X+o.Width > right {
+		right = o.X + o.Width
+	}
+	if o.Y+o.Height > bottom {
+		bottom = o.Y + o.Height
+	}
+
+	return Region{X: left, Y: top, Width: right - left, Height: bottom - top}
+}
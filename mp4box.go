@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// We parse just enough of the fragmented MP4s we produce to cut them into
+// segments. See ISO/IEC 14496-12 for the box layouts.
+
+// box is an MP4 box. data is its body, after the header.
+type box struct {
+	kind string
+	data []byte
+}
+
+// readBox reads the box at the start of buf. It returns how many bytes the box
+// takes up, or 0 if buf does not hold all of it yet.
+func readBox(buf []byte) (box, int) {
+	if len(buf) < 8 {
+		return box{}, 0
+	}
+
+	size := uint64(binary.BigEndian.Uint32(buf))
+	kind := string(buf[4:8])
+	headerSize := uint64(8)
+
+	if size == 1 {
+		if len(buf) < 16 {
+			return box{}, 0
+		}
+		size = binary.BigEndian.Uint64(buf[8:])
+		headerSize = 16
+	}
+
+	// Size 0 means the box extends to the end of the file. We never write such
+	// boxes while streaming, so treat it as incomplete.
+	if size < headerSize || size > uint64(len(buf)) {
+		return box{}, 0
+	}
+
+	return box{kind: kind, data: buf[headerSize:size]}, int(size)
+}
+
+// children parses the boxes inside a container box.
+func (b box) children() []box {
+	boxes := []box{}
+
+	buf := b.data
+	for {
+		child, n := readBox(buf)
+		if n == 0 {
+			return boxes
+		}
+		boxes = append(boxes, child)
+		buf = buf[n:]
+	}
+}
+
+// child finds the first child box of the given kind, following a path such as
+// "trak", "mdia", "mdhd".
+func (b box) child(path ...string) (box, bool) {
+	for _, kind := range path {
+		found := false
+		for _, child := range b.children() {
+			if child.kind == kind {
+				b = child
+				found = true
+				break
+			}
+		}
+		if !found {
+			return box{}, false
+		}
+	}
+
+	return b, true
+}
+
+// fullBoxFlags returns the flags of a full box (one with a version and flags).
+func (b box) fullBoxFlags() uint32 {
+	if len(b.data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b.data) & 0xffffff
+}
+
+// Bit in sample flags meaning the sample is not a sync sample (keyframe).
+const sampleIsNonSync = 0x10000
+
+// trackDefaults holds the trex defaults for the track, from the moov.
+type trackDefaults struct {
+	// Units per second of the track's times.
+	timescale uint32
+
+	sampleDuration uint32
+	sampleFlags    uint32
+}
+
+// parseMoov finds the track's defaults. We only produce single track files.
+func parseMoov(moov box) trackDefaults {
+	defaults := trackDefaults{}
+
+	if mdhd, ok := moov.child("trak", "mdia", "mdhd"); ok && len(mdhd.data) >= 4 {
+		if mdhd.data[0] == 1 {
+			if len(mdhd.data) >= 24 {
+				defaults.timescale = binary.BigEndian.Uint32(mdhd.data[20:])
+			}
+		} else if len(mdhd.data) >= 16 {
+			defaults.timescale = binary.BigEndian.Uint32(mdhd.data[12:])
+		}
+	}
+
+	// version/flags, track_ID, default_sample_description_index,
+	// default_sample_duration, default_sample_size, default_sample_flags.
+	if trex, ok := moov.child("mvex", "trex"); ok && len(trex.data) >= 24 {
+		defaults.sampleDuration = binary.BigEndian.Uint32(trex.data[12:])
+		defaults.sampleFlags = binary.BigEndian.Uint32(trex.data[20:])
+	}
+
+	return defaults
+}
+
+// fragmentInfo is what we need to know about a fragment (a CMAF chunk).
+type fragmentInfo struct {
+	// Whether its first sample is a sync sample.
+	keyframe bool
+
+	// Its decode time and duration, in the track's timescale.
+	decodeTime uint64
+	duration   uint64
+}
+
+// parseMoof reads a moof box about a single track.
+func parseMoof(moof box, defaults trackDefaults) fragmentInfo {
+	info := fragmentInfo{}
+
+	traf, ok := moof.child("traf")
+	if !ok {
+		return info
+	}
+
+	sampleDuration := defaults.sampleDuration
+	sampleFlags := defaults.sampleFlags
+
+	if tfhd, ok := traf.child("tfhd"); ok {
+		flags := tfhd.fullBoxFlags()
+		// version/flags, track_ID, then optional fields by flag.
+		offset := 8
+		if flags&0x1 != 0 {
+			offset += 8
+		}
+		if flags&0x2 != 0 {
+			offset += 4
+		}
+		if flags&0x8 != 0 {
+			if len(tfhd.data) >= offset+4 {
+				sampleDuration = binary.BigEndian.Uint32(tfhd.data[offset:])
+			}
+			offset += 4
+		}
+		if flags&0x10 != 0 {
+			offset += 4
+		}
+		if flags&0x20 != 0 && len(tfhd.data) >= offset+4 {
+			sampleFlags = binary.BigEndian.Uint32(tfhd.data[offset:])
+		}
+	}
+
+	if tfdt, ok := traf.child("tfdt"); ok && len(tfdt.data) >= 8 {
+		if tfdt.data[0] == 1 {
+			if len(tfdt.data) >= 12 {
+				info.decodeTime = binary.BigEndian.Uint64(tfdt.data[4:])
+			}
+		} else {
+			info.decodeTime = uint64(binary.BigEndian.Uint32(tfdt.data[4:]))
+		}
+	}
+
+	firstFlags := sampleFlags
+	firstTrun := true
+
+	for _, trun := range traf.children() {
+		if trun.kind != "trun" || len(trun.data) < 8 {
+			continue
+		}
+
+		flags := trun.fullBoxFlags()
+		count := binary.BigEndian.Uint32(trun.data[4:])
+		offset := 8
+		if flags&0x1 != 0 {
+			offset += 4
+		}
+		firstInTrun := sampleFlags
+		if flags&0x4 != 0 {
+			if len(trun.data) >= offset+4 {
+				firstInTrun = binary.BigEndian.Uint32(trun.data[offset:])
+			}
+			offset += 4
+		}
+
+		sampleSize := 0
+		for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&bit != 0 {
+				sampleSize += 4
+			}
+		}
+
+		for i := uint32(0); i < count; i++ {
+			if len(trun.data) < offset+sampleSize {
+				break
+			}
+
+			field := offset
+			duration := sampleDuration
+			if flags&0x100 != 0 {
+				duration = binary.BigEndian.Uint32(trun.data[field:])
+				field += 4
+			}
+			if flags&0x200 != 0 {
+				field += 4
+			}
+			if i == 0 && flags&0x400 != 0 && flags&0x4 == 0 {
+				firstInTrun = binary.BigEndian.Uint32(trun.data[field:])
+			}
+
+			info.duration += uint64(duration)
+			offset += sampleSize
+		}
+
+		if firstTrun {
+			firstFlags = firstInTrun
+			firstTrun = false
+		}
+	}
+
+	info.keyframe = firstFlags&sampleIsNonSync == 0
+
+	return info
+}
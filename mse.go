@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// These endpoints serve a stream's segments for players using Media Source
+// Extensions (MSE). A player appends the initialization segment from
+// /init.mp4 and then media segments from /segments as they arrive. If it falls
+// behind, such as after its tab sleeps, it fetches /segments again and starts
+// over from the live edge.
+
+// How long we wait for the segmenter to produce something before giving up on
+// a request.
+const segmentWait = 10 * time.Second
+
+// initRequest responds with the initialization segment.
+func (h HTTPHandler) initRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream) {
+	def := stream.Definition()
+	if !def.Segments {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	if !h.allowedOrigin(rw, r, def) || h.refusePaused(rw, r, stream) ||
+		h.shedding(rw, r, def, false) {
+		return
+	}
+
+	viewing, ok := h.startViewing(rw, r)
+	if !ok {
+		return
+	}
+	defer func() {
+		viewing.end(time.Now())
+	}()
+
+	timeout := time.NewTimer(segmentWait)
+	defer timeout.Stop()
+
+	for {
+		init, session, changed := stream.segmenter.Init()
+		if init != nil {
+			rw.Header().Set("Content-Type", "video/mp4")
+			rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			rw.Header().Set("X-Segment-Session", strconv.FormatUint(session, 10))
+			n, err := rw.Write(init)
+			atomic.AddUint64(&stream.stats.BytesSent, uint64(n))
+			_ = viewing.add(n, time.Now())
+			if err != nil {
+				httpLog.Warnf("%s: Unable to write initialization segment: %s",
+					r.RemoteAddr, err)
+			}
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			h.writeError(rw, r, errInputUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// segmentsRequest sends media segments as they are produced, starting with the
+// newest (the live edge), or with the one given by from if we still have it.
+//
+// We end the response if the session changes, since the segments after that go
+// with a different initialization segment. We also end it if the client falls
+// so far behind that we no longer have the segment it needs next.
+func (h HTTPHandler) segmentsRequest(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, span *Span) {
+	def := stream.Definition()
+	if !def.Segments {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	if !h.allowedOrigin(rw, r, def) || h.refusePaused(rw, r, stream) ||
+		h.shedding(rw, r, def, false) {
+		return
+	}
+
+	viewing, ok := h.startViewing(rw, r)
+	if !ok {
+		return
+	}
+	defer func() {
+		viewing.end(time.Now())
+	}()
+
+	timeout := time.NewTimer(segmentWait)
+	defer timeout.Stop()
+
+	var segments []Segment
+	for {
+		window := stream.segmenter.Window()
+		segments = window.Segments
+		if len(segments) > 0 {
+			break
+		}
+
+		select {
+		case <-window.Changed:
+		case <-timeout.C:
+			h.writeError(rw, r, errInputUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	start := segments[len(segments)-1]
+	if from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10,
+		64); err == nil {
+		if segment, ok := findSegment(segments, from); ok &&
+			segment.Session == start.Session {
+			start = segment
+		}
+	}
+
+	rw.Header().Set("Content-Type", "video/mp4")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Header().Set("X-Segment-Session", strconv.FormatUint(start.Session, 10))
+	rw.Header().Set("X-Segment-Sequence", strconv.FormatUint(start.Sequence, 10))
+
+	sequence := start.Sequence
+	chunksSent := 0
+	sent := int64(0)
+	defer func() {
+		span.SetAttribute("bytes_sent", sent)
+		httpLog.Debugf("%s: Sent %d bytes of segments", r.RemoteAddr, sent)
+	}()
+
+	for {
+		window := stream.segmenter.Window()
+
+		segment, ok := findSegment(window.Segments, sequence)
+		if !ok {
+			httpLog.Warnf("%s: Too slow: segment %d is gone", r.RemoteAddr,
+				sequence)
+			return
+		}
+
+		if segment.Session != start.Session {
+			return
+		}
+
+		for ; chunksSent < len(segment.Chunks); chunksSent++ {
+			n, err := rw.Write(segment.Chunks[chunksSent])
+			sent += int64(n)
+			atomic.AddUint64(&stream.stats.BytesSent, uint64(n))
+			if err != nil {
+				return
+			}
+
+			if err := viewing.add(n, time.Now()); err != nil {
+				httpLog.Infof("%s: Viewer %s: %s", r.RemoteAddr,
+					viewing.viewer.Name, err)
+				return
+			}
+
+			if flusher, ok := rw.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+
+		if segment.Complete {
+			if next, ok := findSegment(window.Segments, sequence+1); ok {
+				if next.Session != start.Session {
+					return
+				}
+				sequence++
+				chunksSent = 0
+				continue
+			}
+
+			if !window.Remuxing {
+				return
+			}
+		}
+
+		select {
+		case <-window.Changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func findSegment(segments []Segment, sequence uint64) (Segment, bool) {
+	for _, segment := range segments {
+		if segment.Sequence == sequence {
+			return segment, true
+		}
+	}
+	return Segment{}, false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Some clients, such as embedded displays, can hold only one connection open,
+// so they can't follow /events beside the video. With ?format=multipart, we
+// send both in one multipart/mixed response: the MP4 in video/mp4 parts as
+// the muxer writes it, and between them application/json parts, each an
+// event as /events sends it. There is a state event for the stream every
+// second, or every ?metadata_interval= seconds, and the stream's other
+// events, such as motion, as they happen.
+//
+// Concatenating the video parts gives the MP4 as any other client gets it.
+
+// The boundary between the parts of a multipart response.
+const multipartBoundary = "videostreamerpart"
+
+// How often we send the stream's state by default, and the range clients may
+// ask for.
+const (
+	defaultMetadataInterval = time.Second
+	minMetadataInterval     = 100 * time.Millisecond
+	maxMetadataInterval     = time.Minute
+)
+
+// multipartWriter frames what the muxer writes as parts of a multipart/mixed
+// response, and lets us put JSON parts between them.
+type multipartWriter struct {
+	mutex *sync.Mutex
+	w     io.Writer
+
+	// The content type of the video parts.
+	contentType string
+}
+
+func newMultipartWriter(w io.Writer) *multipartWriter {
+	return &multipartWriter{mutex: &sync.Mutex{}, w: w}
+}
+
+// setContentType sets the response's content type, noting the video's for its
+// parts.
+func (m *multipartWriter) setContentType(rw http.ResponseWriter,
+	contentType string) {
+	m.mutex.Lock()
+	m.contentType = contentType
+	m.mutex.Unlock()
+
+	rw.Header().Set("Content-Type",
+		"multipart/mixed; boundary="+multipartBoundary)
+}
+
+// Write writes what the muxer wrote as a video part.
+func (m *multipartWriter) Write(buf []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.writePart(m.contentType, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// writeJSON writes v as a JSON part.
+func (m *multipartWriter) writeJSON(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.writePart("application/json", buf)
+}
+
+// writePart writes a part in one write, so it goes out together.
+func (m *multipartWriter) writePart(contentType string, buf []byte) error {
+	header := fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+		multipartBoundary, contentType, len(buf))
+	_, err := m.w.Write(append(append([]byte(header), buf...), '\r', '\n'))
+	return err
+}
+
+// parseMetadataInterval reads how often the client wants the stream's state.
+func parseMetadataInterval(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("metadata_interval")
+	if s == "" {
+		return defaultMetadataInterval, nil
+	}
+
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errBadRequest
+	}
+	interval := time.Duration(seconds * float64(time.Second))
+	if interval < minMetadataInterval || interval > maxMetadataInterval {
+		return 0, errBadRequest
+	}
+	return interval, nil
+}
+
+// sendMetadata sends the stream's events to the client as JSON parts, once
+// its output is open, until the client is done. Call the function it returns
+// to stop, before the request ends.
+func (m *multipartWriter) sendMetadata(c *Client, stream *Stream,
+	interval time.Duration) func() {
+	ch := events.subscribe()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		defer events.unsubscribe(ch)
+
+		select {
+		case <-c.outputReady:
+		case <-c.ctx.Done():
+			return
+		case <-done:
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			var e Event
+			select {
+			case <-ticker.C:
+				state := stream.State()
+				e = Event{
+					Type:   "state",
+					Stream: stream.Definition().Name,
+					Time:   time.Now(),
+					State:  &state,
+				}
+			case e = <-ch:
+				if e.Stream != stream.Definition().Name {
+					continue
+				}
+			case <-c.ctx.Done():
+				return
+			case <-done:
+				return
+			}
+
+			if err := m.writeJSON(e); err != nil {
+				httpLog.Debugf("%s: Unable to write metadata: %s", c, err)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Analytics and archivers that want a camera's packets would otherwise each
+// pull another RTSP session from it, which cameras cope with badly. Instead a
+// stream can publish the packets we read to a NATS server, and they can
+// subscribe there. We use just enough of the NATS protocol to do so: we
+// connect, publish with headers, and answer pings.
+//
+// Each packet goes to <subject>.video or <subject>.audio as it came from the
+// demuxer, such as H.264 in the input's form, with headers:
+//
+//   Pts       The packet's time in microseconds, if it has one.
+//   Keyframe  true for video keyframes.
+//   Corrupt   true if the demuxer flagged the packet as corrupt.
+//
+// The codecs, with the extradata needed to decode the packets, go to
+// <subject>.codecs as JSON when we start and whenever they change. The subject
+// is videostreamer.<stream> by default, with any / in the name as a dot.
+// Headers need NATS 2.2 or later.
+//
+// Packets we read while we're not connected are lost.
+
+const (
+	natsDialTimeout = 10 * time.Second
+
+	// How long a write to the server may take before we give up on it.
+	natsWriteTimeout = 10 * time.Second
+
+	// The largest line we accept from the server, such as INFO.
+	natsMaxLine = 64 * 1024
+)
+
+// natsInfo is what we need of the server's INFO.
+type natsInfo struct {
+	Headers    bool  `json:"headers"`
+	MaxPayload int64 `json:"max_payload"`
+}
+
+// natsCodecs is what we publish about the codecs.
+type natsCodecs struct {
+	Video *natsCodec `json:"video,omitempty"`
+	Audio *natsCodec `json:"audio,omitempty"`
+}
+
+type natsCodec struct {
+	Codec     string `json:"codec"`
+	Profile   int    `json:"profile"`
+	Level     int    `json:"level"`
+	Extradata []byte `json:"extradata,omitempty"`
+}
+
+// parseNATSURL checks a NATS server URL. It may have a username and password,
+// or a token as the username.
+func parseNATSURL(server string) (*url.URL, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "nats" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	return u, nil
+}
+
+// validateNATSSubject checks we can publish to the subject.
+func validateNATSSubject(subject string) error {
+	if strings.ContainsAny(subject, " \t\r\n*>") ||
+		strings.HasPrefix(subject, ".") || strings.HasSuffix(subject, ".") {
+		return fmt.Errorf("NATS subject must not have spaces or wildcards, or start or end with a dot")
+	}
+	return nil
+}
+
+// natsSubject is the subject the stream publishes under.
+func (d StreamDefinition) natsSubject() string {
+	if d.NATSSubject != "" {
+		return d.NATSSubject
+	}
+	return "videostreamer." + strings.Replace(d.Name, "/", ".", -1)
+}
+
+// publishNATS publishes the stream's packets while it is configured to.
+func (s *Stream) publishNATS() {
+	s.runOwnClient("nats", func(def StreamDefinition) string {
+		if def.NATSURL == "" {
+			return ""
+		}
+		return def.NATSURL + " " + def.natsSubject()
+	}, func(c *Client) {
+		c.withAudio = true
+	}, func(c *Client, def StreamDefinition) error {
+		server, err := parseNATSURL(def.NATSURL)
+		if err != nil {
+			return err
+		}
+		return publishPacketsNATS(c, server, def.natsSubject())
+	})
+}
+
+// natsConn is a connection to a NATS server.
+type natsConn struct {
+	conn net.Conn
+
+	// Writes come from the publisher and the reader answering pings.
+	mutex *sync.Mutex
+	w     *bufio.Writer
+
+	// What the server sends. connect reads the first lines, and read the rest,
+	// so they must share it: it may hold lines connect didn't get to.
+	r *bufio.Reader
+
+	info natsInfo
+}
+
+// publishPacketsNATS publishes the client's packets until the connection
+// breaks or the client is done.
+func publishPacketsNATS(c *Client, server *url.URL, subject string) error {
+	// The encoder sends nothing before the input is open, so if the channel
+	// closes it gave up on us.
+	select {
+	case <-c.inputReady:
+	case <-c.PacketChan:
+		if c.failure.Code != "" {
+			return c.failure
+		}
+		return nil
+	case <-c.ctx.Done():
+		return nil
+	}
+
+	n, err := dialNATS(server)
+	if err != nil {
+		return fmt.Errorf("%s: %s", redactURL(server.String()), err)
+	}
+	defer func() {
+		_ = n.conn.Close()
+	}()
+
+	encoderLog.Infof("nats: Publishing to %s as %s", redactURL(server.String()),
+		subject)
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- n.read()
+	}()
+
+	published := false
+	for {
+		var p *Packet
+		select {
+		case packet, ok := <-c.PacketChan:
+			if !ok {
+				if c.failure.Code != "" {
+					return c.failure
+				}
+				return nil
+			}
+			p = packet
+		case err := <-readErr:
+			return fmt.Errorf("connection lost: %s", err)
+		}
+
+		if !published || p.newParameters {
+			if err := n.publishCodecs(c.input, subject+".codecs"); err != nil {
+				p.release()
+				return err
+			}
+			published = true
+		}
+
+		err := n.publishPacket(p, subject)
+		atomic.AddInt64(&c.queuedBytes, -p.size)
+		p.release()
+		if err != nil {
+			return err
+		}
+
+		// Write out what we have once we've caught up.
+		if len(c.PacketChan) == 0 {
+			if err := n.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dialNATS connects to the server and says hello.
+func dialNATS(server *url.URL) (*natsConn, error) {
+	conn, err := net.DialTimeout("tcp", server.Host, natsDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &natsConn{
+		conn:  conn,
+		mutex: &sync.Mutex{},
+		w:     bufio.NewWriter(conn),
+		r:     bufio.NewReaderSize(conn, natsMaxLine),
+	}
+	if err := n.connect(server); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// connect reads the server's INFO, sends CONNECT, and pings to find out
+// whether the server accepted it.
+func (n *natsConn) connect(server *url.URL) error {
+	if err := n.conn.SetDeadline(time.Now().Add(natsDialTimeout)); err != nil {
+		return err
+	}
+
+	line, err := n.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading INFO: %s", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting: %s", strings.TrimSpace(line))
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")),
+		&n.info); err != nil {
+		return fmt.Errorf("invalid INFO: %s", err)
+	}
+	if !n.info.Headers {
+		return fmt.Errorf("server doesn't support headers (NATS 2.2 or later is needed)")
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": false,
+		"name":          "videostreamer",
+		"lang":          "go",
+		"version":       "1",
+		"protocol":      1,
+	}
+	if server.User != nil {
+		if password, ok := server.User.Password(); ok {
+			options["user"] = server.User.Username()
+			options["pass"] = password
+		} else {
+			options["auth_token"] = server.User.Username()
+		}
+	}
+	buf, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(n.conn, "CONNECT %s\r\nPING\r\n", buf); err != nil {
+		return err
+	}
+
+	line, err = n.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading response to CONNECT: %s", err)
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		return fmt.Errorf("server refused connection: %s",
+			strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	if strings.TrimSpace(line) != "PONG" {
+		return fmt.Errorf("unexpected response to CONNECT: %s",
+			strings.TrimSpace(line))
+	}
+
+	return n.conn.SetDeadline(time.Time{})
+}
+
+// read answers the server's pings until the connection breaks. We don't
+// subscribe to anything, so there is little else.
+func (n *natsConn) read() error {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			n.mutex.Lock()
+			_, err = n.w.WriteString("PONG\r\n")
+			if err == nil {
+				err = n.w.Flush()
+			}
+			n.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s",
+				strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// publishPacket publishes the packet with its headers.
+func (n *natsConn) publishPacket(p *Packet, subject string) error {
+	if p.audio {
+		subject += ".audio"
+	} else {
+		subject += ".video"
+	}
+
+	headers := "NATS/1.0\r\n"
+	if p.time != noTime {
+		headers += fmt.Sprintf("Pts: %d\r\n", p.time)
+	}
+	if p.keyframe {
+		headers += "Keyframe: true\r\n"
+	}
+	if p.corrupt {
+		headers += "Corrupt: true\r\n"
+	}
+	headers += "\r\n"
+
+	payload := packetBytes(p)
+	if n.info.MaxPayload > 0 &&
+		int64(len(headers)+len(payload)) > n.info.MaxPayload {
+		encoderLog.Warnf("nats: Skipping %d byte packet, larger than the server's maximum payload",
+			len(payload))
+		return nil
+	}
+
+	return n.publish(fmt.Sprintf("HPUB %s %d %d\r\n", subject, len(headers),
+		len(headers)+len(payload)), []byte(headers), payload)
+}
+
+// publishCodecs publishes the input's codecs.
+func (n *natsConn) publishCodecs(input *Input, subject string) error {
+	codecs := natsCodecs{}
+	if params, ok := input.CodecParameters(false); ok {
+		codecs.Video = &natsCodec{Codec: params.Codec, Profile: params.Profile,
+			Level: params.Level, Extradata: params.Extradata}
+	}
+	if params, ok := input.CodecParameters(true); ok {
+		codecs.Audio = &natsCodec{Codec: params.Codec, Profile: params.Profile,
+			Level: params.Level, Extradata: params.Extradata}
+	}
+
+	payload, err := json.Marshal(codecs)
+	if err != nil {
+		return err
+	}
+	return n.publish(fmt.Sprintf("PUB %s %d\r\n", subject, len(payload)),
+		payload)
+}
+
+// publish writes a message: its command line, then its parts. We flush once
+// caught up.
+func (n *natsConn) publish(command string, parts ...[]byte) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := n.w.WriteString(command); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := n.w.Write(part); err != nil {
+			return err
+		}
+	}
+	_, err := n.w.WriteString("\r\n")
+	return err
+}
+
+// flush writes out what we buffered.
+func (n *natsConn) flush() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout)); err != nil {
+		return err
+	}
+	return n.w.Flush()
+}
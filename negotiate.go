@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /stream serves video in whichever container the client can play. Clients
+// say which they want in the Accept header, or with ?format=, which wins
+// since some clients can't set headers:
+//
+//   mp4    video/mp4, what browsers play. The default, unless the stream's
+//          default_format says otherwise.
+//   ts     video/mp2t, MPEG-TS, for set top boxes and players such as VLC.
+//   mjpeg  multipart/x-mixed-replace, a JPEG at a time, for clients that can
+//          show nothing else, such as <img> elements and old NVRs.
+//   multipart
+//          multipart/mixed, the MP4 with the stream's events between its
+//          parts, for clients that can hold only one connection open. See
+//          multipart.go.
+//
+// MPEG-TS is remuxed like MP4. MJPEG means decoding the video and encoding
+// JPEGs for each client, so it costs far more, and we send only so many
+// frames a second.
+
+var errNotAcceptable = HTTPError{
+	Status:  http.StatusNotAcceptable,
+	Code:    "not_acceptable",
+	Message: "No format the client accepts",
+}
+
+// The containers we can serve video in.
+const (
+	formatMP4       = "mp4"
+	formatTS        = "ts"
+	formatMJPEG     = "mjpeg"
+	formatMultipart = "multipart"
+)
+
+// tsFormat is how we serve video as MPEG-TS.
+var tsFormat = OutputFormat{Muxer: "mpegts", ContentType: "video/mp2t"}
+
+// formatContentTypes maps the containers to the content types clients ask
+// for them by.
+var formatContentTypes = map[string]string{
+	formatMP4:       "video/mp4",
+	formatTS:        "video/mp2t",
+	formatMJPEG:     "multipart/x-mixed-replace",
+	formatMultipart: "multipart/mixed",
+}
+
+// How often we send a JPEG to MJPEG clients.
+const mjpegInterval = 200 * time.Millisecond
+
+// The boundary between the parts of an MJPEG response.
+const mjpegBoundary = "videostreamerframe"
+
+// negotiateFormat decides which container to serve the request's video in.
+// Clients that don't say get defaultFormat, or mp4 if it is empty.
+func negotiateFormat(r *http.Request, defaultFormat string) (string, error) {
+	if defaultFormat == "" {
+		defaultFormat = formatMP4
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", errBadRequest
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return defaultFormat, nil
+	}
+
+	parts := strings.Split(accept, ",")
+
+	// Formats the client refuses with q=0. A wildcard doesn't bring them back.
+	refused := map[string]bool{}
+	for _, part := range parts {
+		mediaType, q := parseAcceptPart(part)
+		if format := contentTypeFormat(mediaType); format != "" && q == 0 {
+			refused[format] = true
+		}
+	}
+
+	// Of equally good formats, the first the client lists wins.
+	best := ""
+	bestQ := 0.0
+	for _, part := range parts {
+		mediaType, q := parseAcceptPart(part)
+		if q <= bestQ {
+			continue
+		}
+
+		// Wildcards get the default. Browsers send */* for <video> elements.
+		format := ""
+		switch mediaType {
+		case "*/*":
+			format = firstAccepted(refused, defaultFormat, formatMP4, formatTS)
+		case "video/*":
+			videoFormat := defaultFormat
+			if videoFormat == formatMJPEG || videoFormat == formatMultipart {
+				videoFormat = formatMP4
+			}
+			format = firstAccepted(refused, videoFormat, formatMP4, formatTS)
+		case "multipart/*":
+			format = firstAccepted(refused, formatMJPEG)
+		default:
+			format = contentTypeFormat(mediaType)
+		}
+
+		if format != "" {
+			best = format
+			bestQ = q
+		}
+	}
+
+	if best == "" {
+		// Clients that only ask for JSON are asking how the request fails rather
+		// than for a format, so let them have the default.
+		if strings.Contains(accept, "application/json") {
+			return defaultFormat, nil
+		}
+		return "", errNotAcceptable
+	}
+
+	return best, nil
+}
+
+// contentTypeFormat finds the format a content type asks for, if any.
+func contentTypeFormat(mediaType string) string {
+	for format, contentType := range formatContentTypes {
+		if mediaType == contentType {
+			return format
+		}
+	}
+
+	// Other names players use for MPEG-TS.
+	if mediaType == "video/mpegts" || mediaType == "video/mpeg" {
+		return formatTS
+	}
+
+	return ""
+}
+
+// firstAccepted returns the first of the formats the client doesn't refuse, or
+// "" if it refuses them all.
+func firstAccepted(refused map[string]bool, formats ...string) string {
+	for _, format := range formats {
+		if !refused[format] {
+			return format
+		}
+	}
+	return ""
+}
+
+// parseAcceptPart parses one media range of an Accept header, such as
+// video/mp4;q=0.8, into its type and quality.
+func parseAcceptPart(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+	q := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		// Ignore qualities that aren't from 0 to 1, such as NaN.
+		if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="),
+			64); err == nil && v >= 0 && v <= 1 {
+			q = v
+		}
+	}
+
+	return mediaType, q
+}
+
+// writeMJPEG decodes the client's video and writes it as a JPEG at a time in
+// a multipart/x-mixed-replace response. The client must have decode set.
+func (c *Client) writeMJPEG(w *streamWriter, rw http.ResponseWriter,
+	verbose bool) error {
+	var last time.Time
+	started := false
+
+	return c.decodePackets(verbose, func(decoder MediaDecoder) error {
+		now := time.Now()
+		if now.Sub(last) < mjpegInterval {
+			return nil
+		}
+		last = now
+
+		var buf []byte
+		var err error
+		if !transcodes.run(mjpegInterval, func() {
+			buf, err = decoder.JPEG(0, verbose)
+		}) {
+			return nil
+		}
+		if err != nil {
+			// A frame we can't encode shouldn't end the response.
+			encoderLog.Warnf("%s: %s", c, err)
+			return nil
+		}
+
+		if !started {
+			rw.Header().Set("Content-Type",
+				"multipart/x-mixed-replace; boundary="+mjpegBoundary)
+			started = true
+		}
+
+		return writeMJPEGPart(w, buf)
+	})
+}
+
+// writeMJPEGPart writes a JPEG as the next part of an MJPEG response.
+func writeMJPEGPart(w *streamWriter, buf []byte) error {
+	header := fmt.Sprintf(
+		"--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+		mjpegBoundary, len(buf))
+	_, err := w.Write(append(append([]byte(header), buf...), '\r', '\n'))
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		url           string
+		accept        string
+		defaultFormat string
+		format        string
+		err           error
+	}{
+		// Clients that don't say get the default.
+		{"/stream", "", "", formatMP4, nil},
+		{"/stream", "", formatTS, formatTS, nil},
+
+		// ?format= wins over Accept.
+		{"/stream?format=ts", "video/mp4", "", formatTS, nil},
+		{"/stream?format=avi", "", "", "", errBadRequest},
+
+		// Exact types.
+		{"/stream", "video/mp4", "", formatMP4, nil},
+		{"/stream", "video/mp2t", "", formatTS, nil},
+		{"/stream", "Video/MPEGTS", "", formatTS, nil},
+		{"/stream", "multipart/x-mixed-replace", "", formatMJPEG, nil},
+		{"/stream", "multipart/mixed", "", formatMultipart, nil},
+
+		// Wildcards.
+		{"/stream", "*/*", formatTS, formatTS, nil},
+		{"/stream", "video/*", "", formatMP4, nil},
+		{"/stream", "video/*", formatMJPEG, formatMP4, nil},
+		{"/stream", "multipart/*", "", formatMJPEG, nil},
+		{"/stream", "image/webp, */*;q=0.8", "", formatMP4, nil},
+
+		// The best quality wins, and of equals the first listed.
+		{"/stream", "video/mp4;q=0.5, video/mp2t", "", formatTS, nil},
+		{"/stream", "video/mp2t, video/mp4", "", formatTS, nil},
+		{"/stream", "video/mp4, video/mp2t", "", formatMP4, nil},
+		{"/stream", "*/*;q=0.1, video/mp2t;q=0.9", "", formatTS, nil},
+
+		// q=0 refuses a type, even when a wildcard would match it.
+		{"/stream", "video/mp4;q=0", "", "", errNotAcceptable},
+		{"/stream", "video/mp4;q=0, */*", "", formatTS, nil},
+		{"/stream", "video/mp4;q=0, video/mp2t;q=0, video/*", "", "",
+			errNotAcceptable},
+		{"/stream", "multipart/x-mixed-replace;q=0, multipart/*", "", "",
+			errNotAcceptable},
+
+		// Qualities we can't make sense of count as 1.
+		{"/stream", "video/mp2t;q=0.5, video/mp4;q=abc", "", formatMP4, nil},
+		{"/stream", "video/mp2t;q=0.5, video/mp4;q=NaN", "", formatMP4, nil},
+		{"/stream", "video/mp2t;q=0.5, video/mp4;q=2", "", formatMP4, nil},
+
+		// Unknown types.
+		{"/stream", "text/html", "", "", errNotAcceptable},
+		{"/stream", "application/json", formatTS, formatTS, nil},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		format, err := negotiateFormat(r, test.defaultFormat)
+		if format != test.format || err != test.err {
+			t.Errorf("%s with Accept %q and default %q: got %q, %v, wanted %q, %v",
+				test.url, test.accept, test.defaultFormat, format, err, test.format,
+				test.err)
+		}
+	}
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// We describe our API in an OpenAPI document at /api/openapi.json, so that
+// integrators can generate clients from it. The admin endpoints are only in it
+// if they're available, that is, with an admin token.
+//
+// The same description validates requests: before handling a request for one
+// of the operations, we check its parameters have the types and values the
+// document says, and refuse it with a 400 if not. Parameters the document
+// doesn't have we leave to the handlers, as before.
+//
+// We build the document from apiOperations rather than keeping a file, so
+// that what we serve and what we validate can't disagree.
+
+// apiSchema is the schema of a parameter. We only have simple ones.
+type apiSchema struct {
+	// string, integer, number, or boolean.
+	Type string
+
+	// The values a string may have, if only some.
+	Enum []string
+
+	// The bounds of a number, if it has them.
+	Minimum *float64
+	Maximum *float64
+}
+
+// apiParameter is a parameter of an operation.
+type apiParameter struct {
+	Name string
+
+	// path, query, or header.
+	In string
+
+	Description string
+	Required    bool
+	Schema      apiSchema
+}
+
+// apiOperation is something a client can ask of us.
+type apiOperation struct {
+	Method string
+
+	// Such as /api/streams/{name}/pause. A path may have one path parameter,
+	// which matches the rest of the path between what is either side of it, so
+	// that stream names may have a /.
+	Path string
+
+	ID      string
+	Summary string
+
+	// Whether it needs the admin token.
+	Admin bool
+
+	Parameters []apiParameter
+
+	// The content type of a successful response.
+	ContentType string
+}
+
+// bound is a pointer to a bound of a number, for a schema.
+func bound(f float64) *float64 {
+	return &f
+}
+
+// Parameters many operations have.
+var (
+	apiStreamName = apiParameter{
+		Name:        "name",
+		In:          "path",
+		Description: "The stream's name.",
+		Required:    true,
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiProfile = apiParameter{
+		Name:        "profile",
+		In:          "query",
+		Description: "One of the stream's profiles.",
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiStart = apiParameter{
+		Name:        "start",
+		In:          "query",
+		Description: "Whether to start with the next packet or at a keyframe.",
+		Schema:      apiSchema{Type: "string", Enum: []string{"immediate", "keyframe"}},
+	}
+	apiBurst = apiParameter{
+		Name:        "burst",
+		In:          "query",
+		Description: "Seconds of what we kept to start with at once.",
+		Schema: apiSchema{
+			Type:    "number",
+			Minimum: bound(0),
+			Maximum: bound(maxGOPCacheDuration.Seconds()),
+		},
+	}
+	apiDuration = apiParameter{
+		Name:        "duration",
+		In:          "query",
+		Description: "Seconds of the stream to send, as a complete file.",
+		Schema:      apiSchema{Type: "number", Minimum: bound(0)},
+	}
+	apiClientID = apiParameter{
+		Name:        "client_id",
+		In:          "query",
+		Description: "An ID of the client's own, reported beside the one we give it.",
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiSessionID = apiParameter{
+		Name:        "session_id",
+		In:          "query",
+		Description: "The session ID we gave the client, to resume.",
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiViewerToken = apiParameter{
+		Name:        "token",
+		In:          "query",
+		Description: "A viewer's token, for clients that can't send headers.",
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiQueryStream = apiParameter{
+		Name:        "stream",
+		In:          "query",
+		Description: "The stream's name, or the default stream if not given.",
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiRecordingFrom = apiParameter{
+		Name:        "from",
+		In:          "query",
+		Description: "The start of the time range, as RFC 3339 or Unix seconds.",
+		Schema:      apiSchema{Type: "string"},
+	}
+	apiRecordingTo = apiParameter{
+		Name:        "to",
+		In:          "query",
+		Description: "The end of the time range, as RFC 3339 or Unix seconds.",
+		Schema:      apiSchema{Type: "string"},
+	}
+)
+
+// streamParameters are the parameters of /stream.
+var streamParameters = []apiParameter{
+	apiProfile,
+	{
+		Name:        "format",
+		In:          "query",
+		Description: "The container to send the video in.",
+		Schema: apiSchema{
+			Type: "string",
+			Enum: []string{formatMP4, formatTS, formatMJPEG, formatMultipart},
+		},
+	},
+	{
+		Name:        "maxkbps",
+		In:          "query",
+		Description: "The most kbit/s to send.",
+		Schema:      apiSchema{Type: "integer", Minimum: bound(1)},
+	},
+	{
+		Name:        "metadata_interval",
+		In:          "query",
+		Description: "Seconds between state parts, for format=multipart.",
+		Schema: apiSchema{
+			Type:    "number",
+			Minimum: bound(minMetadataInterval.Seconds()),
+			Maximum: bound(maxMetadataInterval.Seconds()),
+		},
+	},
+	{
+		Name:        "chunked",
+		In:          "query",
+		Description: "0 to not use chunked transfer encoding.",
+		Schema:      apiSchema{Type: "string"},
+	},
+	apiStart,
+	apiBurst,
+	apiDuration,
+	apiClientID,
+	apiSessionID,
+	apiViewerToken,
+}
+
+// audioParameters are the parameters of /audio.
+var audioParameters = []apiParameter{
+	apiProfile,
+	apiStart,
+	apiBurst,
+	apiDuration,
+	apiClientID,
+	apiSessionID,
+	apiViewerToken,
+}
+
+// apiOperations are the operations we describe.
+var apiOperations = []apiOperation{
+	{
+		Method:      "GET",
+		Path:        "/stream",
+		ID:          "getDefaultStream",
+		Summary:     "Watch the default stream.",
+		Parameters:  streamParameters,
+		ContentType: "video/mp4",
+	},
+	{
+		Method:      "GET",
+		Path:        "/stream/{name}",
+		ID:          "getStream",
+		Summary:     "Watch a stream.",
+		Parameters:  append([]apiParameter{apiStreamName}, streamParameters...),
+		ContentType: "video/mp4",
+	},
+	{
+		Method:      "GET",
+		Path:        "/audio",
+		ID:          "getDefaultAudio",
+		Summary:     "Listen to the default stream's audio.",
+		Parameters:  audioParameters,
+		ContentType: "video/mp4",
+	},
+	{
+		Method:      "GET",
+		Path:        "/audio/{name}",
+		ID:          "getAudio",
+		Summary:     "Listen to a stream's audio.",
+		Parameters:  append([]apiParameter{apiStreamName}, audioParameters...),
+		ContentType: "video/mp4",
+	},
+	{
+		Method:  "GET",
+		Path:    "/dvr/{name}",
+		ID:      "getDVR",
+		Summary: "Watch a stream from its DVR window.",
+		Parameters: []apiParameter{
+			apiStreamName,
+			{
+				Name:        "behind",
+				In:          "query",
+				Description: "Seconds behind live to start.",
+				Schema:      apiSchema{Type: "number", Minimum: bound(0)},
+			},
+			apiViewerToken,
+		},
+		ContentType: "video/mp4",
+	},
+	{
+		Method:      "GET",
+		Path:        "/hls/{name}/stream.m3u8",
+		ID:          "getHLSPlaylist",
+		Summary:     "Get a stream's HLS playlist.",
+		Parameters:  []apiParameter{apiStreamName, apiViewerToken},
+		ContentType: hlsPlaylistType,
+	},
+	{
+		Method:      "GET",
+		Path:        "/compare/{name}",
+		ID:          "compareStream",
+		Summary:     "Watch a stream beside the stream it is compared with.",
+		Parameters:  []apiParameter{apiStreamName, apiViewerToken},
+		ContentType: "multipart/x-mixed-replace",
+	},
+	{
+		Method:      "GET",
+		Path:        "/stream.json",
+		ID:          "describeStream",
+		Summary:     "Describe how players can get a stream.",
+		Parameters:  []apiParameter{apiQueryStream},
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/codecs/{name}",
+		ID:          "getCodecs",
+		Summary:     "Get a stream's codecs.",
+		Parameters:  []apiParameter{apiStreamName},
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/healthz",
+		ID:          "getHealth",
+		Summary:     "Check whether any stream's encoder is stuck.",
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/readyz",
+		ID:          "getReady",
+		Summary:     "Check whether we take new viewers.",
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/metrics",
+		ID:          "getMetrics",
+		Summary:     "Get metrics in the Prometheus text format.",
+		ContentType: "text/plain",
+	},
+	{
+		Method:      "GET",
+		Path:        "/api/openapi.json",
+		ID:          "getOpenAPI",
+		Summary:     "Get this document.",
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/status",
+		ID:          "getStatus",
+		Summary:     "List the streams and their clients.",
+		Admin:       true,
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/events",
+		ID:          "getEvents",
+		Summary:     "Follow events as server-sent events.",
+		Admin:       true,
+		Parameters:  []apiParameter{apiQueryStream},
+		ContentType: "text/event-stream",
+	},
+	{
+		Method:      "POST",
+		Path:        "/api/streams/{name}/pause",
+		ID:          "pauseStream",
+		Summary:     "Pause a stream.",
+		Admin:       true,
+		Parameters:  []apiParameter{apiStreamName},
+		ContentType: "application/json",
+	},
+	{
+		Method:      "POST",
+		Path:        "/api/streams/{name}/resume",
+		ID:          "resumeStream",
+		Summary:     "Resume a stream.",
+		Admin:       true,
+		Parameters:  []apiParameter{apiStreamName},
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/api/streams/{name}/key",
+		ID:          "getStreamKey",
+		Summary:     "Get a stream's key.",
+		Admin:       true,
+		Parameters:  []apiParameter{apiStreamName},
+		ContentType: "application/json",
+	},
+	{
+		Method:      "POST",
+		Path:        "/api/streams/{name}/key",
+		ID:          "rotateStreamKey",
+		Summary:     "Rotate a stream's key.",
+		Admin:       true,
+		Parameters:  []apiParameter{apiStreamName},
+		ContentType: "application/json",
+	},
+	{
+		Method:  "POST",
+		Path:    "/clients/{id}/kick",
+		ID:      "kickClients",
+		Summary: "Disconnect the clients with an ID.",
+		Admin:   true,
+		Parameters: []apiParameter{{
+			Name:        "id",
+			In:          "path",
+			Description: "The clients' ID.",
+			Required:    true,
+			Schema:      apiSchema{Type: "string"},
+		}},
+		ContentType: "application/json",
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/recordings",
+		ID:      "findRecordings",
+		Summary: "Find a stream's recordings and the events during them.",
+		Admin:   true,
+		Parameters: []apiParameter{
+			apiQueryStream,
+			apiRecordingFrom,
+			apiRecordingTo,
+		},
+		ContentType: "application/json",
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/recordings/export",
+		ID:      "exportRecordings",
+		Summary: "Download a stream's recordings as a ZIP file.",
+		Admin:   true,
+		Parameters: []apiParameter{
+			apiQueryStream,
+			apiRecordingFrom,
+			apiRecordingTo,
+		},
+		ContentType: "application/zip",
+	},
+	{
+		Method:      "GET",
+		Path:        "/api/viewers",
+		ID:          "listViewers",
+		Summary:     "List viewers and their usage.",
+		Admin:       true,
+		ContentType: "application/json",
+	},
+	{
+		Method:      "POST",
+		Path:        "/api/trigger",
+		ID:          "triggerStream",
+		Summary:     "Publish a trigger event for a stream.",
+		Admin:       true,
+		Parameters:  []apiParameter{apiQueryStream},
+		ContentType: "application/json",
+	},
+	{
+		Method:      "GET",
+		Path:        "/api/drain",
+		ID:          "getDrain",
+		Summary:     "Get whether we're draining.",
+		Admin:       true,
+		ContentType: "application/json",
+	},
+	{
+		Method:      "POST",
+		Path:        "/api/drain",
+		ID:          "drainServer",
+		Summary:     "Stop taking new viewers, and stop once those watching finish.",
+		Admin:       true,
+		ContentType: "application/json",
+	},
+}
+
+// match decides whether the operation is the one for the method and path. It
+// returns the path parameter's value, if the operation has one.
+func (o apiOperation) match(method, path string) (string, bool) {
+	if method != o.Method {
+		return "", false
+	}
+
+	open := strings.Index(o.Path, "{")
+	if open == -1 {
+		return "", path == o.Path
+	}
+	prefix := o.Path[:open]
+	suffix := o.Path[strings.Index(o.Path, "}")+1:]
+
+	if len(path) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) {
+		return "", false
+	}
+	return path[len(prefix) : len(path)-len(suffix)], true
+}
+
+// findOperation finds the operation for the request. admin says whether the
+// admin endpoints are available.
+func findOperation(r *http.Request, admin bool) (apiOperation, string, bool) {
+	for _, operation := range apiOperations {
+		if operation.Admin && !admin {
+			continue
+		}
+		if value, ok := operation.match(r.Method, r.URL.Path); ok {
+			return operation, value, true
+		}
+	}
+	return apiOperation{}, "", false
+}
+
+// validate checks a parameter's value against its schema.
+func (s apiSchema) validate(value string) bool {
+	n := 0.0
+	switch s.Type {
+	case "integer":
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		n = float64(i)
+	case "number":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		n = f
+	case "boolean":
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	}
+
+	if s.Minimum != nil && n < *s.Minimum || s.Maximum != nil && n > *s.Maximum {
+		return false
+	}
+
+	if len(s.Enum) == 0 {
+		return true
+	}
+	for _, allowed := range s.Enum {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRequest checks the request's parameters against the operation it is
+// for, if it is for one we describe.
+func (h HTTPHandler) validateRequest(r *http.Request) error {
+	operation, pathValue, ok := findOperation(r, h.AdminToken != "")
+	if !ok {
+		return nil
+	}
+
+	query := r.URL.Query()
+	for _, param := range operation.Parameters {
+		value := ""
+		present := false
+		switch param.In {
+		case "path":
+			value, present = pathValue, pathValue != ""
+		case "query":
+			_, present = query[param.Name]
+			value = query.Get(param.Name)
+		case "header":
+			value = r.Header.Get(param.Name)
+			present = value != ""
+		}
+
+		if !present {
+			if param.Required {
+				return HTTPError{
+					Status:  http.StatusBadRequest,
+					Code:    "bad_request",
+					Message: fmt.Sprintf("Missing parameter %s", param.Name),
+				}
+			}
+			continue
+		}
+
+		if !param.Schema.validate(value) {
+			return HTTPError{
+				Status:  http.StatusBadRequest,
+				Code:    "bad_request",
+				Message: fmt.Sprintf("Invalid parameter %s", param.Name),
+			}
+		}
+	}
+
+	return nil
+}
+
+// openAPIDocument builds the OpenAPI document. admin says whether to include
+// the admin endpoints.
+func openAPIDocument(admin bool) map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, operation := range apiOperations {
+		if operation.Admin && !admin {
+			continue
+		}
+
+		params := []interface{}{}
+		for _, param := range operation.Parameters {
+			schema := map[string]interface{}{"type": param.Schema.Type}
+			if len(param.Schema.Enum) > 0 {
+				schema["enum"] = param.Schema.Enum
+			}
+			if param.Schema.Minimum != nil {
+				schema["minimum"] = *param.Schema.Minimum
+			}
+			if param.Schema.Maximum != nil {
+				schema["maximum"] = *param.Schema.Maximum
+			}
+			params = append(params, map[string]interface{}{
+				"name":        param.Name,
+				"in":          param.In,
+				"description": param.Description,
+				"required":    param.Required,
+				"schema":      schema,
+			})
+		}
+
+		op := map[string]interface{}{
+			"operationId": operation.ID,
+			"summary":     operation.Summary,
+			"parameters":  params,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "Success.",
+					"content": map[string]interface{}{
+						operation.ContentType: map[string]interface{}{},
+					},
+				},
+				"default": map[string]interface{}{
+					"description": "An error.",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"$ref": "#/components/schemas/Error",
+							},
+						},
+					},
+				},
+			},
+		}
+		if operation.Admin {
+			op["security"] = []interface{}{
+				map[string]interface{}{"adminToken": []string{}},
+			}
+		}
+
+		if paths[operation.Path] == nil {
+			paths[operation.Path] = map[string]interface{}{}
+		}
+		paths[operation.Path][strings.ToLower(operation.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "videostreamer",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"error": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"code":    map[string]interface{}{"type": "string"},
+								"message": map[string]interface{}{"type": "string"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// openAPIRequest responds with the OpenAPI document.
+func (h HTTPHandler) openAPIRequest(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(
+		openAPIDocument(h.AdminToken != "")); err != nil {
+		httpLog.Errorf("%s: Unable to write OpenAPI document: %s", r.RemoteAddr,
+			err)
+	}
+}
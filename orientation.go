@@ -0,0 +1,90 @@
+package main
+
+import "fmt"
+
+// Cameras mounted on a ceiling or on their side send their picture upside
+// down or sideways. A stream can turn and mirror it back.
+//
+// In MP4, including the segments we cut, we can say so in the metadata: the
+// track's display matrix tells players how to show the picture, and we remux
+// the video untouched. MPEG-TS and RTP have nowhere to say it, so players show
+// those as the camera sends them. Pictures we decode and encode ourselves, for
+// MJPEG clients, snapshots, time-lapses, and analysis, we turn and mirror
+// pixel by pixel.
+
+// Orientation is how to correct the picture. We rotate first, then flip.
+type Orientation struct {
+	// Degrees to rotate clockwise: 0, 90, 180, or 270.
+	Rotate int
+
+	// Mirror left to right, and top to bottom.
+	HFlip bool
+	VFlip bool
+}
+
+// validateRotation checks the rotation is one we can do.
+func validateRotation(rotate int) error {
+	switch rotate {
+	case 0, 90, 180, 270:
+		return nil
+	}
+	return fmt.Errorf("rotate must be 0, 90, 180, or 270")
+}
+
+// identity says whether the orientation leaves the picture as it is.
+func (o Orientation) identity() bool {
+	return o.Rotate == 0 && !o.HFlip && !o.VFlip
+}
+
+// transposes says whether the orientation swaps the picture's width and
+// height.
+func (o Orientation) transposes() bool {
+	return o.Rotate == 90 || o.Rotate == 270
+}
+
+// apply corrects a picture of width by height, one byte per pixel. It returns
+// a new picture if it changed anything. If the orientation transposes, the
+// new one is height by width.
+func (o Orientation) apply(buf []byte, width, height int) []byte {
+	if o.identity() {
+		return buf
+	}
+
+	outWidth, outHeight := width, height
+	if o.transposes() {
+		outWidth, outHeight = height, width
+	}
+
+	out := make([]byte, len(buf))
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			// Work back from where the pixel ends up to where it came from:
+			// undo the flips, then the rotation.
+			fx, fy := x, y
+			if o.HFlip {
+				fx = outWidth - 1 - fx
+			}
+			if o.VFlip {
+				fy = outHeight - 1 - fy
+			}
+
+			sx, sy := fx, fy
+			switch o.Rotate {
+			case 90:
+				sx, sy = fy, height-1-fx
+			case 180:
+				sx, sy = width-1-fx, height-1-fy
+			case 270:
+				sx, sy = width-1-fy, fx
+			}
+
+			out[y*outWidth+x] = buf[sy*width+sx]
+		}
+	}
+	return out
+}
+
+// orientation is how to correct the stream's picture.
+func (d StreamDefinition) orientation() Orientation {
+	return Orientation{Rotate: d.Rotate, HFlip: d.HFlip, VFlip: d.VFlip}
+}
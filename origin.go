@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A stream can be limited to being embedded in pages of certain sites, so
+// that other sites can't hotlink it. Browsers tell us the page a request is
+// from in the Origin header, or failing that, the Referer header. We check
+// its scheme and host against the stream's allowed_origins. Entries are:
+//
+//   https://example.com  That scheme and host (and port, if given).
+//   example.com          That host, over any scheme.
+//   *.example.com        Any host under example.com, over any scheme.
+//
+// Requests with neither header, such as from players outside browsers, are
+// allowed unless referer_required is set. Pages can choose not to send a
+// Referer, so only with that set are hotlinkers sure to be refused.
+
+var errForbiddenOrigin = HTTPError{
+	Status:  http.StatusForbidden,
+	Code:    "forbidden_origin",
+	Message: "Not allowed from this site",
+}
+
+// allowedOrigin checks the page the request is from may use the stream. If
+// so, and the request is cross-origin, it allows the page to read the
+// response. If not, it responds with an error and returns false.
+func (h HTTPHandler) allowedOrigin(rw http.ResponseWriter, r *http.Request,
+	def StreamDefinition) bool {
+	if len(def.AllowedOrigins) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	from := origin
+	if from == "" || from == "null" {
+		from = r.Header.Get("Referer")
+	}
+
+	if from == "" {
+		if !def.RefererRequired {
+			return true
+		}
+		httpLog.Warnf("%s: No origin or referer for stream %s", r.RemoteAddr,
+			def.Name)
+		h.writeError(rw, r, errForbiddenOrigin)
+		return false
+	}
+
+	u, err := url.Parse(from)
+	if err != nil || u.Host == "" || !originMatches(def.AllowedOrigins, u) {
+		httpLog.Warnf("%s: Origin %s is not allowed for stream %s", r.RemoteAddr,
+			from, def.Name)
+		h.writeError(rw, r, errForbiddenOrigin)
+		return false
+	}
+
+	if origin != "" && origin != "null" {
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Add("Vary", "Origin")
+	}
+
+	return true
+}
+
+// originMatches decides whether a page's URL matches one of the allowed
+// origins.
+func originMatches(allowed []string, u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	hostPort := strings.ToLower(u.Host)
+
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "/"))
+
+		if strings.Contains(entry, "://") {
+			if entry == strings.ToLower(u.Scheme)+"://"+hostPort {
+				return true
+			}
+			continue
+		}
+
+		if strings.HasPrefix(entry, "*.") {
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+			continue
+		}
+
+		if host == entry || hostPort == entry {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowedOrigin(t *testing.T) {
+	def := StreamDefinition{
+		Name: "cam",
+		AllowedOrigins: []string{"https://example.com", "*.example.org",
+			"example.net:8080"},
+	}
+
+	tests := []struct {
+		name            string
+		origin          string
+		referer         string
+		refererRequired bool
+		allowed         bool
+	}{
+		{"exact match", "https://example.com", "", false, true},
+		{"exact match with a different case", "HTTPS://Example.COM", "", false,
+			true},
+		{"scheme mismatch", "http://example.com", "", false, false},
+		{"port mismatch", "https://example.com:8443", "", false, false},
+		{"wildcard subdomain", "https://cdn.example.org", "", false, true},
+		{"wildcard nested subdomain", "http://a.b.example.org", "", false, true},
+		{"wildcard doesn't match the domain itself", "https://example.org", "",
+			false, false},
+		{"wildcard doesn't match a lookalike", "https://badexample.org", "", false,
+			false},
+		{"host and port", "http://example.net:8080", "", false, true},
+		{"host without the port", "http://example.net", "", false, false},
+		{"other site", "https://evil.com", "", false, false},
+		{"missing origin falls back to referer",
+			"", "https://example.com/page.html", false, true},
+		{"null origin falls back to referer",
+			"null", "https://cdn.example.org/embed", false, true},
+		{"referer from another site", "", "https://evil.com/example.com", false,
+			false},
+		{"referer with user info", "", "https://example.com@evil.com/", false,
+			false},
+		{"origin wins over referer", "https://evil.com", "https://example.com/",
+			false, false},
+		{"malformed referer", "", "https://exa mple.com/%zz", false, false},
+		{"referer without a host", "", "/page.html", false, false},
+		{"neither header", "", "", false, true},
+		{"neither header when required", "", "", true, false},
+	}
+
+	for _, test := range tests {
+		def.RefererRequired = test.refererRequired
+
+		r := httptest.NewRequest("GET", "/stream", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			r.Header.Set("Referer", test.referer)
+		}
+		rw := httptest.NewRecorder()
+
+		allowed := HTTPHandler{}.allowedOrigin(rw, r, def)
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed %t, wanted %t", test.name, allowed, test.allowed)
+			continue
+		}
+
+		if !allowed && rw.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, wanted %d", test.name, rw.Code,
+				http.StatusForbidden)
+		}
+
+		// Cross-origin pages may read the response only when they sent an
+		// Origin we allowed.
+		allowOrigin := rw.Header().Get("Access-Control-Allow-Origin")
+		if allowed && test.origin != "" && test.origin != "null" {
+			if allowOrigin != test.origin {
+				t.Errorf("%s: Access-Control-Allow-Origin %q, wanted %q", test.name,
+					allowOrigin, test.origin)
+			}
+		} else if allowOrigin != "" {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, wanted none", test.name,
+				allowOrigin)
+		}
+	}
+}
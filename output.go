@@ -0,0 +1,62 @@
+//go:build !nolibav
+// +build !nolibav
+
+package main
+
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// #include <stdint.h>
+import "C"
+
+// Outputs write through goWriteOutput. It finds where to write by looking up
+// an ID. We can't give C a pointer to Go memory to hold onto.
+var outputWriters = struct {
+	mutex   *sync.Mutex
+	nextID  uint64
+	writers map[uint64]io.Writer
+}{
+	mutex:   &sync.Mutex{},
+	writers: map[uint64]io.Writer{},
+}
+
+func registerOutputWriter(w io.Writer) uint64 {
+	outputWriters.mutex.Lock()
+	defer outputWriters.mutex.Unlock()
+
+	outputWriters.nextID++
+	outputWriters.writers[outputWriters.nextID] = w
+	return outputWriters.nextID
+}
+
+func unregisterOutputWriter(id uint64) {
+	outputWriters.mutex.Lock()
+	defer outputWriters.mutex.Unlock()
+
+	delete(outputWriters.writers, id)
+}
+
+// goWriteOutput receives output from libavformat. opaque points to the ID of
+// the writer.
+//
+//export goWriteOutput
+func goWriteOutput(opaque unsafe.Pointer, buf *C.uint8_t, size C.int) C.int {
+	id := *(*C.uint64_t)(opaque)
+
+	outputWriters.mutex.Lock()
+	w, ok := outputWriters.writers[uint64(id)]
+	outputWriters.mutex.Unlock()
+	if !ok {
+		return -1
+	}
+
+	n, err := w.Write(C.GoBytes(unsafe.Pointer(buf), size))
+	if err != nil {
+		return -1
+	}
+
+	return C.int(n)
+}
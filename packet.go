@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// How many queued packets a client writes with one call into C at most.
+const writeBatchSize = 16
+
+// QueueLimits bounds the memory used by packets queued for clients.
+type QueueLimits struct {
+	// The most bytes that may be queued for one client. 0 means no limit.
+	ClientBytes int64
+
+	// The most bytes of packets that may be held for all clients. 0 means no
+	// limit. Since clients share packets, this counts each packet once.
+	TotalBytes int64
+}
+
+// Bytes of packets currently held. Access atomically.
+var livePacketBytes int64
+
+// Packet is a packet read from the input. The encoder gives the same Packet to
+// every client rather than a copy each. Each client releases it when it is done
+// with it, and the last one frees it.
+//
+// Clients must not modify the packet's data.
+type Packet struct {
+	// How many references there are. Access atomically.
+	refs int32
+
+	// The packet as the Media that read it represents it. For libav this is an
+	// AVPacket.
+	data interface{}
+
+	// Frees data once the last reference is released.
+	free func()
+
+	// When the packet is from, in microseconds. noTime if unknown.
+	time int64
+
+	size int64
+
+	// Whether the packet is from the audio stream rather than the video stream.
+	audio bool
+
+	// Whether the packet is a keyframe, and whether the demuxer found it to be
+	// corrupt.
+	keyframe bool
+	corrupt  bool
+
+	// Whether the video's codec parameters changed with this packet. Outputs
+	// opened before it have the old ones.
+	newParameters bool
+}
+
+// newPacket takes ownership of data. The encoder holds the first reference.
+func newPacket(data interface{}, free func(), size, time int64) *Packet {
+	atomic.AddInt64(&livePacketBytes, size)
+
+	return &Packet{
+		refs: 1,
+		data: data,
+		free: free,
+		time: time,
+		size: size,
+	}
+}
+
+func (p *Packet) retain() {
+	atomic.AddInt32(&p.refs, 1)
+}
+
+func (p *Packet) release() {
+	if atomic.AddInt32(&p.refs, -1) == 0 {
+		if p.free != nil {
+			p.free()
+		}
+		atomic.AddInt64(&livePacketBytes, -p.size)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// An admin can pause a stream, such as to turn indoor cameras off while
+// someone is home. While a stream is paused, we close its input and keep it
+// closed, end its clients, and refuse new ones with stream_paused. Recording,
+// segmenting, and our other own clients stop too. Pausing a stream pauses its
+// profiles with it.
+//
+// Pausing lasts until the stream is resumed, or we restart.
+
+var errStreamPaused = HTTPError{
+	Status:  http.StatusServiceUnavailable,
+	Code:    "stream_paused",
+	Message: "Stream is paused",
+}
+
+// Paused says whether the stream is paused.
+func (s *Stream) Paused() bool {
+	return atomic.LoadInt32(&s.paused) == 1
+}
+
+// setPaused pauses or resumes the stream, publishing an event if that changed.
+// The encoder notices and closes the input.
+func (s *Stream) setPaused(paused bool) {
+	value := int32(0)
+	if paused {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.paused, value) == value {
+		return
+	}
+
+	if paused {
+		serverLog.Infof("Paused stream %s", s.Definition().Name)
+		s.publishState("paused")
+	} else {
+		serverLog.Infof("Resumed stream %s", s.Definition().Name)
+		s.publishState("resumed")
+	}
+}
+
+// refusePaused responds with an error if the stream is paused.
+func (h HTTPHandler) refusePaused(rw http.ResponseWriter, r *http.Request,
+	stream *Stream) bool {
+	if !stream.Paused() {
+		return false
+	}
+	h.writeError(rw, r, errStreamPaused)
+	return true
+}
+
+// pausePath finds the stream named in an /api/streams/<name>/pause or
+// /api/streams/<name>/resume path, and whether to pause it. ok is false if the
+// path names no stream.
+func pausePath(path string) (string, bool, bool) {
+	paused := strings.HasSuffix(path, "/pause")
+	if paused {
+		path = strings.TrimSuffix(path, "/pause")
+	} else {
+		path = strings.TrimSuffix(path, "/resume")
+	}
+
+	if !strings.HasPrefix(path, "/api/streams/") {
+		return "", false, false
+	}
+	name := strings.TrimPrefix(path, "/api/streams/")
+	if name == "" || strings.Contains(name, "/") {
+		return "", false, false
+	}
+	return name, paused, true
+}
+
+// pauseRequest pauses or resumes a stream and its profiles, and responds with
+// the stream's state.
+func (h HTTPHandler) pauseRequest(rw http.ResponseWriter, r *http.Request,
+	name string, paused bool) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	stream := h.Streams.Get(name)
+	if stream == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	stream.setPaused(paused)
+	for _, def := range stream.Definition().profileDefinitions() {
+		if profile := h.Streams.Get(def.Name); profile != nil {
+			profile.setPaused(paused)
+		}
+	}
+
+	httpLog.Infof("%s: Set stream %s paused: %t", r.RemoteAddr, name, paused)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(stream.State()); err != nil {
+		httpLog.Errorf("%s: Unable to write response: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPausePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		name   string
+		paused bool
+		ok     bool
+	}{
+		{"/api/streams/cam/pause", "cam", true, true},
+		{"/api/streams/cam/resume", "cam", false, true},
+		{"/api/streams/pause", "", false, false},
+		{"/api/streams/resume", "", false, false},
+		{"/api/streams//pause", "", false, false},
+		{"/api/streams/a/b/pause", "", false, false},
+		{"/api/streams/cam/key", "", false, false},
+	}
+
+	for _, test := range tests {
+		name, paused, ok := pausePath(test.path)
+		if name != test.name || paused != test.paused || ok != test.ok {
+			t.Errorf("pausePath(%q) = %q, %t, %t, wanted %q, %t, %t", test.path,
+				name, paused, ok, test.name, test.paused, test.ok)
+		}
+	}
+}
+
+func TestPauseRequestWithoutName(t *testing.T) {
+	h := HTTPHandler{AdminToken: "secret"}
+
+	for _, path := range []string{"/api/streams/pause",
+		"/api/streams/resume"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("POST", path, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("POST %s: status %d, wanted %d", path, rw.Code,
+				http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A playlist input plays the entries of a playlist file one after another as
+// one stream, starting again from the first after the last, such as for a
+// channel that runs around the clock. Timestamps carry on from one entry to
+// the next as they do for folder inputs.
+//
+// A playlist has an entry per line: a file, or a URL such as of another
+// stream. Blank lines and lines starting with # are skipped, so M3U playlists
+// work too. Relative paths are relative to the playlist. We read the playlist
+// again each time an entry ends, so changes take effect with the next entry.
+//
+// If an entry fails to open, we skip it and try the one after. Only if none
+// open do we give up.
+
+// playlistInputFormat is the input format for playlist inputs. The input URL
+// is the playlist file.
+const playlistInputFormat = "playlist"
+
+// readPlaylist reads the entries of a playlist.
+func readPlaylist(path string) ([]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	var entries []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		if !strings.Contains(entry, "://") && !filepath.IsAbs(entry) {
+			entry = filepath.Join(filepath.Dir(path), entry)
+		}
+
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no entries in %s", path)
+	}
+
+	return entries, nil
+}
+
+// openPlaylist opens the first entry of a playlist that opens.
+func openPlaylist(media Media, inputURL, expandedURL string,
+	timeout time.Duration, verbose bool) (*Input, error) {
+	entries, err := readPlaylist(expandedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		input, err := media.OpenInput("", entry, nil, timeout, verbose)
+		if err != nil {
+			encoderLog.Warnf("playlist: %s: Skipping %s: %s", expandedURL, entry,
+				err)
+			continue
+		}
+
+		return &Input{
+			MediaInput:  input,
+			format:      playlistInputFormat,
+			url:         inputURL,
+			expandedURL: expandedURL,
+			playlist:    expandedURL,
+			entry:       i,
+			file:        entry,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unable to open any entry of %s", expandedURL)
+}
+
+// nextEntry moves a playlist input on to the next of its entries that opens.
+func (i *Input) nextEntry(timeout time.Duration, verbose bool) error {
+	entries, err := readPlaylist(i.playlist)
+	if err != nil {
+		return err
+	}
+
+	for n := 1; n <= len(entries); n++ {
+		entry := (i.entry + n) % len(entries)
+
+		if err := i.Next("", entries[entry], timeout, verbose); err != nil {
+			encoderLog.Warnf("playlist: %s: Skipping %s: %s", i.playlist,
+				entries[entry], err)
+			continue
+		}
+
+		i.entry = entry
+		i.file = entries[entry]
+		return nil
+	}
+
+	return fmt.Errorf("unable to open any entry of %s", i.playlist)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Streams can have priorities, so that under load we give up on the least
+// important ones first. A stream's priority is a number, 0 by default, and
+// higher is more important. Profiles have their stream's priority.
+//
+// While we fall back to profiles, streams of the lowest priority fall back
+// first. If we're still overloaded when we next measure, the next priority
+// falls back too, and so on. Likewise once we shed clients: we refuse new
+// clients of the lowest priority streams first, and disconnect their clients
+// to make room for more important streams, and we move up a priority each
+// time we measure until we're back under our caps. We don't disconnect the
+// clients of the most important streams, since there is nothing more
+// important to make room for.
+//
+// With every stream at the same priority, they all fall back, or are shed,
+// together.
+
+// The range of priorities. Bounded so they fit what we store atomically.
+const (
+	minPriority = -1000
+	maxPriority = 1000
+)
+
+// validatePriority checks the priority is within range.
+func validatePriority(priority int) error {
+	if priority < minPriority || priority > maxPriority {
+		return fmt.Errorf("priority must be between %d and %d", minPriority,
+			maxPriority)
+	}
+	return nil
+}
+
+// priorities is the distinct priorities of the streams, lowest first.
+func priorities(streams *Streams) []int {
+	seen := map[int]struct{}{}
+	levels := []int{}
+	for _, stream := range streams.All() {
+		priority := stream.Definition().Priority
+		if _, ok := seen[priority]; ok {
+			continue
+		}
+		seen[priority] = struct{}{}
+		levels = append(levels, priority)
+	}
+	sort.Ints(levels)
+	return levels
+}
+
+// lowestPriority is the lowest priority of any stream, or 0 if there are none.
+func lowestPriority(streams *Streams) int {
+	if levels := priorities(streams); len(levels) > 0 {
+		return levels[0]
+	}
+	return 0
+}
+
+// nextPriority is the lowest priority of any stream above priority. It returns
+// false if there is none.
+func nextPriority(streams *Streams, priority int) (int, bool) {
+	for _, level := range priorities(streams) {
+		if level > priority {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// dropClients disconnects the clients of streams of the priority and below to
+// shed load, if there are streams more important.
+func dropClients(streams *Streams, priority int) {
+	if _, ok := nextPriority(streams, priority); !ok {
+		return
+	}
+
+	for _, stream := range streams.All() {
+		if stream.Definition().Priority > priority {
+			continue
+		}
+		for _, c := range stream.Clients() {
+			httpLog.Infof("%s: Disconnecting to shed load", c)
+			c.cancel()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Privacy masks black out parts of a stream's picture, such as a neighbour's
+// garden a camera can't mask itself. We can only mask pictures we decode and
+// encode ourselves: MJPEG clients, snapshots, time-lapses, and what we send
+// for frame analysis. Motion detection ignores masked parts too. The video we
+// remux, for MP4 and MPEG-TS clients, segments, RTP, and recordings, is the
+// camera's as is.
+
+// validateMasks checks the masks are regions within the picture.
+func validateMasks(masks []Region) error {
+	for i, m := range masks {
+		if m.X < 0 || m.Y < 0 || m.Width <= 0 || m.Height <= 0 ||
+			m.X+m.Width > 1 || m.Y+m.Height > 1 {
+			return fmt.Errorf("privacy mask %d must be within the picture", i+1)
+		}
+	}
+	return nil
+}
+
+// warnUnmasked warns, if the stream has privacy masks, that what we remux
+// shows what they mask. Clients can always ask for MP4 or MPEG-TS, so a
+// stream with masks always has something unmasked.
+func (d StreamDefinition) warnUnmasked() {
+	if len(d.PrivacyMasks) == 0 {
+		return
+	}
+
+	outputs := []string{"MP4 and MPEG-TS clients"}
+	if d.Segments || d.HLS || d.DVRWindow > 0 {
+		outputs = append(outputs, "segments")
+	}
+	if d.RTPOutput != "" {
+		outputs = append(outputs, "RTP")
+	}
+	if d.NATSURL != "" {
+		outputs = append(outputs, "NATS")
+	}
+	if d.RecordDir != "" {
+		outputs = append(outputs, "recordings")
+	}
+
+	serverLog.Warnf("Stream %s: Privacy masks only cover pictures we decode. These get the camera's video unmasked: %s",
+		d.Name, strings.Join(outputs, ", "))
+}
+
+// maskLuma blacks out the masks in a picture of width by height, one byte per
+// pixel. We round outwards so that each mask covers at least its region.
+func maskLuma(buf []byte, width, height int, masks []Region) {
+	for _, m := range masks {
+		x0, x1 := maskSpan(m.X, m.Width, width)
+		y0, y1 := maskSpan(m.Y, m.Height, height)
+		for y := y0; y < y1; y++ {
+			row := buf[y*width : (y+1)*width]
+			for x := x0; x < x1; x++ {
+				row[x] = 0
+			}
+		}
+	}
+}
+
+// maskSpan converts a mask's start and length, as fractions, to pixels from
+// start to end, rounded outwards and within size.
+func maskSpan(start, length float64, size int) (int, int) {
+	from := int(math.Floor(start * float64(size)))
+	to := int(math.Ceil((start + length) * float64(size)))
+	if from < 0 {
+		from = 0
+	}
+	if to > size {
+		to = size
+	}
+	return from, to
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cameras usually offer a high resolution main stream and a low resolution
+// substream. A stream can have both under the one name: its input is the main
+// stream, and each of its profiles is another input, such as the substream.
+// Clients pick a profile with ?profile=<name>, such as ?profile=low.
+//
+// Each profile is a stream of its own named <stream>/<profile>, so its input
+// opens only while clients watch it, as with any stream. Profiles serve
+// clients only. Segments, recording, and the like use the main stream.
+
+// mainProfile names the stream's own input when picking a profile.
+const mainProfile = "main"
+
+// StreamProfile is another input for a stream, such as a camera's substream.
+type StreamProfile struct {
+	// Such as low.
+	Name string `json:"name"`
+
+	// InputFormat defaults to the stream's.
+	InputFormat string `json:"input_format"`
+	InputURL    string `json:"input_url"`
+
+	// Bitrate is roughly the input's bitrate in kbit/s. 0 means we measure it.
+	Bitrate int `json:"bitrate"`
+
+	// WarmHours are the hours during which we keep the profile's input open
+	// even without clients. See warm.go.
+	WarmHours string `json:"warm_hours"`
+}
+
+func (d StreamDefinition) validateProfiles() error {
+	seen := map[string]struct{}{}
+	for _, profile := range d.Profiles {
+		if profile.Name == "" || profile.Name == mainProfile ||
+			strings.Contains(profile.Name, "/") {
+			return fmt.Errorf("stream %s: profiles must have a name other than %s, without /",
+				d.Name, mainProfile)
+		}
+
+		if profile.InputURL == "" {
+			return fmt.Errorf("stream %s: profile %s must have an input URL",
+				d.Name, profile.Name)
+		}
+
+		if err := checkURLTemplate(profile.InputURL); err != nil {
+			return fmt.Errorf("stream %s: profile %s: invalid input URL: %s",
+				d.Name, profile.Name, err)
+		}
+
+		if profile.Bitrate < 0 {
+			return fmt.Errorf("stream %s: profile %s: bitrate must not be negative",
+				d.Name, profile.Name)
+		}
+
+		if profile.WarmHours != "" {
+			if _, err := parseWarmHours(profile.WarmHours); err != nil {
+				return fmt.Errorf("stream %s: profile %s: %s", d.Name, profile.Name,
+					err)
+			}
+		}
+
+		if _, ok := seen[profile.Name]; ok {
+			return fmt.Errorf("stream %s: profile %s defined more than once",
+				d.Name, profile.Name)
+		}
+		seen[profile.Name] = struct{}{}
+	}
+
+	if _, ok := seen[d.FallbackProfile]; d.FallbackProfile != "" && !ok {
+		return fmt.Errorf("stream %s: fallback profile %s is not one of its profiles",
+			d.Name, d.FallbackProfile)
+	}
+
+	return nil
+}
+
+// profileDefinitions defines a stream for each of the stream's profiles.
+// They serve clients as the stream does, but have none of its other outputs.
+func (d StreamDefinition) profileDefinitions() []StreamDefinition {
+	defs := []StreamDefinition{}
+	for _, profile := range d.Profiles {
+		// A profile with its own input format doesn't share the stream's options.
+		inputFormat := profile.InputFormat
+		inputOptions := map[string]string(nil)
+		if inputFormat == "" {
+			inputFormat = d.InputFormat
+			inputOptions = d.InputOptions
+		}
+
+		defs = append(defs, StreamDefinition{
+			Name:               d.Name + "/" + profile.Name,
+			InputFormat:        inputFormat,
+			InputOptions:       inputOptions,
+			InputURL:           profile.InputURL,
+			Bitrate:            profile.Bitrate,
+			WarmHours:          profile.WarmHours,
+			Verbose:            d.Verbose,
+			MaxClients:         d.MaxClients,
+			Headers:            d.Headers,
+			AllowedOrigins:     d.AllowedOrigins,
+			RefererRequired:    d.RefererRequired,
+			NoChunking:         d.NoChunking,
+			DefaultFormat:      d.DefaultFormat,
+			IncludeAudio:       d.IncludeAudio,
+			SilentAudio:        d.SilentAudio,
+			Rotate:             d.Rotate,
+			HFlip:              d.HFlip,
+			VFlip:              d.VFlip,
+			Dewarp:             d.Dewarp,
+			Priority:           d.Priority,
+			ReconnectGrace:     d.ReconnectGrace,
+			PrivacyMasks:       d.PrivacyMasks,
+			FragmentDuration:   d.FragmentDuration,
+			BufferOutput:       d.BufferOutput,
+			MaxInterleaveDelta: d.MaxInterleaveDelta,
+			OpenTimeout:        d.OpenTimeout,
+			OpenRetries:        d.OpenRetries,
+			Unavailable:        d.Unavailable,
+			SlateImage:         d.SlateImage,
+			ReadTimeout:        d.ReadTimeout,
+			Realtime:           d.Realtime,
+			RealtimeBurst:      d.RealtimeBurst,
+			Loop:               d.Loop,
+			DiscardCorrupt:     d.DiscardCorrupt,
+			MaxAVDrift:         d.MaxAVDrift,
+			CorrectAVDrift:     d.CorrectAVDrift,
+		})
+	}
+	return defs
+}
+
+// withProfile finds the stream serving the profile of the stream. It returns
+// nil if the stream has no such profile. If no profile is given and we're
+// overloaded, it is the stream's fallback profile, if it has one.
+func (s *Streams) withProfile(stream *Stream, profile string) *Stream {
+	def := stream.Definition()
+	if profile == "" && def.FallbackProfile != "" &&
+		fallingBack(def.Priority) {
+		profile = def.FallbackProfile
+	}
+
+	if profile == "" || profile == mainProfile {
+		return stream
+	}
+	return s.Get(def.Name + "/" + profile)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Cameras' RTSP servers have their quirks, and people keep rediscovering the
+// same workarounds for each brand. A stream can name its camera's quirks, and
+// we fill in the settings known to work with it. Settings the stream gives
+// itself win: we only fill in input options it doesn't set, and retries if it
+// sets none. Quirks turn on discard_corrupt and correct_av_drift, if they
+// call for them, whatever the stream says.
+//
+//   hikvision  Hikvision and their rebrands. RTSP over TCP, since they drop
+//              UDP under load, and timestamps generated for the packets they
+//              send without any. Their audio clock drifts, so we correct it.
+//   reolink    Reolink. RTSP over TCP, timestamps from our clock since theirs
+//              jump, and corrupt packets dropped. They often refuse the first
+//              connection after idling, so we retry.
+//   tapo       TP-Link Tapo. RTSP over TCP. They refuse connections while
+//              busy with their app, so we retry, and their audio clock
+//              drifts, so we correct it.
+
+// Quirks are the settings a camera needs.
+type Quirks struct {
+	InputOptions   map[string]string
+	OpenRetries    int
+	DiscardCorrupt bool
+	CorrectAVDrift bool
+}
+
+var quirkProfiles = map[string]Quirks{
+	"hikvision": {
+		InputOptions: map[string]string{
+			"rtsp_transport": "tcp",
+			"fflags":         "+genpts",
+		},
+		CorrectAVDrift: true,
+	},
+	"reolink": {
+		InputOptions: map[string]string{
+			"rtsp_transport":              "tcp",
+			"use_wallclock_as_timestamps": "1",
+		},
+		OpenRetries:    2,
+		DiscardCorrupt: true,
+	},
+	"tapo": {
+		InputOptions: map[string]string{
+			"rtsp_transport": "tcp",
+		},
+		OpenRetries:    2,
+		CorrectAVDrift: true,
+	},
+}
+
+// quirkProfileNames lists the quirk profiles in order.
+func quirkProfileNames() []string {
+	names := []string{}
+	for name := range quirkProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateQuirks checks we know the quirks, and that the input is one they
+// are for.
+func validateQuirks(quirks, inputFormat string) error {
+	if quirks == "" {
+		return nil
+	}
+	if _, ok := quirkProfiles[quirks]; !ok {
+		return fmt.Errorf("quirks must be one of %s",
+			strings.Join(quirkProfileNames(), ", "))
+	}
+	if inputFormat != "rtsp" {
+		return fmt.Errorf("quirks are for rtsp inputs")
+	}
+	return nil
+}
+
+// withQuirks fills in the settings the stream's quirks call for.
+func (d StreamDefinition) withQuirks() StreamDefinition {
+	quirks, ok := quirkProfiles[d.Quirks]
+	if !ok {
+		return d
+	}
+
+	// Don't change the options of the definition we were given.
+	options := map[string]string{}
+	for name, value := range quirks.InputOptions {
+		options[name] = value
+	}
+	for name, value := range d.InputOptions {
+		options[name] = value
+	}
+	d.InputOptions = options
+
+	if d.OpenRetries == 0 {
+		d.OpenRetries = quirks.OpenRetries
+	}
+	if quirks.DiscardCorrupt {
+		d.DiscardCorrupt = true
+	}
+	if quirks.CorrectAVDrift {
+		d.CorrectAVDrift = true
+	}
+	return d
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We can record a stream to files. We write the segments the Segmenter cuts,
+// so each file is a fragmented MP4 holding the initialization segment and
+// whole segments. Since segments start at keyframes, every file starts with
+// one and ends just before the next, at the end of a GOP. Each file plays on
+// its own, and clips cut from its start don't begin with broken frames.
+//
+// A file ends at the first segment boundary after it is as long as the
+// stream's record_file_length. It also ends when the session does, such as
+// when the input reconnects, since what follows goes with a different
+// initialization segment.
+//
+// Fragmented MP4s have no index of their samples, so players fetching one over
+// HTTP have to find their way through it fragment by fragment. With
+// record_faststart on, we rewrite each file once it is complete as a regular
+// MP4 with its index at the front.
+//
+// Once a file is complete, we add it to the directory's index.
+//
+// With record_on_events set, we record only around events of those types,
+// such as motion. Recording starts record_pre_roll before the event, going
+// back through the segments we hold, and carries on until record_post_roll
+// after the last such event. For events that start and end, such as
+// motion_start and motion_end, it carries on until record_post_roll after the
+// end. Files still start and end on segment boundaries, so they may begin a
+// little earlier and end a little later than that.
+
+const (
+	// Defaults unless the stream's definition says otherwise.
+	defaultRecordFileLength = time.Minute
+	defaultRecordPreRoll    = 5 * time.Second
+	defaultRecordPostRoll   = 10 * time.Second
+
+	// The most pre-roll we hold segments for.
+	maxRecordPreRoll = 2 * time.Minute
+)
+
+// Files we are still writing have this suffix. We rename them when they are
+// complete.
+const recordingPartSuffix = ".part"
+
+// recording is a file we are writing.
+type recording struct {
+	file *os.File
+
+	// The directory we record to, as configured.
+	dir string
+
+	// Where the file goes once complete.
+	path string
+
+	// The session whose segments we write to it.
+	session uint64
+
+	// When its first segment started.
+	start time.Time
+
+	// The length of the complete segments we wrote to it, and of what we wrote
+	// of the one we're writing.
+	duration time.Duration
+	partial  time.Duration
+
+	// Whether to rewrite it with its index at the front once complete, and
+	// what to do that with.
+	faststart bool
+	media     Media
+	verbose   bool
+
+	// The index of the directory it is in.
+	index *RecordingIndex
+
+	stream string
+
+	// The type of event that started it, if we record around events.
+	trigger string
+}
+
+// recordTrigger tracks whether events call for recording, when we record
+// only around them.
+type recordTrigger struct {
+	mutex *sync.Mutex
+
+	// Events that started and have not yet ended, by their type less _start,
+	// such as motion.
+	ongoing map[string]struct{}
+
+	// When the post-roll after the last event ends.
+	until time.Time
+
+	// The type of the event that started the current recording.
+	cause string
+}
+
+// recordFileLength is how long recording files are.
+func (d StreamDefinition) recordFileLength() time.Duration {
+	if d.RecordFileLength > 0 {
+		return time.Duration(d.RecordFileLength * float64(time.Second))
+	}
+	return defaultRecordFileLength
+}
+
+// recordPreRoll is how much from before an event we record.
+func (d StreamDefinition) recordPreRoll() time.Duration {
+	if d.RecordPreRoll > 0 {
+		return time.Duration(d.RecordPreRoll * float64(time.Second))
+	}
+	return defaultRecordPreRoll
+}
+
+// recordPostRoll is how much after an event we record.
+func (d StreamDefinition) recordPostRoll() time.Duration {
+	if d.RecordPostRoll > 0 {
+		return time.Duration(d.RecordPostRoll * float64(time.Second))
+	}
+	return defaultRecordPostRoll
+}
+
+func newRecordTrigger() *recordTrigger {
+	return &recordTrigger{
+		mutex:   &sync.Mutex{},
+		ongoing: map[string]struct{}{},
+	}
+}
+
+// event notes an event of the stream. If it is one we record around, we
+// record until the post-roll after it, and until it ends if it has an end.
+func (t *recordTrigger) event(def StreamDefinition, e Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, eventType := range def.RecordOnEvents {
+		if e.Type != eventType &&
+			!(strings.HasSuffix(eventType, "_start") &&
+				e.Type == strings.TrimSuffix(eventType, "_start")+"_end") {
+			continue
+		}
+
+		if len(t.ongoing) == 0 && !e.Time.Before(t.until) {
+			t.cause = e.Type
+		}
+
+		if strings.HasSuffix(e.Type, "_start") {
+			t.ongoing[strings.TrimSuffix(e.Type, "_start")] = struct{}{}
+		}
+		if strings.HasSuffix(e.Type, "_end") {
+			delete(t.ongoing, strings.TrimSuffix(e.Type, "_end"))
+		}
+
+		if until := e.Time.Add(def.recordPostRoll()); until.After(t.until) {
+			t.until = until
+		}
+		return
+	}
+}
+
+// active decides whether events call for recording at the time.
+func (t *recordTrigger) active(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.ongoing) > 0 || now.Before(t.until)
+}
+
+// trigger is the type of the event that started the current recording.
+func (t *recordTrigger) trigger() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.cause
+}
+
+// record writes the stream's segments to files while the stream is configured
+// to.
+func (s *Stream) record() {
+	var rec *recording
+	defer func() {
+		rec.finish()
+		s.setRecording(false)
+	}()
+
+	// The segment we write next, and how many of its chunks we wrote. 0 means
+	// we start with the newest segment.
+	sequence := uint64(0)
+	chunksWritten := 0
+
+	for {
+		s.setRecording(rec != nil)
+
+		def := s.Definition()
+		onEvents := def.RecordDir != "" && len(def.RecordOnEvents) > 0
+
+		s.segmenter.keepAtLeast(def.segmentsKeep())
+
+		window := s.segmenter.Window()
+
+		// Recording around events, we start and stop between segments.
+		if def.RecordDir == "" || (rec != nil && rec.dir != def.RecordDir) ||
+			(onEvents && chunksWritten == 0 && !s.trigger.active(time.Now())) {
+			rec.finish()
+			rec = nil
+			sequence = 0
+			chunksWritten = 0
+		}
+
+		if onEvents && rec == nil && !s.trigger.active(time.Now()) {
+			if !s.waitForSegments(window) {
+				return
+			}
+			continue
+		}
+
+		if def.RecordDir == "" || len(window.Segments) == 0 {
+			if !s.waitForSegments(window) {
+				return
+			}
+			continue
+		}
+
+		if sequence == 0 {
+			sequence = window.Segments[len(window.Segments)-1].Sequence
+			if onEvents {
+				sequence = preRollSequence(window.Segments, def.recordPreRoll())
+			}
+		}
+
+		segment, ok := findSegment(window.Segments, sequence)
+		if !ok {
+			if sequence < window.Segments[0].Sequence {
+				encoderLog.Warnf("record: %s: Too slow: segment %d is gone",
+					def.Name, sequence)
+				rec.finish()
+				rec = nil
+				sequence = 0
+				chunksWritten = 0
+				continue
+			}
+
+			if !s.waitForSegments(window) {
+				return
+			}
+			continue
+		}
+
+		// When the file we start next starts, if it follows on from the last.
+		var follows time.Time
+
+		if chunksWritten == 0 && rec != nil && (rec.session != segment.Session ||
+			rec.duration >= def.recordFileLength()) {
+			if rec.session == segment.Session {
+				follows = rec.start.Add(rec.duration)
+			}
+			rec.finish()
+			rec = nil
+		}
+
+		if rec == nil {
+			init, session, _ := s.segmenter.Init()
+			if init == nil || session != segment.Session {
+				// We no longer have the initialization segment this segment goes
+				// with.
+				sequence++
+				continue
+			}
+
+			// We may be starting partway through the segment, and for pre-roll, some
+			// segments back.
+			start := time.Now().Add(-durationFrom(window.Segments, sequence))
+			if !follows.IsZero() {
+				start = follows
+			}
+
+			trigger := ""
+			if onEvents {
+				trigger = s.trigger.trigger()
+			}
+
+			var err error
+			rec, err = newRecording(def, s.media, init, session, start,
+				trigger)
+			if err != nil {
+				encoderLog.Errorf("record: %s: Unable to start recording: %s",
+					def.Name, err)
+				if !s.waitForSegments(window) {
+					return
+				}
+				continue
+			}
+
+			encoderLog.Debugf("record: %s: Recording to %s", def.Name, rec.path)
+		}
+
+		for ; chunksWritten < len(segment.Chunks); chunksWritten++ {
+			if _, err := rec.file.Write(segment.Chunks[chunksWritten]); err != nil {
+				encoderLog.Errorf("record: %s: Unable to write recording: %s",
+					def.Name, err)
+				rec.finish()
+				rec = nil
+				break
+			}
+		}
+
+		if rec == nil {
+			// Start over with the next segment.
+			sequence++
+			chunksWritten = 0
+			continue
+		}
+
+		if segment.Complete {
+			rec.duration += segment.Duration
+			rec.partial = 0
+			sequence++
+			chunksWritten = 0
+
+			if _, ok := findSegment(window.Segments, sequence); !ok &&
+				!window.Remuxing {
+				// The session ended. Don't leave its last file open until the next
+				// one starts.
+				rec.finish()
+				rec = nil
+			}
+			continue
+		}
+
+		rec.partial = segment.Duration
+
+		if !s.waitForSegments(window) {
+			return
+		}
+	}
+}
+
+// recordEvents keeps the stream's events in the index of its recordings while
+// we record it, to mark when they happened.
+func (s *Stream) recordEvents() {
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	for {
+		var e Event
+		select {
+		case e = <-ch:
+		case <-s.ctx.Done():
+			return
+		}
+
+		def := s.Definition()
+		if e.Stream != def.Name || def.RecordDir == "" || e.State != nil {
+			continue
+		}
+
+		s.trigger.event(def, e)
+
+		index, err := recordingIndex(def.RecordDir)
+		if err != nil {
+			encoderLog.Errorf("record: %s: Unable to open index: %s", def.Name, err)
+			continue
+		}
+
+		if err := index.AddEvent(e); err != nil {
+			encoderLog.Errorf("record: %s: Unable to add %s event to index: %s",
+				def.Name, e.Type, err)
+		}
+	}
+}
+
+// preRollSequence finds the segment to start recording from to include the
+// pre-roll. We go back no further than the start of the newest session.
+func preRollSequence(segments []Segment, preRoll time.Duration) uint64 {
+	i := len(segments) - 1
+	covered := segments[i].Duration
+	for i > 0 && covered < preRoll &&
+		segments[i-1].Session == segments[i].Session {
+		i--
+		covered += segments[i].Duration
+	}
+	return segments[i].Sequence
+}
+
+// durationFrom is how long the segments are from the one with the sequence to
+// the newest.
+func durationFrom(segments []Segment, sequence uint64) time.Duration {
+	var duration time.Duration
+	for _, segment := range segments {
+		if segment.Sequence >= sequence {
+			duration += segment.Duration
+		}
+	}
+	return duration
+}
+
+// waitForSegments waits for the window to change. It returns false if the
+// stream stops first.
+func (s *Stream) waitForSegments(window SegmentWindow) bool {
+	select {
+	case <-window.Changed:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// newRecording starts a file with the initialization segment. Files go in a
+// directory per stream and are named for when they start, as
+// <dir>/<stream>/<stream>-20060102T150405Z.mp4.
+func newRecording(def StreamDefinition, media Media, init []byte,
+	session uint64, start time.Time, trigger string) (*recording, error) {
+	index, err := recordingIndex(def.RecordDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open index: %s", err)
+	}
+
+	dir := filepath.Join(def.RecordDir, def.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s", def.Name,
+		start.UTC().Format("20060102T150405Z"))
+	path := filepath.Join(dir, name+".mp4")
+
+	// Files could start within the same second, such as if the input
+	// reconnects right away. The one before may still be a part file.
+	for i := 2; exists(path) || exists(path+recordingPartSuffix); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d.mp4", name, i))
+	}
+
+	file, err := os.OpenFile(path+recordingPartSuffix,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Write(init); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path + recordingPartSuffix)
+		return nil, err
+	}
+
+	return &recording{
+		file:      file,
+		dir:       def.RecordDir,
+		path:      path,
+		session:   session,
+		start:     start,
+		faststart: def.RecordFaststart,
+		media:     media,
+		verbose:   def.libavVerbose(),
+		index:     index,
+		stream:    def.Name,
+		trigger:   trigger,
+	}, nil
+}
+
+// finish closes the file and gives it its final name. It does nothing if the
+// recording is nil.
+//
+// Whatever we wrote is playable, even if we stop partway through a segment,
+// since we write whole chunks.
+//
+// If we rewrite the file for faststart, we do so in the background so that
+// recording the next file doesn't wait for it.
+func (r *recording) finish() {
+	if r == nil {
+		return
+	}
+
+	r.duration += r.partial
+	r.partial = 0
+
+	if err := r.file.Close(); err != nil {
+		encoderLog.Errorf("record: Unable to close %s: %s", r.path, err)
+		return
+	}
+
+	if r.faststart {
+		go r.rewrite()
+		return
+	}
+
+	r.rename()
+}
+
+// rewrite remuxes the complete file with its index at the front. If that
+// fails, we keep the file as we recorded it.
+func (r *recording) rewrite() {
+	part := r.path + recordingPartSuffix
+	rewritten := r.path + ".faststart" + recordingPartSuffix
+
+	if err := r.media.Faststart(part, rewritten, r.verbose); err != nil {
+		encoderLog.Warnf("record: Unable to rewrite %s for faststart: %s",
+			r.path, err)
+		_ = os.Remove(rewritten)
+		r.rename()
+		return
+	}
+
+	// Rename before removing the part file so that one or the other always
+	// exists. newRecording looks for both to choose a name.
+	if err := os.Rename(rewritten, r.path); err != nil {
+		encoderLog.Errorf("record: Unable to rename %s: %s", r.path, err)
+		return
+	}
+
+	if err := os.Remove(part); err != nil {
+		encoderLog.Errorf("record: Unable to remove %s: %s", part, err)
+	}
+
+	encoderLog.Infof("record: Recorded %s (%s, faststart)", r.path,
+		r.duration.Round(time.Second))
+	r.addToIndex()
+}
+
+// rename gives the file we recorded its final name.
+func (r *recording) rename() {
+	if err := os.Rename(r.path+recordingPartSuffix, r.path); err != nil {
+		encoderLog.Errorf("record: Unable to rename %s: %s", r.path, err)
+		return
+	}
+
+	encoderLog.Infof("record: Recorded %s (%s)", r.path,
+		r.duration.Round(time.Second))
+	r.addToIndex()
+}
+
+// addToIndex adds the complete file to its directory's index.
+func (r *recording) addToIndex() {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		encoderLog.Errorf("record: Unable to index %s: %s", r.path, err)
+		return
+	}
+
+	rel, err := filepath.Rel(r.dir, r.path)
+	if err != nil {
+		encoderLog.Errorf("record: Unable to index %s: %s", r.path, err)
+		return
+	}
+
+	if err := r.index.Add(Recording{
+		Stream:   r.stream,
+		Path:     filepath.ToSlash(rel),
+		Start:    r.start.UTC(),
+		End:      r.start.Add(r.duration).UTC(),
+		Duration: r.duration.Seconds(),
+		Size:     info.Size(),
+		Trigger:  r.trigger,
+	}); err != nil {
+		encoderLog.Errorf("record: Unable to index %s: %s", r.path, err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We keep an index of the recordings in each recording directory so we can
+// find those in a time range without looking through the directories. It is
+// a file of JSON lines, one per recording, that we append to as each
+// recording completes. We read it when we first need it and keep it in
+// memory from then on.
+//
+// We also keep the events of recorded streams, such as motion events, in a
+// second file alongside it. These mark what happened when, such as on a
+// timeline of the recordings.
+
+// The files' names in the recording directory.
+const (
+	recordingIndexFile = "index.jsonl"
+	recordingEventFile = "events.jsonl"
+)
+
+// Recording describes a complete recording file.
+type Recording struct {
+	Stream string `json:"stream"`
+
+	// The file's path relative to the recording directory.
+	Path string `json:"path"`
+
+	// When the recording starts and ends. End is Start plus Duration.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// In seconds.
+	Duration float64 `json:"duration"`
+
+	// In bytes.
+	Size int64 `json:"size"`
+
+	// The type of event that started the recording, if an event did. Empty for
+	// continuous recording.
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// RecordingIndex is the index of one recording directory.
+type RecordingIndex struct {
+	mutex *sync.Mutex
+
+	file       *os.File
+	eventsFile *os.File
+
+	// Each stream's recordings, by start time. A stream's recordings don't
+	// overlap, so they are in order of end time too.
+	recordings map[string][]Recording
+
+	// Each stream's events, by time.
+	events map[string][]Event
+}
+
+// The indexes we have open, by directory.
+var recordingIndexes = struct {
+	mutex   *sync.Mutex
+	indexes map[string]*RecordingIndex
+}{
+	mutex:   &sync.Mutex{},
+	indexes: map[string]*RecordingIndex{},
+}
+
+// recordingIndex returns the index of the directory, reading it if we have
+// not yet.
+func recordingIndex(dir string) (*RecordingIndex, error) {
+	recordingIndexes.mutex.Lock()
+	defer recordingIndexes.mutex.Unlock()
+
+	dir = filepath.Clean(dir)
+	if index, ok := recordingIndexes.indexes[dir]; ok {
+		return index, nil
+	}
+
+	index, err := openRecordingIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	recordingIndexes.indexes[dir] = index
+	return index, nil
+}
+
+// openRecordingIndex reads the directory's index. We leave out recordings
+// whose files are gone, such as ones deleted to make room, and rewrite the
+// index without them. Likewise we leave out events from before a stream's
+// oldest recording.
+func openRecordingIndex(dir string) (*RecordingIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, recordingIndexFile)
+
+	index := &RecordingIndex{
+		mutex:      &sync.Mutex{},
+		recordings: map[string][]Recording{},
+		events:     map[string][]Event{},
+	}
+
+	recordings, dropped, err := readRecordingIndex(dir, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, recording := range recordings {
+		index.insert(recording)
+	}
+
+	if dropped > 0 {
+		serverLog.Infof("Removing %d missing recordings from %s", dropped, path)
+		lines := make([]interface{}, 0, len(recordings))
+		for _, recording := range recordings {
+			lines = append(lines, recording)
+		}
+		if err := writeJSONLines(path, lines); err != nil {
+			return nil, err
+		}
+	}
+
+	eventsPath := filepath.Join(dir, recordingEventFile)
+
+	events, dropped, err := readRecordingEvents(eventsPath, index.recordings)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		index.events[e.Stream] = append(index.events[e.Stream], e)
+	}
+
+	if dropped > 0 {
+		lines := make([]interface{}, 0, len(events))
+		for _, e := range events {
+			lines = append(lines, e)
+		}
+		if err := writeJSONLines(eventsPath, lines); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index.file = file
+
+	eventsFile, err := os.OpenFile(eventsPath,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	index.eventsFile = eventsFile
+
+	return index, nil
+}
+
+// readRecordingIndex reads the recordings in the index whose files still
+// exist, and counts those it leaves out. If we crashed while adding one, the
+// last line may be incomplete. We skip lines like that.
+func readRecordingIndex(dir, path string) ([]Recording, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var recordings []Recording
+	dropped := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var recording Recording
+		if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+			serverLog.Warnf("Skipping invalid line in %s: %s", path, err)
+			dropped++
+			continue
+		}
+
+		if !exists(filepath.Join(dir, recording.Path)) {
+			dropped++
+			continue
+		}
+
+		recordings = append(recordings, recording)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	return recordings, dropped, nil
+}
+
+// readRecordingEvents reads the events in the file from when their stream
+// has recordings, and counts those it leaves out.
+func readRecordingEvents(path string,
+	recordings map[string][]Recording) ([]Event, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var events []Event
+	dropped := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			serverLog.Warnf("Skipping invalid line in %s: %s", path, err)
+			dropped++
+			continue
+		}
+
+		streamRecordings := recordings[e.Stream]
+		if len(streamRecordings) == 0 ||
+			e.Time.Before(streamRecordings[0].Start) {
+			dropped++
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	return events, dropped, nil
+}
+
+// writeJSONLines replaces the file with one holding each value as a line of
+// JSON.
+func writeJSONLines(path string, values []interface{}) error {
+	file, err := os.OpenFile(path+recordingPartSuffix,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for _, value := range values {
+		buf, err := json.Marshal(value)
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		_, _ = w.Write(append(buf, '\n'))
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(path+recordingPartSuffix, path)
+}
+
+// Add adds a complete recording to the index.
+func (x *RecordingIndex) Add(recording Recording) error {
+	buf, err := json.Marshal(recording)
+	if err != nil {
+		return err
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if _, err := x.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+
+	x.insert(recording)
+	return nil
+}
+
+// insert adds the recording to those in memory. Hold the mutex, or be the only
+// one with the index.
+func (x *RecordingIndex) insert(recording Recording) {
+	recordings := x.recordings[recording.Stream]
+
+	i := sort.Search(len(recordings), func(i int) bool {
+		return recordings[i].Start.After(recording.Start)
+	})
+
+	recordings = append(recordings, Recording{})
+	copy(recordings[i+1:], recordings[i:])
+	recordings[i] = recording
+
+	x.recordings[recording.Stream] = recordings
+}
+
+// Find returns the stream's recordings overlapping the time range, oldest
+// first. A zero from or to leaves that end of the range open.
+func (x *RecordingIndex) Find(stream string, from, to time.Time) []Recording {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	recordings := x.recordings[stream]
+
+	i := 0
+	if !from.IsZero() {
+		i = sort.Search(len(recordings), func(i int) bool {
+			return recordings[i].End.After(from)
+		})
+	}
+
+	found := []Recording{}
+	for ; i < len(recordings); i++ {
+		if !to.IsZero() && !recordings[i].Start.Before(to) {
+			break
+		}
+		found = append(found, recordings[i])
+	}
+
+	return found
+}
+
+// AddEvent adds an event of a stream we record.
+func (x *RecordingIndex) AddEvent(e Event) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if _, err := x.eventsFile.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+
+	x.events[e.Stream] = append(x.events[e.Stream], e)
+	return nil
+}
+
+// FindEvents returns the stream's events in the time range, oldest first. A
+// zero from or to leaves that end of the range open.
+func (x *RecordingIndex) FindEvents(stream string, from, to time.Time) []Event {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	events := x.events[stream]
+
+	i := 0
+	if !from.IsZero() {
+		i = sort.Search(len(events), func(i int) bool {
+			return !events[i].Time.Before(from)
+		})
+	}
+
+	found := []Event{}
+	for ; i < len(events); i++ {
+		if !to.IsZero() && !events[i].Time.Before(to) {
+			break
+		}
+		found = append(found, events[i])
+	}
+
+	return found
+}
+
+// RecordingResult is a recording we found, along with where to fetch it.
+type RecordingResult struct {
+	Recording
+	URL string `json:"url"`
+}
+
+// recordingsRequest responds with a stream's recordings in a time range, and
+// the events that happened in it, as JSON. ?stream=<name> chooses the stream,
+// and ?from=<time> and ?to=<time> the range. Without them, the range is open
+// at that end. Times are RFC 3339 or Unix seconds.
+func (h HTTPHandler) recordingsRequest(rw http.ResponseWriter,
+	r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	def, index, from, to, ok := h.recordingQuery(rw, r)
+	if !ok {
+		return
+	}
+
+	recordings := []RecordingResult{}
+	for _, recording := range index.Find(def.Name, from, to) {
+		recordings = append(recordings, RecordingResult{
+			Recording: recording,
+			URL:       "/recordings/" + recording.Path,
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+		"recordings": recordings,
+		"events":     index.FindEvents(def.Name, from, to),
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write recordings: %s", r.RemoteAddr, err)
+	}
+}
+
+// recordingQuery decides the stream and time range a request for recordings
+// is for, and finds the index of the stream's recordings. If it can't, it
+// responds with an error and returns false.
+func (h HTTPHandler) recordingQuery(rw http.ResponseWriter,
+	r *http.Request) (StreamDefinition, *RecordingIndex, time.Time, time.Time,
+	bool) {
+	stream := h.Streams.Get(r.URL.Query().Get("stream"))
+	if stream == nil {
+		h.writeError(rw, r, errNotFound)
+		return StreamDefinition{}, nil, time.Time{}, time.Time{}, false
+	}
+
+	def := stream.Definition()
+	if def.RecordDir == "" {
+		h.writeError(rw, r, errNotFound)
+		return StreamDefinition{}, nil, time.Time{}, time.Time{}, false
+	}
+
+	from, err := parseRecordingTime(r.URL.Query().Get("from"))
+	if err != nil {
+		h.writeError(rw, r, errBadRequest)
+		return StreamDefinition{}, nil, time.Time{}, time.Time{}, false
+	}
+
+	to, err := parseRecordingTime(r.URL.Query().Get("to"))
+	if err != nil {
+		h.writeError(rw, r, errBadRequest)
+		return StreamDefinition{}, nil, time.Time{}, time.Time{}, false
+	}
+
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		h.writeError(rw, r, errBadRequest)
+		return StreamDefinition{}, nil, time.Time{}, time.Time{}, false
+	}
+
+	index, err := recordingIndex(def.RecordDir)
+	if err != nil {
+		httpLog.Errorf("%s: Unable to open recording index: %s", r.RemoteAddr,
+			err)
+		h.writeError(rw, r, errInternal)
+		return StreamDefinition{}, nil, time.Time{}, time.Time{}, false
+	}
+
+	return def, index, from, to, true
+}
+
+// parseRecordingTime parses a time given as RFC 3339, such as
+// 2024-01-02T15:04:05Z, or as Unix seconds. An empty string is the zero time.
+func parseRecordingTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// recordingFileRequest serves a recording file, given as <stream>/<file> as
+// in the index. Range requests work, so players can seek.
+func (h HTTPHandler) recordingFileRequest(rw http.ResponseWriter,
+	r *http.Request, path string) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	pieces := strings.Split(path, "/")
+	if len(pieces) != 2 || pieces[0] == "" ||
+		!strings.HasSuffix(pieces[1], ".mp4") {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	stream := h.Streams.Get(pieces[0])
+	if stream == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	def := stream.Definition()
+	if def.RecordDir == "" {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(def.RecordDir, def.Name, pieces[1]))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			httpLog.Errorf("%s: Unable to open recording: %s", r.RemoteAddr, err)
+		}
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(rw, r, pieces[1], info.ModTime(), file)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clients on mobile networks drop and reconnect often. With reconnect_grace,
+// when a stream's last client leaves we keep its input open that long, so a
+// client reconnecting doesn't wait for the input to open again.
+//
+// We also give each client of /stream a session ID, in a cookie and an
+// X-Session-ID header. A client reconnecting within the grace window with its
+// session ID, as the cookie, the header, or ?session_id=, picks up about
+// where it left off: if the stream has a DVR window that still has that
+// point, we redirect it to /dvr there. Otherwise it gets the stream live, as
+// any client does.
+
+// The cookie holding the session ID.
+const sessionCookie = "videostreamer_session"
+
+// The longest grace window.
+const maxReconnectGrace = 10 * time.Minute
+
+// sessionKey is a session's client on a stream. A browser sends the same
+// cookie to every stream.
+type sessionKey struct {
+	id     string
+	stream string
+}
+
+// sessionStore remembers when clients left streams, for as long as they may
+// resume.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[sessionKey]time.Time
+}
+
+var sessions = &sessionStore{sessions: map[sessionKey]time.Time{}}
+
+// reconnectGrace is how long we keep the stream's input open, and remember
+// where clients left, after they leave.
+func (d StreamDefinition) reconnectGrace() time.Duration {
+	return time.Duration(d.ReconnectGrace * float64(time.Second))
+}
+
+// validateReconnectGrace checks the grace window is one we allow.
+func validateReconnectGrace(seconds float64) error {
+	if seconds < 0 || seconds > maxReconnectGrace.Seconds() {
+		return fmt.Errorf("reconnect grace must be between 0 and %g seconds",
+			maxReconnectGrace.Seconds())
+	}
+	return nil
+}
+
+// leave remembers that the session's client left the stream.
+func (s *sessionStore) leave(id, stream string, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Forget sessions too old to resume. The grace window is per stream, so we
+	// keep them as long as the longest.
+	for key, left := range s.sessions {
+		if now.Sub(left) > maxReconnectGrace {
+			delete(s.sessions, key)
+		}
+	}
+
+	s.sessions[sessionKey{id: id, stream: stream}] = now
+}
+
+// resume finds when the session's client left the stream, if it did within
+// grace. It forgets the session either way.
+func (s *sessionStore) resume(id, stream string, grace time.Duration,
+	now time.Time) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := sessionKey{id: id, stream: stream}
+	left, ok := s.sessions[key]
+	delete(s.sessions, key)
+	if !ok || now.Sub(left) > grace {
+		return time.Time{}, false
+	}
+	return left, true
+}
+
+// requestSessionID is the session ID the client gave, if any.
+func requestSessionID(r *http.Request) string {
+	ids := []string{r.Header.Get("X-Session-ID"), r.URL.Query().Get("session_id")}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		ids = append(ids, cookie.Value)
+	}
+
+	for _, id := range ids {
+		if validClientID(id) {
+			return id
+		}
+	}
+	return ""
+}
+
+// newSessionID makes up a session ID.
+func newSessionID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// dvrRedirect is the URL of the stream's DVR window, behind live, relative
+// to the request, so that it works behind a proxy serving us under a prefix.
+// http.Redirect would make it absolute.
+func dvrRedirect(r *http.Request, name string, behind time.Duration) string {
+	// From /stream/<name> we go up to where /stream is.
+	up := strings.Repeat("../", strings.Count(r.URL.EscapedPath(), "/")-1)
+	return fmt.Sprintf("%sdvr/%s?behind=%.3f", up, url.PathEscape(name),
+		behind.Seconds())
+}
+
+// startSession gives the client a session ID, the one it had if it gave one,
+// and sends it. If the client is reconnecting and can pick up from the DVR
+// window, we redirect it there and return false.
+func (h HTTPHandler) startSession(rw http.ResponseWriter, r *http.Request,
+	stream *Stream, audio bool) (string, bool) {
+	def := stream.Definition()
+	grace := def.reconnectGrace()
+	if grace == 0 {
+		return "", true
+	}
+
+	now := time.Now()
+	id := requestSessionID(r)
+	if id != "" {
+		left, ok := sessions.resume(id, def.Name, grace, now)
+		if ok && !audio && def.DVRWindow > 0 &&
+			now.Sub(left) < def.dvrWindow() {
+			httpLog.Infof("%s: Resuming session %s from the DVR window",
+				r.RemoteAddr, id)
+			atomic.AddUint64(&stream.stats.SessionsResumedDVR, 1)
+			rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			rw.Header().Set("Location", dvrRedirect(r, def.Name, now.Sub(left)))
+			rw.WriteHeader(http.StatusFound)
+			return "", false
+		}
+		if ok {
+			httpLog.Infof("%s: Resuming session %s live", r.RemoteAddr, id)
+			atomic.AddUint64(&stream.stats.SessionsResumedLive, 1)
+		}
+	} else if id = newSessionID(); id == "" {
+		return "", true
+	}
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(maxReconnectGrace.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	rw.Header().Set("X-Session-ID", id)
+	return id, true
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io/ioutil"
+)
+
+// sendRTP sends the stream over RTP while it is configured to. This is mainly
+// for multicast to viewers on a LAN.
+func (s *Stream) sendRTP() {
+	s.runOwnClient("rtp", func(def StreamDefinition) string {
+		if def.RTPOutput == "" {
+			return ""
+		}
+		return def.RTPOutput + " " + def.RTPFEC
+	}, (*Client).waitForOutput, func(c *Client, def StreamDefinition) error {
+		format := rtpFormat
+		if def.RTPFEC != "" {
+			format.FEC = "prompeg=" + def.RTPFEC
+		}
+
+		c.format = &format
+		c.outputURL = def.RTPOutput
+		c.reopen = true
+
+		encoderLog.Infof("rtp: %s: Sending to %s", def.Name,
+			redactURL(def.RTPOutput))
+
+		return c.writePackets(ioutil.Discard, func(string) {},
+			def.libavVerbose(), nil)
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// We upload to S3, or anything that speaks its API such as MinIO, using just
+// enough of it to do so: a PUT of each object, signed with AWS Signature
+// Version 4. The bucket is given as a URL, either path style
+// (https://s3.us-east-1.amazonaws.com/bucket/prefix) or virtual hosted style
+// (https://bucket.s3.amazonaws.com/prefix). Credentials come from the
+// environment as they do for the AWS CLI: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, optionally AWS_SESSION_TOKEN, and AWS_REGION.
+
+const (
+	s3Timeout = 30 * time.Second
+
+	// The region we sign for unless the environment says otherwise.
+	defaultS3Region = "us-east-1"
+
+	// The longest error response we read.
+	maxS3ResponseSize = 64 * 1024
+)
+
+// s3Bucket uploads objects to a bucket.
+type s3Bucket struct {
+	url *url.URL
+
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+// parseS3URL checks a bucket URL.
+func parseS3URL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("scheme must be https or http")
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host")
+	}
+
+	if u.User != nil || u.RawQuery != "" {
+		return nil, fmt.Errorf("credentials and query strings are not supported")
+	}
+
+	return u, nil
+}
+
+func newS3Bucket(rawURL string) (*s3Bucket, error) {
+	u, err := parseS3URL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &s3Bucket{
+		url:          u,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: s3Timeout},
+	}
+
+	if b.region == "" {
+		b.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if b.region == "" {
+		b.region = defaultS3Region
+	}
+
+	if b.accessKey == "" || b.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	return b, nil
+}
+
+// put uploads an object. Its key is relative to the bucket URL's path.
+func (b *s3Bucket) put(key, contentType string, body []byte) error {
+	u := *b.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = ""
+
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	b.sign(req, body, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxS3ResponseSize))
+		return fmt.Errorf("%s responded %s: %s", u.Host, resp.Status,
+			strings.TrimSpace(string(buf)))
+	}
+
+	return nil
+}
+
+// sign adds Signature Version 4 authorization to the request. We sign the
+// host and each header the request has.
+func (b *s3Bucket) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if b.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values,
+			","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes a path as Signature Version 4 wants: everything but
+// unreserved characters and slashes.
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' ||
+			c == '~' || c == '/' {
+			escaped.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&escaped, "%%%02X", c)
+	}
+	return escaped.String()
+}
+
+// canonicalQuery is the query string sorted by name, as Signature Version 4
+// wants.
+func canonicalQuery(values url.Values) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		for _, value := range values[name] {
+			pairs = append(pairs, s3EscapeQuery(name)+"="+s3EscapeQuery(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3EscapeQuery(s string) string {
+	return strings.Replace(s3EscapePath(s), "/", "%2F", -1)
+}
+
+func sha256Hex(buf []byte) string {
+	digest := sha256.Sum256(buf)
+	return hex.EncodeToString(digest[:])
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Segmenter holds a stream's video cut into CMAF segments. We remux the video
+// once into a fragmented MP4 made of CMAF chunks, and cut it into segments
+// along keyframes. Segment based outputs such as HLS and DASH can all serve
+// from these. Since each segment is a list of chunks, they can send a segment
+// chunk by chunk while it is still being produced.
+type Segmenter struct {
+	mutex *sync.Mutex
+
+	// The initialization segment: ftyp and moov. It changes each time we remux
+	// anew, such as after the input reconnects. Each such session has a new
+	// number. Segments go with the initialization segment of their session.
+	init    []byte
+	session uint64
+
+	// The initialization segments of sessions with segments in the window,
+	// including this one, so that HLS players can play segments of earlier
+	// sessions.
+	inits map[uint64][]byte
+
+	// Whether a session is in progress.
+	remuxing bool
+
+	// Recent segments, oldest first. The last may be incomplete.
+	segments []*Segment
+
+	// How many segments starting a discontinuity we have dropped from the
+	// window. HLS calls this the discontinuity sequence.
+	discontinuitySequence uint64
+
+	nextSequence uint64
+
+	// The longest segment we have had. HLS's target duration must not go
+	// down.
+	longest time.Duration
+
+	// How many bytes of chunks the session has had.
+	sessionBytes int64
+
+	// How much of the stream we keep at least, such as for pre-roll of
+	// recordings. We keep more than segmentsKept segments if need be.
+	keep time.Duration
+
+	// Closed and replaced whenever something changes, so that anyone waiting
+	// for the next chunk can wait on it.
+	changed chan struct{}
+}
+
+// Segment is a CMAF segment. It starts with a keyframe.
+type Segment struct {
+	// Segments are numbered in order, starting from 1.
+	Sequence uint64
+
+	// The session the segment is from. For DASH, each session is a period.
+	Session uint64
+
+	// Whether the segment is the first of a session that followed another.
+	// Its timestamps don't continue from the segment before it, and it goes
+	// with a different initialization segment, so players must be told (such
+	// as with EXT-X-DISCONTINUITY in HLS).
+	Discontinuity bool
+
+	// How many bytes of chunks the session had before the segment, so that
+	// /dvr can address the session's bytes.
+	Offset int64
+
+	// Decode time of the segment's first sample.
+	Start time.Duration
+
+	// Duration so far if the segment is incomplete.
+	Duration time.Duration
+
+	// Each chunk is a moof and mdat (and any boxes preceding them).
+	Chunks [][]byte
+
+	// Whether the segment has all of its chunks.
+	Complete bool
+}
+
+const (
+	// How many segments we keep at least.
+	segmentsKept = 10
+
+	// How long we try to make segments. A segment ends at the first keyframe
+	// after it is this long, so segments are about this long or longer.
+	segmentTargetDuration = 2 * time.Second
+
+	// The largest box we'll buffer. Anything bigger means we are not parsing
+	// the MP4 correctly.
+	maxSegmentBoxSize = 64 * 1024 * 1024
+)
+
+func newSegmenter() *Segmenter {
+	return &Segmenter{
+		mutex:        &sync.Mutex{},
+		inits:        map[uint64][]byte{},
+		nextSequence: 1,
+		changed:      make(chan struct{}),
+	}
+}
+
+// Init returns the initialization segment and its session, along with a
+// channel closed the next time something changes. The segment is nil if we
+// don't have one.
+func (s *Segmenter) Init() ([]byte, uint64, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.init, s.session, s.changed
+}
+
+// SessionInit returns the initialization segment of the session, if it has
+// segments in the window or is the current session. It is nil otherwise.
+func (s *Segmenter) SessionInit(session uint64) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.inits[session]
+}
+
+// SegmentWindow is a copy of the segments we have.
+type SegmentWindow struct {
+	// Oldest first.
+	Segments []Segment
+
+	// Discontinuities before the first segment.
+	DiscontinuitySequence uint64
+
+	// Whether we are still producing segments.
+	Remuxing bool
+
+	// The longest segment we have had, including those no longer here.
+	Longest time.Duration
+
+	// Closed the next time the segments change.
+	Changed <-chan struct{}
+}
+
+// Window returns a copy of the segments we have.
+func (s *Segmenter) Window() SegmentWindow {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments := make([]Segment, 0, len(s.segments))
+	for _, segment := range s.segments {
+		copied := *segment
+		copied.Chunks = segment.Chunks[:len(segment.Chunks):len(segment.Chunks)]
+		segments = append(segments, copied)
+	}
+
+	return SegmentWindow{
+		Segments:              segments,
+		DiscontinuitySequence: s.discontinuitySequence,
+		Remuxing:              s.remuxing,
+		Longest:               s.longest,
+		Changed:               s.changed,
+	}
+}
+
+func (s *Segmenter) setInit(init []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.init = init
+	s.session++
+	s.inits[s.session] = init
+	s.sessionBytes = 0
+	s.remuxing = true
+	s.notify()
+}
+
+// addChunk adds a chunk to the current segment, or starts a new segment with
+// it.
+func (s *Segmenter) addChunk(chunk []byte, keyframe bool, start,
+	duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var current *Segment
+	if len(s.segments) > 0 && !s.segments[len(s.segments)-1].Complete {
+		current = s.segments[len(s.segments)-1]
+	}
+
+	// Segments must start with a keyframe. Drop chunks until we see one.
+	if current == nil && !keyframe {
+		return
+	}
+
+	if current != nil && current.Session != s.session {
+		current.Complete = true
+		current = nil
+		if !keyframe {
+			return
+		}
+	}
+
+	if current != nil && keyframe && current.Duration >= segmentTargetDuration {
+		current.Complete = true
+		current = nil
+	}
+
+	if current == nil {
+		current = &Segment{
+			Sequence: s.nextSequence,
+			Session:  s.session,
+			Offset:   s.sessionBytes,
+			Start:    start,
+		}
+		s.nextSequence++
+
+		if len(s.segments) > 0 {
+			current.Discontinuity =
+				s.segments[len(s.segments)-1].Session != current.Session
+		}
+
+		s.segments = append(s.segments, current)
+		for len(s.segments) > segmentsKept &&
+			segmentsDuration(s.segments[1:]) >= s.keep {
+			if s.segments[0].Discontinuity {
+				s.discontinuitySequence++
+			}
+			s.segments = s.segments[1:]
+		}
+
+		for session := range s.inits {
+			if session < s.segments[0].Session && session != s.session {
+				delete(s.inits, session)
+			}
+		}
+	}
+
+	current.Chunks = append(current.Chunks, chunk)
+	s.sessionBytes += int64(len(chunk))
+	current.Duration += duration
+	if current.Duration > s.longest {
+		s.longest = current.Duration
+	}
+
+	s.notify()
+}
+
+// keepAtLeast keeps at least this much of the stream in the window, beyond
+// the usual segmentsKept segments.
+func (s *Segmenter) keepAtLeast(keep time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keep = keep
+}
+
+func segmentsDuration(segments []*Segment) time.Duration {
+	var duration time.Duration
+	for _, segment := range segments {
+		duration += segment.Duration
+	}
+	return duration
+}
+
+// endSession completes the last segment. We call this when we stop remuxing,
+// such as because the input went away.
+func (s *Segmenter) endSession() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.segments) > 0 {
+		s.segments[len(s.segments)-1].Complete = true
+	}
+	s.remuxing = false
+	s.notify()
+}
+
+// notify wakes anyone waiting for a change. Hold the mutex.
+func (s *Segmenter) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// segmentWriter receives the CMAF MP4 and passes its pieces to the stream's
+// Segmenter.
+type segmentWriter struct {
+	stream *Stream
+
+	// What we have received but not yet handled.
+	buf []byte
+
+	// The ftyp, until we see the moov.
+	init []byte
+
+	defaults trackDefaults
+
+	// Boxes preceding the next moof, such as styp, and the moof itself.
+	pending []byte
+	moof    *fragmentInfo
+}
+
+func (w *segmentWriter) Write(buf []byte) (int, error) {
+	w.buf = append(w.buf, buf...)
+
+	for {
+		b, n := readBox(w.buf)
+		if n == 0 {
+			break
+		}
+
+		// The segmenter keeps what we give it, so copy it out of our buffer.
+		raw := append([]byte{}, w.buf[:n]...)
+		w.buf = w.buf[n:]
+
+		w.handleBox(b, raw)
+	}
+
+	// Don't let the buffer grow the underlying array forever.
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+
+	if len(w.buf) > maxSegmentBoxSize {
+		return 0, fmt.Errorf("MP4 box too large to segment")
+	}
+
+	return len(buf), nil
+}
+
+func (w *segmentWriter) handleBox(b box, raw []byte) {
+	switch b.kind {
+	case "ftyp":
+		w.init = raw
+	case "moov":
+		w.defaults = parseMoov(b)
+		w.stream.segmenter.setInit(append(w.init, raw...))
+		w.init = nil
+	case "moof":
+		info := parseMoof(b, w.defaults)
+		w.moof = &info
+		w.pending = append(w.pending, raw...)
+	case "mdat":
+		if w.moof == nil {
+			return
+		}
+
+		chunk := append(w.pending, raw...)
+		w.stream.segmenter.addChunk(chunk, w.moof.keyframe,
+			w.timeToDuration(w.moof.decodeTime),
+			w.timeToDuration(w.moof.duration))
+
+		w.pending = nil
+		w.moof = nil
+	case "mfra":
+		// The trailer's random access index is only useful for files.
+	default:
+		w.pending = append(w.pending, raw...)
+	}
+}
+
+// timeToDuration converts a time in the track's timescale.
+func (w *segmentWriter) timeToDuration(t uint64) time.Duration {
+	if w.defaults.timescale == 0 {
+		return 0
+	}
+
+	seconds := t / uint64(w.defaults.timescale)
+	remainder := t % uint64(w.defaults.timescale)
+
+	return time.Duration(seconds)*time.Second +
+		time.Duration(remainder)*time.Second/
+			time.Duration(w.defaults.timescale)
+}
+
+// segment cuts the stream into segments while it is configured to, or while
+// we serve it as HLS, record it, or keep it for /dvr.
+func (s *Stream) segment() {
+	s.runOwnClient("segmenter", func(def StreamDefinition) string {
+		// The orientation is in the init segment, so changing it starts anew.
+		if def.Segments || def.HLS || def.RecordDir != "" || def.DVRWindow > 0 {
+			return fmt.Sprintf("on %v", def.orientation())
+		}
+		return ""
+	}, (*Client).waitForOutput, func(c *Client, def StreamDefinition) error {
+		c.format = &cmafFormat
+		c.options.Orientation = def.orientation()
+		c.reopen = true
+		err := c.writePackets(&segmentWriter{stream: s}, func(string) {},
+			def.libavVerbose(), nil)
+		s.segmenter.endSession()
+		return err
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "fmt"
+
+// startService would run us as a Windows service.
+func startService(stop func()) (func(), error) {
+	return nil, fmt.Errorf("running as a service is only supported on Windows")
+}
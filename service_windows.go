@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// With -service, we run as a Windows service. The service control manager
+// starts us, and we shut down when it tells us to stop, such as when the
+// service is stopped or Windows shuts down. We talk to it through advapi32
+// directly rather than depend on a package for it.
+
+// Values from winsvc.h.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented = 120
+)
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procStartServiceCtrlDispatcher = advapi32.NewProc(
+		"StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc(
+		"RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus = advapi32.NewProc("SetServiceStatus")
+)
+
+// windowsService is the service we run as. The service control manager calls
+// us back on threads of its own, so the callbacks find it here.
+var windowsService = struct {
+	mutex  sync.Mutex
+	handle uintptr
+	state  uint32
+
+	// Calls stop once told to stop.
+	stop     func()
+	stopOnce sync.Once
+
+	// Closed once we registered with the service control manager, or failed
+	// to.
+	registered chan error
+
+	// Closed once we have stopped.
+	stopped chan struct{}
+}{}
+
+// startService tells the service control manager we're running, and calls
+// stop when it tells us to stop. Call the function it returns once we have
+// stopped. It fails if the service control manager didn't start us.
+func startService(stop func()) (func(), error) {
+	windowsService.stop = stop
+	windowsService.registered = make(chan error, 1)
+	windowsService.stopped = make(chan struct{})
+
+	dispatched := make(chan error, 1)
+	go func() {
+		// The dispatcher runs until the service stops, calling serviceMain on a
+		// thread of its own.
+		table := []serviceTableEntry{
+			{
+				name: syscall.StringToUTF16Ptr(""),
+				proc: syscall.NewCallback(serviceMain),
+			},
+			{},
+		}
+		r, _, err := procStartServiceCtrlDispatcher.Call(
+			uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 {
+			dispatched <- fmt.Errorf("unable to connect to the service control manager: %s",
+				err)
+			return
+		}
+		dispatched <- nil
+	}()
+
+	select {
+	case err := <-windowsService.registered:
+		if err != nil {
+			return nil, err
+		}
+	case err := <-dispatched:
+		if err == nil {
+			err = fmt.Errorf("service control manager stopped us before we started")
+		}
+		return nil, err
+	}
+
+	serverLog.Infof("Running as a Windows service")
+
+	return func() {
+		setServiceStatus(serviceStopped, 0)
+		close(windowsService.stopped)
+
+		// Once we report we stopped, the dispatcher returns. Give it a moment so
+		// the service control manager hears from us before we exit.
+		select {
+		case <-dispatched:
+		case <-time.After(time.Second):
+		}
+	}, nil
+}
+
+// serviceMain is the service's ServiceMain. It registers for controls and
+// says we're running, then waits until we stop.
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	name := syscall.StringToUTF16Ptr("")
+	if argc > 0 && argv != nil && *argv != nil {
+		name = *argv
+	}
+
+	handle, _, err := procRegisterServiceCtrlHandlerEx.Call(
+		uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceHandler), 0)
+	if handle == 0 {
+		windowsService.registered <- fmt.Errorf("unable to register service control handler: %s",
+			err)
+		return 0
+	}
+
+	windowsService.mutex.Lock()
+	windowsService.handle = handle
+	windowsService.mutex.Unlock()
+
+	setServiceStatus(serviceRunning, 0)
+	windowsService.registered <- nil
+
+	<-windowsService.stopped
+	return 0
+}
+
+// serviceHandler is the service's HandlerEx. It handles the controls the
+// service control manager sends us.
+func serviceHandler(control, eventType uint32, eventData,
+	context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		// We have shutdownTimeout to finish clients and close listeners, and
+		// then hookTimeout for hook commands.
+		setServiceStatus(serviceStopPending,
+			shutdownTimeout+hookTimeout+5*time.Second)
+		windowsService.stopOnce.Do(func() {
+			serverLog.Infof("Service control manager told us to stop")
+			windowsService.stop()
+		})
+		return 0
+	case serviceControlInterrogate:
+		windowsService.mutex.Lock()
+		state := windowsService.state
+		windowsService.mutex.Unlock()
+		setServiceStatus(state, 0)
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+// setServiceStatus tells the service control manager our state. waitHint is
+// how long until we next tell it, while we stop.
+func setServiceStatus(state uint32, waitHint time.Duration) {
+	windowsService.mutex.Lock()
+	defer windowsService.mutex.Unlock()
+
+	if windowsService.handle == 0 {
+		return
+	}
+	windowsService.state = state
+
+	status := serviceStatus{
+		serviceType:  serviceWin32OwnProcess,
+		currentState: state,
+		waitHint:     uint32(waitHint / time.Millisecond),
+	}
+	if state == serviceRunning {
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+
+	r, _, err := procSetServiceStatus.Call(windowsService.handle,
+		uintptr(unsafe.Pointer(&status)))
+	if r == 0 {
+		serverLog.Errorf("Unable to set service status: %s", err)
+	}
+}
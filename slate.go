@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png" // For slate images.
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With unavailable set to slate, while a stream's input is down, clients get
+// a placeholder video rather than an error or nothing, so dashboards show the
+// camera is offline instead of a spinning player. It says CAMERA OFFLINE and
+// since when, over slate_image if the stream has one, and a dark picture
+// otherwise.
+//
+// We serve it when the input fails to open, and when it fails while open. In
+// the latter case, clients' responses end, since their outputs are the
+// input's, and we keep the slate open for slateLinger so that as they
+// reconnect they get it. While we serve it, we try the input again every
+// slateRetryInterval. Once the input opens, the slate's clients' responses
+// end, and they reconnect to get the stream.
+//
+// We draw the picture ourselves and encode a short video of it as we do
+// time-lapses, then play it in a loop, so this needs no ffmpeg filters (such
+// as lavfi's drawtext, which needs fonts). We make a slate each time the input
+// goes down, for its time, and remove it when we're done with it.
+
+const (
+	// How often we try the input again while serving the slate.
+	slateRetryInterval = 10 * time.Second
+
+	// How long we keep the slate open for clients to reconnect to after the
+	// input fails while open.
+	slateLinger = 10 * time.Second
+
+	// The slate's size without a slate image, and its length and frame rate.
+	// It is a still picture, so it needs few frames.
+	slateWidth     = 640
+	slateHeight    = 360
+	slateFrameRate = 5
+	slateFrames    = 10
+
+	// The largest slate image we take.
+	maxSlateImageWidth  = 1920
+	maxSlateImageHeight = 1080
+)
+
+// validateSlateImage checks the slate image is one we can read.
+func validateSlateImage(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("unable to open slate image: %s", err)
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("unable to read slate image: %s", err)
+	}
+	if config.Width < 2 || config.Height < 2 ||
+		config.Width > maxSlateImageWidth || config.Height > maxSlateImageHeight {
+		return fmt.Errorf("slate image must be at most %dx%d", maxSlateImageWidth,
+			maxSlateImageHeight)
+	}
+	return nil
+}
+
+// makeSlate draws the slate's picture and encodes a video of it into a
+// temporary directory. since is when the input went down.
+func makeSlate(media Media, imageFile string, since time.Time,
+	verbose bool) (string, error) {
+	var background image.Image
+	if imageFile != "" {
+		buf, err := ioutil.ReadFile(imageFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read slate image: %s", err)
+		}
+		background, _, err = image.Decode(bytes.NewReader(buf))
+		if err != nil {
+			return "", fmt.Errorf("unable to decode slate image: %s", err)
+		}
+	}
+
+	picture := drawSlate(background, []string{
+		"CAMERA OFFLINE",
+		"SINCE " + since.Format("2006-01-02 15:04:05"),
+	})
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, picture, nil); err != nil {
+		return "", fmt.Errorf("unable to encode slate picture: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "videostreamer-slate")
+	if err != nil {
+		return "", fmt.Errorf("unable to make slate directory: %s", err)
+	}
+
+	for i := 1; i <= slateFrames; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%06d.jpg", i)),
+			buf.Bytes(), 0644); err != nil {
+			_ = os.RemoveAll(dir)
+			return "", fmt.Errorf("unable to write slate picture: %s", err)
+		}
+	}
+
+	file := filepath.Join(dir, "slate.mp4")
+	if err := media.Timelapse(filepath.Join(dir, "%06d.jpg"), file,
+		slateFrameRate, verbose); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("unable to encode slate: %s", err)
+	}
+
+	for i := 1; i <= slateFrames; i++ {
+		_ = os.Remove(filepath.Join(dir, fmt.Sprintf("%06d.jpg", i)))
+	}
+
+	return file, nil
+}
+
+// drawSlate draws the lines of text in the middle of the background, or of a
+// dark grey picture if there is none, on a dark band so they can be read
+// over any picture.
+func drawSlate(background image.Image, lines []string) *image.RGBA {
+	bounds := image.Rect(0, 0, slateWidth, slateHeight)
+	if background != nil {
+		// Encoders want even sizes.
+		size := background.Bounds().Size()
+		bounds = image.Rect(0, 0, size.X&^1, size.Y&^1)
+	}
+
+	img := image.NewRGBA(bounds)
+	dark := &image.Uniform{C: color.Gray{Y: 0x20}}
+	if background != nil {
+		draw.Draw(img, bounds, background, background.Bounds().Min, draw.Src)
+	} else {
+		draw.Draw(img, bounds, dark, image.Point{}, draw.Src)
+	}
+
+	// Each dot of a glyph is scale pixels square, with a dot's space between
+	// glyphs and two between lines. The longest line takes most of the width.
+	longest := 0
+	for _, line := range lines {
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+	scale := bounds.Dx() * 3 / 4 / (longest * (slateGlyphWidth + 1))
+	if scale < 1 {
+		scale = 1
+	}
+
+	lineHeight := (slateGlyphHeight + 2) * scale
+	top := (bounds.Dy() - len(lines)*lineHeight) / 2
+
+	band := image.Rect(0, top-lineHeight/2, bounds.Dx(),
+		top+len(lines)*lineHeight+lineHeight/2)
+	draw.Draw(img, band, dark, image.Point{}, draw.Src)
+
+	for i, line := range lines {
+		drawText(img, line, top+i*lineHeight, scale)
+	}
+
+	return img
+}
+
+// drawText draws the text across the middle of the picture, in slateFont's
+// capitals, with its top at top.
+func drawText(img *image.RGBA, text string, top, scale int) {
+	light := color.Gray{Y: 0xe0}
+	width := len(text)*(slateGlyphWidth+1)*scale - scale
+	left := (img.Bounds().Dx() - width) / 2
+
+	for i, c := range text {
+		glyph := slateFont[c]
+		for row := 0; row < slateGlyphHeight; row++ {
+			for col := 0; col < slateGlyphWidth; col++ {
+				if glyph[row]&(1<<uint(slateGlyphWidth-1-col)) == 0 {
+					continue
+				}
+				x := left + (i*(slateGlyphWidth+1)+col)*scale
+				y := top + row*scale
+				draw.Draw(img, image.Rect(x, y, x+scale, y+scale),
+					&image.Uniform{C: light}, image.Point{}, draw.Src)
+			}
+		}
+	}
+}
+
+// The size of slateFont's glyphs in dots.
+const (
+	slateGlyphWidth  = 5
+	slateGlyphHeight = 7
+)
+
+// slateFont has the glyphs the slate needs, a row of dots to a byte, the
+// leftmost dot in the highest of the low 5 bits. Characters it doesn't have
+// are blank.
+var slateFont = map[rune][slateGlyphHeight]byte{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x19, 0x15, 0x13, 0x11, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+}
+
+// openSlate makes a slate for the stream and opens it as its input. since is
+// when the input went down. We record the stream's input format and URL on
+// it, as if it were the input, so that if they change we close it as we would
+// the input.
+func (s *Stream) openSlate(def StreamDefinition, since time.Time) (*Input,
+	error) {
+	file, err := makeSlate(s.media, def.SlateImage, since, def.libavVerbose())
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := s.media.OpenInput("", file, nil, def.openTimeout(),
+		def.libavVerbose())
+	if err != nil {
+		_ = os.RemoveAll(filepath.Dir(file))
+		return nil, fmt.Errorf("unable to open slate: %s", err)
+	}
+
+	return &Input{
+		MediaInput:  input,
+		format:      def.InputFormat,
+		url:         def.InputURL,
+		options:     def.InputOptions,
+		expandedURL: file,
+		slate:       true,
+		retryAt:     time.Now().Add(slateRetryInterval),
+	}, nil
+}
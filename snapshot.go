@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// We can archive a snapshot of a stream every so often, such as to look back
+// over a day at a glance, whether or not anyone is watching. Every
+// snapshot_interval we save a JPEG of a frame at full size to
+// <dir>/<stream>/<stream>-20060102T150405Z.jpg, named for when we took it in
+// UTC. With snapshot_retention set, we remove snapshots older than that.
+//
+// With snapshot_s3_url set, we also upload each snapshot to that S3 bucket,
+// under the same name. Retention doesn't apply there. Buckets have their own
+// lifecycle rules for that.
+
+const (
+	// Defaults unless the stream's definition says otherwise.
+	defaultSnapshotInterval = time.Minute
+
+	// How often we look for snapshots to remove.
+	snapshotPruneInterval = time.Minute
+
+	// Snapshots waiting to upload. If uploading falls further behind than
+	// this, we skip uploading snapshots until it catches up.
+	snapshotUploadQueue = 10
+)
+
+// snapshotArchiver saves snapshots.
+type snapshotArchiver struct {
+	name string
+
+	// Where the stream's snapshots go, if on disk.
+	dir string
+
+	interval  time.Duration
+	retention time.Duration
+
+	lastSaved  time.Time
+	lastPruned time.Time
+
+	bucket  *s3Bucket
+	uploads chan snapshot
+}
+
+// snapshot is a snapshot to upload.
+type snapshot struct {
+	key  string
+	jpeg []byte
+}
+
+// snapshotInterval is how often we save a snapshot.
+func (d StreamDefinition) snapshotInterval() time.Duration {
+	if d.SnapshotInterval > 0 {
+		return time.Duration(d.SnapshotInterval * float64(time.Second))
+	}
+	return defaultSnapshotInterval
+}
+
+func newSnapshotArchiver(def StreamDefinition) *snapshotArchiver {
+	a := &snapshotArchiver{
+		name:      def.Name,
+		interval:  def.snapshotInterval(),
+		retention: time.Duration(def.SnapshotRetention * float64(time.Second)),
+	}
+
+	if def.SnapshotDir != "" {
+		a.dir = filepath.Join(def.SnapshotDir, def.Name)
+	}
+
+	if def.SnapshotS3URL != "" {
+		bucket, err := newS3Bucket(def.SnapshotS3URL)
+		if err != nil {
+			encoderLog.Errorf("snapshot: %s: Not uploading snapshots: %s", a.name,
+				err)
+		} else {
+			a.bucket = bucket
+			a.uploads = make(chan snapshot, snapshotUploadQueue)
+			go a.upload()
+		}
+	}
+
+	return a
+}
+
+func (a *snapshotArchiver) frame(decoder MediaDecoder, now time.Time) error {
+	if now.Sub(a.lastSaved) < a.interval {
+		return nil
+	}
+	a.lastSaved = now
+
+	// A frame we can't encode shouldn't stop the other analysers, so we only
+	// log it.
+	var buf []byte
+	var err error
+	if !transcodes.run(backgroundTranscodeWait, func() {
+		buf, err = decoder.JPEG(0, false)
+	}) {
+		encoderLog.Debugf("snapshot: %s: Skipping snapshot, encoders busy", a.name)
+		return nil
+	}
+	if err != nil {
+		encoderLog.Warnf("snapshot: %s: %s", a.name, err)
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%s.jpg", a.name,
+		now.UTC().Format("20060102T150405Z"))
+
+	if a.dir != "" {
+		if err := a.save(name, buf); err != nil {
+			encoderLog.Errorf("snapshot: %s: Unable to save snapshot: %s", a.name,
+				err)
+		}
+
+		if a.retention > 0 && now.Sub(a.lastPruned) >= snapshotPruneInterval {
+			a.lastPruned = now
+			a.prune(now)
+		}
+	}
+
+	if a.uploads != nil {
+		select {
+		case a.uploads <- snapshot{key: a.name + "/" + name, jpeg: buf}:
+		default:
+			encoderLog.Warnf("snapshot: %s: Too slow uploading, skipping %s",
+				a.name, name)
+		}
+	}
+
+	return nil
+}
+
+func (a *snapshotArchiver) stop(now time.Time) {
+	if a.uploads != nil {
+		close(a.uploads)
+	}
+}
+
+// save writes a snapshot to disk. We write it under another name first so
+// that there is never a partial snapshot amongst the others.
+func (a *snapshotArchiver) save(name string, buf []byte) error {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(a.dir, name)
+	if err := ioutil.WriteFile(path+".tmp", buf, 0644); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// prune removes snapshots older than the retention.
+func (a *snapshotArchiver) prune(now time.Time) {
+	entries, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		encoderLog.Errorf("snapshot: %s: %s", a.name, err)
+		return
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), ".jpg") ||
+			now.Sub(entry.ModTime()) < a.retention {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(a.dir, entry.Name())); err != nil {
+			encoderLog.Errorf("snapshot: %s: Unable to remove snapshot: %s",
+				a.name, err)
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		encoderLog.Debugf("snapshot: %s: Removed %d old snapshots", a.name,
+			removed)
+	}
+}
+
+// upload uploads snapshots until we stop.
+func (a *snapshotArchiver) upload() {
+	for snapshot := range a.uploads {
+		if err := a.bucket.put(snapshot.key, "image/jpeg",
+			snapshot.jpeg); err != nil {
+			encoderLog.Warnf("snapshot: %s: Unable to upload %s: %s", a.name,
+				snapshot.key, err)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import "syscall"
+
+// setReusePort sets SO_REUSEPORT on the socket. This lets several processes
+// listen on the same port. Unlike on Linux, the kernel does not necessarily
+// spread connections between them.
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+		syscall.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// syscall does not define SO_REUSEPORT for Linux.
+const soReusePort = 0xf
+
+// setReusePort sets SO_REUSEPORT on the socket. This lets several processes
+// listen on the same port, with the kernel spreading connections between them.
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
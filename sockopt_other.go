@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "fmt"
+
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
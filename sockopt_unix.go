@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// listenBacklog calls listen(2) on the socket to change its backlog.
+func listenBacklog(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+// listenBacklog would change the socket's backlog. Windows ignores calling
+// listen() again on a listening socket, so we can't.
+func listenBacklog(fd uintptr, backlog int) error {
+	return fmt.Errorf("changing the backlog is not supported on Windows")
+}
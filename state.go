@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Besides events such as motion, we publish a stream's state each time it
+// changes, so that dashboards following /events can stay up to date without
+// polling /status. These events have the stream's whole state in state:
+//
+//   clients          A client connected or disconnected.
+//   input_open       We opened the input.
+//   input_closed     We closed the input, such as because no one is watching
+//                    or it failed.
+//   recording_start  We started recording.
+//   recording_stop   We stopped recording.
+//   paused           An admin paused the stream.
+//   resumed          An admin resumed the stream.
+//
+// /events also sends a state event for each stream when a client connects.
+//
+// These are only for /events. They happen too often for the webhook and
+// MQTT, and aren't what recordings mark.
+
+// StateEvent is a stream's state.
+type StateEvent struct {
+	// How many clients are watching.
+	Clients int `json:"clients"`
+
+	// Whether the input is open.
+	Input bool `json:"input"`
+
+	// Whether we are recording.
+	Recording bool `json:"recording"`
+
+	// Whether an admin paused the stream.
+	Paused bool `json:"paused"`
+}
+
+// streamState is what we track of a stream's state for state events.
+type streamState struct {
+	mutex *sync.Mutex
+
+	input     bool
+	recording bool
+}
+
+func newStreamState() *streamState {
+	return &streamState{mutex: &sync.Mutex{}}
+}
+
+// State returns the stream's state.
+func (s *Stream) State() StateEvent {
+	s.clientsMutex.Lock()
+	clients := len(s.connected)
+	s.clientsMutex.Unlock()
+
+	s.state.mutex.Lock()
+	defer s.state.mutex.Unlock()
+
+	return StateEvent{
+		Clients:   clients,
+		Input:     s.state.input,
+		Recording: s.state.recording,
+		Paused:    s.Paused(),
+	}
+}
+
+// setInputOpen notes whether the input is open, publishing an event if that
+// changed.
+func (s *Stream) setInputOpen(open bool) {
+	s.state.mutex.Lock()
+	changed := s.state.input != open
+	s.state.input = open
+	s.state.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if open {
+		s.publishState("input_open")
+	} else {
+		s.publishState("input_closed")
+	}
+}
+
+// setRecording notes whether we are recording, publishing an event if that
+// changed.
+func (s *Stream) setRecording(recording bool) {
+	s.state.mutex.Lock()
+	changed := s.state.recording != recording
+	s.state.recording = recording
+	s.state.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if recording {
+		s.publishState("recording_start")
+	} else {
+		s.publishState("recording_stop")
+	}
+}
+
+// publishState publishes an event of the type with the stream's state.
+func (s *Stream) publishState(eventType string) {
+	state := s.State()
+	events.publish(Event{
+		Type:   eventType,
+		Stream: s.Definition().Name,
+		Time:   time.Now(),
+		State:  &state,
+	})
+}
@@ -0,0 +1,905 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StreamDefinition describes one stream we serve.
+//
+// Changing InputFormat or InputURL requires reopening the input (and so
+// disconnecting any clients). Other settings take effect without disturbing
+// the input or connected clients.
+type StreamDefinition struct {
+	// Name identifies the stream. Clients request /stream/<name>.
+	Name string `json:"name"`
+
+	InputFormat string `json:"input_format"`
+	InputURL    string `json:"input_url"`
+
+	// InputOptions are the input format's options, such as video_size and
+	// framerate for a capture device, or rtsp_transport for RTSP.
+	InputOptions map[string]string `json:"input_options"`
+
+	// Bitrate is roughly the input's bitrate in kbit/s, for picking what to
+	// serve clients asking for at most so much. 0 means we measure it.
+	Bitrate int `json:"bitrate"`
+
+	// Quirks names the camera's quirks, such as hikvision, to fill in the
+	// settings known to work with it.
+	Quirks string `json:"quirks"`
+
+	// Profiles are other inputs clients may pick instead, such as a camera's
+	// substream.
+	Profiles []StreamProfile `json:"profiles"`
+
+	// FallbackProfile is the profile new clients get while we're overloaded,
+	// unless they ask for one.
+	FallbackProfile string `json:"fallback_profile"`
+
+	// ReconnectGrace is how long, in seconds, we keep the input open after the
+	// last client leaves, and let clients resume where they left off. See
+	// resume.go. The default is 0.
+	ReconnectGrace float64 `json:"reconnect_grace"`
+
+	// WarmHours are the hours of the day during which we keep the input open
+	// even without clients, such as "07:00-09:30,17:00-22:00".
+	WarmHours string `json:"warm_hours"`
+
+	// Priority is how important the stream is under load, higher being more
+	// important. Less important streams fall back to profiles and have their
+	// clients shed first. The default is 0.
+	Priority int `json:"priority"`
+
+	// Verbose turns on verbose libav logging for this stream, as if libav's log
+	// level was debug.
+	Verbose bool `json:"verbose"`
+
+	// MaxClients limits how many clients may stream at once. 0 means no limit.
+	MaxClients int `json:"max_clients"`
+
+	// Headers are added to stream responses. They can override our defaults
+	// (such as Cache-Control).
+	Headers map[string]string `json:"headers"`
+
+	// AllowedOrigins limits the sites whose pages may embed the stream, such as
+	// https://example.com, example.com, or *.example.com. Empty means any.
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	// RefererRequired refuses requests that say neither what page they are
+	// from nor what site, when AllowedOrigins is set.
+	RefererRequired bool `json:"referer_required"`
+
+	// NoChunking serves the stream as a raw body ending when the connection
+	// closes, as with HTTP/1.0, rather than with chunked transfer encoding.
+	// Some embedded players mishandle chunking.
+	NoChunking bool `json:"no_chunking"`
+
+	// DefaultFormat is the container clients get on /stream when they don't ask
+	// for one: mp4, ts, mjpeg, or multipart. The default is mp4.
+	DefaultFormat string `json:"default_format"`
+
+	// IncludeAudio puts the input's audio in the MP4 and MPEG-TS clients get on
+	// /stream, alongside the video, rather than only serving it on /audio.
+	IncludeAudio bool `json:"include_audio"`
+
+	// SilentAudio adds a silent AAC track to the MP4 and MPEG-TS clients get
+	// on /stream when they don't get the input's audio, for players that won't
+	// play video alone, such as some TVs.
+	SilentAudio bool `json:"silent_audio"`
+
+	// Rotate turns the picture this many degrees clockwise: 0, 90, 180, or 270.
+	// HFlip and VFlip then mirror it left to right and top to bottom. This is
+	// for cameras mounted on their side or upside down.
+	Rotate int  `json:"rotate"`
+	HFlip  bool `json:"hflip"`
+	VFlip  bool `json:"vflip"`
+
+	// Dewarp takes a flat view through a fisheye lens for the pictures we
+	// decode, such as for MJPEG clients. The video we remux is as the camera
+	// sends it.
+	Dewarp *Dewarp `json:"dewarp"`
+
+	// Compare is another stream to show beside this one at /compare/<name>.
+	// See compare.go.
+	Compare *Comparison `json:"compare"`
+
+	// FragmentDuration cuts the MP4 we send clients into fragments at least
+	// this often, in seconds, between keyframes too. 0 means only at keyframes.
+	FragmentDuration float64 `json:"fragment_duration"`
+
+	// BufferOutput lets libav and net/http buffer what we send clients rather
+	// than writing out each packet at once. Fewer writes, more latency.
+	BufferOutput bool `json:"buffer_output"`
+
+	// MaxInterleaveDelta writes packets to clients through libav's
+	// interleaving queue, holding each at most this many seconds. 0 means we
+	// write each packet as it arrives.
+	MaxInterleaveDelta float64 `json:"max_interleave_delta"`
+
+	// Segments cuts the stream into CMAF segments. While this is on, the input
+	// stays open even without clients.
+	Segments bool `json:"segments"`
+
+	// HLS serves the stream's segments as HLS at /hls/<name>/stream.m3u8. This
+	// cuts the stream into segments as Segments does.
+	HLS bool `json:"hls"`
+
+	// DVRWindow keeps this many seconds of the stream's segments, up to an
+	// hour, so that players of /dvr can pause and seek back. This cuts the
+	// stream into segments as Segments does.
+	DVRWindow float64 `json:"dvr_window"`
+
+	// RTPOutput sends the stream as MPEG-TS over RTP to this URL, such as
+	// rtp://239.0.0.1:5004 for multicast. While this is set, the input stays
+	// open even without clients.
+	RTPOutput string `json:"rtp_output"`
+
+	// RTPFEC adds forward error correction to the RTP output, as SMPTE 2022-1
+	// (Pro-MPEG) packets on the two ports following the output's. It is the
+	// number of columns and rows of the FEC matrix, such as l=5:d=20.
+	RTPFEC string `json:"rtp_fec"`
+
+	// NATSURL is a NATS server to publish the packets we read to, such as
+	// nats://localhost:4222, under NATSSubject. The subject defaults to
+	// videostreamer.<name>.
+	NATSURL     string `json:"nats_url"`
+	NATSSubject string `json:"nats_subject"`
+
+	// Motion detects motion in the video and publishes motion events. This
+	// decodes the video, which takes far more CPU than remuxing. While this is
+	// on, the input stays open even without clients.
+	Motion bool `json:"motion"`
+
+	// MotionThreshold is the fraction of the picture that must change to count
+	// as motion, such as 0.02. 0 means the default.
+	MotionThreshold float64 `json:"motion_threshold"`
+
+	// PrivacyMasks are regions to black out in the pictures we decode, such as
+	// for MJPEG clients, snapshots, and motion detection. The video we remux is
+	// as the camera sends it.
+	PrivacyMasks []Region `json:"privacy_masks"`
+
+	// AnalysisURL is a service to post a JPEG of a frame to every so often,
+	// such as an object detection service. It responds with labels for what it
+	// found. Like motion detection, this decodes the video.
+	AnalysisURL string `json:"analysis_url"`
+
+	// AnalysisInterval is how often to post a frame, in seconds. 0 means the
+	// default.
+	AnalysisInterval float64 `json:"analysis_interval"`
+
+	// AnalysisWidth is the most pixels wide the frames we post are. We scale
+	// wider frames down. 0 means the default.
+	AnalysisWidth int `json:"analysis_width"`
+
+	// AudioDetection detects sound louder than AudioThreshold and publishes
+	// audio events. This decodes the audio. While this is on, the input stays
+	// open even without clients.
+	AudioDetection bool `json:"audio_detection"`
+
+	// AudioThreshold is the level in dBFS above which there is activity, such
+	// as -30. 0 means the default.
+	AudioThreshold float64 `json:"audio_threshold"`
+
+	// MaxAVDrift is how far in seconds the input's audio clock may drift from
+	// its video clock before we publish an av_drift event. 0 means the default.
+	MaxAVDrift float64 `json:"max_av_drift"`
+
+	// CorrectAVDrift shifts the audio's timestamps to cancel drift.
+	CorrectAVDrift bool `json:"correct_av_drift"`
+
+	// AlertAfter is how long in seconds we may read nothing from the input
+	// before we publish a stream_down event. 0 means we don't. While this is
+	// on, the input stays open even without clients.
+	AlertAfter float64 `json:"alert_after"`
+
+	// OnFirstClient and OnLastClient are shell commands we run when the first
+	// client joins and when the last client leaves.
+	OnFirstClient string `json:"on_first_client"`
+	OnLastClient  string `json:"on_last_client"`
+
+	// OpenTimeout is how long opening the input may take, in seconds. 0 means
+	// the default.
+	OpenTimeout float64 `json:"open_timeout"`
+
+	// OpenRetries is how many more times we try to open the input before we
+	// tell waiting clients it is unavailable.
+	OpenRetries int `json:"open_retries"`
+
+	// Unavailable is what to do when the input can't be opened: wait, exit,
+	// 503, or slate. See unavailable.go.
+	Unavailable string `json:"unavailable"`
+
+	// SlateImage is a JPEG or PNG file to show in the slate, with unavailable
+	// set to slate.
+	SlateImage string `json:"slate_image"`
+
+	// ReadTimeout is how long reading a packet from the input may take, in
+	// seconds, before we consider it dead and reopen it. 0 means the default.
+	ReadTimeout float64 `json:"read_timeout"`
+
+	// Realtime reads the input no faster than real time, going by its packets'
+	// times. This is for inputs that aren't live, such as files. We always read
+	// files on disk, and folder and playlist inputs, this way.
+	Realtime bool `json:"realtime"`
+
+	// RealtimeBurst is how far ahead of real time we may read such inputs, in
+	// seconds. The default is 0.
+	RealtimeBurst float64 `json:"realtime_burst"`
+
+	// Loop starts the input again from the beginning when it ends, such as a
+	// file, with timestamps carrying on. Looping implies Realtime.
+	Loop bool `json:"loop"`
+
+	// DiscardCorrupt drops packets the demuxer found to be corrupt rather than
+	// passing them on to clients.
+	DiscardCorrupt bool `json:"discard_corrupt"`
+
+	// RecordDir is a directory to record the stream to. Recording cuts the
+	// stream into segments as Segments does, and keeps the input open even
+	// without clients.
+	RecordDir string `json:"record_dir"`
+
+	// RecordFileLength is how long each recording file is at least, in
+	// seconds. Files end at the first keyframe after this. 0 means the
+	// default.
+	RecordFileLength float64 `json:"record_file_length"`
+
+	// RecordFaststart rewrites each recording file once complete as a regular
+	// MP4 with its index at the front, which streams better over HTTP.
+	RecordFaststart bool `json:"record_faststart"`
+
+	// RecordOnEvents records only around events of these types, such as
+	// motion_start, rather than all the time. For a type ending in _start, we
+	// record until its _end event as well.
+	RecordOnEvents []string `json:"record_on_events"`
+
+	// RecordPreRoll is how much from before an event to record, in seconds, up
+	// to 120. 0 means the default.
+	RecordPreRoll float64 `json:"record_pre_roll"`
+
+	// RecordPostRoll is how much after an event to record, in seconds. 0 means
+	// the default.
+	RecordPostRoll float64 `json:"record_post_roll"`
+
+	// TimelapseDir is a directory to save time-lapse videos of the stream to.
+	// Like motion detection, this decodes the video. It may be the same as
+	// RecordDir.
+	TimelapseDir string `json:"timelapse_dir"`
+
+	// TimelapseInterval is how often to take a frame for time-lapses, in
+	// seconds. 0 means the default.
+	TimelapseInterval float64 `json:"timelapse_interval"`
+
+	// TimelapsePeriod is how long each time-lapse covers, in seconds, up to a
+	// day. Periods start from local midnight. 0 means the default, a day.
+	TimelapsePeriod float64 `json:"timelapse_period"`
+
+	// SnapshotDir is a directory to save a snapshot of the stream to every
+	// SnapshotInterval. Like motion detection, this decodes the video.
+	SnapshotDir string `json:"snapshot_dir"`
+
+	// SnapshotInterval is how often to save a snapshot, in seconds. 0 means
+	// the default.
+	SnapshotInterval float64 `json:"snapshot_interval"`
+
+	// SnapshotRetention is how long to keep snapshots in SnapshotDir, in
+	// seconds. 0 means we keep them.
+	SnapshotRetention float64 `json:"snapshot_retention"`
+
+	// SnapshotS3URL is an S3 bucket to upload snapshots to as well, or
+	// instead, such as https://s3.us-east-1.amazonaws.com/bucket/prefix.
+	SnapshotS3URL string `json:"snapshot_s3_url"`
+}
+
+// Config holds what we read from the configuration file.
+type Config struct {
+	Streams []StreamDefinition `json:"streams"`
+}
+
+// Stream is a stream we serve. Each has its own encoder goroutine.
+type Stream struct {
+	// How many clients are connected. Access atomically.
+	clients int32
+
+	// 1 if an admin paused the stream. Access atomically.
+	paused int32
+
+	// Until when, in Unix nanoseconds, we refuse clients because the input
+	// failed to open, with the 503 unavailable setting. Access atomically.
+	unavailableUntil int64
+
+	// Protect access to def, codecs, and labels. def may be replaced when we
+	// reload. codecs is what the input had when we last opened it, or nil if we
+	// have not opened it. labels are from the last frame we analysed, if any.
+	mutex  *sync.RWMutex
+	def    StreamDefinition
+	codecs *StreamCodecs
+	labels *StreamLabels
+
+	// Clients provide encoder info about themselves when they start up.
+	ClientChan chan *Client
+
+	// Done when the stream stops. This happens if the stream is removed from
+	// the configuration, or when we shut down. Everything serving the stream
+	// stops with it.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stats *StreamStats
+
+	// Clients connected to the stream, for reporting on them.
+	clientsMutex *sync.Mutex
+	connected    map[*Client]struct{}
+
+	limits QueueLimits
+
+	media Media
+
+	// The stream cut into segments, if its definition asks for them.
+	segmenter *Segmenter
+
+	// Whether events call for recording, if we record only around them.
+	trigger *recordTrigger
+
+	// How long clients recently took to start.
+	joins *joinStats
+
+	// What we publish state events about.
+	state *streamState
+
+	// Commands to run as clients come and go.
+	hooks *hookQueue
+}
+
+// Streams is the set of streams we serve.
+type Streams struct {
+	// Streams' contexts derive from this.
+	ctx context.Context
+
+	mutex   *sync.RWMutex
+	streams map[string]*Stream
+
+	// The stream to serve at /stream. This is the first one defined.
+	defaultName string
+
+	limits QueueLimits
+
+	media Media
+}
+
+// readConfig reads and validates a configuration file.
+func readConfig(file string) (Config, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Config{}, fmt.Errorf("error reading config: %s", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return Config{}, fmt.Errorf("error parsing config: %s", err)
+	}
+
+	if len(config.Streams) == 0 {
+		return Config{}, fmt.Errorf("no streams defined")
+	}
+
+	seen := map[string]struct{}{}
+	for i, def := range config.Streams {
+		if err := def.validate(); err != nil {
+			return Config{}, err
+		}
+
+		def = def.withQuirks()
+		config.Streams[i] = def
+		def.warnUnmasked()
+
+		for _, d := range append([]StreamDefinition{def},
+			def.profileDefinitions()...) {
+			if _, ok := seen[d.Name]; ok {
+				return Config{}, fmt.Errorf("stream %s defined more than once", d.Name)
+			}
+			seen[d.Name] = struct{}{}
+		}
+	}
+
+	for _, def := range config.Streams {
+		if def.Compare == nil {
+			continue
+		}
+		if _, ok := seen[def.Compare.With]; !ok {
+			return Config{}, fmt.Errorf("stream %s: no stream %s to compare with",
+				def.Name, def.Compare.With)
+		}
+	}
+
+	return config, nil
+}
+
+func (d StreamDefinition) validate() error {
+	if len(d.Name) == 0 {
+		return fmt.Errorf("stream is missing a name")
+	}
+
+	if len(d.InputFormat) == 0 {
+		return fmt.Errorf("stream %s: you must provide an input format", d.Name)
+	}
+
+	if len(d.InputURL) == 0 {
+		return fmt.Errorf("stream %s: you must provide an input URL", d.Name)
+	}
+
+	if err := checkURLTemplate(d.InputURL); err != nil {
+		return fmt.Errorf("stream %s: invalid input URL: %s", d.Name, err)
+	}
+
+	if d.Bitrate < 0 {
+		return fmt.Errorf("stream %s: bitrate must not be negative", d.Name)
+	}
+
+	if err := validateQuirks(d.Quirks, d.InputFormat); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if err := d.validateProfiles(); err != nil {
+		return err
+	}
+
+	if d.NATSURL != "" {
+		if _, err := parseNATSURL(d.NATSURL); err != nil {
+			return fmt.Errorf("stream %s: invalid NATS URL: %s", d.Name, err)
+		}
+	}
+
+	if err := validateNATSSubject(d.NATSSubject); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if len(d.RTPFEC) > 0 && len(d.RTPOutput) == 0 {
+		return fmt.Errorf("stream %s: FEC requires an RTP output", d.Name)
+	}
+
+	if d.MotionThreshold < 0 || d.MotionThreshold > 1 {
+		return fmt.Errorf("stream %s: motion threshold must be between 0 and 1",
+			d.Name)
+	}
+
+	if err := validateMasks(d.PrivacyMasks); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if d.AnalysisInterval < 0 || d.AnalysisWidth < 0 {
+		return fmt.Errorf("stream %s: analysis interval and width must not be negative",
+			d.Name)
+	}
+
+	if d.AudioThreshold > 0 {
+		return fmt.Errorf("stream %s: audio threshold must not be positive",
+			d.Name)
+	}
+
+	if d.MaxAVDrift < 0 {
+		return fmt.Errorf("stream %s: max A/V drift must not be negative", d.Name)
+	}
+
+	if d.AlertAfter < 0 {
+		return fmt.Errorf("stream %s: alert after must not be negative", d.Name)
+	}
+
+	if d.OpenTimeout < 0 || d.OpenRetries < 0 {
+		return fmt.Errorf("stream %s: open timeout and retries must not be negative",
+			d.Name)
+	}
+
+	if d.ReadTimeout < 0 {
+		return fmt.Errorf("stream %s: read timeout must not be negative", d.Name)
+	}
+
+	if err := validateUnavailable(d.Unavailable); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if d.SlateImage != "" {
+		if d.Unavailable != unavailableSlate {
+			return fmt.Errorf("stream %s: slate image requires unavailable to be %s",
+				d.Name, unavailableSlate)
+		}
+		if err := validateSlateImage(d.SlateImage); err != nil {
+			return fmt.Errorf("stream %s: %s", d.Name, err)
+		}
+	}
+
+	if d.RecordFileLength < 0 {
+		return fmt.Errorf("stream %s: record file length must not be negative",
+			d.Name)
+	}
+
+	if d.RecordPreRoll < 0 || d.RecordPreRoll > maxRecordPreRoll.Seconds() {
+		return fmt.Errorf("stream %s: record pre-roll must be between 0 and %g",
+			d.Name, maxRecordPreRoll.Seconds())
+	}
+
+	for name := range d.InputOptions {
+		if name == "" {
+			return fmt.Errorf("stream %s: input option names must not be empty",
+				d.Name)
+		}
+	}
+
+	if _, ok := formatContentTypes[d.DefaultFormat]; d.DefaultFormat != "" &&
+		!ok {
+		return fmt.Errorf("stream %s: unknown default format: %s", d.Name,
+			d.DefaultFormat)
+	}
+
+	if d.RealtimeBurst < 0 || d.RealtimeBurst > maxRealtimeBurst.Seconds() {
+		return fmt.Errorf("stream %s: realtime burst must be between 0 and %g seconds",
+			d.Name, maxRealtimeBurst.Seconds())
+	}
+
+	if d.WarmHours != "" {
+		if _, err := parseWarmHours(d.WarmHours); err != nil {
+			return fmt.Errorf("stream %s: %s", d.Name, err)
+		}
+	}
+
+	if err := validateReconnectGrace(d.ReconnectGrace); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if err := validatePriority(d.Priority); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if err := validateRotation(d.Rotate); err != nil {
+		return fmt.Errorf("stream %s: %s", d.Name, err)
+	}
+
+	if d.Dewarp != nil {
+		if err := d.Dewarp.validate(); err != nil {
+			return fmt.Errorf("stream %s: %s", d.Name, err)
+		}
+	}
+
+	if d.Compare != nil {
+		if err := d.Compare.validate(d.Name); err != nil {
+			return err
+		}
+	}
+
+	if d.FragmentDuration < 0 {
+		return fmt.Errorf("stream %s: fragment duration must not be negative",
+			d.Name)
+	}
+
+	if d.MaxInterleaveDelta < 0 {
+		return fmt.Errorf("stream %s: max interleave delta must not be negative",
+			d.Name)
+	}
+
+	if d.DVRWindow < 0 || d.DVRWindow > maxDVRWindow.Seconds() {
+		return fmt.Errorf("stream %s: DVR window must be between 0 and %g",
+			d.Name, maxDVRWindow.Seconds())
+	}
+
+	if d.RecordPostRoll < 0 {
+		return fmt.Errorf("stream %s: record post-roll must not be negative",
+			d.Name)
+	}
+
+	if len(d.RecordOnEvents) > 0 && d.RecordDir == "" {
+		return fmt.Errorf("stream %s: recording on events requires a record directory",
+			d.Name)
+	}
+
+	if d.SnapshotInterval < 0 || d.SnapshotRetention < 0 {
+		return fmt.Errorf("stream %s: snapshot interval and retention must not be negative",
+			d.Name)
+	}
+
+	if d.SnapshotS3URL != "" {
+		if _, err := parseS3URL(d.SnapshotS3URL); err != nil {
+			return fmt.Errorf("stream %s: invalid snapshot S3 URL: %s", d.Name, err)
+		}
+	}
+
+	if d.TimelapseInterval < 0 {
+		return fmt.Errorf("stream %s: timelapse interval must not be negative",
+			d.Name)
+	}
+
+	if d.TimelapsePeriod < 0 ||
+		d.TimelapsePeriod > (24*time.Hour).Seconds() {
+		return fmt.Errorf("stream %s: timelapse period must be between 0 and a day",
+			d.Name)
+	}
+
+	return nil
+}
+
+// openTimeout is how long opening the input may take.
+func (d StreamDefinition) openTimeout() time.Duration {
+	if d.OpenTimeout > 0 {
+		return time.Duration(d.OpenTimeout * float64(time.Second))
+	}
+	return defaultOpenTimeout
+}
+
+// readTimeout is how long reading a packet from the input may take.
+func (d StreamDefinition) readTimeout() time.Duration {
+	if d.ReadTimeout > 0 {
+		return time.Duration(d.ReadTimeout * float64(time.Second))
+	}
+	return defaultReadTimeout
+}
+
+// outputOptions is how we tune outputs to the stream's clients.
+func (d StreamDefinition) outputOptions() OutputOptions {
+	return OutputOptions{
+		FragmentDuration: time.Duration(d.FragmentDuration * float64(time.Second)),
+		Buffered:         d.BufferOutput,
+		MaxInterleaveDelta: time.Duration(d.MaxInterleaveDelta *
+			float64(time.Second)),
+		Orientation: d.orientation(),
+		SilentAudio: d.SilentAudio,
+	}
+}
+
+// libavVerbose decides whether libav logs verbosely for this stream.
+func (d StreamDefinition) libavVerbose() bool {
+	return d.Verbose || libavLog.enabled(levelDebug)
+}
+
+func newStreams(ctx context.Context, media Media,
+	limits QueueLimits) *Streams {
+	return &Streams{
+		ctx:     ctx,
+		mutex:   &sync.RWMutex{},
+		streams: map[string]*Stream{},
+		limits:  limits,
+		media:   media,
+	}
+}
+
+// Apply updates the streams to match the given definitions.
+//
+// New streams start up. Removed streams stop and their clients disconnect.
+// Streams whose definition changed get the new definition. If the input
+// changed, the encoder notices and reopens it. Otherwise the change applies
+// without interrupting anything.
+func (s *Streams) Apply(defs []StreamDefinition) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wanted := map[string]struct{}{}
+
+	// Each profile is a stream of its own.
+	all := []StreamDefinition{}
+	for _, def := range defs {
+		all = append(all, def)
+		all = append(all, def.profileDefinitions()...)
+	}
+
+	for _, def := range all {
+		wanted[def.Name] = struct{}{}
+
+		stream, ok := s.streams[def.Name]
+		if !ok {
+			ctx, cancel := context.WithCancel(s.ctx)
+			stream = &Stream{
+				mutex:        &sync.RWMutex{},
+				def:          def,
+				ClientChan:   make(chan *Client),
+				ctx:          ctx,
+				cancel:       cancel,
+				stats:        &StreamStats{},
+				clientsMutex: &sync.Mutex{},
+				connected:    map[*Client]struct{}{},
+				limits:       s.limits,
+				media:        s.media,
+				segmenter:    newSegmenter(),
+				trigger:      newRecordTrigger(),
+				joins:        newJoinStats(),
+				state:        newStreamState(),
+				hooks:        newHookQueue(),
+			}
+			s.streams[def.Name] = stream
+
+			go stream.encoder()
+			go stream.segment()
+			go stream.sendRTP()
+			go stream.publishNATS()
+			go stream.analyseVideo()
+			go stream.detectAudio()
+			go stream.alert()
+			go stream.keepWarm()
+			go stream.record()
+			go stream.recordEvents()
+			hooksRunning.Add(1)
+			go stream.runHooks()
+
+			serverLog.Infof("Added stream %s", def.Name)
+			continue
+		}
+
+		old := stream.Definition()
+		if reflect.DeepEqual(old, def) {
+			continue
+		}
+
+		stream.setDefinition(def)
+
+		if old.InputFormat != def.InputFormat || old.InputURL != def.InputURL {
+			serverLog.Infof("Updated stream %s (input changed)", def.Name)
+		} else {
+			serverLog.Infof("Updated stream %s", def.Name)
+		}
+	}
+
+	for name, stream := range s.streams {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+
+		stream.cancel()
+		delete(s.streams, name)
+
+		serverLog.Infof("Removed stream %s", name)
+	}
+
+	s.defaultName = defs[0].Name
+}
+
+// Get finds a stream by name. An empty name means the default stream.
+func (s *Streams) Get(name string) *Stream {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if name == "" {
+		name = s.defaultName
+	}
+
+	return s.streams[name]
+}
+
+// Definition returns the stream's current definition.
+func (s *Stream) Definition() StreamDefinition {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.def
+}
+
+func (s *Stream) addClient(c *Client) {
+	s.clientsMutex.Lock()
+
+	s.connected[c] = struct{}{}
+	if len(s.connected) == 1 {
+		s.queueHook("first_client", c)
+	}
+	s.clientsMutex.Unlock()
+
+	s.publishState("clients")
+}
+
+func (s *Stream) removeClient(c *Client) {
+	s.clientsMutex.Lock()
+
+	delete(s.connected, c)
+	if len(s.connected) == 0 {
+		s.queueHook("last_client", c)
+	}
+	s.clientsMutex.Unlock()
+
+	s.publishState("clients")
+}
+
+// Clients returns the clients connected to the stream, oldest first.
+func (s *Stream) Clients() []*Client {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	clients := make([]*Client, 0, len(s.connected))
+	for c := range s.connected {
+		clients = append(clients, c)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Connected.Before(clients[j].Connected)
+	})
+
+	return clients
+}
+
+// runOwnClient runs a client of our own, such as the segmenter, for as long as
+// the stream's definition calls for it. It is one more client of the encoder,
+// so the input stays open meanwhile.
+//
+// settings gives the parts of the definition the client depends on, or an
+// empty string if the client should not run. If they change, we kick the
+// client and start it again. While the stream is paused, the client doesn't
+// run. setup, if not nil, sets up each client before the
+// encoder sees it. run serves the client. If it ends, such as because the
+// input failed, we start it again after a moment.
+func (s *Stream) runOwnClient(name string,
+	settings func(StreamDefinition) string, setup func(*Client),
+	run func(*Client, StreamDefinition) error) {
+	for {
+		def := s.Definition()
+
+		if started := settings(def); started != "" && !s.Paused() {
+			c := newClient(s.ctx, name, "internal")
+			if setup != nil {
+				setup(c)
+			}
+
+			if err := s.join(c); err == errStreamPaused {
+				c.cancel()
+				continue
+			} else if err != nil {
+				c.cancel()
+				return
+			}
+
+			go func() {
+				ticker := time.NewTicker(time.Second)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ticker.C:
+						if settings(s.Definition()) != started || s.Paused() {
+							c.cancel()
+							return
+						}
+					case <-c.ctx.Done():
+						return
+					}
+				}
+			}()
+
+			err := run(c, def)
+			c.cancel()
+			if err != nil {
+				encoderLog.Warnf("%s: %s: %s", name, def.Name, err)
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// join hands the client to the encoder. It fails if the stream is paused, or
+// if the stream stops or the client's context ends first.
+func (s *Stream) join(c *Client) error {
+	if s.Paused() {
+		return errStreamPaused
+	}
+
+	select {
+	case s.ClientChan <- c:
+		return nil
+	case <-s.ctx.Done():
+		return errNotFound
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+func (s *Stream) setDefinition(def StreamDefinition) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.def = def
+}
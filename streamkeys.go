@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Streams whose input listens for a publisher, such as RTMP with ?listen=1 or
+// SRT in listener mode, can require a key for each. Their input URLs hold the
+// key as the {key} placeholder, such as
+// rtmp://0.0.0.0:1935/live/{key}?listen=1, where libav accepts only a
+// publisher that gives that stream name, or
+// srt://0.0.0.0:9000?mode=listener&passphrase={key}. Giving each publisher
+// their own stream gives each their own key.
+//
+// We generate a stream's key the first time its input needs it. With
+// -stream-keys, we keep keys in that file as a JSON object of stream names to
+// keys, so they survive restarts. Rotating a key through the admin API
+// replaces it and reopens the stream's input, so the old key stops working.
+
+// The bytes of randomness in a key. As hex, a key is twice as long.
+const streamKeyBytes = 16
+
+// StreamKeys holds each stream's key.
+type StreamKeys struct {
+	mutex *sync.Mutex
+
+	// Where we keep the keys. If empty, we keep them only in memory.
+	file string
+
+	keys map[string]string
+}
+
+// streamKeys holds the keys of our streams.
+var streamKeys = &StreamKeys{
+	mutex: &sync.Mutex{},
+	keys:  map[string]string{},
+}
+
+// loadStreamKeys reads the keys in a file, if it exists, and keeps keys there
+// from now on.
+func loadStreamKeys(file string) (*StreamKeys, error) {
+	k := &StreamKeys{
+		mutex: &sync.Mutex{},
+		file:  file,
+		keys:  map[string]string{},
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &k.keys); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// get returns the stream's key, generating one if it has none.
+func (k *StreamKeys) get(name string) (string, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if key, ok := k.keys[name]; ok {
+		return key, nil
+	}
+
+	return k.generate(name)
+}
+
+// current returns the stream's key, or an empty string if it has none.
+func (k *StreamKeys) current(name string) string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.keys[name]
+}
+
+// rotate replaces the stream's key.
+func (k *StreamKeys) rotate(name string) (string, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return k.generate(name)
+}
+
+// generate gives the stream a new key and saves it. Hold the mutex.
+func (k *StreamKeys) generate(name string) (string, error) {
+	buf := make([]byte, streamKeyBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(buf)
+
+	old, hadKey := k.keys[name]
+	k.keys[name] = key
+
+	if err := k.save(); err != nil {
+		if hadKey {
+			k.keys[name] = old
+		} else {
+			delete(k.keys, name)
+		}
+		return "", err
+	}
+
+	return key, nil
+}
+
+// save writes the keys to the file, if we have one. Hold the mutex.
+func (k *StreamKeys) save() error {
+	if k.file == "" {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(k.file, append(buf, '\n'), 0600)
+}
+
+// usesStreamKey decides whether an input URL has the {key} placeholder.
+func usesStreamKey(template string) bool {
+	uses := false
+	_, _ = expandTemplate(template, func(name, arg string) (string, error) {
+		if name == "key" {
+			uses = true
+		}
+		return "", nil
+	})
+	return uses
+}
+
+// streamKeyRequest responds with a stream's key, given as
+// /api/streams/<name>/key. A POST rotates the key first, which reopens the
+// stream's input so that the old key stops working.
+func (h HTTPHandler) streamKeyRequest(rw http.ResponseWriter, r *http.Request,
+	name string) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	stream := h.Streams.Get(name)
+	if name == "" || strings.Contains(name, "/") || stream == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	def := stream.Definition()
+	if !usesStreamKey(def.InputURL) {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	var key string
+	var err error
+	if r.Method == "POST" {
+		key, err = streamKeys.rotate(def.Name)
+	} else {
+		key, err = streamKeys.get(def.Name)
+	}
+	if err != nil {
+		httpLog.Errorf("%s: Unable to get stream key for %s: %s", r.RemoteAddr,
+			def.Name, err)
+		h.writeError(rw, r, errInternal)
+		return
+	}
+
+	if r.Method == "POST" {
+		httpLog.Infof("%s: Rotated stream key for %s", r.RemoteAddr, def.Name)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(map[string]string{
+		"stream": def.Name,
+		"key":    key,
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write response: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// streamSummary is a snapshot of a stream's counters.
+type streamSummary struct {
+	bytesRead          uint64
+	bytesSent          uint64
+	packetsDropped     uint64
+	clientsDroppedSlow uint64
+}
+
+// logSummaries logs a line about each stream every interval. This gives a
+// heartbeat in the logs, and a rough idea of what is happening without
+// collecting metrics.
+func logSummaries(streams *Streams, interval time.Duration) {
+	previous := map[*Stream]streamSummary{}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current := map[*Stream]streamSummary{}
+
+		for _, stream := range streams.All() {
+			summary := streamSummary{
+				bytesRead:      atomic.LoadUint64(&stream.stats.BytesRead),
+				bytesSent:      atomic.LoadUint64(&stream.stats.BytesSent),
+				packetsDropped: atomic.LoadUint64(&stream.stats.PacketsDropped),
+				clientsDroppedSlow: atomic.LoadUint64(
+					&stream.stats.ClientsDroppedSlow),
+			}
+			current[stream] = summary
+
+			// A stream we haven't seen before has counted from zero since it started.
+			last := previous[stream]
+
+			serverLog.Infof("summary: %s: %d clients, input %.1f kbit/s, sent %d bytes, dropped %d packets and %d slow clients in the last %s",
+				stream.Definition().Name,
+				atomic.LoadInt32(&stream.clients),
+				float64(summary.bytesRead-last.bytesRead)*8/1000/interval.Seconds(),
+				summary.bytesSent-last.bytesSent,
+				summary.packetsDropped-last.packetsDropped,
+				summary.clientsDroppedSlow-last.clientsDroppedSlow,
+				interval)
+		}
+
+		previous = current
+	}
+}
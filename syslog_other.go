@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func newSyslogWriter() (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter connects to the local syslog daemon. Under systemd this goes
+// to the journal.
+func newSyslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "videostreamer")
+}
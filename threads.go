@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Threads is how libav's decoders and encoders use threads. libav uses one
+// thread for each by default, which leaves big machines idle when we decode
+// many streams at high resolutions. On small boards, more threads than cores
+// only contend.
+//
+// Muxing (remuxing for clients, recording) doesn't use threads. Each output
+// runs in its client's goroutine already.
+type Threads struct {
+	// How many threads decoders and encoders use. 0 means one per CPU.
+	Decoder int
+	Encoder int
+
+	// Bits of libav's FF_THREAD_FRAME and FF_THREAD_SLICE.
+	Type int
+}
+
+// libav's thread types.
+const (
+	threadFrame = 1
+	threadSlice = 2
+)
+
+// parseThreadType parses a thread type such as frame, slice, or frame+slice.
+func parseThreadType(s string) (int, error) {
+	threadType := 0
+	for _, name := range strings.Split(s, "+") {
+		switch strings.TrimSpace(name) {
+		case "frame":
+			threadType |= threadFrame
+		case "slice":
+			threadType |= threadSlice
+		default:
+			return 0, fmt.Errorf("invalid thread type: %s", name)
+		}
+	}
+	return threadType, nil
+}
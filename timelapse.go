@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We can make time-lapse videos of a stream, such as of a 3D printer's work
+// each day. We save a JPEG of a frame every timelapse_interval. When each
+// timelapse_period ends, we encode the frames from it as a video and remove
+// them. Periods start from local midnight, so by default there is a
+// time-lapse a day.
+//
+// Time-lapses go in a directory per stream as recordings do, named for when
+// their period started, as <dir>/<stream>/<stream>-timelapse-20060102T150405Z.mp4.
+// They aren't in the index of recordings since they don't play in real time.
+//
+// A period's frames are in a directory of their own until we encode them, so
+// we carry on with them if we restart within the period. If we stop and a
+// period ends meanwhile, we encode its frames the next time we start.
+
+const (
+	// Defaults unless the stream's definition says otherwise.
+	defaultTimelapseInterval = 10 * time.Second
+	defaultTimelapsePeriod   = 24 * time.Hour
+
+	// The frame rate of time-lapse videos. At the defaults, a day plays in
+	// about 5 minutes.
+	timelapseFrameRate = 30
+
+	// The most pixels wide frames are. We scale wider frames down.
+	timelapseWidth = 1920
+
+	// Directories of frames waiting to be encoded have this suffix.
+	timelapseFramesSuffix = ".frames"
+)
+
+// Encoding is costly, so we encode one time-lapse at a time.
+var timelapseMutex = &sync.Mutex{}
+
+// timelapse saves frames and encodes them into time-lapses.
+type timelapse struct {
+	name  string
+	media Media
+
+	// Where the stream's time-lapses go.
+	dir string
+
+	interval time.Duration
+	period   time.Duration
+	verbose  bool
+
+	lastSaved time.Time
+
+	// The period we are saving frames for, its directory, and how many frames
+	// are in it.
+	start  time.Time
+	frames string
+	count  int
+}
+
+// timelapseInterval is how often we save a frame for time-lapses.
+func (d StreamDefinition) timelapseInterval() time.Duration {
+	if d.TimelapseInterval > 0 {
+		return time.Duration(d.TimelapseInterval * float64(time.Second))
+	}
+	return defaultTimelapseInterval
+}
+
+// timelapsePeriod is how long each time-lapse covers.
+func (d StreamDefinition) timelapsePeriod() time.Duration {
+	if d.TimelapsePeriod > 0 {
+		return time.Duration(d.TimelapsePeriod * float64(time.Second))
+	}
+	return defaultTimelapsePeriod
+}
+
+func newTimelapse(s *Stream, def StreamDefinition) *timelapse {
+	t := &timelapse{
+		name:     def.Name,
+		media:    s.media,
+		dir:      filepath.Join(def.TimelapseDir, def.Name),
+		interval: def.timelapseInterval(),
+		period:   def.timelapsePeriod(),
+		verbose:  def.libavVerbose(),
+	}
+
+	go t.encodeEnded(t.framesDir(t.periodStart(time.Now())))
+
+	return t
+}
+
+func (t *timelapse) frame(decoder MediaDecoder, now time.Time) error {
+	if now.Sub(t.lastSaved) < t.interval {
+		return nil
+	}
+	t.lastSaved = now
+
+	if start := t.periodStart(now); !start.Equal(t.start) {
+		if t.frames != "" {
+			go t.encode(t.frames)
+		}
+		t.start = start
+		t.frames = t.framesDir(start)
+		t.count = countTimelapseFrames(t.frames)
+	}
+
+	// A frame we can't save shouldn't stop the other analysers, so we only log
+	// it.
+	var buf []byte
+	var err error
+	if !transcodes.run(backgroundTranscodeWait, func() {
+		buf, err = decoder.JPEG(timelapseWidth, false)
+	}) {
+		encoderLog.Debugf("timelapse: %s: Skipping frame, encoders busy", t.name)
+		return nil
+	}
+	if err != nil {
+		encoderLog.Warnf("timelapse: %s: %s", t.name, err)
+		return nil
+	}
+
+	if err := t.save(buf); err != nil {
+		encoderLog.Errorf("timelapse: %s: Unable to save frame: %s", t.name, err)
+	}
+	return nil
+}
+
+// stop leaves the period's frames for when we start again, or for encoding
+// then if the period is over.
+func (t *timelapse) stop(now time.Time) {}
+
+// periodStart is when the period a time is in started.
+func (t *timelapse) periodStart(now time.Time) time.Time {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		now.Location())
+	return midnight.Add(now.Sub(midnight) / t.period * t.period)
+}
+
+// framesDir is where we save the frames of the period starting at the time.
+func (t *timelapse) framesDir(start time.Time) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%s-timelapse-%s%s", t.name,
+		start.UTC().Format("20060102T150405Z"), timelapseFramesSuffix))
+}
+
+// frameFile is the file of a numbered frame. Frames are numbered from 1.
+func frameFile(frames string, n int) string {
+	return filepath.Join(frames, fmt.Sprintf("%06d.jpg", n))
+}
+
+// countTimelapseFrames counts the frames saved in a directory so far.
+func countTimelapseFrames(frames string) int {
+	n := 0
+	for exists(frameFile(frames, n+1)) {
+		n++
+	}
+	return n
+}
+
+// save saves a frame as the next in the period's directory.
+func (t *timelapse) save(buf []byte) error {
+	if err := os.MkdirAll(t.frames, 0755); err != nil {
+		return err
+	}
+
+	// Write it under another name first so that there is never a partial
+	// frame amongst the others.
+	path := frameFile(t.frames, t.count+1)
+	if err := ioutil.WriteFile(path+".tmp", buf, 0644); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	t.count++
+	return nil
+}
+
+// encodeEnded encodes the frames of periods that ended while we weren't
+// running. current is the directory of the period in progress, which we leave
+// alone.
+func (t *timelapse) encodeEnded(current string) {
+	entries, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			encoderLog.Errorf("timelapse: %s: %s", t.name, err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		frames := filepath.Join(t.dir, entry.Name())
+		if !entry.IsDir() || !strings.HasSuffix(frames, timelapseFramesSuffix) ||
+			frames == current {
+			continue
+		}
+		t.encode(frames)
+	}
+}
+
+// encode encodes a period's frames into a time-lapse and removes them. If
+// encoding fails, we keep the frames so we can try again the next time we
+// start.
+func (t *timelapse) encode(frames string) {
+	timelapseMutex.Lock()
+	defer timelapseMutex.Unlock()
+
+	if countTimelapseFrames(frames) == 0 {
+		_ = os.RemoveAll(frames)
+		return
+	}
+
+	path := strings.TrimSuffix(frames, timelapseFramesSuffix) + ".mp4"
+	part := path + recordingPartSuffix
+
+	// libav reads the frames as an image sequence, so escape anything it would
+	// take as part of the pattern.
+	pattern := strings.Replace(frames, "%", "%%", -1) +
+		string(filepath.Separator) + "%06d.jpg"
+
+	if err := t.media.Timelapse(pattern, part, timelapseFrameRate,
+		t.verbose); err != nil {
+		encoderLog.Errorf("timelapse: %s: Unable to encode %s, keeping its frames: %s",
+			t.name, path, err)
+		_ = os.Remove(part)
+		return
+	}
+
+	if err := os.Rename(part, path); err != nil {
+		encoderLog.Errorf("timelapse: %s: Unable to rename %s: %s", t.name, path,
+			err)
+		return
+	}
+
+	if err := os.RemoveAll(frames); err != nil {
+		encoderLog.Errorf("timelapse: %s: Unable to remove %s: %s", t.name,
+			frames, err)
+	}
+
+	encoderLog.Infof("timelapse: %s: Made %s", t.name, path)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// We export spans to an OpenTelemetry collector using OTLP over HTTP with its
+// JSON encoding. This avoids depending on the OpenTelemetry SDK.
+
+// Tracer records spans and exports them in the background.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+
+	// Finished spans waiting to be exported. If this is full, we drop spans
+	// rather than slow anything down.
+	spans chan *Span
+}
+
+// Span is an operation we trace. A nil *Span is valid and does nothing. That
+// is what we get when tracing is off.
+type Span struct {
+	tracer *Tracer
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+
+	name   string
+	server bool
+	start  time.Time
+	end    time.Time
+
+	mutex      *sync.Mutex
+	attributes map[string]interface{}
+	err        string
+}
+
+// tracer is what we trace with. It is nil if tracing is off.
+var tracer *Tracer
+
+const (
+	// How many finished spans we hold waiting for export at most.
+	traceQueueSize = 4096
+
+	// How many spans we export in one request at most, and how often we export.
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// newTracer starts exporting to the OTLP/HTTP endpoint, such as
+// http://localhost:4318.
+func newTracer(endpoint, serviceName string) *Tracer {
+	t := &Tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		spans:       make(chan *Span, traceQueueSize),
+	}
+
+	go t.export()
+
+	return t
+}
+
+// startSpan starts a span. If parent is nil, it starts a new trace.
+func startSpan(name string, parent *Span) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	s := &Span{
+		tracer:     tracer,
+		name:       name,
+		start:      time.Now(),
+		mutex:      &sync.Mutex{},
+		attributes: map[string]interface{}{},
+	}
+
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+
+	return s
+}
+
+// startRequestSpan starts a span for serving a request. If the request carries
+// a W3C traceparent header, the span continues that trace.
+func startRequestSpan(r *http.Request) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	s := startSpan(r.Method+" "+r.URL.Path, nil)
+	s.server = true
+	if traceID, parentID, ok := parseTraceParent(
+		r.Header.Get("traceparent")); ok {
+		s.traceID = traceID
+		s.parentID = parentID
+	}
+
+	s.SetAttribute("http.method", r.Method)
+	s.SetAttribute("http.target", r.URL.Path)
+	s.SetAttribute("net.peer.addr", r.RemoteAddr)
+
+	return s
+}
+
+// parseTraceParent parses a traceparent header such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceParent(header string) ([16]byte, [8]byte, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+
+	pieces := strings.Split(strings.TrimSpace(header), "-")
+	if len(pieces) < 4 || pieces[0] == "ff" {
+		return traceID, parentID, false
+	}
+
+	if n, err := hex.Decode(traceID[:], []byte(pieces[1])); err != nil ||
+		n != len(traceID) || traceID == [16]byte{} {
+		return traceID, parentID, false
+	}
+
+	if n, err := hex.Decode(parentID[:], []byte(pieces[2])); err != nil ||
+		n != len(parentID) || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+
+	return traceID, parentID, true
+}
+
+// SetAttribute records information about the span. Values may be strings,
+// bools, ints, int64s, or float64s.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+	}
+}
+
+// export sends spans to the collector in batches.
+func (t *Tracer) export() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.send(batch); err != nil {
+			serverLog.Errorf("Unable to export %d spans: %s", len(batch), err)
+		}
+		batch = []*Span{}
+	}
+}
+
+func (t *Tracer) send(spans []*Span) error {
+	otlpSpans := []map[string]interface{}{}
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{
+						"service.name": t.serviceName,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "videostreamer"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(t.endpoint, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// otlp converts the span to OTLP's JSON representation.
+func (s *Span) otlp() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// SPAN_KIND_INTERNAL or SPAN_KIND_SERVER.
+	kind := 1
+	if s.server {
+		kind = 2
+	}
+
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+
+	// STATUS_CODE_ERROR.
+	if s.err != "" {
+		span["status"] = map[string]interface{}{"code": 2, "message": s.err}
+	}
+
+	return span
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	otlp := []interface{}{}
+
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{
+				"intValue": strconv.FormatInt(value, 10),
+			}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprintf("%v", value)}
+		}
+
+		otlp = append(otlp, map[string]interface{}{"key": key, "value": v})
+	}
+
+	return otlp
+}
+
+// redactURL removes any password from a URL so we can record it. Camera URLs
+// often include credentials.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+
+	return u.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Encoding JPEGs, for MJPEG clients, snapshots, time-lapses, and analysis, is
+// the costliest thing we do, and with many streams and clients it could take
+// every CPU we have. So we encode on a bounded set of workers, and within a
+// budget of CPU time: at most so many encodes run at once, and once encoding
+// has used its share of the CPUs, further encodes are shed until it hasn't.
+//
+// An encode waits for a worker only so long. MJPEG clients wait until their
+// next frame is due, and the rest a second. An encode that can't get a worker
+// in time, or comes while we're over budget, is shed: the MJPEG client, or
+// the snapshot, goes without that frame.
+//
+// We count the time encodes take as the CPU time they use. With more than one
+// encoder thread they may use more.
+
+// How many encodes may run at once by default.
+var defaultTranscodeWorkers = runtime.NumCPU()
+
+// How long snapshots, time-lapses, and analysis wait for a worker.
+const backgroundTranscodeWait = time.Second
+
+// transcodePool runs encodes on a bounded set of workers within a CPU budget.
+type transcodePool struct {
+	slots chan struct{}
+
+	// The budget in CPUs, such as 1.5. 0 means none.
+	budget float64
+
+	mutex *sync.Mutex
+	// Encoding time spent and not yet paid off by the budget, and when we last
+	// paid it off.
+	owed time.Duration
+	last time.Time
+
+	// For metrics. Access atomically.
+	queued int64
+	done   uint64
+	shed   uint64
+	busy   int64
+}
+
+// transcodes is where we run encodes. Set up at startup.
+var transcodes = newTranscodePool(defaultTranscodeWorkers, 0)
+
+func newTranscodePool(workers int, budget float64) *transcodePool {
+	return &transcodePool{
+		slots:  make(chan struct{}, workers),
+		budget: budget,
+		mutex:  &sync.Mutex{},
+		last:   time.Now(),
+	}
+}
+
+// run runs the encode on a worker, waiting up to wait for one. It returns
+// false if it shed the encode instead.
+func (p *transcodePool) run(wait time.Duration, encode func()) bool {
+	if p.overBudget(time.Now()) {
+		atomic.AddUint64(&p.shed, 1)
+		return false
+	}
+
+	atomic.AddInt64(&p.queued, 1)
+	timer := time.NewTimer(wait)
+	select {
+	case p.slots <- struct{}{}:
+		timer.Stop()
+		atomic.AddInt64(&p.queued, -1)
+	case <-timer.C:
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddUint64(&p.shed, 1)
+		return false
+	}
+
+	start := time.Now()
+	encode()
+	took := time.Since(start)
+	<-p.slots
+
+	p.mutex.Lock()
+	p.owed += took
+	p.mutex.Unlock()
+
+	atomic.AddUint64(&p.done, 1)
+	atomic.AddInt64(&p.busy, int64(took))
+	return true
+}
+
+// overBudget decides whether encoding has used more than its share of the
+// CPUs of late. The budget pays off what encodes owe as time passes, and we
+// let them owe up to a second's worth.
+func (p *transcodePool) overBudget(now time.Time) bool {
+	if p.budget <= 0 {
+		return false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.owed -= time.Duration(float64(now.Sub(p.last)) * p.budget)
+	if p.owed < 0 {
+		p.owed = 0
+	}
+	p.last = now
+
+	return p.owed >= time.Duration(p.budget*float64(time.Second))
+}
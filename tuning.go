@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// How big our queues and buffers should be depends on where clients are. On a
+// LAN, small ones keep latency down and a client falling behind is likely
+// gone. Over the internet, clients stall for a moment now and then and catch
+// up, so they need more room before we give up on them. On a small device,
+// memory is what runs out first.
+//
+// Rather than have everyone tune each setting, -profile picks a set of them
+// for a kind of deployment, and the individual flags override it.
+
+// Tuning is the sizes of our queues and buffers.
+type Tuning struct {
+	// How many packets may be queued for a client before we drop it.
+	ClientQueuePackets int
+
+	// Most bytes that may be queued for a client before we drop it. 0 means no
+	// limit.
+	ClientQueueBytes int64
+
+	// Size of the buffer libav muxes client outputs into before writing them
+	// out.
+	OutputBufferSize int
+
+	// Socket send buffer size for client connections. 0 means the system
+	// default.
+	SendBufferSize int
+
+	// Whether to buffer what we send clients rather than writing out each
+	// packet at once.
+	BufferOutput bool
+}
+
+// The deployment profiles. lan is what we did before there were profiles.
+var tuningProfiles = map[string]Tuning{
+	"lan": {
+		ClientQueuePackets: 32,
+		OutputBufferSize:   32 * 1024,
+	},
+	"wan": {
+		ClientQueuePackets: 256,
+		ClientQueueBytes:   16 * 1024 * 1024,
+		OutputBufferSize:   64 * 1024,
+		SendBufferSize:     1024 * 1024,
+		BufferOutput:       true,
+	},
+	"constrained": {
+		ClientQueuePackets: 16,
+		ClientQueueBytes:   2 * 1024 * 1024,
+		OutputBufferSize:   8 * 1024,
+	},
+}
+
+const defaultTuningProfile = "lan"
+
+// The largest output buffer we allow. libav takes the size as an int, and
+// anything near this is a mistake.
+const maxOutputBufferSize = 16 * 1024 * 1024
+
+// How many packets may be queued for a client. This is how far behind a client
+// may fall before we drop it. Set from the tuning at startup.
+var clientQueueSize = tuningProfiles[defaultTuningProfile].ClientQueuePackets
+
+// The size of the buffer libav muxes client outputs into. Set from the tuning
+// at startup.
+var outputBufferSize = tuningProfiles[defaultTuningProfile].OutputBufferSize
+
+// tuningProfileNames lists the profiles in order.
+func tuningProfileNames() []string {
+	names := []string{}
+	for name := range tuningProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tuningProfileHelp describes each profile, for -help.
+func tuningProfileHelp() string {
+	help := []string{}
+	for _, name := range tuningProfileNames() {
+		t := tuningProfiles[name]
+		help = append(help, fmt.Sprintf(
+			"%s: -client-queue-packets %d -client-queue-bytes %d -output-buffer-size %d -send-buffer %d -buffer-output=%t",
+			name, t.ClientQueuePackets, t.ClientQueueBytes, t.OutputBufferSize,
+			t.SendBufferSize, t.BufferOutput))
+	}
+	return strings.Join(help, "; ")
+}
+
+// tune applies the profile, then the flags that were given on the command
+// line over it.
+func tune(profile string, fs *flag.FlagSet, clientQueuePackets int,
+	clientQueueBytes int64, outputBufferSize, sendBufferSize int,
+	bufferOutput bool) (Tuning, error) {
+	t, ok := tuningProfiles[profile]
+	if !ok {
+		return Tuning{}, fmt.Errorf("profile must be one of %s",
+			strings.Join(tuningProfileNames(), ", "))
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "client-queue-packets":
+			t.ClientQueuePackets = clientQueuePackets
+		case "client-queue-bytes":
+			t.ClientQueueBytes = clientQueueBytes
+		case "output-buffer-size":
+			t.OutputBufferSize = outputBufferSize
+		case "send-buffer":
+			t.SendBufferSize = sendBufferSize
+		case "buffer-output":
+			t.BufferOutput = bufferOutput
+		}
+	})
+
+	if t.ClientQueuePackets < 1 {
+		return Tuning{}, fmt.Errorf("client queue packets must be at least 1")
+	}
+	if t.ClientQueueBytes < 0 {
+		return Tuning{}, fmt.Errorf("client queue bytes must not be negative")
+	}
+	if t.OutputBufferSize < 1024 || t.OutputBufferSize > maxOutputBufferSize {
+		return Tuning{}, fmt.Errorf("output buffer size must be between 1024 and %d",
+			maxOutputBufferSize)
+	}
+	if t.SendBufferSize < 0 {
+		return Tuning{}, fmt.Errorf("send buffer must not be negative")
+	}
+	return t, nil
+}
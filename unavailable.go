@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A stream's unavailable setting says what to do when its input can't be
+// opened:
+//
+//   wait   Clients wait while we try open_retries more times, then get a 503.
+//          This is the default.
+//   exit   As wait, but we also open the input when we start, and exit if we
+//          can't, so that a supervisor or orchestrator notices a
+//          misconfigured camera right away.
+//   503    Clients get a 503 with a Retry-After header as soon as opening
+//          fails, and clients arriving within Retry-After get one at once
+//          rather than waiting for the input again. After that, the next
+//          client tries the input again.
+//   slate  Clients get a generated "camera offline" video instead of an
+//          error, also when the input fails while open. See slate.go.
+
+// The unavailable settings.
+const (
+	unavailableWait  = "wait"
+	unavailableExit  = "exit"
+	unavailable503   = "503"
+	unavailableSlate = "slate"
+)
+
+// How long clients refused while the input is unavailable should wait before
+// trying again.
+const unavailableRetryAfter = 10 * time.Second
+
+// validateUnavailable checks the unavailable setting is one we know.
+func validateUnavailable(unavailable string) error {
+	switch unavailable {
+	case "", unavailableWait, unavailableExit, unavailable503, unavailableSlate:
+		return nil
+	}
+	return fmt.Errorf("unavailable must be %s, %s, %s, or %s", unavailableWait,
+		unavailableExit, unavailable503, unavailableSlate)
+}
+
+// markUnavailable records that the stream's input can't be opened, so that
+// with the 503 setting we refuse clients until Retry-After has passed.
+func (s *Stream) markUnavailable(now time.Time) {
+	atomic.StoreInt64(&s.unavailableUntil,
+		now.Add(unavailableRetryAfter).UnixNano())
+}
+
+// markAvailable records that the stream's input opened.
+func (s *Stream) markAvailable() {
+	atomic.StoreInt64(&s.unavailableUntil, 0)
+}
+
+// refuseUnavailable responds with a 503 if the stream's input recently failed
+// to open and the stream is set to refuse clients then. It returns true if it
+// did.
+func (h HTTPHandler) refuseUnavailable(rw http.ResponseWriter, r *http.Request,
+	stream *Stream) bool {
+	if stream.Definition().Unavailable != unavailable503 {
+		return false
+	}
+
+	until := atomic.LoadInt64(&stream.unavailableUntil)
+	wait := time.Until(time.Unix(0, until))
+	if until == 0 || wait <= 0 {
+		return false
+	}
+
+	setRetryAfter(rw, wait)
+	h.writeError(rw, r, errInputUnavailable)
+	return true
+}
+
+// setRetryAfter tells the client how long to wait before trying again, in
+// whole seconds.
+func setRetryAfter(rw http.ResponseWriter, wait time.Duration) {
+	rw.Header().Set("Retry-After",
+		strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+}
+
+// checkInputsAtStart opens the inputs of streams, and their profiles, set to
+// exit when they're unavailable. It fails if any can't be opened.
+func checkInputsAtStart(media Media, defs []StreamDefinition) error {
+	for _, def := range defs {
+		if err := checkInputsAtStart(media, def.profileDefinitions()); err != nil {
+			return err
+		}
+
+		if def.Unavailable != unavailableExit {
+			continue
+		}
+
+		input, err := openInput(media, def.Name, def.InputFormat, def.InputURL,
+			def.InputOptions, def.openTimeout(), def.libavVerbose())
+		if err != nil {
+			return fmt.Errorf("stream %s: unable to open input: %s", def.Name, err)
+		}
+		destroyInput(input)
+		serverLog.Infof("Stream %s: Input is available", def.Name)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Input URLs may contain placeholders we expand each time we open the input.
+// This is for sources whose URLs embed things that change, such as tokens that
+// rotate, or that should not be in the configuration, such as secrets.
+//
+// A placeholder is {name} or {name:argument}:
+//
+//   {env:NAME}  The environment variable NAME.
+//   {file:PATH} The contents of the file PATH, less surrounding whitespace. For
+//               example, a secret mounted at /run/secrets/camera-token.
+//   {date}      The current date, as 2006-01-02.
+//   {time}      The current time, as 150405.
+//   {unix}      The current Unix time in seconds.
+//   {key}       The stream's key. See StreamKeys.
+//
+// {{ and }} are a literal { and }. Values are inserted as is, so they must be
+// valid where they appear in the URL.
+
+// expandURL expands the placeholders in an input URL. key is the stream's
+// key, if the URL uses it.
+func expandURL(template string, now time.Time, key string) (string, error) {
+	return expandTemplate(template, func(name, arg string) (string, error) {
+		switch name {
+		case "env":
+			value, ok := os.LookupEnv(arg)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", arg)
+			}
+			return value, nil
+		case "file":
+			buf, err := ioutil.ReadFile(arg)
+			if err != nil {
+				return "", fmt.Errorf("error reading %s: %s", arg, err)
+			}
+			return strings.TrimSpace(string(buf)), nil
+		case "date":
+			return now.Format("2006-01-02"), nil
+		case "time":
+			return now.Format("150405"), nil
+		case "unix":
+			return strconv.FormatInt(now.Unix(), 10), nil
+		case "key":
+			if key == "" {
+				return "", fmt.Errorf("no stream key")
+			}
+			return key, nil
+		default:
+			return "", fmt.Errorf("unknown placeholder: {%s}", name)
+		}
+	})
+}
+
+// checkURLTemplate checks that the placeholders in an input URL are valid,
+// without expanding them.
+func checkURLTemplate(template string) error {
+	_, err := expandTemplate(template, func(name, arg string) (string, error) {
+		switch name {
+		case "env", "file":
+			if arg == "" {
+				return "", fmt.Errorf("placeholder {%s} needs an argument", name)
+			}
+			return "", nil
+		case "date", "time", "unix", "key":
+			return "", nil
+		default:
+			return "", fmt.Errorf("unknown placeholder: {%s}", name)
+		}
+	})
+	return err
+}
+
+// expandTemplate replaces each placeholder with what value returns for it.
+func expandTemplate(template string,
+	value func(name, arg string) (string, error)) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+
+		if c == '}' {
+			if i+1 < len(template) && template[i+1] == '}' {
+				i++
+			}
+			b.WriteByte('}')
+			continue
+		}
+
+		if c != '{' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if i+1 < len(template) && template[i+1] == '{' {
+			b.WriteByte('{')
+			i++
+			continue
+		}
+
+		end := strings.IndexByte(template[i:], '}')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated placeholder in URL")
+		}
+
+		placeholder := template[i+1 : i+end]
+		name, arg := placeholder, ""
+		if colon := strings.IndexByte(placeholder, ':'); colon != -1 {
+			name, arg = placeholder[:colon], placeholder[colon+1:]
+		}
+
+		v, err := value(name, arg)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+
+		i += end
+	}
+
+	return b.String(), nil
+}
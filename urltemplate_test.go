@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "videostreamer")
+	if err != nil {
+		t.Fatalf("unable to make directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte(" s3cret\n"), 0600); err != nil {
+		t.Fatalf("unable to write secret: %s", err)
+	}
+
+	env := map[string]string{
+		"VIDEOSTREAMER_TEST_TOKEN": "abc",
+		"VIDEOSTREAMER_TEST_PATH":  "live/cam 1?a=b&c=100%",
+		"VIDEOSTREAMER_TEST_BRACE": "{date}",
+	}
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("unable to set %s: %s", k, err)
+		}
+		defer func(k string) { _ = os.Unsetenv(k) }(k)
+	}
+
+	now := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	tests := []struct {
+		template string
+		key      string
+		url      string
+		ok       bool
+	}{
+		{"rtsp://cam/stream", "", "rtsp://cam/stream", true},
+		{"rtsp://cam/stream?token={env:VIDEOSTREAMER_TEST_TOKEN}", "",
+			"rtsp://cam/stream?token=abc", true},
+		{"rtsp://cam/stream?token={file:" + secret + "}", "",
+			"rtsp://cam/stream?token=s3cret", true},
+		{"http://dvr/{date}/{time}.ts?t={unix}", "",
+			"http://dvr/2020-03-04/050607.ts?t=1583298367", true},
+		{"rtmp://0.0.0.0/live/{key}?listen=1", "0123abcd",
+			"rtmp://0.0.0.0/live/0123abcd?listen=1", true},
+
+		// Values go in as they are. They aren't escaped, and placeholders in
+		// them aren't expanded.
+		{"rtsp://cam/{env:VIDEOSTREAMER_TEST_PATH}", "",
+			"rtsp://cam/live/cam 1?a=b&c=100%", true},
+		{"rtsp://cam/{env:VIDEOSTREAMER_TEST_BRACE}", "", "rtsp://cam/{date}",
+			true},
+
+		// {{ and }} are literal braces.
+		{"http://cam/{{date}}", "", "http://cam/{date}", true},
+		{"http://cam/a}b", "", "http://cam/a}b", true},
+
+		{"http://cam/{date", "", "", false},
+		{"http://cam/{nope}", "", "", false},
+		{"http://cam/{}", "", "", false},
+		{"http://cam/{env:VIDEOSTREAMER_TEST_UNSET}", "", "", false},
+		{"http://cam/{file:" + filepath.Join(dir, "missing") + "}", "", "",
+			false},
+		{"rtmp://0.0.0.0/live/{key}", "", "", false},
+	}
+
+	for _, test := range tests {
+		url, err := expandURL(test.template, now, test.key)
+		if test.ok {
+			if err != nil {
+				t.Errorf("expandURL(%q): %s", test.template, err)
+			} else if url != test.url {
+				t.Errorf("expandURL(%q) = %q, wanted %q", test.template, url,
+					test.url)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("expandURL(%q) = %q, wanted an error", test.template, url)
+		}
+	}
+}
+
+func TestCheckURLTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		ok       bool
+	}{
+		{"rtsp://cam/stream", true},
+		{"rtsp://cam/{env:TOKEN}/{file:/run/secret}/{date}{time}{unix}/{key}",
+			true},
+		{"rtsp://cam/{{literal}}", true},
+		{"rtsp://cam/{env}", false},
+		{"rtsp://cam/{file:}", false},
+		{"rtsp://cam/{nope}", false},
+		{"rtsp://cam/{date", false},
+	}
+
+	for _, test := range tests {
+		err := checkURLTemplate(test.template)
+		if (err == nil) != test.ok {
+			t.Errorf("checkURLTemplate(%q) = %v, wanted ok %t", test.template, err,
+				test.ok)
+		}
+	}
+}
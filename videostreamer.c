@@ -1,7 +1,10 @@
+//go:build !nolibav
+// +build !nolibav
+
 //
 // This library provides remuxing from a video stream (such as an RTSP URL) to
 // an MP4 container. It writes a fragmented MP4 so that it can be streamed to a
-// pipe.
+// pipe, or through a caller provided function.
 //
 // There is no re-encoding. The stream is copied as is.
 //
@@ -10,36 +13,214 @@
 
 #include <errno.h>
 #include <libavdevice/avdevice.h>
+#include <libavutil/channel_layout.h>
+#include <libavutil/display.h>
+#include <libavutil/pixdesc.h>
+#include <libavutil/samplefmt.h>
+#include <stdatomic.h>
+#include <libavutil/time.h>
 #include <libavutil/timestamp.h>
+#include <math.h>
+#include <libswscale/swscale.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
 #include "videostreamer.h"
 
+// Inputs, outputs, and decoders currently allocated. Outputs and decoders may
+// be opened and destroyed from multiple threads.
+static atomic_int_fast64_t __vs_inputs;
+static atomic_int_fast64_t __vs_outputs;
+static atomic_int_fast64_t __vs_decoders;
+
+// How many threads decoders and encoders use, and how they use them. We set
+// these once, before opening anything.
+static int __vs_decoder_threads = 1;
+static int __vs_encoder_threads = 1;
+static int __vs_thread_type = FF_THREAD_FRAME | FF_THREAD_SLICE;
+
+static struct VSOutput *
+__vs_open_output(const char * const, const char * const,
+		const vs_write_fn, void * const, const struct VSInput * const,
+		const int, const bool, const char * const,
+		const struct VSOutputOptions * const, const bool);
+
+// Whether to interrupt blocking I/O. Other threads may set this.
+struct VSInterrupt {
+	atomic_bool interrupted;
+
+	// If not 0, blocking I/O gives up after this time (in
+	// av_gettime_relative() terms).
+	atomic_int_fast64_t deadline;
+};
+
+static AVFormatContext *
+__vs_open_format(struct VSInterrupt * const, const char * const,
+		const char * const, const AVDictionary * const, const int64_t,
+		bool * const, const bool);
+
+static void
+__vs_find_streams(const AVFormatContext * const, int * const, int * const,
+		const bool);
+
+static bool
+__vs_remap_packet(const struct VSInput * const, AVPacket * const);
+
+static struct VSInterrupt *
+__vs_alloc_interrupt(void);
+
+static int
+__vs_interrupt_callback(void * const);
+
+static bool
+__vs_timed_out(const struct VSInterrupt * const);
+
 static void
 __vs_log_packet(const AVFormatContext * const,
 		const AVPacket * const, const char * const);
 
+static void
+__vs_close_faststart(AVFormatContext ** const, AVFormatContext ** const);
+
+static void
+__vs_set_codec_threads(AVCodecContext * const, const bool);
+
+static int
+__vs_extract_extradata(struct VSInput * const, const AVPacket * const);
+
+static bool
+__vs_annexb(const uint8_t * const, const int);
+
+static void
+__vs_parse_parameters(AVCodecParameters * const, const AVPacket * const);
+
+static int
+__vs_add_silent_stream(struct VSOutput * const);
+
+static int
+__vs_write_silence(struct VSOutput * const, const int64_t, const bool);
+
+static void
+__vs_free_jpeg_encoder(AVCodecContext ** const, struct SwsContext ** const,
+		AVFrame ** const);
+
+static void
+__vs_mask_frame(AVFrame * const, const double * const, const int);
+
+static void
+__vs_orient_frame(const AVFrame * const, AVFrame * const, const int,
+		const bool, const bool);
+
+static void
+__vs_dewarp_frame(const AVFrame * const, AVFrame * const,
+		const struct VSDewarp * const);
+
+static bool
+__vs_dewarp_source(const struct VSDewarp * const, const double, const double,
+		const double, double * const, double * const);
+
+// What we have open while encoding a time-lapse, so that we can free it in
+// one place.
+struct VSTimelapse {
+	AVFormatContext * input_ctx;
+	AVCodecContext * decoder_ctx;
+	AVCodecContext * encoder_ctx;
+	AVFormatContext * output_ctx;
+	struct SwsContext * sws_ctx;
+	AVFrame * frame;
+	AVFrame * scaled;
+	AVPacket * pkt;
+
+	// Frames encoded so far. This is the next frame's pts.
+	int64_t frames;
+};
+
+static int
+__vs_timelapse_frames(struct VSTimelapse * const, const char * const,
+		const int, const bool);
+
+static int
+__vs_open_timelapse_output(struct VSTimelapse * const, const char * const,
+		const int, const bool);
+
+static AVCodecContext *
+__vs_open_timelapse_encoder(const enum AVCodecID, const int, const int,
+		const int, const bool, const bool);
+
+static int
+__vs_timelapse_packets(struct VSTimelapse * const, const bool);
+
+static void
+__vs_close_timelapse(struct VSTimelapse * const);
+
+// Set how many threads decoders and encoders use. 0 means one per CPU. The
+// thread type is FF_THREAD_FRAME and/or FF_THREAD_SLICE. Frame threading
+// delays each frame by a frame per thread.
+//
+// Call this before opening anything.
+void
+vs_set_threads(const int decoder_threads, const int encoder_threads,
+		const int thread_type)
+{
+	__vs_decoder_threads = decoder_threads;
+	__vs_encoder_threads = encoder_threads;
+	__vs_thread_type = thread_type;
+}
+
+static void
+__vs_set_codec_threads(AVCodecContext * const codec_ctx, const bool decoder)
+{
+	codec_ctx->thread_count = decoder ? __vs_decoder_threads :
+		__vs_encoder_threads;
+	codec_ctx->thread_type = __vs_thread_type;
+}
+
+// Set up the library. If devices is set, we can read from capture devices,
+// such as with the v4l2, decklink, gdigrab, and avfoundation input formats.
 void
-vs_setup(void)
+vs_setup(const bool devices)
 {
 	// Set up library.
 
 	// Register muxers, demuxers, and protocols.
 	av_register_all();
 
-	// Make formats available.
-	avdevice_register_all();
+	// Make the input formats of capture devices available.
+	if (devices) {
+		avdevice_register_all();
+	}
 
 	avformat_network_init();
 }
 
+void
+vs_get_allocations(struct VSAllocations * const allocations)
+{
+	if (!allocations) {
+		return;
+	}
+
+	allocations->inputs = (int64_t) atomic_load(&__vs_inputs);
+	allocations->outputs = (int64_t) atomic_load(&__vs_outputs);
+	allocations->decoders = (int64_t) atomic_load(&__vs_decoders);
+}
+
+// Open an input. If input_format_name is empty, libav guesses the format,
+// such as from a file's contents.
+//
+// options are the input format's options, such as a capture device's
+// video_size. They may be NULL. If the format doesn't know one of them, we
+// fail.
 struct VSInput *
 vs_open_input(const char * const input_format_name,
-		const char * const input_url, const bool verbose)
+		const char * const input_url, const AVDictionary * const options,
+		const int64_t timeout_us, bool * const timed_out, const bool verbose)
 {
-	if (!input_format_name || strlen(input_format_name) == 0 ||
-			!input_url || strlen(input_url) == 0) {
+	if (timed_out) {
+		*timed_out = false;
+	}
+
+	if (!input_format_name || !input_url || strlen(input_url) == 0) {
 		printf("%s\n", strerror(EINVAL));
 		return NULL;
 	}
@@ -50,60 +231,256 @@ vs_open_input(const char * const input_format_name,
 		return NULL;
 	}
 
+	atomic_fetch_add(&__vs_inputs, 1);
 
-	AVInputFormat * const input_format = av_find_input_format(input_format_name);
-	if (!input_format) {
-		printf("input format not found\n");
+	input->interrupt = __vs_alloc_interrupt();
+	if (!input->interrupt) {
+		printf("%s\n", strerror(errno));
 		vs_destroy_input(input);
 		return NULL;
 	}
 
-	int const open_status = avformat_open_input(&input->format_ctx, input_url,
-			input_format, NULL);
-	if (open_status != 0) {
-		printf("unable to open input: %s\n", av_err2str(open_status));
+	input->format_ctx = __vs_open_format(input->interrupt, input_format_name,
+			input_url, options, timeout_us, timed_out, verbose);
+	if (!input->format_ctx) {
 		vs_destroy_input(input);
 		return NULL;
 	}
 
-	if (avformat_find_stream_info(input->format_ctx, NULL) < 0) {
-		printf("failed to find stream info\n");
+
+	// Find the first video stream and the first audio stream. Not having audio
+	// is fine.
+
+	__vs_find_streams(input->format_ctx, &input->video_stream_index,
+			&input->audio_stream_index, verbose);
+
+	if (input->video_stream_index == -1) {
+		printf("no video stream found\n");
 		vs_destroy_input(input);
 		return NULL;
 	}
 
 
-	if (verbose) {
-		av_dump_format(input->format_ctx, 0, input_url, 0);
+	return input;
+}
+
+// Move the input on to another file, or to the start of the same one again.
+// We read from it from now on as if it followed on from what we read so far:
+// its packets look like they are from the streams we first opened, with
+// timestamps continuing from where those we read so far end. Outputs opened
+// from the input carry on.
+//
+// The file must have the same video codec as the input we first opened. If
+// its audio is different, or the input had none, we skip its audio.
+//
+// Returns -1 on failure. The input is left as it was.
+int
+vs_next_input(struct VSInput * const input,
+		const char * const input_format_name, const char * const input_url,
+		const int64_t timeout_us, bool * const timed_out, const bool verbose)
+{
+	if (timed_out) {
+		*timed_out = false;
+	}
+
+	if (!input || !input_format_name || !input_url ||
+			strlen(input_url) == 0) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
 	}
 
+	AVFormatContext * read_ctx = __vs_open_format(input->interrupt,
+			input_format_name, input_url, NULL, timeout_us, timed_out, verbose);
+	if (!read_ctx) {
+		return -1;
+	}
 
-	// Find the first video stream.
+	int video_stream_index = -1;
+	int audio_stream_index = -1;
+	__vs_find_streams(read_ctx, &video_stream_index, &audio_stream_index,
+			verbose);
 
-	input->video_stream_index = -1;
+	if (video_stream_index == -1) {
+		printf("no video stream found\n");
+		avformat_close_input(&read_ctx);
+		return -1;
+	}
 
-	for (unsigned int i = 0; i < input->format_ctx->nb_streams; i++) {
-		AVStream * const in_stream = input->format_ctx->streams[i];
+	const AVCodecParameters * const video_par =
+		input->format_ctx->streams[input->video_stream_index]->codecpar;
+	if (read_ctx->streams[video_stream_index]->codecpar->codec_id !=
+			video_par->codec_id) {
+		printf("next input has a different video codec\n");
+		avformat_close_input(&read_ctx);
+		return -1;
+	}
 
-		if (in_stream->codecpar->codec_type != AVMEDIA_TYPE_VIDEO) {
-			if (verbose) {
-				printf("skip non-video stream %u\n", i);
+	if (audio_stream_index != -1 && (input->audio_stream_index == -1 ||
+				read_ctx->streams[audio_stream_index]->codecpar->codec_id !=
+				input->format_ctx->streams[
+				input->audio_stream_index]->codecpar->codec_id)) {
+		if (verbose) {
+			printf("skipping audio of next input\n");
+		}
+		audio_stream_index = -1;
+	}
+
+	if (input->read_ctx) {
+		avformat_close_input(&input->read_ctx);
+	}
+
+	input->read_ctx = read_ctx;
+	input->read_video_stream_index = video_stream_index;
+	input->read_audio_stream_index = audio_stream_index;
+
+	int64_t const start_time = read_ctx->start_time != AV_NOPTS_VALUE ?
+		read_ctx->start_time : 0;
+	input->ts_offset = input->end_ts - start_time;
+
+	return 0;
+}
+
+// Open a format context we can interrupt. If input_format_name is empty, libav
+// guesses the format.
+//
+// Returns NULL on failure. If that was because we took longer than
+// timeout_us, we set timed_out.
+static AVFormatContext *
+__vs_open_format(struct VSInterrupt * const interrupt,
+		const char * const input_format_name, const char * const input_url,
+		const AVDictionary * const options, const int64_t timeout_us,
+		bool * const timed_out, const bool verbose)
+{
+	AVInputFormat * input_format = NULL;
+	if (strlen(input_format_name) > 0) {
+		input_format = av_find_input_format(input_format_name);
+		if (!input_format) {
+			printf("input format not found\n");
+			return NULL;
+		}
+	}
+
+	// Allocate the context ourselves so that we can interrupt opening it. A
+	// half dead camera can otherwise block us for a long time.
+	AVFormatContext * format_ctx = avformat_alloc_context();
+	if (!format_ctx) {
+		printf("unable to allocate format context\n");
+		return NULL;
+	}
+
+	format_ctx->interrupt_callback.callback = __vs_interrupt_callback;
+	format_ctx->interrupt_callback.opaque = interrupt;
+
+	if (timeout_us > 0) {
+		atomic_store(&interrupt->deadline, av_gettime_relative() + timeout_us);
+	}
+
+	// avformat_open_input() replaces the options with those it didn't use, so
+	// we give it a copy.
+	AVDictionary * opts = NULL;
+	if (options && av_dict_copy(&opts, options, 0) < 0) {
+		printf("unable to copy input options\n");
+		avformat_free_context(format_ctx);
+		return NULL;
+	}
+
+	// On failure this frees the context and sets it to NULL.
+	int const open_status = avformat_open_input(&format_ctx, input_url,
+			input_format, &opts);
+	if (open_status != 0) {
+		av_dict_free(&opts);
+		if (__vs_timed_out(interrupt)) {
+			printf("timed out opening input\n");
+			if (timed_out) {
+				*timed_out = true;
 			}
-			continue;
+		} else {
+			printf("unable to open input: %s\n", av_err2str(open_status));
 		}
+		atomic_store(&interrupt->deadline, 0);
+		return NULL;
+	}
 
-		input->video_stream_index = (int) i;
-		break;
+	// Options left over are ones the input format doesn't have, such as a
+	// misspelling.
+	const AVDictionaryEntry * const unknown = av_dict_get(opts, "", NULL,
+			AV_DICT_IGNORE_SUFFIX);
+	if (unknown) {
+		printf("unknown input option: %s\n", unknown->key);
+		atomic_store(&interrupt->deadline, 0);
+		av_dict_free(&opts);
+		avformat_close_input(&format_ctx);
+		return NULL;
 	}
+	av_dict_free(&opts);
 
-	if (input->video_stream_index == -1) {
-		printf("no video stream found\n");
-		vs_destroy_input(input);
+	if (avformat_find_stream_info(format_ctx, NULL) < 0) {
+		if (__vs_timed_out(interrupt)) {
+			printf("timed out finding stream info\n");
+			if (timed_out) {
+				*timed_out = true;
+			}
+		} else {
+			printf("failed to find stream info\n");
+		}
+		atomic_store(&interrupt->deadline, 0);
+		avformat_close_input(&format_ctx);
 		return NULL;
 	}
 
+	// vs_read_packet() sets its own deadline.
+	atomic_store(&interrupt->deadline, 0);
 
-	return input;
+
+	if (verbose) {
+		av_dump_format(format_ctx, 0, input_url, 0);
+	}
+
+	return format_ctx;
+}
+
+// Find the first video stream and the first audio stream. The index is -1 if
+// there is no such stream.
+static void
+__vs_find_streams(const AVFormatContext * const format_ctx,
+		int * const video_stream_index, int * const audio_stream_index,
+		const bool verbose)
+{
+	*video_stream_index = -1;
+	*audio_stream_index = -1;
+
+	for (unsigned int i = 0; i < format_ctx->nb_streams; i++) {
+		AVStream * const in_stream = format_ctx->streams[i];
+
+		if (in_stream->codecpar->codec_type == AVMEDIA_TYPE_VIDEO &&
+				*video_stream_index == -1) {
+			*video_stream_index = (int) i;
+			continue;
+		}
+
+		if (in_stream->codecpar->codec_type == AVMEDIA_TYPE_AUDIO &&
+				*audio_stream_index == -1) {
+			*audio_stream_index = (int) i;
+			continue;
+		}
+
+		if (verbose) {
+			printf("skip stream %u\n", i);
+		}
+	}
+}
+
+// Shift the timestamps of audio packets we read from now on by offset, in
+// AV_TIME_BASE units. This cancels drift between the audio and video clocks.
+// Like vs_read_packet(), only the reading thread may call this.
+void
+vs_set_audio_offset(struct VSInput * const input, const int64_t offset)
+{
+	if (!input) {
+		return;
+	}
+
+	input->audio_ts_offset = offset;
 }
 
 void
@@ -113,31 +490,152 @@ vs_destroy_input(struct VSInput * const input)
 		return;
 	}
 
+	if (input->read_ctx) {
+		avformat_close_input(&input->read_ctx);
+	}
+
 	if (input->format_ctx) {
 		avformat_close_input(&input->format_ctx);		
 	}
 
+	av_bsf_free(&input->extradata_bsf);
+	avcodec_parameters_free(&input->new_codecpar);
+
+	// libav may call the interrupt callback while closing, so this goes last.
+	free(input->interrupt);
+
 	free(input);
+
+	atomic_fetch_sub(&__vs_inputs, 1);
+}
+
+// Make the input's blocking I/O give up, now and from now on. This is safe to
+// call from another thread while the input is in use, but not while it is
+// being destroyed.
+void
+vs_interrupt_input(struct VSInput * const input)
+{
+	if (!input || !input->interrupt) {
+		return;
+	}
+
+	atomic_store(&input->interrupt->interrupted, true);
+}
+
+static struct VSInterrupt *
+__vs_alloc_interrupt(void)
+{
+	struct VSInterrupt * const interrupt = calloc(1,
+			sizeof(struct VSInterrupt));
+	if (!interrupt) {
+		return NULL;
+	}
+
+	atomic_init(&interrupt->interrupted, false);
+	atomic_init(&interrupt->deadline, 0);
+
+	return interrupt;
+}
+
+// Tell libav to give up on blocking I/O if we were interrupted or are past the
+// deadline.
+static int
+__vs_interrupt_callback(void * const opaque)
+{
+	const struct VSInterrupt * const interrupt = opaque;
+
+	if (atomic_load(&interrupt->interrupted)) {
+		return 1;
+	}
+
+	return __vs_timed_out(interrupt);
+}
+
+static bool
+__vs_timed_out(const struct VSInterrupt * const interrupt)
+{
+	int64_t const deadline = (int64_t) atomic_load(&interrupt->deadline);
+
+	return deadline != 0 && av_gettime_relative() > deadline;
 }
 
 struct VSOutput *
 vs_open_output(const char * const output_format_name,
 		const char * const output_url, const struct VSInput * const input,
-		const bool verbose)
+		const char * const fec, const bool verbose)
+{
+	if (!output_url || strlen(output_url) == 0 || !input) {
+		printf("%s\n", strerror(EINVAL));
+		return NULL;
+	}
+
+	return __vs_open_output(output_format_name, output_url, NULL, NULL, input,
+			input->video_stream_index, false, fec, NULL, verbose);
+}
+
+// Open an output that writes using the given function rather than to a URL.
+// opaque is passed to the function each time it is called.
+//
+// If audio is set, the output has the input's audio stream rather than its
+// video stream.
+//
+// If cmaf is set, the output is an MP4 made of CMAF chunks. See
+// __vs_open_output().
+//
+// options may be NULL for the defaults.
+struct VSOutput *
+vs_open_output_writer(const char * const output_format_name,
+		const vs_write_fn write_fn, void * const opaque,
+		const struct VSInput * const input, const bool audio, const bool cmaf,
+		const struct VSOutputOptions * const options, const bool verbose)
+{
+	if (!write_fn || !input) {
+		printf("%s\n", strerror(EINVAL));
+		return NULL;
+	}
+
+	const int stream_index = audio ? input->audio_stream_index :
+		input->video_stream_index;
+	if (stream_index == -1) {
+		printf("input has no such stream\n");
+		return NULL;
+	}
+
+	return __vs_open_output(output_format_name, NULL, write_fn, opaque, input,
+			stream_index, cmaf, NULL, options, verbose);
+}
+
+// Open an output. We write either to output_url, or using write_fn.
+static struct VSOutput *
+__vs_open_output(const char * const output_format_name,
+		const char * const output_url, const vs_write_fn write_fn,
+		void * const opaque, const struct VSInput * const input,
+		const int stream_index, const bool cmaf, const char * const fec,
+		const struct VSOutputOptions * const options, const bool verbose)
 {
-	if (!output_format_name || strlen(output_format_name) == 0 ||
-			!output_url || strlen(output_url) == 0 ||
-			!input) {
+	if (!output_format_name || strlen(output_format_name) == 0 || !input) {
 		printf("%s\n", strerror(EINVAL));
 		return NULL;
 	}
 
+	const struct VSOutputOptions defaults = {0};
+	const struct VSOutputOptions * const opt = options ? options : &defaults;
+
 	struct VSOutput * const output = calloc(1, sizeof(struct VSOutput));
 	if (!output) {
 		printf("%s\n", strerror(errno));
 		return NULL;
 	}
 
+	atomic_fetch_add(&__vs_outputs, 1);
+
+	output->interrupt = __vs_alloc_interrupt();
+	if (!output->interrupt) {
+		printf("%s\n", strerror(errno));
+		vs_destroy_output(output);
+		return NULL;
+	}
+
 
 	AVOutputFormat * const output_format = av_guess_format(output_format_name,
 			NULL, NULL);
@@ -154,8 +652,29 @@ vs_open_output(const char * const output_format_name,
 		return NULL;
 	}
 
+	output->format_ctx->interrupt_callback.callback = __vs_interrupt_callback;
+	output->format_ctx->interrupt_callback.opaque = output->interrupt;
+
+	// libav's interleaving queue holds packets until it has one from each
+	// stream, or until max_interleave_delta passes (10 seconds by default).
+	// That can be seconds of latency with a stream that sends packets rarely,
+	// so we only interleave when asked, and with the caller's bound.
+	if (opt->max_interleave_delta > 0) {
+		output->format_ctx->max_interleave_delta = opt->max_interleave_delta;
+		output->interleave = true;
+	}
+
+
+	// Copy the stream.
+
+	if (stream_index < 0 ||
+			(unsigned int) stream_index >= input->format_ctx->nb_streams) {
+		printf("input stream not found with stream index %d\n", stream_index);
+		vs_destroy_output(output);
+		return NULL;
+	}
 
-	// Copy the video stream.
+	output->input_stream_index = stream_index;
 
 	AVStream * const out_stream = avformat_new_stream(output->format_ctx, NULL);
 	if (!out_stream) {
@@ -164,8 +683,7 @@ vs_open_output(const char * const output_format_name,
 		return NULL;
 	}
 
-	AVStream * const in_stream = input->format_ctx->streams[
-		input->video_stream_index];
+	AVStream * const in_stream = input->format_ctx->streams[stream_index];
 
 	if (avcodec_parameters_copy(out_stream->codecpar,
 				in_stream->codecpar) < 0) {
@@ -174,17 +692,110 @@ vs_open_output(const char * const output_format_name,
 		return NULL;
 	}
 
+	if (stream_index == input->video_stream_index &&
+			(opt->rotate != 0 || opt->hflip || opt->vflip)) {
+		int32_t * const matrix = (int32_t *) av_stream_new_side_data(out_stream,
+				AV_PKT_DATA_DISPLAYMATRIX, sizeof(int32_t) * 9);
+		if (!matrix) {
+			printf("unable to add display matrix\n");
+			vs_destroy_output(output);
+			return NULL;
+		}
+
+		// av_display_rotation_set() turns anticlockwise.
+		av_display_rotation_set(matrix, (double) -opt->rotate);
+		av_display_matrix_flip(matrix, opt->hflip, opt->vflip);
+	}
+
+	// A video output may carry the input's audio too, as a second stream.
+	output->audio_input_stream_index = -1;
+
+	if (opt->with_audio && stream_index == input->video_stream_index &&
+			input->audio_stream_index != -1) {
+		AVStream * const out_audio_stream = avformat_new_stream(
+				output->format_ctx, NULL);
+		if (!out_audio_stream) {
+			printf("unable to add audio stream\n");
+			vs_destroy_output(output);
+			return NULL;
+		}
+
+		if (avcodec_parameters_copy(out_audio_stream->codecpar,
+					input->format_ctx->streams[input->audio_stream_index]->codecpar) < 0) {
+			printf("unable to copy audio codec parameters\n");
+			vs_destroy_output(output);
+			return NULL;
+		}
+
+		output->audio_input_stream_index = input->audio_stream_index;
+	}
+
+	if (opt->silent_audio && stream_index == input->video_stream_index &&
+			output->audio_input_stream_index == -1) {
+		if (__vs_add_silent_stream(output) != 0) {
+			vs_destroy_output(output);
+			return NULL;
+		}
+	}
+
 
 	if (verbose) {
-		av_dump_format(output->format_ctx, 0, output_url, 1);
+		av_dump_format(output->format_ctx, 0, output_url ? output_url : "writer",
+				1);
 	}
 
 
-	// Open output file.
-	if (avio_open(&output->format_ctx->pb, output_url, AVIO_FLAG_WRITE) < 0) {
-		printf("unable to open output file\n");
-		vs_destroy_output(output);
-		return NULL;
+	// Open output file, or set up writing through the caller's function.
+	if (write_fn) {
+		// avio takes ownership of this buffer.
+		int const buffer_size = opt->buffer_size > 0 ? opt->buffer_size :
+			32768;
+		unsigned char * const buffer = av_malloc((size_t) buffer_size);
+		if (!buffer) {
+			printf("unable to allocate output buffer\n");
+			vs_destroy_output(output);
+			return NULL;
+		}
+
+		output->format_ctx->pb = avio_alloc_context(buffer, buffer_size, 1,
+				opaque, NULL, write_fn, NULL);
+		if (!output->format_ctx->pb) {
+			printf("unable to allocate output context\n");
+			av_free(buffer);
+			vs_destroy_output(output);
+			return NULL;
+		}
+
+		output->custom_io = true;
+	} else {
+		// For RTP, the protocol can add forward error correction, such as
+		// prompeg=l=5:d=20.
+		AVDictionary * io_opts = NULL;
+		if (fec && strlen(fec) > 0 &&
+				av_dict_set(&io_opts, "fec", fec, 0) < 0) {
+			printf("unable to set fec opt\n");
+			vs_destroy_output(output);
+			return NULL;
+		}
+
+		if (avio_open2(&output->format_ctx->pb, output_url, AVIO_FLAG_WRITE,
+					&output->format_ctx->interrupt_callback, &io_opts) < 0) {
+			printf("unable to open output file\n");
+			vs_destroy_output(output);
+			av_dict_free(&io_opts);
+			return NULL;
+		}
+
+		// Options left over were not recognized, such as fec for a protocol
+		// other than rtp.
+		if (av_dict_count(io_opts) != 0) {
+			printf("some output options not set\n");
+			vs_destroy_output(output);
+			av_dict_free(&io_opts);
+			return NULL;
+		}
+
+		av_dict_free(&io_opts);
 	}
 
 
@@ -206,13 +817,51 @@ vs_open_output(const char * const output_format_name,
 	// I found that while Chrome had no trouble displaying the resulting mp4 with
 	// just frag_keyframe, Firefox would not until I also added empty_moov.
 	// empty_moov apparently writes some info at the start of the file.
-	if (av_dict_set(&opts, "movflags", "frag_keyframe+empty_moov", 0) < 0) {
+	//
+	// CMAF requires default_base_moof as well.
+	//
+	// Other formats (such as adts for audio alone) do not have this option.
+	const char * const movflags = cmaf ?
+		"frag_keyframe+empty_moov+default_base_moof" : "frag_keyframe+empty_moov";
+	if (strcmp(output_format_name, "mp4") == 0 &&
+			av_dict_set(&opts, "movflags", movflags, 0) < 0) {
 		printf("unable to set movflags opt\n");
 		vs_destroy_output(output);
 		return NULL;
 	}
 
-	if (av_dict_set_int(&opts, "flush_packets", 1, 0) < 0) {
+	// For CMAF we also cut a fragment (a CMAF chunk) every so often between
+	// keyframes. This way whoever segments the output can pass on a segment
+	// piece by piece as it arrives rather than waiting for the whole thing.
+	//
+	// Other MP4 outputs can do the same so that clients receive each bit of
+	// video sooner, rather than only once the next keyframe arrives.
+	int64_t frag_duration = opt->frag_duration;
+	if (cmaf && frag_duration == 0) {
+		frag_duration = 500000;
+	}
+
+	if (strcmp(output_format_name, "mp4") == 0 && frag_duration > 0 &&
+			av_dict_set_int(&opts, "frag_duration", frag_duration, 0) < 0) {
+		printf("unable to set frag_duration opt\n");
+		vs_destroy_output(output);
+		av_dict_free(&opts);
+		return NULL;
+	}
+
+	if (cmaf) {
+		if (av_dict_set(&opts, "brand", "cmfc", 0) < 0) {
+			printf("unable to set brand opt\n");
+			vs_destroy_output(output);
+			av_dict_free(&opts);
+			return NULL;
+		}
+	}
+
+	// Write out each packet as soon as it is muxed, unless we're told to let
+	// avio buffer.
+	if (av_dict_set_int(&opts, "flush_packets", opt->buffered ? 0 : 1,
+				0) < 0) {
 		printf("unable to set flush_packets opt\n");
 		vs_destroy_output(output);
 		av_dict_free(&opts);
@@ -226,6 +875,8 @@ vs_open_output(const char * const output_format_name,
 		return NULL;
 	}
 
+	output->header_written = true;
+
 
 	// Check any options that were not set. Because I'm not sure if all are
 	// appropriate to set through the avformat_write_header().
@@ -240,41 +891,184 @@ vs_open_output(const char * const output_format_name,
 
 
 	output->last_dts = AV_NOPTS_VALUE;
+	output->audio_last_dts = AV_NOPTS_VALUE;
+	output->silence_next_pts = AV_NOPTS_VALUE;
 
 	return output;
 }
 
-void
-vs_destroy_output(struct VSOutput * const output)
+// Silence is stereo AAC-LC at 48 kHz, in frames of 1024 samples. We count it
+// in samples.
+static const AVRational __vs_silence_time_base = {1, 48000};
+#define VS_SILENCE_FRAME_SAMPLES 1024
+
+// A raw AAC-LC frame of stereo silence, and the AudioSpecificConfig
+// describing the stream: AAC-LC, 48 kHz, 2 channels.
+static const uint8_t __vs_silence_frame[] = {
+	0x21, 0x00, 0x49, 0x90, 0x02, 0x19, 0x00, 0x23, 0x80,
+};
+static const uint8_t __vs_silence_config[] = {0x11, 0x90};
+
+// Add a silent AAC stream to the output as its second stream. Players that
+// won't play video alone, such as some TVs, then play it. We make the silence
+// up rather than encoding it, so this costs next to nothing.
+//
+// Returns 0 on success, -1 on error.
+static int
+__vs_add_silent_stream(struct VSOutput * const output)
 {
-	if (!output) {
-		return;
+	AVStream * const stream = avformat_new_stream(output->format_ctx, NULL);
+	if (!stream) {
+		printf("unable to add silent audio stream\n");
+		return -1;
+	}
+
+	AVCodecParameters * const codecpar = stream->codecpar;
+	codecpar->codec_type = AVMEDIA_TYPE_AUDIO;
+	codecpar->codec_id = AV_CODEC_ID_AAC;
+	codecpar->sample_rate = __vs_silence_time_base.den;
+	codecpar->frame_size = VS_SILENCE_FRAME_SAMPLES;
+#if LIBAVCODEC_VERSION_MAJOR >= 60
+	av_channel_layout_default(&codecpar->ch_layout, 2);
+#else
+	codecpar->channels = 2;
+	codecpar->channel_layout = AV_CH_LAYOUT_STEREO;
+#endif
+
+	codecpar->extradata = av_mallocz(sizeof(__vs_silence_config) +
+			AV_INPUT_BUFFER_PADDING_SIZE);
+	if (!codecpar->extradata) {
+		printf("unable to allocate silent audio extradata\n");
+		return -1;
+	}
+	memcpy(codecpar->extradata, __vs_silence_config,
+			sizeof(__vs_silence_config));
+	codecpar->extradata_size = (int) sizeof(__vs_silence_config);
+
+	stream->time_base = __vs_silence_time_base;
+
+	output->silent_audio = true;
+	return 0;
+}
+
+// Write silent frames to the output's second stream until it reaches
+// until, the pts of the video we just wrote, in samples. It starts with the
+// first video packet, and stays at most a frame ahead of the video.
+//
+// Returns 0 on success, -1 on error.
+static int
+__vs_write_silence(struct VSOutput * const output, const int64_t until,
+		const bool verbose)
+{
+	if (output->silence_next_pts == AV_NOPTS_VALUE) {
+		output->silence_next_pts = until;
+	}
+
+	AVStream * const stream = output->format_ctx->streams[1];
+
+	while (output->silence_next_pts <= until) {
+		AVPacket * pkt = av_packet_alloc();
+		if (!pkt) {
+			printf("unable to allocate silent packet\n");
+			return -1;
+		}
+
+		if (av_new_packet(pkt, (int) sizeof(__vs_silence_frame)) != 0) {
+			printf("unable to allocate silent packet data\n");
+			av_packet_free(&pkt);
+			return -1;
+		}
+		memcpy(pkt->data, __vs_silence_frame, sizeof(__vs_silence_frame));
+
+		pkt->stream_index = 1;
+		pkt->pts = av_rescale_q(output->silence_next_pts, __vs_silence_time_base,
+				stream->time_base);
+		pkt->dts = pkt->pts;
+		pkt->duration = av_rescale_q(VS_SILENCE_FRAME_SAMPLES,
+				__vs_silence_time_base, stream->time_base);
+		pkt->flags |= AV_PKT_FLAG_KEY;
+		pkt->pos = -1;
+
+		if (verbose) {
+			__vs_log_packet(output->format_ctx, pkt, "silence");
+		}
+
+		output->audio_last_dts = pkt->dts;
+		output->silence_next_pts += VS_SILENCE_FRAME_SAMPLES;
+
+		const int write_res = output->interleave ?
+			av_interleaved_write_frame(output->format_ctx, pkt) :
+			av_write_frame(output->format_ctx, pkt);
+		av_packet_free(&pkt);
+		if (write_res != 0) {
+			printf("unable to write silent frame: %s\n", av_err2str(write_res));
+			return -1;
+		}
+	}
+
+	return 0;
+}
+
+void
+vs_destroy_output(struct VSOutput * const output)
+{
+	if (!output) {
+		return;
 	}
 
 	if (output->format_ctx) {
-		if (av_write_trailer(output->format_ctx) != 0) {
-			printf("unable to write trailer\n");
+		// Writing the trailer finalizes the MP4 so that whoever receives it has a
+		// playable file rather than a truncated one. We can only do this if we
+		// wrote the header.
+		if (output->header_written) {
+			if (av_write_trailer(output->format_ctx) != 0) {
+				printf("unable to write trailer\n");
+			}
 		}
 
-		if (avio_closep(&output->format_ctx->pb) != 0) {
-			printf("avio_closep failed\n");
+		if (output->custom_io) {
+			if (output->format_ctx->pb) {
+				av_freep(&output->format_ctx->pb->buffer);
+				avio_context_free(&output->format_ctx->pb);
+			}
+		} else {
+			if (avio_closep(&output->format_ctx->pb) != 0) {
+				printf("avio_closep failed\n");
+			}
 		}
 
 		avformat_free_context(output->format_ctx);
 	}
 
+	free(output->interrupt);
+
 	free(output);
+
+	atomic_fetch_sub(&__vs_outputs, 1);
+}
+
+// Make the output's blocking I/O give up, now and from now on. Like
+// vs_interrupt_input(), this is safe to call from another thread.
+void
+vs_interrupt_output(struct VSOutput * const output)
+{
+	if (!output || !output->interrupt) {
+		return;
+	}
+
+	atomic_store(&output->interrupt->interrupted, true);
 }
 
 // Read a compressed and encoded frame as a packet.
 //
 // Returns:
+// -2 if we reached the end of the input, such as of a file
 // -1 if error
-// 0 if nothing useful read (e.g., non-video packet)
+// 0 if nothing useful read (e.g., a packet from a stream we don't use)
 // 1 if read a packet
 int
-vs_read_packet(const struct VSInput * input, AVPacket * const pkt,
-		const bool verbose)
+vs_read_packet(struct VSInput * const input, AVPacket * const pkt,
+		const int64_t timeout_us, const bool verbose)
 {
 	if (!input || !pkt) {
 		printf("%s\n", strerror(errno));
@@ -286,18 +1080,57 @@ vs_read_packet(const struct VSInput * input, AVPacket * const pkt,
 
 	// Read encoded frame (as a packet).
 
-	if (av_read_frame(input->format_ctx, pkt) != 0) {
-		printf("unable to read frame\n");
+	if (timeout_us > 0) {
+		atomic_store(&input->interrupt->deadline,
+				av_gettime_relative() + timeout_us);
+	}
+
+	AVFormatContext * const read_ctx = input->read_ctx ? input->read_ctx :
+		input->format_ctx;
+
+	int const read_status = av_read_frame(read_ctx, pkt);
+
+	bool const timed_out = __vs_timed_out(input->interrupt);
+	atomic_store(&input->interrupt->deadline, 0);
+
+	if (read_status != 0) {
+		if (read_status == AVERROR_EOF) {
+			if (verbose) {
+				printf("end of input\n");
+			}
+			return -2;
+		}
+
+		if (atomic_load(&input->interrupt->interrupted)) {
+			printf("reading frame interrupted\n");
+		} else if (timed_out) {
+			printf("timed out reading frame\n");
+		} else {
+			printf("unable to read frame: %s\n", av_err2str(read_status));
+		}
 		return -1;
 	}
 
 
-	// Ignore it if it's not our video stream.
+	// Ignore it if it's not our video or audio stream.
 
-	if (pkt->stream_index != input->video_stream_index) {
+	if (input->read_ctx && !__vs_remap_packet(input, pkt)) {
+		if (verbose) {
+			printf("skipping packet from input stream %d, our video is from stream %d, audio from stream %d\n",
+					pkt->stream_index, input->read_video_stream_index,
+					input->read_audio_stream_index);
+		}
+
+		av_packet_unref(pkt);
+		return 0;
+	}
+
+	if (pkt->stream_index != input->video_stream_index &&
+			pkt->stream_index != input->audio_stream_index) {
 		if (verbose) {
-			printf("skipping packet from input stream %d, our video is from stream %d\n",
-					pkt->stream_index, input->video_stream_index);
+			printf("skipping packet from input stream %d, our video is from stream %d, audio from stream %d\n",
+					pkt->stream_index, input->video_stream_index,
+					input->audio_stream_index);
 		}
 
 		av_packet_unref(pkt);
@@ -305,19 +1138,371 @@ vs_read_packet(const struct VSInput * input, AVPacket * const pkt,
 	}
 
 
+	// Shift audio to cancel drift against the video. See vs_set_audio_offset().
+
+	if (pkt->stream_index == input->audio_stream_index &&
+			input->audio_ts_offset != 0) {
+		AVStream * const in_stream = input->format_ctx->streams[pkt->stream_index];
+		int64_t const offset = av_rescale_q(input->audio_ts_offset, AV_TIME_BASE_Q,
+				in_stream->time_base);
+
+		if (pkt->pts != AV_NOPTS_VALUE) {
+			pkt->pts += offset;
+		}
+
+		if (pkt->dts != AV_NOPTS_VALUE) {
+			pkt->dts += offset;
+		}
+	}
+
+
 	if (verbose) {
 		__vs_log_packet(input->format_ctx, pkt, "in");
 	}
 
+
+	// Track where what we read ends, in case we move on to another file.
+
+	int64_t const ts = pkt->dts != AV_NOPTS_VALUE ? pkt->dts : pkt->pts;
+	if (ts != AV_NOPTS_VALUE) {
+		AVStream * const in_stream = input->format_ctx->streams[pkt->stream_index];
+		int64_t const end_ts = av_rescale_q(ts + pkt->duration,
+				in_stream->time_base, AV_TIME_BASE_Q);
+		if (end_ts > input->end_ts) {
+			input->end_ts = end_ts;
+		}
+	}
+
+	return 1;
+}
+
+// Make a packet read from the file we moved on to look like it is from the
+// stream we first opened: give it that stream's index, and its timestamps in
+// that stream's time base, following on from the packets before.
+//
+// Returns false if the packet is from a stream we don't use.
+static bool
+__vs_remap_packet(const struct VSInput * const input, AVPacket * const pkt)
+{
+	int stream_index = -1;
+	if (pkt->stream_index == input->read_video_stream_index) {
+		stream_index = input->video_stream_index;
+	} else if (pkt->stream_index == input->read_audio_stream_index) {
+		stream_index = input->audio_stream_index;
+	}
+
+	if (stream_index == -1) {
+		return false;
+	}
+
+	AVRational const read_time_base =
+		input->read_ctx->streams[pkt->stream_index]->time_base;
+	AVRational const time_base =
+		input->format_ctx->streams[stream_index]->time_base;
+	int64_t const offset = av_rescale_q(input->ts_offset, AV_TIME_BASE_Q,
+			time_base);
+
+	if (pkt->pts != AV_NOPTS_VALUE) {
+		pkt->pts = av_rescale_q(pkt->pts, read_time_base, time_base) + offset;
+	}
+
+	if (pkt->dts != AV_NOPTS_VALUE) {
+		pkt->dts = av_rescale_q(pkt->dts, read_time_base, time_base) + offset;
+	}
+
+	pkt->duration = av_rescale_q(pkt->duration, read_time_base, time_base);
+	pkt->stream_index = stream_index;
+
+	return true;
+}
+
+// Find the time of a packet read from the input, in AV_TIME_BASE units.
+//
+// Returns AV_NOPTS_VALUE if the packet has no timestamp.
+int64_t
+vs_packet_time(const struct VSInput * const input, const AVPacket * const pkt)
+{
+	if (!input || !pkt) {
+		return AV_NOPTS_VALUE;
+	}
+
+	int64_t const ts = pkt->dts != AV_NOPTS_VALUE ? pkt->dts : pkt->pts;
+	if (ts == AV_NOPTS_VALUE) {
+		return AV_NOPTS_VALUE;
+	}
+
+	AVStream * const in_stream = input->format_ctx->streams[pkt->stream_index];
+
+	return av_rescale_q(ts, in_stream->time_base, AV_TIME_BASE_Q);
+}
+
+// Check whether the video's codec parameters change with this packet. Cameras
+// may change them mid-stream, such as when their settings change, or when
+// they switch resolution between day and night modes. Outputs copy the
+// parameters when they open, so those opened before the change would have the
+// old ones and their video would be corrupt.
+//
+// The parameters that change are in the extradata (for H.264, its SPS and
+// PPS). When it changes, we also find the video's new dimensions, profile, and
+// level.
+//
+// Some demuxers, such as FLV's, give new extradata as side data. Otherwise,
+// for H.264 and H.265 with extradata in Annex B form, as from RTSP, we
+// extract the parameter sets from keyframes and compare. MP4 style extradata
+// (avcC and the like) is in another form than what we extract, and comes from
+// files, mostly, so we compare only side data for it.
+//
+// We don't change the input's parameters here, as outputs may be opening from
+// them in other threads. Call vs_apply_codec_parameters() once they can't be.
+//
+// Returns:
+// -1 if error
+// 0 if the parameters are the same
+// 1 if they changed
+int
+vs_check_codec_parameters(struct VSInput * const input, const AVPacket * const pkt,
+		const bool verbose)
+{
+	if (!input || !pkt) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	if (pkt->stream_index != input->video_stream_index) {
+		return 0;
+	}
+
+	const AVCodecParameters * const codecpar =
+		input->format_ctx->streams[input->video_stream_index]->codecpar;
+
+#if LIBAVCODEC_VERSION_MAJOR >= 59
+	size_t size = 0;
+#else
+	int size = 0;
+#endif
+	const uint8_t * extradata = av_packet_get_side_data(pkt,
+			AV_PKT_DATA_NEW_EXTRADATA, &size);
+
+	AVPacket * filtered = NULL;
+
+	if (!extradata) {
+		if (!(pkt->flags & AV_PKT_FLAG_KEY) ||
+				(codecpar->codec_id != AV_CODEC_ID_H264 &&
+				 codecpar->codec_id != AV_CODEC_ID_HEVC) ||
+				!__vs_annexb(codecpar->extradata, codecpar->extradata_size)) {
+			return 0;
+		}
+
+		filtered = av_packet_alloc();
+		if (!filtered) {
+			printf("unable to allocate packet\n");
+			return -1;
+		}
+
+		const int extract_res = __vs_extract_extradata(input, pkt);
+		if (extract_res != 1 ||
+				av_bsf_receive_packet(input->extradata_bsf, filtered) != 0) {
+			av_packet_free(&filtered);
+			return extract_res == -1 ? -1 : 0;
+		}
+
+		extradata = av_packet_get_side_data(filtered, AV_PKT_DATA_NEW_EXTRADATA,
+				&size);
+	}
+
+	if (!extradata || size == 0 ||
+			((int) size == codecpar->extradata_size &&
+			 memcmp(extradata, codecpar->extradata, (size_t) size) == 0)) {
+		av_packet_free(&filtered);
+		return 0;
+	}
+
+	AVCodecParameters * new_codecpar = avcodec_parameters_alloc();
+	if (!new_codecpar ||
+			avcodec_parameters_copy(new_codecpar, codecpar) < 0) {
+		printf("unable to copy codec parameters\n");
+		avcodec_parameters_free(&new_codecpar);
+		av_packet_free(&filtered);
+		return -1;
+	}
+
+	av_freep(&new_codecpar->extradata);
+	new_codecpar->extradata = av_mallocz((size_t) size +
+			AV_INPUT_BUFFER_PADDING_SIZE);
+	if (!new_codecpar->extradata) {
+		printf("unable to allocate extradata\n");
+		avcodec_parameters_free(&new_codecpar);
+		av_packet_free(&filtered);
+		return -1;
+	}
+
+	memcpy(new_codecpar->extradata, extradata, (size_t) size);
+	new_codecpar->extradata_size = (int) size;
+
+	av_packet_free(&filtered);
+
+	__vs_parse_parameters(new_codecpar, pkt);
+
+	if (verbose) {
+		printf("codec parameters changed: %dx%d (was %dx%d), extradata %d bytes (was %d bytes)\n",
+				new_codecpar->width, new_codecpar->height, codecpar->width,
+				codecpar->height, new_codecpar->extradata_size,
+				codecpar->extradata_size);
+	}
+
+	avcodec_parameters_free(&input->new_codecpar);
+	input->new_codecpar = new_codecpar;
+	return 1;
+}
+
+// Give the video the parameters vs_check_codec_parameters() found. Outputs
+// opened from now on use them. No outputs or decoders may be opening
+// meanwhile.
+//
+// Returns -1 on failure. The parameters are left as they were.
+int
+vs_apply_codec_parameters(struct VSInput * const input)
+{
+	if (!input || !input->new_codecpar) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	AVStream * const in_stream =
+		input->format_ctx->streams[input->video_stream_index];
+
+	// Copying into the stream's parameters would leave them half copied if it
+	// failed, so we copy into a new one and swap it in. Demuxers reach the
+	// parameters through the stream.
+	AVCodecParameters * codecpar = avcodec_parameters_alloc();
+	if (!codecpar ||
+			avcodec_parameters_copy(codecpar, input->new_codecpar) < 0) {
+		printf("unable to copy codec parameters\n");
+		avcodec_parameters_free(&codecpar);
+		avcodec_parameters_free(&input->new_codecpar);
+		return -1;
+	}
+
+	avcodec_parameters_free(&in_stream->codecpar);
+	in_stream->codecpar = codecpar;
+
+	avcodec_parameters_free(&input->new_codecpar);
+	return 0;
+}
+
+// Find the video's dimensions, profile, and level from its new extradata and a
+// keyframe, using libav's parser for the codec. If it can't tell, we leave
+// them as they were.
+static void
+__vs_parse_parameters(AVCodecParameters * const codecpar,
+		const AVPacket * const pkt)
+{
+	AVCodecParserContext * const parser = av_parser_init(codecpar->codec_id);
+	if (!parser) {
+		return;
+	}
+
+	// Each packet is a whole frame.
+	parser->flags |= PARSER_FLAG_COMPLETE_FRAMES;
+
+	AVCodecContext * codec_ctx = avcodec_alloc_context3(NULL);
+	if (!codec_ctx ||
+			avcodec_parameters_to_context(codec_ctx, codecpar) < 0) {
+		avcodec_free_context(&codec_ctx);
+		av_parser_close(parser);
+		return;
+	}
+
+	uint8_t * out = NULL;
+	int out_size = 0;
+	av_parser_parse2(parser, codec_ctx, &out, &out_size, pkt->data, pkt->size,
+			pkt->pts, pkt->dts, pkt->pos);
+
+	if (parser->width > 0 && parser->height > 0) {
+		codecpar->width = parser->width;
+		codecpar->height = parser->height;
+	}
+
+	// The parser sets these on the codec context, which started out with the
+	// old ones.
+	codecpar->profile = codec_ctx->profile;
+	codecpar->level = codec_ctx->level;
+
+	avcodec_free_context(&codec_ctx);
+	av_parser_close(parser);
+}
+
+// Send a reference to the packet through the extract_extradata filter. The
+// filter gives back one packet for each it receives.
+//
+// Returns:
+// -1 if error
+// 1 if the filter has a packet for us
+static int
+__vs_extract_extradata(struct VSInput * const input,
+		const AVPacket * const pkt)
+{
+	if (!input->extradata_bsf) {
+		const AVBitStreamFilter * const filter =
+			av_bsf_get_by_name("extract_extradata");
+		if (!filter) {
+			printf("extract_extradata filter not found\n");
+			return -1;
+		}
+
+		if (av_bsf_alloc(filter, &input->extradata_bsf) < 0) {
+			printf("unable to allocate filter\n");
+			return -1;
+		}
+
+		if (avcodec_parameters_copy(input->extradata_bsf->par_in,
+					input->format_ctx->streams[input->video_stream_index]->codecpar) < 0 ||
+				av_bsf_init(input->extradata_bsf) < 0) {
+			printf("unable to initialise filter\n");
+			av_bsf_free(&input->extradata_bsf);
+			return -1;
+		}
+	}
+
+	// The filter takes the reference, leaving ref blank.
+	AVPacket * ref = av_packet_clone(pkt);
+	if (!ref) {
+		printf("unable to reference packet\n");
+		return -1;
+	}
+
+	const int send_res = av_bsf_send_packet(input->extradata_bsf, ref);
+	av_packet_free(&ref);
+	if (send_res != 0) {
+		printf("unable to filter packet: %s\n", av_err2str(send_res));
+		return -1;
+	}
+
 	return 1;
 }
 
+// Decide whether extradata is in Annex B form: parameter sets each after a
+// start code, rather than in an avcC or hvcC box.
+static bool
+__vs_annexb(const uint8_t * const extradata, const int size)
+{
+	if (!extradata) {
+		return false;
+	}
+
+	return (size >= 3 && extradata[0] == 0 && extradata[1] == 0 &&
+			extradata[2] == 1) ||
+		(size >= 4 && extradata[0] == 0 && extradata[1] == 0 &&
+		 extradata[2] == 0 && extradata[3] == 1);
+}
+
 // We change the packet's pts, dts, duration, pos.
 //
 // We do not unref it.
 //
 // Returns:
 // -1 if error
+// 0 if we skipped the packet as it is not from a stream the output copies
 // 1 if we wrote the packet
 int
 vs_write_packet(const struct VSInput * const input,
@@ -335,20 +1520,26 @@ vs_write_packet(const struct VSInput * const input,
 	}
 
 
+	// We read both video and audio packets. Each output has one of them, or
+	// the video and the audio as its second stream.
+	int out_stream_index = 0;
+	if (pkt->stream_index == output->audio_input_stream_index) {
+		out_stream_index = 1;
+	} else if (pkt->stream_index != output->input_stream_index) {
+		return 0;
+	}
+
+
 	// If there are multiple input streams, then the stream index on the packet
 	// may not match the stream index in our output. We need to ensure the index
-	// matches. Note by this point we have checked that it is indeed a packet
-	// from the stream we want (we do this when reading the packet).
-	//
-	// As we only ever have a single output stream (one, video), the index will
-	// be 0.
-	if (pkt->stream_index != 0) {
+	// matches.
+	if (pkt->stream_index != out_stream_index) {
 		if (verbose) {
-			printf("updating packet stream index to 0 (from %d)\n",
-					pkt->stream_index);
+			printf("updating packet stream index to %d (from %d)\n",
+					out_stream_index, pkt->stream_index);
 		}
 
-		pkt->stream_index = 0;
+		pkt->stream_index = out_stream_index;
 	}
 
 
@@ -358,6 +1549,10 @@ vs_write_packet(const struct VSInput * const input,
 		return -1;
 	}
 
+	// Each output stream's dts must increase on its own.
+	int64_t * const last_dts = out_stream_index == 1 ? &output->audio_last_dts :
+		&output->last_dts;
+
 	// It is possible that the input is not well formed. Its dts (decompression
 	// timestamp) may fluctuate. av_write_frame() says that the dts must be
 	// strictly increasing.
@@ -376,22 +1571,22 @@ vs_write_packet(const struct VSInput * const input,
 	// 3.2.4 at least) there is logic to rewrite the dts and warn if it happens.
 	// Let's do the same. Note my logic is a little different here.
 	bool fix_dts = pkt->dts != AV_NOPTS_VALUE &&
-		output->last_dts != AV_NOPTS_VALUE &&
-		pkt->dts <= output->last_dts;
+		*last_dts != AV_NOPTS_VALUE &&
+		pkt->dts <= *last_dts;
 
 	// It is also possible for input streams to include a packet with
 	// dts/pts=NOPTS after packets with dts/pts set. These won't be caught by the
 	// prior case. If we try to send these to the encoder however, we'll generate
 	// the same error (non monotonically increasing DTS) since the output packet
 	// will have dts/pts=0.
-	fix_dts |= pkt->dts == AV_NOPTS_VALUE && output->last_dts != AV_NOPTS_VALUE;
+	fix_dts |= pkt->dts == AV_NOPTS_VALUE && *last_dts != AV_NOPTS_VALUE;
 
 	if (fix_dts) {
-		int64_t const next_dts = output->last_dts+1;
+		int64_t const next_dts = *last_dts+1;
 
 		if (verbose) {
 			printf("Warning: Non-monotonous DTS in input stream. Previous: %" PRId64 " current: %" PRId64 ". changing to %" PRId64 ".\n",
-					output->last_dts, pkt->dts, next_dts);
+					*last_dts, pkt->dts, next_dts);
 		}
 
 		// We also apparently (ffmpeg.c does this too) need to update the pts.
@@ -444,31 +1639,1404 @@ vs_write_packet(const struct VSInput * const input,
 
 
 	// Track last dts we see (see where we use it for why).
-	output->last_dts = pkt->dts;
+	*last_dts = pkt->dts;
+
+	// Silence keeps up with the video, so note where the video is before
+	// writing takes the packet.
+	int64_t const video_samples = output->silent_audio ?
+		av_rescale_q(pkt->dts, out_stream->time_base, __vs_silence_time_base) :
+		AV_NOPTS_VALUE;
 
 
 	// Write encoded frame (as a packet).
 
-	// av_interleaved_write_frame() works too, but I don't think it is needed.
-	// Using av_write_frame() skips buffering.
-	const int write_res = av_write_frame(output->format_ctx, pkt);
+	// av_write_frame() skips buffering. Most of our outputs have one stream,
+	// so there is nothing to interleave unless we're asked to.
+	// av_interleaved_write_frame() takes ownership of the packet's data.
+	const int write_res = output->interleave ?
+		av_interleaved_write_frame(output->format_ctx, pkt) :
+		av_write_frame(output->format_ctx, pkt);
 	if (write_res != 0) {
 		printf("unable to write frame: %s\n", av_err2str(write_res));
 		return -1;
 	}
 
+	if (output->silent_audio &&
+			__vs_write_silence(output, video_samples, verbose) != 0) {
+		return -1;
+	}
+
 	return 1;
 }
 
-static void
-__vs_log_packet(const AVFormatContext * const format_ctx,
-		const AVPacket * const pkt, const char * const tag)
+// Write several packets.
+//
+// Unlike vs_write_packet(), we do not change the packets. We write a reference
+// to each instead. This means the packets may be shared, such as with other
+// outputs.
+//
+// Returns:
+// -1 if error
+// 1 if we wrote the packets
+int
+vs_write_packets(const struct VSInput * const input,
+		struct VSOutput * const output, AVPacket * const * const pkts,
+		const int n, const bool verbose)
 {
-		AVRational * const time_base = &format_ctx->streams[pkt->stream_index]->time_base;
+	if (!input || !output || !pkts || n < 0) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
 
-		printf("%s: pts:%s pts_time:%s dts:%s dts_time:%s duration:%s duration_time:%s stream_index:%d\n",
-				tag, av_ts2str(pkt->pts), av_ts2timestr(pkt->pts, time_base),
-				av_ts2str(pkt->dts), av_ts2timestr(pkt->dts, time_base),
-				av_ts2str(pkt->duration), av_ts2timestr(pkt->duration, time_base),
-				pkt->stream_index);
+	for (int i = 0; i < n; i++) {
+		AVPacket pkt;
+		memset(&pkt, 0, sizeof(AVPacket));
+
+		if (av_packet_ref(&pkt, pkts[i]) != 0) {
+			printf("unable to reference packet\n");
+			return -1;
+		}
+
+		const int write_res = vs_write_packet(input, output, &pkt, verbose);
+		av_packet_unref(&pkt);
+		if (write_res == -1) {
+			return -1;
+		}
+	}
+
+	return 1;
+}
+
+// Find the format to use for an output with just the input's audio. This is
+// one where the audio does not need to be re-encoded.
+//
+// Returns NULL if there is no audio stream, or if we don't know of such a
+// format for its codec.
+const char *
+vs_audio_format(const struct VSInput * const input)
+{
+	if (!input || input->audio_stream_index == -1) {
+		return NULL;
+	}
+
+	AVStream * const in_stream = input->format_ctx->streams[
+		input->audio_stream_index];
+
+	switch (in_stream->codecpar->codec_id) {
+	case AV_CODEC_ID_AAC:
+		return "adts";
+	case AV_CODEC_ID_OPUS:
+	case AV_CODEC_ID_VORBIS:
+		return "ogg";
+	case AV_CODEC_ID_MP3:
+		return "mp3";
+	default:
+		return NULL;
+	}
+}
+
+// Find the codec parameters of the input's video stream, or of its audio
+// stream if audio is set.
+//
+// Returns NULL if there is no such stream.
+const AVCodecParameters *
+vs_codec_parameters(const struct VSInput * const input, const bool audio)
+{
+	if (!input) {
+		return NULL;
+	}
+
+	const int stream_index = audio ? input->audio_stream_index :
+		input->video_stream_index;
+	if (stream_index == -1) {
+		return NULL;
+	}
+
+	return input->format_ctx->streams[stream_index]->codecpar;
+}
+
+// Open a decoder for the input's video stream, or for its audio stream if
+// audio is set.
+//
+// The decoder has its own copy of the codec parameters, so it may outlive the
+// input.
+struct VSDecoder *
+vs_open_decoder(const struct VSInput * const input, const bool audio,
+		const bool verbose)
+{
+	if (!input) {
+		printf("%s\n", strerror(EINVAL));
+		return NULL;
+	}
+
+	const int stream_index = audio ? input->audio_stream_index :
+		input->video_stream_index;
+	if (stream_index == -1) {
+		printf("input has no such stream\n");
+		return NULL;
+	}
+
+	struct VSDecoder * const decoder = calloc(1, sizeof(struct VSDecoder));
+	if (!decoder) {
+		printf("%s\n", strerror(errno));
+		return NULL;
+	}
+
+	atomic_fetch_add(&__vs_decoders, 1);
+
+	decoder->input_stream_index = stream_index;
+
+	const AVCodecParameters * const codecpar =
+		input->format_ctx->streams[stream_index]->codecpar;
+
+	const AVCodec * const codec = avcodec_find_decoder(codecpar->codec_id);
+	if (!codec) {
+		printf("decoder not found for %s\n", avcodec_get_name(codecpar->codec_id));
+		vs_destroy_decoder(decoder);
+		return NULL;
+	}
+
+	decoder->codec_ctx = avcodec_alloc_context3(codec);
+	if (!decoder->codec_ctx) {
+		printf("unable to allocate codec context\n");
+		vs_destroy_decoder(decoder);
+		return NULL;
+	}
+
+	if (avcodec_parameters_to_context(decoder->codec_ctx, codecpar) < 0) {
+		printf("unable to copy codec parameters\n");
+		vs_destroy_decoder(decoder);
+		return NULL;
+	}
+
+	__vs_set_codec_threads(decoder->codec_ctx, true);
+
+	if (avcodec_open2(decoder->codec_ctx, codec, NULL) != 0) {
+		printf("unable to open decoder\n");
+		vs_destroy_decoder(decoder);
+		return NULL;
+	}
+
+	decoder->frame = av_frame_alloc();
+	if (!decoder->frame) {
+		printf("unable to allocate frame\n");
+		vs_destroy_decoder(decoder);
+		return NULL;
+	}
+
+	if (verbose) {
+		printf("opened %s decoder for input stream %d\n", codec->name,
+				stream_index);
+	}
+
+	return decoder;
+}
+
+void
+vs_destroy_decoder(struct VSDecoder * const decoder)
+{
+	if (!decoder) {
+		return;
+	}
+
+	if (decoder->frame) {
+		av_frame_free(&decoder->frame);
+	}
+
+	if (decoder->codec_ctx) {
+		avcodec_free_context(&decoder->codec_ctx);
+	}
+
+	free(decoder);
+
+	atomic_fetch_sub(&__vs_decoders, 1);
+}
+
+// Send a packet to the decoder. Afterwards, receive frames with
+// vs_receive_frame() until it has none.
+//
+// We do not change or unref the packet, so it may be shared.
+//
+// Returns:
+// -1 if error
+// 0 if we skipped the packet, such as one from another stream or one the
+//   decoder could not make sense of
+// 1 if we sent the packet
+int
+vs_decode_packet(struct VSDecoder * const decoder, const AVPacket * const pkt,
+		const bool verbose)
+{
+	if (!decoder || !pkt) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	if (pkt->stream_index != decoder->input_stream_index) {
+		return 0;
+	}
+
+	const int send_res = avcodec_send_packet(decoder->codec_ctx, pkt);
+
+	// Inputs are often damaged, such as from packet loss with RTSP over UDP.
+	// Skip what the decoder rejects rather than giving up.
+	if (send_res == AVERROR_INVALIDDATA) {
+		if (verbose) {
+			printf("decoder rejected packet: %s\n", av_err2str(send_res));
+		}
+		return 0;
+	}
+
+	// We receive every frame after each packet, so the decoder should always
+	// be ready for another.
+	if (send_res != 0) {
+		printf("unable to send packet to decoder: %s\n", av_err2str(send_res));
+		return -1;
+	}
+
+	return 1;
+}
+
+// Receive the next decoded frame. It replaces the decoder's frame.
+//
+// Returns:
+// -1 if error
+// 0 if there is no frame until we send another packet
+// 1 if we received a frame
+int
+vs_receive_frame(struct VSDecoder * const decoder, const bool verbose)
+{
+	if (!decoder) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	av_frame_unref(decoder->frame);
+
+	const int receive_res = avcodec_receive_frame(decoder->codec_ctx,
+			decoder->frame);
+	if (receive_res == AVERROR(EAGAIN)) {
+		return 0;
+	}
+
+	if (receive_res != 0) {
+		printf("unable to receive frame: %s\n", av_err2str(receive_res));
+		return -1;
+	}
+
+	if (verbose) {
+		printf("decoded frame: pts:%s\n", av_ts2str(decoder->frame->pts));
+	}
+
+	return 1;
+}
+
+// Scale the brightness of the decoder's video frame down to width by height,
+// one byte per pixel, row by row. Each output pixel is the average of the
+// frame's pixels it covers.
+//
+// We read the luma plane directly rather than converting the frame, so this
+// works with 8 bit YUV (and gray) frames, which is what video decoders
+// usually produce.
+//
+// Returns:
+// -1 if error, such as if the frame has another pixel format
+// 1 if we wrote the pixels
+int
+vs_frame_luma(const struct VSDecoder * const decoder, uint8_t * const buf,
+		const int width, const int height)
+{
+	if (!decoder || !buf || width <= 0 || height <= 0) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	const AVFrame * const frame = decoder->frame;
+	if (!frame->data[0] || frame->width < width || frame->height < height) {
+		printf("no suitable frame to scale\n");
+		return -1;
+	}
+
+	const AVPixFmtDescriptor * const desc = av_pix_fmt_desc_get(frame->format);
+	const uint64_t unsupported_flags = AV_PIX_FMT_FLAG_RGB | AV_PIX_FMT_FLAG_PAL |
+		AV_PIX_FMT_FLAG_HWACCEL;
+	if (!desc || (desc->flags & unsupported_flags) ||
+			desc->comp[0].plane != 0 || desc->comp[0].step != 1 ||
+			desc->comp[0].depth != 8) {
+		printf("unsupported pixel format for luma: %s\n",
+				desc ? desc->name : "unknown");
+		return -1;
+	}
+
+	for (int y = 0; y < height; y++) {
+		const int y0 = y * frame->height / height;
+		const int y1 = (y + 1) * frame->height / height;
+
+		for (int x = 0; x < width; x++) {
+			const int x0 = x * frame->width / width;
+			const int x1 = (x + 1) * frame->width / width;
+
+			uint64_t sum = 0;
+			for (int sy = y0; sy < y1; sy++) {
+				const uint8_t * const row = frame->data[0] +
+					(ptrdiff_t) sy * frame->linesize[0];
+				for (int sx = x0; sx < x1; sx++) {
+					sum += row[sx];
+				}
+			}
+
+			buf[y * width + x] = (uint8_t) (sum /
+					(uint64_t) ((y1 - y0) * (x1 - x0)));
+		}
+	}
+
+	return 1;
+}
+
+// Encode the decoder's video frame as a JPEG. If max_width is positive and
+// the frame is wider, we scale it down to that width, keeping its aspect
+// ratio.
+//
+// If dewarp is not NULL, the frame is from a fisheye lens and we take a flat
+// view through it, the same size as the picture.
+//
+// We rotate the picture rotate degrees clockwise (0, 90, 180, or 270), then
+// mirror it if hflip or vflip are set. max_width applies to the picture as
+// rotated.
+//
+// masks are regions to black out, such as for privacy, n_masks of them. Each
+// is four doubles: x, y, width, and height as fractions of the picture's
+// width and height, as rotated. masks may be NULL if there are none.
+//
+// We set up the scaler and encoder each time. We only encode a frame every so
+// often, so this is simpler than keeping them around for when the frame size
+// changes.
+//
+// Returns a packet holding the JPEG, which the caller must free with
+// av_packet_free(), or NULL if error.
+AVPacket *
+vs_frame_jpeg(const struct VSDecoder * const decoder, const int max_width,
+		const struct VSDewarp * const dewarp, const double * const masks, const int n_masks, const int rotate,
+		const bool hflip, const bool vflip, const bool verbose)
+{
+	if (!decoder) {
+		printf("%s\n", strerror(EINVAL));
+		return NULL;
+	}
+
+	const AVFrame * const frame = decoder->frame;
+	if (!frame->data[0] || frame->width <= 0 || frame->height <= 0) {
+		printf("no frame to encode\n");
+		return NULL;
+	}
+
+	const bool transpose = rotate == 90 || rotate == 270;
+	const bool orient = rotate != 0 || hflip || vflip;
+
+	int width = transpose ? frame->height : frame->width;
+	int height = transpose ? frame->width : frame->height;
+	if (max_width > 0 && width > max_width) {
+		height = (int) av_rescale(height, max_width, width);
+		width = max_width;
+	}
+
+	// With 4:2:0 chroma the dimensions must be even.
+	width &= ~1;
+	height &= ~1;
+	if (width == 0 || height == 0) {
+		printf("frame too small to encode\n");
+		return NULL;
+	}
+
+
+	AVCodec * const codec = avcodec_find_encoder(AV_CODEC_ID_MJPEG);
+	if (!codec) {
+		printf("mjpeg encoder not found\n");
+		return NULL;
+	}
+
+	AVCodecContext * codec_ctx = avcodec_alloc_context3(codec);
+	if (!codec_ctx) {
+		printf("unable to allocate codec context\n");
+		return NULL;
+	}
+
+	codec_ctx->width = width;
+	codec_ctx->height = height;
+	codec_ctx->pix_fmt = AV_PIX_FMT_YUVJ420P;
+	codec_ctx->time_base = (AVRational) {1, 25};
+
+	// Fixed quality rather than a bitrate, as with ffmpeg -q:v 3.
+	codec_ctx->flags |= AV_CODEC_FLAG_QSCALE;
+	codec_ctx->global_quality = FF_QP2LAMBDA * 3;
+
+	__vs_set_codec_threads(codec_ctx, false);
+
+	if (avcodec_open2(codec_ctx, codec, NULL) != 0) {
+		printf("unable to open mjpeg encoder\n");
+		__vs_free_jpeg_encoder(&codec_ctx, NULL, NULL);
+		return NULL;
+	}
+
+
+	// Convert to the encoder's pixel format, scaling at the same time. If we
+	// rotate sideways, we scale to the picture's size before rotating.
+
+	const int scaled_width = transpose ? height : width;
+	const int scaled_height = transpose ? width : height;
+
+	struct SwsContext * sws_ctx = sws_getContext(frame->width, frame->height,
+			frame->format, scaled_width, scaled_height, AV_PIX_FMT_YUVJ420P,
+			SWS_BILINEAR, NULL, NULL, NULL);
+	if (!sws_ctx) {
+		printf("unable to create scaler\n");
+		__vs_free_jpeg_encoder(&codec_ctx, NULL, NULL);
+		return NULL;
+	}
+
+	AVFrame * scaled = av_frame_alloc();
+	if (!scaled) {
+		printf("unable to allocate frame\n");
+		__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, NULL);
+		return NULL;
+	}
+
+	scaled->format = AV_PIX_FMT_YUVJ420P;
+	scaled->width = scaled_width;
+	scaled->height = scaled_height;
+	scaled->pts = 0;
+
+	if (av_frame_get_buffer(scaled, 0) != 0) {
+		printf("unable to allocate frame buffer\n");
+		__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+		return NULL;
+	}
+
+	sws_scale(sws_ctx, (const uint8_t * const *) frame->data, frame->linesize,
+			0, frame->height, scaled->data, scaled->linesize);
+
+	if (dewarp) {
+		AVFrame * dewarped = av_frame_alloc();
+		if (!dewarped) {
+			printf("unable to allocate frame\n");
+			__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+			return NULL;
+		}
+
+		dewarped->format = AV_PIX_FMT_YUVJ420P;
+		dewarped->width = scaled_width;
+		dewarped->height = scaled_height;
+		dewarped->pts = 0;
+
+		if (av_frame_get_buffer(dewarped, 0) != 0) {
+			printf("unable to allocate frame buffer\n");
+			av_frame_free(&dewarped);
+			__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+			return NULL;
+		}
+
+		__vs_dewarp_frame(scaled, dewarped, dewarp);
+		av_frame_free(&scaled);
+		scaled = dewarped;
+	}
+
+	if (orient) {
+		AVFrame * oriented = av_frame_alloc();
+		if (!oriented) {
+			printf("unable to allocate frame\n");
+			__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+			return NULL;
+		}
+
+		oriented->format = AV_PIX_FMT_YUVJ420P;
+		oriented->width = width;
+		oriented->height = height;
+		oriented->pts = 0;
+
+		if (av_frame_get_buffer(oriented, 0) != 0) {
+			printf("unable to allocate frame buffer\n");
+			av_frame_free(&oriented);
+			__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+			return NULL;
+		}
+
+		__vs_orient_frame(scaled, oriented, rotate, hflip, vflip);
+		av_frame_free(&scaled);
+		scaled = oriented;
+	}
+
+	// We mask the frame we scaled rather than the decoded one. The decoder may
+	// still refer to that one, and it may be in any pixel format.
+	if (masks && n_masks > 0) {
+		__vs_mask_frame(scaled, masks, n_masks);
+	}
+
+
+	// Encode. Sending the frame then end of stream means the packet is ready
+	// right away.
+
+	if (avcodec_send_frame(codec_ctx, scaled) != 0 ||
+			avcodec_send_frame(codec_ctx, NULL) != 0) {
+		printf("unable to send frame to encoder\n");
+		__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+		return NULL;
+	}
+
+	AVPacket * pkt = av_packet_alloc();
+	if (!pkt) {
+		printf("unable to allocate packet\n");
+		__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+		return NULL;
+	}
+
+	const int receive_res = avcodec_receive_packet(codec_ctx, pkt);
+	__vs_free_jpeg_encoder(&codec_ctx, &sws_ctx, &scaled);
+	if (receive_res != 0) {
+		printf("unable to encode jpeg: %s\n", av_err2str(receive_res));
+		av_packet_free(&pkt);
+		return NULL;
+	}
+
+	if (verbose) {
+		printf("encoded %dx%d jpeg: %d bytes\n", width, height, pkt->size);
+	}
+
+	return pkt;
+}
+
+// Take a flat view through the fisheye lens of a YUVJ420P frame into dst,
+// which must be the same size. What the lens doesn't see is black. This is as
+// Dewarp.apply() in dewarp.go, which explains how.
+static void
+__vs_dewarp_frame(const AVFrame * const src, AVFrame * const dst,
+		const struct VSDewarp * const dewarp)
+{
+	const double aspect = (double) src->width / (double) src->height;
+
+	for (int plane = 0; plane < 3; plane++) {
+		// Chroma is at half resolution.
+		const int shift = plane == 0 ? 0 : 1;
+		const int width = src->width >> shift;
+		const int height = src->height >> shift;
+		const uint8_t black = plane == 0 ? 0 : 128;
+
+		for (int y = 0; y < height; y++) {
+			uint8_t * const row = dst->data[plane] +
+				(ptrdiff_t) y * dst->linesize[plane];
+
+			for (int x = 0; x < width; x++) {
+				row[x] = black;
+
+				double su = 0;
+				double sv = 0;
+				if (!__vs_dewarp_source(dewarp, (x + 0.5) / width,
+							(y + 0.5) / height, aspect, &su, &sv)) {
+					continue;
+				}
+
+				const int sx = (int) floor(su * width);
+				const int sy = (int) floor(sv * height);
+				if (sx < 0 || sy < 0 || sx >= width || sy >= height) {
+					continue;
+				}
+
+				row[x] = src->data[plane][(ptrdiff_t) sy * src->linesize[plane] + sx];
+			}
+		}
+	}
+}
+
+// Find where in the fisheye picture a point of the view comes from. See
+// Dewarp.source() in dewarp.go.
+static bool
+__vs_dewarp_source(const struct VSDewarp * const dewarp, const double u,
+		const double v, const double aspect, double * const su,
+		double * const sv)
+{
+	const double scale = tan(dewarp->fov * M_PI / 360);
+	double x = (2 * u - 1) * scale;
+	double y = (2 * v - 1) * scale / aspect;
+	double z = 1;
+
+	const double tilt = dewarp->tilt * M_PI / 180;
+	const double tilted_y = y * cos(tilt) - z * sin(tilt);
+	z = y * sin(tilt) + z * cos(tilt);
+	y = tilted_y;
+
+	const double pan = dewarp->pan * M_PI / 180;
+	const double panned_x = x * cos(pan) - y * sin(pan);
+	y = x * sin(pan) + y * cos(pan);
+	x = panned_x;
+
+	const double theta = atan2(hypot(x, y), z);
+	const double phi = atan2(y, x);
+	if (theta > dewarp->lens_fov * M_PI / 360) {
+		return false;
+	}
+
+	const double r = theta / (dewarp->lens_fov * M_PI / 360) * dewarp->radius;
+	*su = dewarp->center_x + r * cos(phi) / aspect;
+	*sv = dewarp->center_y + r * sin(phi);
+	return true;
+}
+
+// Rotate a YUVJ420P frame rotate degrees clockwise, then mirror it, into dst.
+// dst must have src's width and height, swapped if rotating sideways.
+static void
+__vs_orient_frame(const AVFrame * const src, AVFrame * const dst,
+		const int rotate, const bool hflip, const bool vflip)
+{
+	for (int plane = 0; plane < 3; plane++) {
+		// Chroma is at half resolution.
+		const int shift = plane == 0 ? 0 : 1;
+		const int src_width = src->width >> shift;
+		const int src_height = src->height >> shift;
+		const int dst_width = dst->width >> shift;
+		const int dst_height = dst->height >> shift;
+
+		for (int y = 0; y < dst_height; y++) {
+			uint8_t * const row = dst->data[plane] +
+				(ptrdiff_t) y * dst->linesize[plane];
+
+			for (int x = 0; x < dst_width; x++) {
+				// Work back from where the pixel ends up to where it came from:
+				// undo the flips, then the rotation.
+				const int fx = hflip ? dst_width - 1 - x : x;
+				const int fy = vflip ? dst_height - 1 - y : y;
+
+				int sx = fx;
+				int sy = fy;
+				if (rotate == 90) {
+					sx = fy;
+					sy = src_height - 1 - fx;
+				} else if (rotate == 180) {
+					sx = src_width - 1 - fx;
+					sy = src_height - 1 - fy;
+				} else if (rotate == 270) {
+					sx = src_width - 1 - fy;
+					sy = fx;
+				}
+
+				row[x] = src->data[plane][(ptrdiff_t) sy * src->linesize[plane] + sx];
+			}
+		}
+	}
+}
+
+// Black out regions of a YUVJ420P frame. See vs_frame_jpeg() for masks. We
+// round outwards, to even pixels since chroma is at half resolution, so that
+// each mask covers at least its region.
+static void
+__vs_mask_frame(AVFrame * const frame, const double * const masks,
+		const int n_masks)
+{
+	for (int i = 0; i < n_masks; i++) {
+		const double * const m = masks + i * 4;
+
+		int x0 = (int) floor(m[0] * frame->width) & ~1;
+		int y0 = (int) floor(m[1] * frame->height) & ~1;
+		int x1 = ((int) ceil((m[0] + m[2]) * frame->width) + 1) & ~1;
+		int y1 = ((int) ceil((m[1] + m[3]) * frame->height) + 1) & ~1;
+
+		x0 = FFMAX(x0, 0);
+		y0 = FFMAX(y0, 0);
+		x1 = FFMIN(x1, frame->width);
+		y1 = FFMIN(y1, frame->height);
+		if (x1 <= x0 || y1 <= y0) {
+			continue;
+		}
+
+		// Full range black: luma 0, chroma in the middle.
+		for (int y = y0; y < y1; y++) {
+			memset(frame->data[0] + (ptrdiff_t) y * frame->linesize[0] + x0, 0,
+					(size_t) (x1 - x0));
+		}
+
+		for (int y = y0 / 2; y < y1 / 2; y++) {
+			memset(frame->data[1] + (ptrdiff_t) y * frame->linesize[1] + x0 / 2,
+					128, (size_t) (x1 - x0) / 2);
+			memset(frame->data[2] + (ptrdiff_t) y * frame->linesize[2] + x0 / 2,
+					128, (size_t) (x1 - x0) / 2);
+		}
+	}
+}
+
+// Measure how loud the decoder's audio frame is: the root mean square of its
+// samples across all channels, as a fraction of full scale.
+//
+// Returns -1 if error, such as if the frame has a sample format we don't
+// know.
+double
+vs_frame_rms(const struct VSDecoder * const decoder)
+{
+	if (!decoder) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	const AVFrame * const frame = decoder->frame;
+	if (!frame->extended_data || frame->nb_samples <= 0 || frame->channels <= 0) {
+		printf("no audio frame to measure\n");
+		return -1;
+	}
+
+	const enum AVSampleFormat format = frame->format;
+	const bool planar = av_sample_fmt_is_planar(format);
+	const int channels = frame->channels;
+
+	double sum = 0;
+
+	for (int ch = 0; ch < channels; ch++) {
+		for (int i = 0; i < frame->nb_samples; i++) {
+			// Planar formats have a plane per channel. Otherwise the channels'
+			// samples are interleaved in the first.
+			const int plane = planar ? ch : 0;
+			const int index = planar ? i : i * channels + ch;
+			const uint8_t * const data = frame->extended_data[plane];
+
+			double sample = 0;
+			switch (av_get_packed_sample_fmt(format)) {
+			case AV_SAMPLE_FMT_U8:
+				sample = (data[index] - 128) / 128.0;
+				break;
+			case AV_SAMPLE_FMT_S16:
+				sample = ((const int16_t *) data)[index] / 32768.0;
+				break;
+			case AV_SAMPLE_FMT_S32:
+				sample = ((const int32_t *) data)[index] / 2147483648.0;
+				break;
+			case AV_SAMPLE_FMT_FLT:
+				sample = ((const float *) data)[index];
+				break;
+			case AV_SAMPLE_FMT_DBL:
+				sample = ((const double *) data)[index];
+				break;
+			default:
+				printf("unsupported sample format: %s\n",
+						av_get_sample_fmt_name(format));
+				return -1;
+			}
+
+			sum += sample * sample;
+		}
+	}
+
+	return sqrt(sum / ((double) frame->nb_samples * channels));
+}
+
+// Remux an MP4 file, such as a fragmented one, into a regular MP4 file with
+// its index (the moov) at the front, as with ffmpeg -movflags faststart.
+// Players fetching the file over HTTP can then start and seek without first
+// fetching its end.
+//
+// Returns -1 on failure.
+int
+vs_faststart(const char * const input_filename,
+		const char * const output_filename, const bool verbose)
+{
+	if (!input_filename || strlen(input_filename) == 0 || !output_filename ||
+			strlen(output_filename) == 0) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	AVFormatContext * input_ctx = NULL;
+	if (avformat_open_input(&input_ctx, input_filename, NULL, NULL) != 0) {
+		printf("unable to open %s\n", input_filename);
+		return -1;
+	}
+
+	if (avformat_find_stream_info(input_ctx, NULL) < 0) {
+		printf("failed to find stream info\n");
+		__vs_close_faststart(&input_ctx, NULL);
+		return -1;
+	}
+
+	AVFormatContext * output_ctx = NULL;
+	if (avformat_alloc_output_context2(&output_ctx, NULL, "mp4",
+				output_filename) < 0) {
+		printf("unable to create output context\n");
+		__vs_close_faststart(&input_ctx, NULL);
+		return -1;
+	}
+
+	for (unsigned int i = 0; i < input_ctx->nb_streams; i++) {
+		AVStream * const out_stream = avformat_new_stream(output_ctx, NULL);
+		if (!out_stream) {
+			printf("unable to add stream\n");
+			__vs_close_faststart(&input_ctx, &output_ctx);
+			return -1;
+		}
+
+		if (avcodec_parameters_copy(out_stream->codecpar,
+					input_ctx->streams[i]->codecpar) < 0) {
+			printf("unable to copy codec parameters\n");
+			__vs_close_faststart(&input_ctx, &output_ctx);
+			return -1;
+		}
+
+		// Let the muxer pick the tag.
+		out_stream->codecpar->codec_tag = 0;
+	}
+
+	if (verbose) {
+		av_dump_format(output_ctx, 0, output_filename, 1);
+	}
+
+	if (avio_open(&output_ctx->pb, output_filename, AVIO_FLAG_WRITE) < 0) {
+		printf("unable to open %s\n", output_filename);
+		__vs_close_faststart(&input_ctx, &output_ctx);
+		return -1;
+	}
+
+	AVDictionary * opts = NULL;
+	if (av_dict_set(&opts, "movflags", "+faststart", 0) < 0) {
+		printf("unable to set movflags\n");
+		__vs_close_faststart(&input_ctx, &output_ctx);
+		return -1;
+	}
+
+	const int header_res = avformat_write_header(output_ctx, &opts);
+	av_dict_free(&opts);
+	if (header_res < 0) {
+		printf("unable to write header: %s\n", av_err2str(header_res));
+		__vs_close_faststart(&input_ctx, &output_ctx);
+		return -1;
+	}
+
+	AVPacket * pkt = av_packet_alloc();
+	if (!pkt) {
+		printf("unable to allocate packet\n");
+		__vs_close_faststart(&input_ctx, &output_ctx);
+		return -1;
+	}
+
+	while (1) {
+		const int read_res = av_read_frame(input_ctx, pkt);
+		if (read_res == AVERROR_EOF) {
+			break;
+		}
+		if (read_res != 0) {
+			printf("unable to read frame: %s\n", av_err2str(read_res));
+			av_packet_free(&pkt);
+			__vs_close_faststart(&input_ctx, &output_ctx);
+			return -1;
+		}
+
+		av_packet_rescale_ts(pkt, input_ctx->streams[pkt->stream_index]->time_base,
+				output_ctx->streams[pkt->stream_index]->time_base);
+		pkt->pos = -1;
+
+		if (verbose) {
+			__vs_log_packet(output_ctx, pkt, "faststart");
+		}
+
+		const int write_res = av_interleaved_write_frame(output_ctx, pkt);
+		av_packet_unref(pkt);
+		if (write_res != 0) {
+			printf("unable to write frame: %s\n", av_err2str(write_res));
+			av_packet_free(&pkt);
+			__vs_close_faststart(&input_ctx, &output_ctx);
+			return -1;
+		}
+	}
+
+	av_packet_free(&pkt);
+
+	// Writing the trailer is when the muxer moves the moov to the front.
+	const int trailer_res = av_write_trailer(output_ctx);
+	__vs_close_faststart(&input_ctx, &output_ctx);
+	if (trailer_res != 0) {
+		printf("unable to write trailer: %s\n", av_err2str(trailer_res));
+		return -1;
+	}
+
+	return 0;
+}
+
+// Encode a time-lapse video from a numbered sequence of JPEGs, such as
+// frames/%06d.jpg numbered from 1. Each image is a frame at the given frame
+// rate. We re-encode, unlike everywhere else: as H.264 if we have an encoder
+// for it, or MPEG-4 Part 2 otherwise. We write an MP4 with its index at the
+// front.
+//
+// Images that fail to decode are skipped. Images need not all be the same
+// size. We scale them to the size of the first.
+//
+// Returns -1 on failure.
+int
+vs_timelapse(const char * const pattern, const char * const output_filename,
+		const int fps, const bool verbose)
+{
+	if (!pattern || strlen(pattern) == 0 || !output_filename ||
+			strlen(output_filename) == 0 || fps <= 0) {
+		printf("%s\n", strerror(EINVAL));
+		return -1;
+	}
+
+	struct VSTimelapse t;
+	memset(&t, 0, sizeof(struct VSTimelapse));
+
+	AVInputFormat * const input_format = av_find_input_format("image2");
+	if (!input_format) {
+		printf("image2 demuxer not found\n");
+		return -1;
+	}
+
+	char framerate[32];
+	snprintf(framerate, sizeof(framerate), "%d", fps);
+
+	AVDictionary * opts = NULL;
+	if (av_dict_set(&opts, "framerate", framerate, 0) < 0) {
+		printf("unable to set framerate\n");
+		return -1;
+	}
+
+	const int open_res = avformat_open_input(&t.input_ctx, pattern,
+			input_format, &opts);
+	av_dict_free(&opts);
+	if (open_res != 0) {
+		printf("unable to open %s: %s\n", pattern, av_err2str(open_res));
+		return -1;
+	}
+
+	if (avformat_find_stream_info(t.input_ctx, NULL) < 0) {
+		printf("failed to find stream info\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	if (t.input_ctx->nb_streams != 1 ||
+			t.input_ctx->streams[0]->codecpar->codec_type != AVMEDIA_TYPE_VIDEO) {
+		printf("images have no video stream\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	const AVCodecParameters * const codecpar = t.input_ctx->streams[0]->codecpar;
+
+	const AVCodec * const decoder = avcodec_find_decoder(codecpar->codec_id);
+	if (!decoder) {
+		printf("decoder not found for %s\n", avcodec_get_name(codecpar->codec_id));
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	t.decoder_ctx = avcodec_alloc_context3(decoder);
+	if (!t.decoder_ctx) {
+		printf("unable to allocate codec context\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	if (avcodec_parameters_to_context(t.decoder_ctx, codecpar) < 0) {
+		printf("unable to copy codec parameters\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	__vs_set_codec_threads(t.decoder_ctx, true);
+
+	if (avcodec_open2(t.decoder_ctx, decoder, NULL) != 0) {
+		printf("unable to open decoder\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	t.frame = av_frame_alloc();
+	t.pkt = av_packet_alloc();
+	if (!t.frame || !t.pkt) {
+		printf("unable to allocate frame or packet\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+
+	// Decode each image and encode it as the next frame.
+
+	while (1) {
+		const int read_res = av_read_frame(t.input_ctx, t.pkt);
+		if (read_res == AVERROR_EOF) {
+			break;
+		}
+		if (read_res != 0) {
+			printf("unable to read frame: %s\n", av_err2str(read_res));
+			__vs_close_timelapse(&t);
+			return -1;
+		}
+
+		const int send_res = avcodec_send_packet(t.decoder_ctx, t.pkt);
+		av_packet_unref(t.pkt);
+		if (send_res != 0) {
+			if (verbose) {
+				printf("skipping image: %s\n", av_err2str(send_res));
+			}
+			continue;
+		}
+
+		if (__vs_timelapse_frames(&t, output_filename, fps, verbose) != 0) {
+			__vs_close_timelapse(&t);
+			return -1;
+		}
+	}
+
+	if (avcodec_send_packet(t.decoder_ctx, NULL) != 0 ||
+			__vs_timelapse_frames(&t, output_filename, fps, verbose) != 0) {
+		printf("unable to flush decoder\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	if (!t.encoder_ctx) {
+		printf("no images to encode\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	if (avcodec_send_frame(t.encoder_ctx, NULL) != 0 ||
+			__vs_timelapse_packets(&t, verbose) != 0) {
+		printf("unable to flush encoder\n");
+		__vs_close_timelapse(&t);
+		return -1;
+	}
+
+	// Writing the trailer is when the muxer moves the moov to the front.
+	const int trailer_res = av_write_trailer(t.output_ctx);
+	const int64_t frames = t.frames;
+	__vs_close_timelapse(&t);
+	if (trailer_res != 0) {
+		printf("unable to write trailer: %s\n", av_err2str(trailer_res));
+		return -1;
+	}
+
+	if (verbose) {
+		printf("encoded time-lapse of %" PRId64 " frames to %s\n", frames,
+				output_filename);
+	}
+
+	return 0;
+}
+
+static void
+__vs_close_faststart(AVFormatContext ** const input_ctx,
+		AVFormatContext ** const output_ctx)
+{
+	if (input_ctx && *input_ctx) {
+		avformat_close_input(input_ctx);
+	}
+
+	if (output_ctx && *output_ctx) {
+		if ((*output_ctx)->pb) {
+			avio_closep(&(*output_ctx)->pb);
+		}
+		avformat_free_context(*output_ctx);
+		*output_ctx = NULL;
+	}
+}
+
+static void
+__vs_free_jpeg_encoder(AVCodecContext ** const codec_ctx,
+		struct SwsContext ** const sws_ctx, AVFrame ** const frame)
+{
+	if (codec_ctx && *codec_ctx) {
+		avcodec_free_context(codec_ctx);
+	}
+
+	if (sws_ctx && *sws_ctx) {
+		sws_freeContext(*sws_ctx);
+		*sws_ctx = NULL;
+	}
+
+	if (frame && *frame) {
+		av_frame_free(frame);
+	}
+}
+
+static void
+__vs_log_packet(const AVFormatContext * const format_ctx,
+		const AVPacket * const pkt, const char * const tag)
+{
+		AVRational * const time_base = &format_ctx->streams[pkt->stream_index]->time_base;
+
+		printf("%s: pts:%s pts_time:%s dts:%s dts_time:%s duration:%s duration_time:%s stream_index:%d\n",
+				tag, av_ts2str(pkt->pts), av_ts2timestr(pkt->pts, time_base),
+				av_ts2str(pkt->dts), av_ts2timestr(pkt->dts, time_base),
+				av_ts2str(pkt->duration), av_ts2timestr(pkt->duration, time_base),
+				pkt->stream_index);
+}
+
+// Encode the frames the time-lapse decoder has ready. We open the encoder and
+// the output when we see the first, since we need its size.
+//
+// Returns -1 on failure.
+static int
+__vs_timelapse_frames(struct VSTimelapse * const t,
+		const char * const output_filename, const int fps, const bool verbose)
+{
+	while (1) {
+		const int receive_res = avcodec_receive_frame(t->decoder_ctx, t->frame);
+		if (receive_res == AVERROR(EAGAIN) || receive_res == AVERROR_EOF) {
+			return 0;
+		}
+		if (receive_res != 0) {
+			printf("unable to decode image: %s\n", av_err2str(receive_res));
+			return -1;
+		}
+
+		if (!t->encoder_ctx &&
+				__vs_open_timelapse_output(t, output_filename, fps, verbose) != 0) {
+			av_frame_unref(t->frame);
+			return -1;
+		}
+
+		// Convert to the encoder's pixel format and size.
+		t->sws_ctx = sws_getCachedContext(t->sws_ctx, t->frame->width,
+				t->frame->height, t->frame->format, t->encoder_ctx->width,
+				t->encoder_ctx->height, t->encoder_ctx->pix_fmt, SWS_BICUBIC, NULL,
+				NULL, NULL);
+		if (!t->sws_ctx) {
+			printf("unable to create scaler\n");
+			av_frame_unref(t->frame);
+			return -1;
+		}
+
+		// The encoder may still hold a reference to the last frame.
+		if (av_frame_make_writable(t->scaled) < 0) {
+			printf("unable to make frame writable\n");
+			av_frame_unref(t->frame);
+			return -1;
+		}
+
+		sws_scale(t->sws_ctx, (const uint8_t * const *) t->frame->data,
+				t->frame->linesize, 0, t->frame->height, t->scaled->data,
+				t->scaled->linesize);
+		av_frame_unref(t->frame);
+
+		t->scaled->pts = t->frames;
+		t->frames++;
+
+		if (avcodec_send_frame(t->encoder_ctx, t->scaled) != 0) {
+			printf("unable to send frame to encoder\n");
+			return -1;
+		}
+
+		if (__vs_timelapse_packets(t, verbose) != 0) {
+			return -1;
+		}
+	}
+}
+
+// Open the time-lapse encoder and output, sized for the frame the decoder
+// has.
+//
+// Returns -1 on failure.
+static int
+__vs_open_timelapse_output(struct VSTimelapse * const t,
+		const char * const output_filename, const int fps, const bool verbose)
+{
+	// With 4:2:0 chroma the dimensions must be even.
+	const int width = t->frame->width & ~1;
+	const int height = t->frame->height & ~1;
+	if (width == 0 || height == 0) {
+		printf("image too small to encode\n");
+		return -1;
+	}
+
+	if (avformat_alloc_output_context2(&t->output_ctx, NULL, "mp4",
+				output_filename) < 0) {
+		printf("unable to create output context\n");
+		return -1;
+	}
+
+	const bool global_header =
+		(t->output_ctx->oformat->flags & AVFMT_GLOBALHEADER) != 0;
+
+	// Not every build has an H.264 encoder, and some have only hardware ones
+	// that may not open here, so fall back to the one built in.
+	const enum AVCodecID codec_ids[] = {AV_CODEC_ID_H264, AV_CODEC_ID_MPEG4};
+	for (size_t i = 0; i < sizeof(codec_ids)/sizeof(codec_ids[0]); i++) {
+		t->encoder_ctx = __vs_open_timelapse_encoder(codec_ids[i], width, height,
+				fps, global_header, verbose);
+		if (t->encoder_ctx) {
+			break;
+		}
+	}
+	if (!t->encoder_ctx) {
+		printf("unable to open an encoder\n");
+		return -1;
+	}
+
+	AVStream * const stream = avformat_new_stream(t->output_ctx, NULL);
+	if (!stream) {
+		printf("unable to add stream\n");
+		return -1;
+	}
+
+	if (avcodec_parameters_from_context(stream->codecpar, t->encoder_ctx) < 0) {
+		printf("unable to copy codec parameters\n");
+		return -1;
+	}
+	stream->time_base = t->encoder_ctx->time_base;
+
+	t->scaled = av_frame_alloc();
+	if (!t->scaled) {
+		printf("unable to allocate frame\n");
+		return -1;
+	}
+
+	t->scaled->format = t->encoder_ctx->pix_fmt;
+	t->scaled->width = width;
+	t->scaled->height = height;
+
+	if (av_frame_get_buffer(t->scaled, 0) != 0) {
+		printf("unable to allocate frame buffer\n");
+		return -1;
+	}
+
+	if (verbose) {
+		av_dump_format(t->output_ctx, 0, output_filename, 1);
+	}
+
+	if (avio_open(&t->output_ctx->pb, output_filename, AVIO_FLAG_WRITE) < 0) {
+		printf("unable to open %s\n", output_filename);
+		return -1;
+	}
+
+	AVDictionary * opts = NULL;
+	if (av_dict_set(&opts, "movflags", "+faststart", 0) < 0) {
+		printf("unable to set movflags\n");
+		return -1;
+	}
+
+	const int header_res = avformat_write_header(t->output_ctx, &opts);
+	av_dict_free(&opts);
+	if (header_res < 0) {
+		printf("unable to write header: %s\n", av_err2str(header_res));
+		return -1;
+	}
+
+	return 0;
+}
+
+// Open an encoder for time-lapse frames.
+//
+// Returns NULL if we have no such encoder or it fails to open.
+static AVCodecContext *
+__vs_open_timelapse_encoder(const enum AVCodecID codec_id, const int width,
+		const int height, const int fps, const bool global_header,
+		const bool verbose)
+{
+	AVCodec * const codec = avcodec_find_encoder(codec_id);
+	if (!codec) {
+		if (verbose) {
+			printf("%s encoder not found\n", avcodec_get_name(codec_id));
+		}
+		return NULL;
+	}
+
+	AVCodecContext * codec_ctx = avcodec_alloc_context3(codec);
+	if (!codec_ctx) {
+		printf("unable to allocate codec context\n");
+		return NULL;
+	}
+
+	codec_ctx->width = width;
+	codec_ctx->height = height;
+	codec_ctx->pix_fmt = AV_PIX_FMT_YUV420P;
+	codec_ctx->time_base = (AVRational) {1, fps};
+	codec_ctx->framerate = (AVRational) {fps, 1};
+
+	// A keyframe every second so that players can seek.
+	codec_ctx->gop_size = fps;
+
+	if (codec_id == AV_CODEC_ID_MPEG4) {
+		// Fixed quality rather than its low default bitrate, as with ffmpeg
+		// -q:v 3.
+		codec_ctx->flags |= AV_CODEC_FLAG_QSCALE;
+		codec_ctx->global_quality = FF_QP2LAMBDA * 3;
+	}
+
+	if (global_header) {
+		codec_ctx->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+	}
+
+	__vs_set_codec_threads(codec_ctx, false);
+
+	if (avcodec_open2(codec_ctx, codec, NULL) != 0) {
+		printf("unable to open %s encoder\n", codec->name);
+		avcodec_free_context(&codec_ctx);
+		return NULL;
+	}
+
+	if (verbose) {
+		printf("opened %s encoder for time-lapse\n", codec->name);
+	}
+
+	return codec_ctx;
+}
+
+// Write the packets the time-lapse encoder has ready.
+//
+// Returns -1 on failure.
+static int
+__vs_timelapse_packets(struct VSTimelapse * const t, const bool verbose)
+{
+	AVStream * const stream = t->output_ctx->streams[0];
+
+	while (1) {
+		const int receive_res = avcodec_receive_packet(t->encoder_ctx, t->pkt);
+		if (receive_res == AVERROR(EAGAIN) || receive_res == AVERROR_EOF) {
+			return 0;
+		}
+		if (receive_res != 0) {
+			printf("unable to encode frame: %s\n", av_err2str(receive_res));
+			return -1;
+		}
+
+		av_packet_rescale_ts(t->pkt, t->encoder_ctx->time_base, stream->time_base);
+		t->pkt->stream_index = stream->index;
+
+		if (verbose) {
+			__vs_log_packet(t->output_ctx, t->pkt, "timelapse");
+		}
+
+		const int write_res = av_interleaved_write_frame(t->output_ctx, t->pkt);
+		av_packet_unref(t->pkt);
+		if (write_res != 0) {
+			printf("unable to write frame: %s\n", av_err2str(write_res));
+			return -1;
+		}
+	}
+}
+
+static void
+__vs_close_timelapse(struct VSTimelapse * const t)
+{
+	if (t->input_ctx) {
+		avformat_close_input(&t->input_ctx);
+	}
+
+	if (t->decoder_ctx) {
+		avcodec_free_context(&t->decoder_ctx);
+	}
+
+	if (t->encoder_ctx) {
+		avcodec_free_context(&t->encoder_ctx);
+	}
+
+	if (t->output_ctx) {
+		if (t->output_ctx->pb) {
+			avio_closep(&t->output_ctx->pb);
+		}
+		avformat_free_context(t->output_ctx);
+		t->output_ctx = NULL;
+	}
+
+	if (t->sws_ctx) {
+		sws_freeContext(t->sws_ctx);
+		t->sws_ctx = NULL;
+	}
+
+	av_frame_free(&t->frame);
+	av_frame_free(&t->scaled);
+	av_packet_free(&t->pkt);
 }
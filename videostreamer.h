@@ -2,12 +2,52 @@
 #define _VIDEOSTREAMER_H
 
 #include <libavformat/avformat.h>
+// Before ffmpeg 4.4, avcodec.h declares the bitstream filter API itself.
+#if __has_include(<libavcodec/bsf.h>)
+#include <libavcodec/bsf.h>
+#endif
 #include <stdbool.h>
 #include <stdint.h>
 
+// Lets another thread interrupt an input's or output's blocking I/O.
+struct VSInterrupt;
+
 struct VSInput {
 	AVFormatContext * format_ctx;
 	int video_stream_index;
+
+	// -1 if there is no audio stream.
+	int audio_stream_index;
+
+	struct VSInterrupt * interrupt;
+
+	// If we moved on to another file (see vs_next_input()), the file we read
+	// from now, and its streams. Otherwise NULL. We keep format_ctx open as it
+	// describes the streams outputs were opened with, and we make packets from
+	// read_ctx look like they are from it.
+	AVFormatContext * read_ctx;
+	int read_video_stream_index;
+	int read_audio_stream_index;
+
+	// Added to the timestamps of packets from read_ctx so that they follow on
+	// from those before, in AV_TIME_BASE units.
+	int64_t ts_offset;
+
+	// Where the packets we read so far end, in AV_TIME_BASE units.
+	int64_t end_ts;
+
+	// Added to the timestamps of audio packets to cancel drift between the
+	// audio and video clocks, in AV_TIME_BASE units.
+	int64_t audio_ts_offset;
+
+	// Extracts the parameter sets (such as H.264's SPS and PPS) the video
+	// carries in its keyframes, so that we notice when they change. NULL until
+	// we need it.
+	AVBSFContext * extradata_bsf;
+
+	// Codec parameters for the video we found to be new, until we apply them.
+	// See vs_check_codec_parameters().
+	AVCodecParameters * new_codecpar;
 };
 
 struct VSOutput {
@@ -19,32 +59,210 @@ struct VSOutput {
   // I am not sure if it is available anywhere already. I tried
   // AVStream->info->last_dts and that is apparently not set.
   int64_t last_dts;
+
+  // Whether we wrote the header. We only write the trailer if so.
+  bool header_written;
+
+  // Whether we write through a caller provided function rather than opening
+  // a URL. If so, we allocated the AVIOContext ourselves.
+  bool custom_io;
+
+  // The input stream we copy. We skip packets from other streams.
+  int input_stream_index;
+
+  // The input's audio stream, if we copy it as well as the video, or -1. Its
+  // packets go to our second stream, with their own last dts.
+  int audio_input_stream_index;
+  int64_t audio_last_dts;
+
+  // Whether our second stream is silence we make up rather than the input's
+  // audio, and the pts of the next silent frame, in samples. See
+  // __vs_write_silence().
+  bool silent_audio;
+  int64_t silence_next_pts;
+
+  // Whether we write packets through libav's interleaving queue.
+  bool interleave;
+
+  // Only URL outputs can be interrupted. When we write through a caller
+  // provided function, it is what blocks.
+  struct VSInterrupt * interrupt;
+};
+
+// A decoder of one of an input's streams. We decode to analyse the picture or
+// sound, such as to detect motion. We never re-encode what we serve.
+struct VSDecoder {
+	AVCodecContext * codec_ctx;
+
+	// The frame we last received.
+	AVFrame * frame;
+
+	// The input stream we decode. We skip packets from other streams.
+	int input_stream_index;
+};
+
+// Options for an output, mostly tuning it for latency. Zero values are the
+// defaults.
+struct VSOutputOptions {
+	// Cut MP4 fragments at least this often, in microseconds, between
+	// keyframes as well. 0 means only at keyframes (or for CMAF, every half
+	// second).
+	int64_t frag_duration;
+
+	// Let avio buffer what we write rather than writing out each packet as
+	// soon as it is muxed.
+	bool buffered;
+
+	// Write packets through libav's interleaving queue, holding a packet at
+	// most this long, in microseconds, for packets of other streams. 0 means
+	// we write each packet straight to the muxer.
+	int64_t max_interleave_delta;
+
+	// Copy the input's audio as well as its video, if it has audio. Only for
+	// video outputs.
+	bool with_audio;
+
+	// Add a silent AAC stream to a video output without the input's audio, for
+	// players that refuse video alone.
+	bool silent_audio;
+
+	// Tell players to rotate the video this many degrees clockwise, then to
+	// mirror it, through its display matrix. Only muxers with somewhere to put
+	// it, such as mp4, do so.
+	int rotate;
+	bool hflip;
+	bool vflip;
+
+	// Size of the buffer we mux into before calling the write function. 0
+	// means the default.
+	int buffer_size;
 };
 
+// A fisheye lens and the flat view to take through it. Positions are fractions
+// of the picture's width and height, the radius is a fraction of its height,
+// and angles are in degrees.
+struct VSDewarp {
+	double center_x;
+	double center_y;
+	double radius;
+	double lens_fov;
+	double fov;
+	double pan;
+	double tilt;
+};
+
+// A function receiving output. It returns the number of bytes it wrote, or a
+// negative value on error.
+typedef int (*vs_write_fn)(void *, uint8_t *, int);
+
+// Counts of what we have allocated and not yet freed. For finding leaks.
+struct VSAllocations {
+	int64_t inputs;
+	int64_t outputs;
+	int64_t decoders;
+};
+
+void
+vs_set_threads(const int, const int, const int);
+
+void
+vs_setup(const bool);
+
 void
-vs_setup(void);
+vs_get_allocations(struct VSAllocations * const);
 
 struct VSInput *
-vs_open_input(const char * const,
-		const char * const, const bool);
+vs_open_input(const char * const, const char * const,
+		const AVDictionary * const, const int64_t, bool * const, const bool);
+
+int
+vs_next_input(struct VSInput * const, const char * const,
+		const char * const, const int64_t, bool * const, const bool);
+
+void
+vs_set_audio_offset(struct VSInput * const, const int64_t);
 
 void
 vs_destroy_input(struct VSInput * const);
 
+void
+vs_interrupt_input(struct VSInput * const);
+
 struct VSOutput *
 vs_open_output(const char * const,
 		const char * const, const struct VSInput * const,
+		const char * const, const bool);
+
+struct VSOutput *
+vs_open_output_writer(const char * const,
+		const vs_write_fn, void * const, const struct VSInput * const,
+		const bool, const bool, const struct VSOutputOptions * const,
 		const bool);
 
+const char *
+vs_audio_format(const struct VSInput * const);
+
+const AVCodecParameters *
+vs_codec_parameters(const struct VSInput * const, const bool);
+
 void
 vs_destroy_output(struct VSOutput * const);
 
+void
+vs_interrupt_output(struct VSOutput * const);
+
 int
-vs_read_packet(const struct VSInput *, AVPacket * const,
+vs_read_packet(struct VSInput * const, AVPacket * const,
+		const int64_t, const bool);
+
+int
+vs_check_codec_parameters(struct VSInput * const, const AVPacket * const,
 		const bool);
 
+int
+vs_apply_codec_parameters(struct VSInput * const);
+
+int64_t
+vs_packet_time(const struct VSInput * const, const AVPacket * const);
+
 int
 vs_write_packet(const struct VSInput * const,
 		struct VSOutput * const, AVPacket * const, const bool);
 
+int
+vs_write_packets(const struct VSInput * const,
+		struct VSOutput * const, AVPacket * const * const, const int,
+		const bool);
+
+struct VSDecoder *
+vs_open_decoder(const struct VSInput * const, const bool, const bool);
+
+void
+vs_destroy_decoder(struct VSDecoder * const);
+
+int
+vs_decode_packet(struct VSDecoder * const, const AVPacket * const,
+		const bool);
+
+int
+vs_receive_frame(struct VSDecoder * const, const bool);
+
+int
+vs_frame_luma(const struct VSDecoder * const, uint8_t * const, const int,
+		const int);
+
+AVPacket *
+vs_frame_jpeg(const struct VSDecoder * const, const int,
+		const struct VSDewarp * const, const double * const, const int,
+		const int, const bool, const bool, const bool);
+
+double
+vs_frame_rms(const struct VSDecoder * const);
+
+int
+vs_faststart(const char * const, const char * const, const bool);
+
+int
+vs_timelapse(const char * const, const char * const, const int, const bool);
+
 #endif
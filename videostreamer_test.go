@@ -0,0 +1,502 @@
+//go:build nolibav
+// +build nolibav
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests run the encoder against fakeMedia, so they need the nolibav tag:
+//
+//   go test -tags nolibav
+
+// How long we wait for something the encoder should do soon.
+const testWait = 5 * time.Second
+
+// newTestStreams starts streams with the definitions, reading from media.
+// Stop them by cancelling the context.
+func newTestStreams(t *testing.T, media *fakeMedia, limits QueueLimits,
+	defs ...StreamDefinition) (*Streams, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	streams := newStreams(ctx, media, limits)
+	streams.Apply(defs)
+	return streams, cancel
+}
+
+// newTestMedia generates small packets quickly.
+func newTestMedia() *fakeMedia {
+	return &fakeMedia{interval: 5 * time.Millisecond, packetSize: 64}
+}
+
+// testDefinition defines a stream reading from fakeMedia.
+func testDefinition(name string) StreamDefinition {
+	return StreamDefinition{Name: name, InputFormat: "fake", InputURL: "fake"}
+}
+
+// testClient is a client writing its output to a buffer.
+type testClient struct {
+	*Client
+	buf  *bytes.Buffer
+	done chan error
+}
+
+// watch joins a client to the stream and has it write its output until it
+// stops.
+func watch(t *testing.T, stream *Stream, id string) *testClient {
+	t.Helper()
+	c := &testClient{
+		Client: newClient(context.Background(), id, "test"),
+		buf:    &bytes.Buffer{},
+		done:   make(chan error, 1),
+	}
+	c.waitForOutput()
+	if err := stream.join(c.Client); err != nil {
+		t.Fatalf("%s: unable to join: %s", id, err)
+	}
+	go func() {
+		c.done <- c.writePackets(c.buf, func(string) {}, false, nil)
+	}()
+	return c
+}
+
+// wait waits for the client to stop writing, and returns why it stopped. Only
+// then may we look at its output.
+func (c *testClient) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-c.done:
+		return err
+	case <-time.After(testWait):
+		t.Fatalf("%s: still writing", c.ID)
+		return nil
+	}
+}
+
+// opened waits for the client to open its output, and so to start getting
+// packets.
+func (c *testClient) opened(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.outputReady:
+	case <-time.After(testWait):
+		t.Fatalf("%s: output didn't open", c.ID)
+	}
+}
+
+// packets counts the packets in the client's output.
+func (c *testClient) packets() int {
+	return strings.Count(c.buf.String(), "packet ")
+}
+
+// eventually waits for cond to hold.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitForCleanup waits for the encoder to free everything it allocated.
+func waitForCleanup(t *testing.T) {
+	t.Helper()
+	eventually(t, "inputs, outputs, and packets to be freed", func() bool {
+		a := mediaAllocations()
+		return a.Inputs == 0 && a.Outputs == 0 && a.Packets == 0
+	})
+}
+
+func TestEncoderClientsJoinAndLeave(t *testing.T) {
+	media := newTestMedia()
+	streams, cancel := newTestStreams(t, media, QueueLimits{},
+		testDefinition("cam"))
+	defer cancel()
+	stream := streams.Get("cam")
+
+	a := watch(t, stream, "a")
+	b := watch(t, stream, "b")
+
+	eventually(t, "the input to open", func() bool {
+		return mediaAllocations().Inputs == 1
+	})
+	eventually(t, "packets to reach both clients", func() bool {
+		return atomic.LoadUint64(&stream.stats.PacketsRead) >= 20
+	})
+
+	// One leaving doesn't affect the other, and the input stays open.
+	a.cancel()
+	if err := a.wait(t); err != nil {
+		t.Fatalf("a: %s", err)
+	}
+	out := a.buf.String()
+	if !strings.HasPrefix(out, "header\n") || !strings.HasSuffix(out,
+		"trailer\n") {
+		t.Errorf("a: output isn't complete: %.40q", out)
+	}
+	if a.packets() == 0 {
+		t.Errorf("a: got no packets")
+	}
+
+	read := atomic.LoadUint64(&stream.stats.PacketsRead)
+	eventually(t, "packets to carry on for b", func() bool {
+		return atomic.LoadUint64(&stream.stats.PacketsRead) >= read+10
+	})
+	if n := mediaAllocations().Inputs; n != 1 {
+		t.Errorf("%d inputs open with b watching, wanted 1", n)
+	}
+
+	// Once the last leaves, the input closes.
+	b.cancel()
+	if err := b.wait(t); err != nil {
+		t.Fatalf("b: %s", err)
+	}
+	if b.packets() == 0 {
+		t.Errorf("b: got no packets")
+	}
+	waitForCleanup(t)
+
+	// A client arriving then opens it again.
+	c := watch(t, stream, "c")
+	eventually(t, "c to get packets", func() bool {
+		return atomic.LoadUint64(&stream.stats.PacketsRead) >= read+30
+	})
+	c.cancel()
+	if err := c.wait(t); err != nil {
+		t.Fatalf("c: %s", err)
+	}
+	if c.packets() == 0 {
+		t.Errorf("c: got no packets")
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestEncoderDropsSlowClients(t *testing.T) {
+	media := newTestMedia()
+	streams, cancel := newTestStreams(t, media, QueueLimits{},
+		testDefinition("cam"))
+	defer cancel()
+	stream := streams.Get("cam")
+
+	fast := watch(t, stream, "fast")
+
+	// The slow client takes nothing from its queue.
+	slow := newClient(context.Background(), "slow", "test")
+	defer slow.cancel()
+	if err := stream.join(slow); err != nil {
+		t.Fatalf("slow: unable to join: %s", err)
+	}
+
+	eventually(t, "the slow client to be dropped", func() bool {
+		return atomic.LoadUint64(&stream.stats.ClientsDroppedSlow) == 1
+	})
+
+	// Dropping it closed its queue, with what it had queued still in it.
+	queued := 0
+	for p := range slow.PacketChan {
+		p.release()
+		queued++
+	}
+	if queued != clientQueueSize {
+		t.Errorf("slow client had %d packets queued, wanted %d", queued,
+			clientQueueSize)
+	}
+
+	// The fast client carries on.
+	read := atomic.LoadUint64(&stream.stats.PacketsRead)
+	eventually(t, "packets to carry on for the fast client", func() bool {
+		return atomic.LoadUint64(&stream.stats.PacketsRead) >= read+10
+	})
+	fast.cancel()
+	if err := fast.wait(t); err != nil {
+		t.Fatalf("fast: %s", err)
+	}
+	if n := atomic.LoadUint64(&stream.stats.ClientsDroppedSlow); n != 1 {
+		t.Errorf("%d clients dropped, wanted 1", n)
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestEncoderDropsClientsOverByteLimit(t *testing.T) {
+	media := newTestMedia()
+	streams, cancel := newTestStreams(t, media,
+		QueueLimits{ClientBytes: int64(media.packetSize) * 4},
+		testDefinition("cam"))
+	defer cancel()
+	stream := streams.Get("cam")
+
+	slow := newClient(context.Background(), "slow", "test")
+	defer slow.cancel()
+	if err := stream.join(slow); err != nil {
+		t.Fatalf("slow: unable to join: %s", err)
+	}
+
+	eventually(t, "the slow client to be dropped", func() bool {
+		return atomic.LoadUint64(&stream.stats.ClientsDroppedSlow) == 1
+	})
+
+	queued := 0
+	for p := range slow.PacketChan {
+		p.release()
+		queued++
+	}
+	if queued != 4 {
+		t.Errorf("slow client had %d packets queued, wanted 4", queued)
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestEncoderDropsClientsOverTotalLimit(t *testing.T) {
+	media := newTestMedia()
+	streams, cancel := newTestStreams(t, media,
+		QueueLimits{TotalBytes: int64(media.packetSize) * 4},
+		testDefinition("cam"), testDefinition("other"))
+	defer cancel()
+	cam := streams.Get("cam")
+	other := streams.Get("other")
+
+	// A client of another stream counts towards the limit too. Whether it keeps
+	// up depends on scheduling, so we don't look at how it does.
+	watching := watch(t, cam, "watching")
+	watching.opened(t)
+
+	slow := newClient(context.Background(), "slow", "test")
+	defer slow.cancel()
+	if err := other.join(slow); err != nil {
+		t.Fatalf("slow: unable to join: %s", err)
+	}
+
+	eventually(t, "the slow client to be dropped", func() bool {
+		return atomic.LoadUint64(&other.stats.ClientsDroppedSlow) == 1
+	})
+	for p := range slow.PacketChan {
+		p.release()
+	}
+
+	cancel()
+	_ = watching.wait(t)
+	waitForCleanup(t)
+}
+
+func TestEncoderShiftsLaggingClients(t *testing.T) {
+	media := newTestMedia()
+	def := testDefinition("cam")
+	def.Profiles = []StreamProfile{{Name: "low", InputURL: "fake", Bitrate: 300}}
+	streams, cancel := newTestStreams(t, media, QueueLimits{}, def)
+	defer cancel()
+	stream := streams.Get("cam")
+
+	// The lagging client takes nothing from its queue. It starts at 1000
+	// kbit/s, so it goes to the profile's 300, then to half that, and then
+	// there is nothing lower.
+	slow := newClient(context.Background(), "slow", "test")
+	defer slow.cancel()
+	slow.thin = newThinner(1000)
+	slow.shiftable = true
+	slow.renditions = streams.renditions(stream)
+	if err := stream.join(slow); err != nil {
+		t.Fatalf("slow: unable to join: %s", err)
+	}
+
+	eventually(t, "the slow client to be dropped", func() bool {
+		return atomic.LoadUint64(&stream.stats.ClientsDroppedSlow) == 1
+	})
+	for p := range slow.PacketChan {
+		p.release()
+	}
+
+	if n := atomic.LoadUint64(&stream.stats.ClientsShifted); n != 2 {
+		t.Errorf("shifted %d times, wanted 2", n)
+	}
+	if kbps := slow.thin.rate * 8 / 1000; kbps != 150 {
+		t.Errorf("shifted to %.0f kbit/s, wanted 150", kbps)
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestEncoderRecoversFromOpenFailure(t *testing.T) {
+	media := newTestMedia()
+	media.failOpen = true
+	streams, cancel := newTestStreams(t, media, QueueLimits{},
+		testDefinition("cam"))
+	defer cancel()
+	stream := streams.Get("cam")
+
+	a := watch(t, stream, "a")
+	if err := a.wait(t); err != errInputUnavailable {
+		t.Fatalf("a: got %v, wanted %s", err, errInputUnavailable)
+	}
+	if a.buf.Len() != 0 {
+		t.Errorf("a: got output without an input: %q", a.buf.String())
+	}
+
+	// The encoder waits for the next client to try again. Joining happens
+	// after this, so it sees the change.
+	media.failOpen = false
+
+	b := watch(t, stream, "b")
+	eventually(t, "b to get packets", func() bool {
+		return atomic.LoadUint64(&stream.stats.PacketsRead) >= 10
+	})
+	b.cancel()
+	if err := b.wait(t); err != nil {
+		t.Fatalf("b: %s", err)
+	}
+	if b.packets() == 0 {
+		t.Errorf("b: got no packets")
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestEncoderRecoversFromReadFailure(t *testing.T) {
+	media := newTestMedia()
+	media.failAfter = 10
+	streams, cancel := newTestStreams(t, media, QueueLimits{},
+		testDefinition("cam"))
+	defer cancel()
+	stream := streams.Get("cam")
+
+	// Clients of the failed input end, with why. Their outputs are the
+	// input's, so writing what was still queued may fail.
+	a := watch(t, stream, "a")
+	_ = a.wait(t)
+	if a.failure != errInputUnavailable {
+		t.Errorf("a: failure is %v, wanted %s", a.failure, errInputUnavailable)
+	}
+	if n := a.packets(); n == 0 || n > media.failAfter {
+		t.Errorf("a: got %d packets, wanted 1 to %d", n, media.failAfter)
+	}
+	waitForCleanup(t)
+
+	// The next client gets a new input, whose packets count from 1 again.
+	b := watch(t, stream, "b")
+	_ = b.wait(t)
+	if n := b.packets(); n == 0 || n > media.failAfter {
+		t.Errorf("b: got %d packets, wanted 1 to %d", n, media.failAfter)
+	}
+	if strings.Contains(b.buf.String(),
+		fmt.Sprintf("packet %d\n", media.failAfter+1)) {
+		t.Errorf("b: got packets of the failed input")
+	}
+	if n := atomic.LoadUint64(&stream.stats.PacketsRead); n !=
+		uint64(2*media.failAfter) {
+		t.Errorf("read %d packets, wanted %d", n, 2*media.failAfter)
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestApplyRemovingStreamCleansUp(t *testing.T) {
+	media := newTestMedia()
+	streams, cancel := newTestStreams(t, media, QueueLimits{},
+		testDefinition("kept"), testDefinition("removed"))
+	defer cancel()
+	kept := streams.Get("kept")
+	removed := streams.Get("removed")
+
+	a := watch(t, kept, "a")
+	b := watch(t, removed, "b")
+	a.opened(t)
+	b.opened(t)
+
+	streams.Apply([]StreamDefinition{testDefinition("kept")})
+
+	if streams.Get("removed") != nil {
+		t.Errorf("removed stream is still there")
+	}
+
+	// The removed stream's client ends with a complete output, and its input
+	// closes.
+	if err := b.wait(t); err != nil {
+		t.Fatalf("b: %s", err)
+	}
+	if !strings.HasSuffix(b.buf.String(), "trailer\n") {
+		t.Errorf("b: output isn't complete")
+	}
+	eventually(t, "the removed stream's input to close", func() bool {
+		return mediaAllocations().Inputs == 1
+	})
+
+	// New clients can't join it.
+	c := newClient(context.Background(), "c", "test")
+	defer c.cancel()
+	if err := removed.join(c); err != errNotFound {
+		t.Errorf("joining removed stream: got %v, wanted %s", err, errNotFound)
+	}
+
+	// The kept stream carries on.
+	read := atomic.LoadUint64(&kept.stats.PacketsRead)
+	eventually(t, "packets to carry on for the kept stream", func() bool {
+		return atomic.LoadUint64(&kept.stats.PacketsRead) >= read+10
+	})
+	a.cancel()
+	if err := a.wait(t); err != nil {
+		t.Fatalf("a: %s", err)
+	}
+
+	cancel()
+	waitForCleanup(t)
+}
+
+func TestRemovedStreamRunsLastClientHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "videostreamer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	events := filepath.Join(dir, "events")
+
+	media := newTestMedia()
+	def := testDefinition("cam")
+	def.OnFirstClient = "echo $VIDEOSTREAMER_EVENT >> " + events
+	def.OnLastClient = def.OnFirstClient
+	streams, cancel := newTestStreams(t, media, QueueLimits{},
+		testDefinition("kept"), def)
+	defer cancel()
+	stream := streams.Get("cam")
+
+	// As an HTTP client does.
+	a := watch(t, stream, "a")
+	stream.addClient(a.Client)
+	a.opened(t)
+
+	// The client finishes after the stream stops, and only then does its
+	// last_client command queue.
+	streams.Apply([]StreamDefinition{testDefinition("kept")})
+	_ = a.wait(t)
+	stream.removeClient(a.Client)
+
+	eventually(t, "the hooks to run", func() bool {
+		buf, _ := ioutil.ReadFile(events)
+		return string(buf) == "first_client\nlast_client\n"
+	})
+
+	cancel()
+	waitForCleanup(t)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With a viewers file, watching streams requires a viewer's token, and we
+// track what each viewer uses: the bytes we send them and how long they
+// watch, per calendar month in UTC. Each viewer may have quotas on these and
+// on how many sessions they have at once. When a viewer reaches a monthly
+// quota, we end their sessions and refuse new ones until the month ends.
+//
+// Viewers give their token as a bearer token in an Authorization header, or
+// as ?token= since players such as <video> elements can't set headers.
+//
+// With a usage file, we keep usage there so that it survives restarts. We save
+// it every so often, so a restart may lose the last little while.
+
+var (
+	errQuotaExceeded = HTTPError{
+		Status:  http.StatusForbidden,
+		Code:    "quota_exceeded",
+		Message: "Monthly quota exceeded",
+	}
+	errTooManySessions = HTTPError{
+		Status:  http.StatusTooManyRequests,
+		Code:    "too_many_sessions",
+		Message: "Too many sessions",
+	}
+)
+
+// How often we save usage if it changed.
+const viewerUsageSaveInterval = time.Minute
+
+// Viewer is someone allowed to watch streams.
+type Viewer struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+
+	// MonthlyGB limits how many gigabytes (10^9 bytes) we send the viewer each
+	// month. 0 means no limit.
+	MonthlyGB float64 `json:"monthly_gb"`
+
+	// MonthlyHours limits how many hours the viewer watches each month, adding
+	// up their sessions. 0 means no limit.
+	MonthlyHours float64 `json:"monthly_hours"`
+
+	// MaxSessions limits how many sessions the viewer has at once. 0 means no
+	// limit.
+	MaxSessions int `json:"max_sessions"`
+}
+
+// ViewerUsage is what a viewer used in a month.
+type ViewerUsage struct {
+	// Such as 2024-01.
+	Month string `json:"month"`
+
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Viewers holds the viewers, their usage, and their sessions.
+type Viewers struct {
+	mutex *sync.Mutex
+
+	viewers []Viewer
+
+	// By viewer name.
+	usage    map[string]*ViewerUsage
+	sessions map[string]int
+
+	// Where we keep usage, if anywhere, and whether it changed since we saved
+	// it.
+	usageFile string
+	dirty     bool
+}
+
+// viewerSession is a viewer watching a stream.
+type viewerSession struct {
+	viewers *Viewers
+	viewer  Viewer
+
+	// Up to when we counted the session's time.
+	counted time.Time
+}
+
+// readViewers reads and validates a viewers file, and the usage file if
+// there is one.
+func readViewers(file, usageFile string) (*Viewers, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading viewers: %s", err)
+	}
+
+	var config struct {
+		Viewers []Viewer `json:"viewers"`
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("error parsing viewers: %s", err)
+	}
+
+	seen := map[string]struct{}{}
+	for _, viewer := range config.Viewers {
+		if viewer.Name == "" || viewer.Token == "" {
+			return nil, fmt.Errorf("viewers must have a name and a token")
+		}
+
+		if viewer.MonthlyGB < 0 || viewer.MonthlyHours < 0 ||
+			viewer.MaxSessions < 0 {
+			return nil, fmt.Errorf("viewer %s: quotas must not be negative",
+				viewer.Name)
+		}
+
+		if _, ok := seen[viewer.Name]; ok {
+			return nil, fmt.Errorf("viewer %s defined more than once", viewer.Name)
+		}
+		seen[viewer.Name] = struct{}{}
+	}
+
+	v := &Viewers{
+		mutex:     &sync.Mutex{},
+		viewers:   config.Viewers,
+		usage:     map[string]*ViewerUsage{},
+		sessions:  map[string]int{},
+		usageFile: usageFile,
+	}
+
+	if usageFile != "" {
+		buf, err := ioutil.ReadFile(usageFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error reading viewer usage: %s", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(buf, &v.usage); err != nil {
+				return nil, fmt.Errorf("error parsing viewer usage: %s", err)
+			}
+		}
+
+		go v.saveUsage()
+	}
+
+	return v, nil
+}
+
+// authenticate finds the viewer whose token the request has.
+func (v *Viewers) authenticate(r *http.Request) (Viewer, bool) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header,
+		"Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if token == "" {
+		return Viewer{}, false
+	}
+
+	for _, viewer := range v.viewers {
+		if subtle.ConstantTimeCompare([]byte(token),
+			[]byte(viewer.Token)) == 1 {
+			return viewer, true
+		}
+	}
+
+	return Viewer{}, false
+}
+
+// start starts a session for the viewer, if their quotas allow it.
+func (v *Viewers) start(viewer Viewer, now time.Time) (*viewerSession,
+	error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if viewer.MaxSessions > 0 && v.sessions[viewer.Name] >= viewer.MaxSessions {
+		return nil, errTooManySessions
+	}
+
+	if v.exceeded(viewer, v.monthUsage(viewer.Name, now)) {
+		return nil, errQuotaExceeded
+	}
+
+	v.sessions[viewer.Name]++
+
+	return &viewerSession{
+		viewers: v,
+		viewer:  viewer,
+		counted: now,
+	}, nil
+}
+
+// monthUsage is the viewer's usage this month. Hold the mutex.
+func (v *Viewers) monthUsage(name string, now time.Time) *ViewerUsage {
+	month := now.UTC().Format("2006-01")
+
+	usage, ok := v.usage[name]
+	if !ok || usage.Month != month {
+		usage = &ViewerUsage{Month: month}
+		v.usage[name] = usage
+	}
+
+	return usage
+}
+
+// exceeded decides whether the usage reaches one of the viewer's quotas.
+func (v *Viewers) exceeded(viewer Viewer, usage *ViewerUsage) bool {
+	return (viewer.MonthlyGB > 0 &&
+		float64(usage.Bytes) >= viewer.MonthlyGB*1e9) ||
+		(viewer.MonthlyHours > 0 && usage.Seconds >= viewer.MonthlyHours*3600)
+}
+
+// add counts bytes sent in the session, along with the time since we last
+// counted. It fails once the viewer reaches a quota.
+func (s *viewerSession) add(n int, now time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	v := s.viewers
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	usage := v.monthUsage(s.viewer.Name, now)
+	usage.Bytes += int64(n)
+	usage.Seconds += now.Sub(s.counted).Seconds()
+	s.counted = now
+	v.dirty = true
+
+	if v.exceeded(s.viewer, usage) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// end ends the session, counting the time since we last counted.
+func (s *viewerSession) end(now time.Time) {
+	if s == nil {
+		return
+	}
+
+	_ = s.add(0, now)
+
+	v := s.viewers
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.sessions[s.viewer.Name]--
+}
+
+// saveUsage writes usage to the usage file every so often if it changed.
+func (v *Viewers) saveUsage() {
+	for range time.Tick(viewerUsageSaveInterval) {
+		v.mutex.Lock()
+		if !v.dirty {
+			v.mutex.Unlock()
+			continue
+		}
+		buf, err := json.MarshalIndent(v.usage, "", "  ")
+		v.dirty = false
+		v.mutex.Unlock()
+
+		if err == nil {
+			err = writeFileAtomic(v.usageFile, append(buf, '\n'), 0644)
+		}
+		if err != nil {
+			serverLog.Errorf("Unable to save viewer usage: %s", err)
+		}
+	}
+}
+
+// writeFileAtomic writes a file under another name first and renames it, so
+// that there is never a partial file.
+func writeFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(path+".tmp", buf, perm); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// startViewing checks the request is from a viewer whose quotas allow
+// another session, and starts one. If not, it responds with an error and
+// returns false. Without a viewers file, anyone may watch, and the session is
+// nil.
+func (h HTTPHandler) startViewing(rw http.ResponseWriter,
+	r *http.Request) (*viewerSession, bool) {
+	if h.Viewers == nil {
+		return nil, true
+	}
+
+	viewer, ok := h.Viewers.authenticate(r)
+	if !ok {
+		httpLog.Warnf("%s: Unauthorized viewer", r.RemoteAddr)
+		h.writeError(rw, r, errUnauthorized)
+		return nil, false
+	}
+
+	if recorder, ok := rw.(*auditRecorder); ok {
+		recorder.entry.Viewer = viewer.Name
+	}
+
+	session, err := h.Viewers.start(viewer, time.Now())
+	if err != nil {
+		httpLog.Warnf("%s: Viewer %s: %s", r.RemoteAddr, viewer.Name, err)
+		h.writeError(rw, r, err.(HTTPError))
+		return nil, false
+	}
+
+	return session, true
+}
+
+// ViewerStatus describes a viewer's usage this month.
+type ViewerStatus struct {
+	Name     string      `json:"name"`
+	Usage    ViewerUsage `json:"usage"`
+	Sessions int         `json:"sessions"`
+
+	MonthlyGB    float64 `json:"monthly_gb"`
+	MonthlyHours float64 `json:"monthly_hours"`
+	MaxSessions  int     `json:"max_sessions"`
+}
+
+// viewersRequest responds with each viewer's usage as JSON.
+func (h HTTPHandler) viewersRequest(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(rw, r) {
+		return
+	}
+
+	if h.Viewers == nil {
+		h.writeError(rw, r, errNotFound)
+		return
+	}
+
+	v := h.Viewers
+	now := time.Now()
+
+	v.mutex.Lock()
+	statuses := []ViewerStatus{}
+	for _, viewer := range v.viewers {
+		statuses = append(statuses, ViewerStatus{
+			Name:         viewer.Name,
+			Usage:        *v.monthUsage(viewer.Name, now),
+			Sessions:     v.sessions[viewer.Name],
+			MonthlyGB:    viewer.MonthlyGB,
+			MonthlyHours: viewer.MonthlyHours,
+			MaxSessions:  viewer.MaxSessions,
+		})
+	}
+	v.mutex.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+		"viewers": statuses,
+	}); err != nil {
+		httpLog.Errorf("%s: Unable to write viewers: %s", r.RemoteAddr, err)
+	}
+}
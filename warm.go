@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A stream's input opens when its first client arrives, and opening it, such
+// as a camera's RTSP session, can take seconds. For streams people watch at
+// known times, such as the profile phones get during the morning commute,
+// warm_hours keeps the input open during those hours, so the first client of
+// the day starts as fast as the rest. Profiles can have their own.
+//
+// Hours are in our local time, as ranges separated by commas, such as
+// "07:00-09:30,17:00-22:00". A range ending before it starts runs past
+// midnight, such as "22:00-06:00", and "00:00-24:00" is all day.
+//
+// While we shed load, we don't keep anything warm.
+
+// hoursRange is a range of the day, in minutes since midnight. end is past
+// start, unless the range runs past midnight.
+type hoursRange struct {
+	start int
+	end   int
+}
+
+// parseWarmHours parses ranges of hours such as "07:00-09:30,17:00-22:00".
+func parseWarmHours(s string) ([]hoursRange, error) {
+	ranges := []hoursRange{}
+	for _, part := range strings.Split(s, ",") {
+		times := strings.Split(strings.TrimSpace(part), "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("warm hours must look like 07:00-09:30")
+		}
+
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("warm hours %s are empty", part)
+		}
+
+		ranges = append(ranges, hoursRange{start: start, end: end})
+	}
+	return ranges, nil
+}
+
+// parseTimeOfDay parses a time of day such as 07:00 into minutes since
+// midnight. 24:00 is the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &hours,
+		&minutes); err != nil || n != 2 {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 ||
+		(hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time of day: %s", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// contains decides whether the time of day is in the range.
+func (r hoursRange) contains(minute int) bool {
+	if r.start < r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
+
+// warmAt decides whether the stream's input should be kept warm at the time.
+func (d StreamDefinition) warmAt(t time.Time) bool {
+	if d.WarmHours == "" {
+		return false
+	}
+
+	ranges, err := parseWarmHours(d.WarmHours)
+	if err != nil {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range ranges {
+		if r.contains(minute) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepWarm keeps the stream's input open during its warm hours.
+func (s *Stream) keepWarm() {
+	s.runOwnClient("warmer", func(def StreamDefinition) string {
+		if !def.warmAt(time.Now()) ||
+			atomic.LoadInt32(&shedLevel) != shedNothing {
+			return ""
+		}
+		return "on"
+	}, nil, func(c *Client, def StreamDefinition) error {
+		encoderLog.Infof("warmer: %s: Keeping input open for warm hours %s",
+			def.Name, def.WarmHours)
+
+		for p := range c.PacketChan {
+			atomic.AddInt64(&c.queuedBytes, -p.size)
+			p.release()
+		}
+
+		if c.failure.Code != "" {
+			return c.failure
+		}
+		return nil
+	})
+}